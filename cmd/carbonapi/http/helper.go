@@ -33,7 +33,11 @@ const (
 )
 
 const (
-	ctxHeaderUUID = "X-CTX-CarbonAPI-UUID"
+	ctxHeaderUUID        = "X-CTX-CarbonAPI-UUID"
+	ctxHeaderXTicks      = "X-CarbonAPI-X-Ticks"
+	ctxHeaderYTicks      = "X-CarbonAPI-Y-Ticks"
+	ctxHeaderYRightTicks = "X-CarbonAPI-Y-Right-Ticks"
+	ctxHeaderTimings     = "X-CarbonAPI-Render-Timings"
 )
 
 func (r responseFormat) String() string {
@@ -133,10 +137,15 @@ const (
 	contentTypePNG        = "image/png"
 	contentTypeCSV        = "text/csv"
 	contentTypeSVG        = "image/svg+xml"
+	contentTypeHTML       = "text/html"
 )
 
 func getFormat(r *http.Request, defaultFormat responseFormat) (responseFormat, bool, string) {
 	format := r.FormValue("format")
+	if format == "" {
+		// graphite-web legacy clients send outputFormat instead of format
+		format = r.FormValue("outputFormat")
+	}
 
 	if format == "" && (parser.TruthyBool(r.FormValue("rawData")) || parser.TruthyBool(r.FormValue("rawdata"))) {
 		return rawFormat, true, format
@@ -2,6 +2,7 @@ package http
 
 import (
 	"fmt"
+	"net/http/httptest"
 	"testing"
 	"time"
 
@@ -68,3 +69,28 @@ func Test_timestampTruncate(t *testing.T) {
 		})
 	}
 }
+
+func Test_getFormat(t *testing.T) {
+	tests := []struct {
+		query  string
+		want   responseFormat
+		wantOk bool
+	}{
+		{"", pngFormat, true},
+		{"format=json", jsonFormat, true},
+		{"format=pickle", pickleFormat, true},
+		{"outputFormat=pickle", pickleFormat, true},
+		{"format=json&outputFormat=pickle", jsonFormat, true},
+		{"outputFormat=pdf", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/render/?"+tt.query, nil)
+			got, ok, _ := getFormat(r, pngFormat)
+			if ok != tt.wantOk || (ok && got != tt.want) {
+				t.Errorf("getFormat(%q): got (%v, %v), want (%v, %v)", tt.query, got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
@@ -151,6 +151,28 @@ func TestRenderHandler(t *testing.T) {
 	}
 }
 
+func TestRenderHandlerJSONError(t *testing.T) {
+	req, rr := setUpRequest(t, "/render/?target=foo.bar(&from=-10minutes&format=json")
+	renderHandler(rr, req)
+
+	r := assert.Equal(t, http.StatusBadRequest, rr.Code, "HttpStatusCode should be 400 Bad Request.")
+	if !r {
+		t.Error("HttpStatusCode should be 400 Bad Request.")
+	}
+	r = assert.Equal(t, contentTypeJSON, rr.Header().Get("Content-Type"), "Error should be returned as JSON.")
+	if !r {
+		t.Error("Error should be returned as JSON.")
+	}
+
+	var body renderError
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("failed to parse error response %q: %v", rr.Body.String(), err)
+	}
+	assert.Equal(t, http.StatusBadRequest, body.Status)
+	assert.NotEmpty(t, body.Error)
+	assert.Equal(t, []string{"foo.bar("}, body.Params["target"])
+}
+
 func TestFindHandler(t *testing.T) {
 	req, rr := setUpRequest(t, "/metrics/find/?query=foo.bar&format=json")
 	findHandler(rr, req)
@@ -2,9 +2,12 @@ package http
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"strconv"
@@ -12,6 +15,7 @@ import (
 	"time"
 
 	"github.com/ansel1/merry"
+	"github.com/go-graphite/carbonapi/cache"
 	"github.com/go-graphite/carbonapi/carbonapipb"
 	"github.com/go-graphite/carbonapi/cmd/carbonapi/config"
 	"github.com/go-graphite/carbonapi/date"
@@ -48,6 +52,38 @@ func setError(w http.ResponseWriter, accessLogDetails *carbonapipb.AccessLogDeta
 	accessLogDetails.HTTPCode = int32(status)
 }
 
+// renderError is the body of a failed render request for data formats
+type renderError struct {
+	Error  string              `json:"error"`
+	Status int                 `json:"status"`
+	Params map[string][]string `json:"params"`
+}
+
+// setRenderError reports an error as a JSON object for the data formats,
+// so API clients can handle it, and as plain text otherwise
+func setRenderError(w http.ResponseWriter, r *http.Request, format responseFormat, accessLogDetails *carbonapipb.AccessLogDetails, msg string, status int, carbonapiUUID string) {
+	switch format {
+	case jsonFormat, csvFormat, rawFormat:
+		body, err := json.Marshal(renderError{
+			Error:  msg,
+			Status: status,
+			Params: r.Form,
+		})
+		if err != nil {
+			setError(w, accessLogDetails, msg, status, carbonapiUUID)
+			return
+		}
+		w.Header().Set(ctxHeaderUUID, carbonapiUUID)
+		w.Header().Set("Content-Type", contentTypeJSON)
+		w.WriteHeader(status)
+		_, _ = w.Write(body)
+		accessLogDetails.Reason = msg
+		accessLogDetails.HTTPCode = int32(status)
+	default:
+		setError(w, accessLogDetails, msg, status, carbonapiUUID)
+	}
+}
+
 func getCacheTimeout(logger *zap.Logger, r *http.Request, defaultTimeout int32) int32 {
 	if tstr := r.FormValue("cacheTimeout"); tstr != "" {
 		t, err := strconv.Atoi(tstr)
@@ -68,9 +104,12 @@ func renderHandler(w http.ResponseWriter, r *http.Request) {
 	t0 := time.Now()
 	uid := uuid.NewV4()
 
-	// TODO: Migrate to context.WithTimeout
-	// ctx, _ := context.WithTimeout(context.TODO(), config.Config.ZipperTimeout)
 	ctx := utilctx.SetUUID(r.Context(), uid.String())
+	if config.Config.RenderTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.Config.RenderTimeout)
+		defer cancel()
+	}
 	username, _, _ := r.BasicAuth()
 	requestHeaders := utilctx.GetLogHeaders(ctx)
 
@@ -144,11 +183,37 @@ func renderHandler(w http.ResponseWriter, r *http.Request) {
 	case "ns", "nanosecond", "nanoseconds":
 		timestampMultiplier = 1000000000
 	default:
-		setError(w, accessLogDetails, "unsupported timestamp format, supported: 's', 'ms', 'us', 'ns'", http.StatusBadRequest, uid.String())
+		setRenderError(w, r, format, accessLogDetails, "unsupported timestamp format, supported: 's', 'ms', 'us', 'ns'", http.StatusBadRequest, uid.String())
 		logAsError = true
 		return
 	}
 
+	// compareWith draws a dimmed time-shifted copy of every target
+	compareFrom := len(targets)
+	if compareWith := r.FormValue("compareWith"); compareWith != "" && (format == pngFormat || format == svgFormat) {
+		if _, err := parser.IntervalString(compareWith, -1); err != nil {
+			setRenderError(w, r, format, accessLogDetails, "invalid compareWith: "+err.Error(), http.StatusBadRequest, uid.String())
+			logAsError = true
+			return
+		}
+		targets = append(targets[:compareFrom:compareFrom], compareTargets(targets, compareWith)...)
+	}
+
+	// exportTicks returns the axis labels of the png in headers, which a cached
+	// response doesn't have
+	exportTicks := format == pngFormat && parser.TruthyBool(r.FormValue("exportTicks"))
+	// imageMap returns an html fragment instead of the png, it's never cached
+	// as the cache can't tell it from the png
+	imageMap := format == pngFormat && parser.TruthyBool(r.FormValue("imageMap"))
+	// dataURI returns the png as a base64 data uri in a text body, for
+	// embedding it into other responses. It isn't cached for the same reason
+	dataURI := format == pngFormat && !exportTicks && !imageMap && parser.TruthyBool(r.FormValue("dataURI"))
+	// renderTimings returns how long the stages of rendering the png took in
+	// a header and logs them, a cached response wasn't rendered at all
+	renderTimings := format == pngFormat && !exportTicks && !imageMap && !dataURI && parser.TruthyBool(r.FormValue("renderTimings"))
+	// graphType=pie with json returns the pie slices instead of the series
+	pieData := format == jsonFormat && png.HaveGraphSupport && r.FormValue("graphType") == "pie"
+
 	responseCacheTimeout := getCacheTimeout(logger, r, config.Config.ResponseCacheConfig.DefaultTimeoutSec)
 	backendCacheTimeout := getCacheTimeout(logger, r, config.Config.BackendCacheConfig.DefaultTimeoutSec)
 
@@ -167,7 +232,11 @@ func renderHandler(w http.ResponseWriter, r *http.Request) {
 		duration := time.Second * time.Duration(until32-from32)
 		from32 = timestampTruncate(from32, duration, config.Config.TruncateTime)
 		until32 = timestampTruncate(until32, duration, config.Config.TruncateTime)
-		responseCacheKey = responseCacheComputeKey(from32, until32, targets, formatRaw, maxDataPoints, noNullPoints, template)
+		cacheFormat := formatRaw
+		if pieData {
+			cacheFormat += " pie"
+		}
+		responseCacheKey = responseCacheComputeKey(from32, until32, targets, cacheFormat, maxDataPoints, noNullPoints, template)
 		if duration <= time.Hour && now32-until32 < 60 {
 			// short cache ttl
 			responseCacheTimeout = config.Config.ResponseCacheConfig.ShortTimeoutSec
@@ -220,7 +289,7 @@ func renderHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	if useCache {
+	if useCache && !exportTicks && !imageMap && !dataURI && !renderTimings {
 		tc := time.Now()
 		response, err := config.Config.ResponseCache.Get(responseCacheKey)
 		td := time.Since(tc).Nanoseconds()
@@ -239,26 +308,26 @@ func renderHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if from32 == until32 {
-		setError(w, accessLogDetails, "Invalid or empty time range", http.StatusBadRequest, uid.String())
+		setRenderError(w, r, format, accessLogDetails, "Invalid or empty time range", http.StatusBadRequest, uid.String())
 		logAsError = true
 		return
 	}
 
 	defer func() {
-		if r := recover(); r != nil {
+		if rec := recover(); rec != nil {
 			logger.Error("panic during eval:",
 				zap.String("cache_key", responseCacheKey),
-				zap.Any("reason", r),
+				zap.Any("reason", rec),
 				zap.Stack("stack"),
 			)
 			logAsError = true
 			var answer string
 			if config.Config.HTTPResponseStackTrace {
-				answer = fmt.Sprintf("%v\nStack trace: %v", r, zap.Stack("").String)
+				answer = fmt.Sprintf("%v\nStack trace: %v", rec, zap.Stack("").String)
 			} else {
-				answer = fmt.Sprint(r)
+				answer = fmt.Sprint(rec)
 			}
-			setError(w, accessLogDetails, answer, http.StatusInternalServerError, uid.String())
+			setRenderError(w, r, format, accessLogDetails, answer, http.StatusInternalServerError, uid.String())
 		}
 	}()
 
@@ -279,11 +348,11 @@ func renderHandler(w http.ResponseWriter, r *http.Request) {
 		results = make([]*types.MetricData, 0)
 		values := make(map[parser.MetricRequest][]*types.MetricData)
 
-		for _, target := range targets {
+		for i, target := range targets {
 			exp, e, err := parser.ParseExpr(target)
 			if err != nil || e != "" {
 				msg := buildParseErrorString(target, e, err)
-				setError(w, accessLogDetails, msg, http.StatusBadRequest, uid.String())
+				setRenderError(w, r, format, accessLogDetails, msg, http.StatusBadRequest, uid.String())
 				logAsError = true
 				return
 			}
@@ -294,6 +363,9 @@ func renderHandler(w http.ResponseWriter, r *http.Request) {
 			if err != nil {
 				errors[target] = merry.Wrap(err)
 			}
+			if i >= compareFrom {
+				png.DimSeries(result)
+			}
 
 			results = append(results, result...)
 		}
@@ -314,6 +386,15 @@ func renderHandler(w http.ResponseWriter, r *http.Request) {
 
 	var body []byte
 
+	// some targets were dropped because render didn't finish in time
+	truncated := len(errors) > 0 && ctx.Err() == context.DeadlineExceeded
+	// graphs stop drawing series when the deadline passes. When it already
+	// has, draw what was fetched unless the client goes away.
+	renderCtx := ctx
+	if truncated {
+		renderCtx = r.Context()
+	}
+
 	returnCode := http.StatusOK
 	if len(results) == 0 {
 		// Obtain error code from the errors
@@ -327,7 +408,7 @@ func renderHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if returnCode == 400 || returnCode == http.StatusForbidden || returnCode >= 500 {
-			setError(w, accessLogDetails, strings.Join(errMsgs, ","), returnCode, uid.String())
+			setRenderError(w, r, format, accessLogDetails, strings.Join(errMsgs, ","), returnCode, uid.String())
 			logAsError = true
 			return
 		}
@@ -335,6 +416,10 @@ func renderHandler(w http.ResponseWriter, r *http.Request) {
 
 	switch format {
 	case jsonFormat:
+		if pieData {
+			body = png.MarshalPieJSONRequest(r, results, template)
+			break
+		}
 		if maxDataPoints != 0 {
 			types.ConsolidateJSON(maxDataPoints, results)
 			accessLogDetails.MaxDataPoints = maxDataPoints
@@ -344,14 +429,14 @@ func renderHandler(w http.ResponseWriter, r *http.Request) {
 	case protoV2Format:
 		body, err = types.MarshalProtobufV2(results)
 		if err != nil {
-			setError(w, accessLogDetails, err.Error(), http.StatusInternalServerError, uid.String())
+			setRenderError(w, r, format, accessLogDetails, err.Error(), http.StatusInternalServerError, uid.String())
 			logAsError = true
 			return
 		}
 	case protoV3Format:
 		body, err = types.MarshalProtobufV3(results)
 		if err != nil {
-			setError(w, accessLogDetails, err.Error(), http.StatusInternalServerError, uid.String())
+			setRenderError(w, r, format, accessLogDetails, err.Error(), http.StatusInternalServerError, uid.String())
 			logAsError = true
 			return
 		}
@@ -362,18 +447,67 @@ func renderHandler(w http.ResponseWriter, r *http.Request) {
 	case pickleFormat:
 		body = types.MarshalPickle(results)
 	case pngFormat:
-		body = png.MarshalPNGRequest(r, results, template)
+		if exportTicks {
+			var ticks png.AxisTicks
+			body, ticks = png.MarshalPNGRequestWithTicks(renderCtx, r, results, template, truncated)
+			setTicksHeaders(w, ticks)
+			break
+		}
+		if imageMap {
+			body = png.MarshalPNGImageMapRequest(renderCtx, r, results, template, truncated)
+			break
+		}
+		if dataURI {
+			body = png.DataURI(png.MarshalPNGRequest(renderCtx, r, results, template, truncated))
+			break
+		}
+		if renderTimings {
+			var timings png.RenderTimings
+			body, timings = png.MarshalPNGRequestWithTimings(renderCtx, r, results, template, truncated)
+			w.Header().Set(ctxHeaderTimings, timings.String())
+			logger.Debug("render timings", timings.Fields()...)
+			break
+		}
+		if _, ok := config.Config.ResponseCache.(cache.NullCache); ok && returnCode == http.StatusOK {
+			// nothing will be cached, so don't buffer the whole image
+			accessLogDetails.Metrics = targets
+			accessLogDetails.CarbonzipperResponseSizeBytes = int64(size)
+			accessLogDetails.HaveNonFatalErrors = len(errors) > 0
+
+			w.Header().Set(ctxHeaderUUID, uid.String())
+			w.Header().Set("Content-Type", contentTypePNG)
+			cw := &countingWriter{w: w}
+			if err := png.WritePNGRequest(renderCtx, cw, r, results, template, truncated); err != nil {
+				logger.Warn("failed to write png response", zap.Error(err))
+			}
+			accessLogDetails.CarbonapiResponseSizeBytes = cw.n
+			return
+		}
+		body = png.MarshalPNGRequest(renderCtx, r, results, template, truncated)
 	case svgFormat:
-		body = png.MarshalSVGRequest(r, results, template)
+		body = png.MarshalSVGRequest(renderCtx, r, results, template, truncated)
 	}
 
 	accessLogDetails.Metrics = targets
 	accessLogDetails.CarbonzipperResponseSizeBytes = int64(size)
 	accessLogDetails.CarbonapiResponseSizeBytes = int64(len(body))
 
-	writeResponse(w, returnCode, body, format, jsonp, uid.String())
+	if imageMap || dataURI {
+		contentType := contentTypeHTML
+		if dataURI {
+			contentType = contentTypeRaw
+		}
+		w.Header().Set(ctxHeaderUUID, uid.String())
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(returnCode)
+		_, _ = w.Write(body)
+	} else {
+		writeResponse(w, returnCode, body, format, jsonp, uid.String())
+	}
 
-	if len(results) != 0 {
+	// the graph may have been cut short by the deadline while drawing
+	truncated = truncated || renderCtx.Err() != nil
+	if len(results) != 0 && !truncated && !imageMap && !dataURI {
 		tc := time.Now()
 		config.Config.ResponseCache.Set(responseCacheKey, body, responseCacheTimeout)
 		td := time.Since(tc).Nanoseconds()
@@ -384,6 +518,36 @@ func renderHandler(w http.ResponseWriter, r *http.Request) {
 	accessLogDetails.HaveNonFatalErrors = gotErrors
 }
 
+// setTicksHeaders exports the axis labels of the graph as "value:pixel" lists
+func setTicksHeaders(w http.ResponseWriter, ticks png.AxisTicks) {
+	w.Header().Set(ctxHeaderXTicks, png.FormatTicks(ticks.X))
+	w.Header().Set(ctxHeaderYTicks, png.FormatTicks(ticks.Y))
+	if len(ticks.YRight) > 0 {
+		w.Header().Set(ctxHeaderYRightTicks, png.FormatTicks(ticks.YRight))
+	}
+}
+
+// countingWriter counts bytes written through it, for the access log
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// compareTargets wraps targets into timeShift for the compareWith overlay
+func compareTargets(targets []string, shift string) []string {
+	shifted := make([]string, len(targets))
+	for i, target := range targets {
+		shifted[i] = "timeShift(" + target + ",\"" + shift + "\")"
+	}
+	return shifted
+}
+
 func responseCacheComputeKey(from, until int64, targets []string, format string, maxDataPoints int64, noNullPoints bool, template string) string {
 	var responseCacheKey stringutils.Builder
 	responseCacheKey.Grow(256)
@@ -1,9 +1,41 @@
 package http
 
 import (
+	"net/http/httptest"
 	"testing"
+
+	"github.com/go-graphite/carbonapi/expr/functions/cairo/png"
+	"github.com/go-graphite/carbonapi/pkg/parser"
 )
 
+func TestCompareTargets(t *testing.T) {
+	targets := []string{
+		"test.metric.*.cpu.load_avg",
+		"sumSeries(test.metric.*.memory.free)",
+		"alias(test.metric, 'a \"quoted\" name')",
+	}
+	want := []string{
+		`timeShift(test.metric.*.cpu.load_avg,"-7d")`,
+		`timeShift(sumSeries(test.metric.*.memory.free),"-7d")`,
+		`timeShift(alias(test.metric, 'a "quoted" name'),"-7d")`,
+	}
+
+	got := compareTargets(targets, "-7d")
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("compareTargets()[%d] = %s, want %s", i, got[i], want[i])
+		}
+		exp, e, err := parser.ParseExpr(got[i])
+		if err != nil || e != "" {
+			t.Errorf("failed to parse %s: err=%v, rest=%q", got[i], err, e)
+			continue
+		}
+		if exp.Target() != "timeShift" {
+			t.Errorf("%s parsed as %s, want timeShift", got[i], exp.Target())
+		}
+	}
+}
+
 func BenchmarkResponseCacheComputeKey(b *testing.B) {
 	var from int64 = 1628876560
 	var until int64 = 1628876620
@@ -46,3 +78,22 @@ func BenchmarkBackendCacheComputeKeyAbs(b *testing.B) {
 		_ = backendCacheComputeKeyAbs(from, until, targets)
 	}
 }
+
+func TestSetTicksHeaders(t *testing.T) {
+	w := httptest.NewRecorder()
+	setTicksHeaders(w, png.AxisTicks{
+		X: []png.Tick{{Value: 60, Pixel: 10}, {Value: 120, Pixel: 20}},
+		Y: []png.Tick{{Value: 0, Pixel: 100}},
+	})
+
+	want := map[string]string{
+		ctxHeaderXTicks:      "60:10.0,120:20.0",
+		ctxHeaderYTicks:      "0:100.0",
+		ctxHeaderYRightTicks: "",
+	}
+	for header, value := range want {
+		if got := w.Header().Get(header); got != value {
+			t.Errorf("%s: got %q, want %q", header, got, value)
+		}
+	}
+}
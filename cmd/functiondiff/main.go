@@ -235,6 +235,8 @@ Reason behind that change is that on dark background it's much nicer to read old
 * ` + "`target` : graphite series, seriesList or function (likely containing series or seriesList)\n" +
 		"* `from`, `until` : time specifiers. Eg. \"1d\", \"10min\", \"04:37_20150822\", \"now\", \"today\", ... (**NOTE** does not handle timezones the same as graphite)\n" +
 		"* `format` : support graphite values of { json, raw, pickle, csv, png, svg } adds { protobuf } and does not support { pdf }\n" +
+		"* `outputFormat` : alias for `format`, used by legacy graphite clients (e.g. `outputFormat=pickle`); `format` wins if both are set\n" +
+		"* `compareWith` : (png, svg) time shift like `-7d`; every target is also drawn as a dimmed `timeShift` copy on the same time axis, e.g. to compare this week with the last one\n" +
 		"* `jsonp` : (...)\n" +
 		"* `noCache` : prevent query-response caching (which is 60s if enabled)\n" +
 		"* `cacheTimeout` : override default result cache (60s)\n" +
@@ -246,16 +248,26 @@ Reason behind that change is that on dark background it's much nicer to read old
 _When ` + "`format=png`_ (default if not specified)\n" +
 		"* `width`, `height` : number of pixels (default: width=330 , height=250)\n" +
 		"* `pixelRatio` : (1.0)\n" +
+		"* `aspectRatio` : ( <not defined> ) width to height ratio of the plot area, either a number (1.5) or a pair (16:9). The area is centered and the rest is left as background instead of being stretched\n" +
 		"* `margin` : (10)\n" +
+		"* `marginPercent` : (0) margin as a percentage of the smaller of `width` and `height`, so the whitespace keeps its proportion at any size. Overrides `margin` when set\n" +
+		"* `rotateOutput` : (0) rotate the rendered png clockwise by 90, 180 or 270 degrees, swapping `width` and `height` for 90 and 270. The graph is laid out unrotated, so image maps and axis tick headers keep the unrotated coordinates; other formats ignore it\n" +
 		"* `logBase` : Y-scale should use. Recognizes \"e\" or a floating point ( >= 1 )\n" +
+		"* `xLogBase` : log base the X scale should use, same values as `logBase`. Points are placed by the logarithm of their time, with labels and major grid lines at the powers of the base. Meant for series whose timestamps stand for sizes, like request size distributions. A base of 1 or a graph starting at or before 0 shows an error instead\n" +
+		"* `logBaseLeft`, `logBaseRight` : log base for the left and right Y axes when there are two of them, overrides `logBase` for that axis. Same values as `logBase`. The grid follows the right axis when only it is logarithmic. Values <= 0 are not drawn on a log scale, which then starts at the least positive value\n" +
 		"* `fgcolor` : foreground color\n" +
-		"* `bgcolor` : background color\n" +
+		"* `bgcolor` : background color. Colors can be set by name, as hex (`ff0000`, or `ff000080` with alpha) or as `rgb(255,0,0)`/`rgba(255,0,0,0.5)`; a translucent background gives a semi-transparent PNG. The commas of `rgb()` colors don't split the lists of `colorList`, `events` and `highlightRanges`\n" +
 		"* `majorLine` : major line color\n" +
 		"* `minorLine` : minor line color\n" +
 		"* `fontName` : (\"Sans\")\n" +
 		"* `fontSize` : (10.0)\n" +
 		"* `fontBold` : (false)\n" +
 		"* `fontItalic` : (false)\n" +
+		"* `titleFontName`, `titleFontBold`, `titleFontItalic` : font of the title and the vertical titles, by default the same as `fontName`, `fontBold` and `fontItalic`\n" +
+		"* `graphType` : (\"line\") also recognizes { \"sparkline\", \"panels\", \"heatmap\" }. \"sparkline\" is a compact mode for tiny graphs: implies `graphOnly`, no margin and a thin line. \"panels\" draws every series in its own band, one under another, each with its own Y axis and all sharing the X axis at the bottom. \"heatmap\" draws the first series as a grid of days by hours of the day in `tz`, every cell colored by the average of its points on the `colorByValue` gradient, with a color scale instead of the legend\n" +
+		"* `sparklineDots` : (false) with `graphType=sparkline` mark the lowest point of each series with a blue dot and the highest with a red one\n" +
+		"* `events` : ( <not defined> ) comma separated list of `timestamp:label:color` entries (label and color are optional) drawn as vertical markers, e.g. `events=1617235200:deploy:red,1617242400:rollback`\n" +
+		"* `highlightRanges` : ( <not defined> ) comma separated list of `start:end:color` entries (color is optional, yellow by default) drawn as translucent vertical bands beneath the grid and series, e.g. `highlightRanges=1617235200:1617242400:gray`\n" +
 		"* `graphOnly` : (false)\n" +
 		"* `hideLegend` : (false) (**NOTE** if not defined and >10 result metrics this becomes true)\n" +
 		"* `hideGrid` : (false)\n" +
@@ -263,12 +275,47 @@ _When ` + "`format=png`_ (default if not specified)\n" +
 		"* `hideYAxis` : (false)\n" +
 		"* `hideXAxis` : (false)\n" +
 		"* `yAxisSide` : (\"left\")\n" +
+		"* `statsBox` : (\"none\") also recognizes { \"topleft\", \"topright\", \"bottomleft\", \"bottomright\" }. Prints max, min and average of the first visible series in that corner of the plot\n" +
+		"* `statsBoxAll` : (false) print stats for every visible series instead of the first one\n" +
+		"* `lineLabels` : ( <not defined> ) `name` or `value`; write the name, and for `value` also the last value, of every series at the right end of its line in its color. Space for the labels is taken from the right of the plot area, overlapping labels are moved apart vertically\n" +
+		"* `showLast` : (false) mark the last present point of every series with a dot and write its value next to it. Unlike `lineLabels` the series name is not written\n" +
+		"* `maxSeries` : (0) draw only the first N series, the legend tells how many were left out. 0 means no limit\n" +
+		"* `focusSeries` : ( <not defined> ) comma separated list of 0-based series indices to highlight; other series are drawn dimmed and thinner, the legend still shows all of them\n" +
+		"* `smoothWindow` : (0) number of points; every series is also drawn as a thinner dashed trailing moving average in its color, absent points are left out of the window. Unlike `movingAverage` the series itself is kept\n" +
+		"* `cumulative` : (false) draw every series as the running total of its values. Absent points keep the total so far. The Y axis fits the totals\n" +
+		"* `colorByValue` : (false) color line segments by their value instead of by series, the legend is replaced with a gradient bar labeled with the minimum, the middle and the maximum of the range\n" +
+		"* `colorByValueLow`, `colorByValueHigh` : (\"blue\", \"red\") colors for the low and the high end of the `colorByValue` scale\n" +
+		"* `colorByValueMin`, `colorByValueMax` : value range of the `colorByValue` scale, defaults to the Y axis range\n" +
+		"* `bubbles` : (false) take series in pairs and draw the first one of each pair as filled circles with the radius proportional to the second one; points where either value is absent are skipped\n" +
+		"* `bubbleMaxRadius` : (10) radius of the circle for the largest size in `bubbles` mode\n" +
+		"* `plotShadow` : (false) draw a soft drop shadow under the plot area\n" +
+		"* `crispGrid` : (true) draw grid lines and graph borders without antialiasing, aligned to pixels. The axis labels are moved with their grid lines. Set to false to antialias everything\n" +
+		"* `pixelSnap` : (\"false\") `true` or `axes` draws the grid on pixel centers even without `crispGrid` and starts unrotated text on whole pixels, `all` puts the points of the series lines on pixel centers too. Sharpens small thumbnails\n" +
+		"* `showTimeRange` : (false) print \"From ... to ...\" with the absolute start and end time of the graph in `tz` at the bottom of the picture\n" +
+		"* `trimEmptyEdges` : (false) narrow the time range to the first and the last point any series has, so absent points at the edges, e.g. from collection lag, don't leave empty space\n" +
+		"* `lastPoints` : (0) draw only the last N points of every series, so the graph zooms to the most recent data whatever the queried range. Shorter series are drawn in full\n" +
+		"* `exportTicks` : (false) return the axis labels of a png with their pixel positions in `X-CarbonAPI-X-Ticks`, `X-CarbonAPI-Y-Ticks` and, with two Y axes, `X-CarbonAPI-Y-Right-Ticks` headers as comma separated \"value:pixel\" lists. X values are unix timestamps. The response cache is not used for such requests\n" +
+		"* `renderTimings` : (false) return how long the stages of rendering a png took in the `X-CarbonAPI-Render-Timings` header as a \"stage=milliseconds\" list of `prepare`, `yAxis`, `lines`, `encode` and `total`, and log them at the debug level. The response cache is not used for such requests\n" +
+		"* `imageMap` : (false) return, instead of the png, an html fragment with the png embedded as a data uri and an image map that has a rectangle titled with the value and timestamp around every drawn point. The response cache is not used for such requests\n" +
+		"* `dataURI` : (false) return the png as a `data:image/png;base64,...` uri in a text/plain body, to inline it into other responses. The response cache is not used for such requests\n" +
 		"* `connectedLimit` : number of missing points to bridge when `linemode` is not one of { \"slope\", \"staircase\" } likely \"connected\" (4294967296)\n" +
-		"* `lineMode` : (\"slope\")\n" +
-		"* `areaMode` : (\"none\") also recognizes { \"first\", \"all\", \"stacked\" }\n" +
+		"* `connectedGapDash` : (0) dash length for segments that bridge missing points in \"connected\" `lineMode`, so interpolated parts stand out. 0 draws them solid. Not applied to stacked series\n" +
+		"* `lineMode` : (\"slope\") also recognizes { \"staircase\", \"connected\", \"staircaseZero\" }. \"staircaseZero\" is \"staircase\" with `drawNullAsZero`, so counter resets drop to zero\n" +
+		"* `decimation` : (\"average\") how points consolidated into one pixel step are drawn. \"average\" uses the series' consolidation function, \"lttb\" (largest triangle three buckets) and \"minmax\" keep the visually important point, so spikes survive. Stacked series always use their consolidation function\n" +
+		"* `stepAlign` : (\"start\") also recognizes { \"center\", \"end\" }. Where in its time bucket a point is drawn, \"center\" lines up series with different steps. The time range is widened so the last points stay inside the graph\n" +
+		"* `areaMode` : (\"none\") also recognizes { \"first\", \"all\", \"stacked\", \"stackedPercent\" }. \"stackedPercent\" stacks shares of each column total, so the stack always fills the 0-100%% axis\n" +
+		"* `stackOrder` : (\"input\") also recognizes { \"name\", \"value\" }; order stacked series from the bottom of the stack by name or with the largest total first\n" +
+		"* `drawStackTotal` : (false) with `areaMode=stacked`, draw the sum of the stack as a bold line over the areas. It is not in the legend\n" +
+		"* `showRaw` : (false) draw series consolidated for display as a faint hairline of their raw points under the drawn line. Not applied to stacked series\n" +
+		"* `referenceLines` : (false) draw series whose present values are all equal, like thresholds from `constantLine()`, gray and dashed and without a legend swatch, unless they have their own color or dashes. They don't take colors from the palette\n" +
+		"* `stackTotalColor` : (`fgColor`) color of the `drawStackTotal` line\n" +
 		"* `areaAlpha` : ( <not defined> ) float value for area alpha\n" +
+		"* `positiveColor`, `negativeColor` : (\"\") fill the area between every line and zero with `positiveColor` above zero and `negativeColor` below it, e.g. for profit and loss graphs. Segments crossing zero are split at the crossing, `areaAlpha` sets the opacity of the fill\n" +
 		"* `pieMode` : (\"average\") also recognizes { \"maximum\", \"minimum\" } (**NOTE** pie graph support is explicitly unplanned)\n" +
+		"* `graphType=pie` with `format=json` (or `outputFormat=json`) returns pie slices instead of the series: `[{\"name\": ..., \"value\": ..., \"color\": \"#rrggbb\"}]`, values are aggregated by `pieMode`, series without values are left out. Pie images are still not drawn\n" +
 		"* `lineWidth` : (1.2) float value for line width\n" +
+		"* `lineCap` : (\"butt\") also recognizes { \"round\", \"square\" }\n" +
+		"* `lineJoin` : (\"miter\") also recognizes { \"round\", \"bevel\" }. \"round\" looks much smoother on thick volatile series\n" +
 		"* `dashed` : (false) dashed lines\n" +
 		"* `rightWidth` : (1.2) ...\n" +
 		"* `rightDashed` : (false)\n" +
@@ -276,23 +323,46 @@ _When ` + "`format=png`_ (default if not specified)\n" +
 		"* `leftWidth` : (1.2)\n" +
 		"* `leftDashed` : (false)\n" +
 		"* `leftColor` : ...\n" +
+		"* `rightAxisPattern` : put series whose name matches this regular expression, or glob like `*.latency` when it isn't a valid regular expression, on the right Y axis. Series put there by `secondYAxis()` stay there\n" +
 		"* `title` : (\"\") graph title\n" +
 		"* `vtitle` : (\"\") ...\n" +
 		"* `vtitleRight` : (\"\") ...\n" +
+		"* `noDataText`, `noDataColor` : (\"No Data\", \"red\") message shown when there is nothing to draw and its color. A message too wide for the image is drawn smaller\n" +
+		"* `emptyFrame` : (false) without data still draw the axes and the grid of the requested time range, with the message over them, so the graph keeps its shape\n" +
+		"* `cornerRadius` : (0) round the corners of the background and of the plot area frame by this many pixels. The grid and the series are clipped to the rounded plot area\n" +
 		"* `colorList` : (\"blue,green,red,purple,yellow,aqua,grey,magenta,pink,gold,rose\")\n" +
+		"* `colorListName` : ( <not defined> ) named palette to use when `colorList` is not set. Recognizes { \"default\", \"okabe-ito\" (colorblind safe, also available as \"colorblind\") }\n" +
+		"* `stableColors` : (false) pick the palette color by a hash of the series name, so a series keeps its color when the order of results changes\n" +
+		"* `template` : (\"default\") name of the template with default values for all the parameters above. Besides the ones from `graphTemplates` config, recognizes \"dark\"\n" +
 		"* `majorGridLineColor` : (\"rose\")\n" +
 		"* `minorGridLineColor` : (\"grey\")\n" +
+		"* `gridInFront` : (false) draw the grid lines again over the stacked areas, so opaque areas don't hide them. The lines are still drawn over the grid\n" +
 		"* `uniqueLegend` : (false)\n" +
+		"* `legendBox` : (false) draw a rounded translucent `bgColor` box behind the legend, so it stays readable over grid lines\n" +
+		"* `legendSwatch` : (\"square\") also recognizes { \"line\", \"circle\" }. Shape of the series mark in the legend, \"line\" shows the width and the dashes of the series\n" +
+		"* `legendTruncate` : (0) shorten legend names to at most this many characters with an ellipsis, so long names don't force a single legend column. Image map titles keep the full name\n" +
+		"* `legendEllipsis` : (\"end\") also recognizes { \"middle\" }. Where `legendTruncate` cuts the name, \"middle\" keeps both its head and its tail\n" +
+		"* `legendMaxHeightPercent` : (0) cap the legend at this percentage of the height, so many series can't squeeze the plot away. Entries that don't fit are summed up as \"… N more\". 0 doesn't cap\n" +
 		"* `drawNullAsZero` : (false) (**NOTE** affects display only - does not translate missing values to zero in functions. For that use ...)\n" +
 		"* `drawAsInfinite` : (false) ...\n" +
+		"* `reverseDrawOrder` : (false) draw lines from the last series to the first, so the first one stays on top. Stacked series keep their order\n" +
 		"* `yMin` : <undefined>\n" +
 		"* `yMax` : <undefined>\n" +
 		"* `yStep` : <undefined>\n" +
 		"* `xMin` : <undefined>\n" +
 		"* `xMax` : <undefined>\n" +
 		"* `xStep` : <undefined>\n" +
-		"* `xFormat` : (\"\") ...\n" +
-		"* `minorY` : (1) ...\n" +
+		"* `xFormat` : (\"\") strftime format of the X axis labels, e.g. `%%d.%%m %%H:%%M`. Replaces the format picked for the zoom level, the label positions still follow it\n" +
+		"* `minorY` : (1) number of minor horizontal gridlines between each pair of major ones, 0 disables them\n" +
+		"* `gridDensity` : (1) number of major gridlines per Y and X axis label interval, at most 10; labels stay on every `gridDensity`-th line\n" +
+		"* `snapTime` : (false) widen the time range to whole units of the X axis labels (minutes, hours, days), so the axis starts and ends on round times. The data is not changed\n" +
+		"* `xSubGrid` : (0) divide every minor vertical grid interval into this many parts with faint lines. Subdivisions closer than 2 pixels are not drawn\n" +
+		"* `calendarGrid` : (false) when the X axis is labeled in days, put labels and major vertical gridlines on local midnights in `tz`, and on the first days of months for steps of 30 days and more, instead of fixed intervals from the epoch\n" +
+		"* `hideFirstXLabel`, `hideLastXLabel` : (false) leave out the first or the last X axis label, e.g. when it sits half past the edge of the plot area\n" +
+		"* `yDivisions` : (0) with two Y axes, divide both of them into exactly this many steps, so the labels of the right axis fall on the gridlines of the left one. Overrides `yStepL` and `yStepR`, log scale axes are not affected\n" +
+		"* `plotPaddingTop`, `plotPaddingBottom` : (0.05) extra room above the highest and below the lowest point, as a fraction of the Y span. Ignored for an axis with explicit limits or log scale, never makes the axis cross zero\n" +
+		"* `yMaxHeadroom` : (false) when yMax is not set, extend the Y axis to the next tick above the highest point, so the top line never touches the frame. Ignored for log scale\n" +
+		"* `yScalePercentile` : (0) when set to e.g. 99, the top of the Y axis is based on that percentile of all values instead of the maximum, so spikes don't flatten the rest of the graph; points above it are drawn at the top edge. yMax still wins\n" +
 		"* `yMinLeft` : <undefined>\n" +
 		"* `yMinRight` : <undefined>\n" +
 		"* `yMaxLeft` : <undefined>\n" +
@@ -301,7 +371,12 @@ _When ` + "`format=png`_ (default if not specified)\n" +
 		"* `ySTepR` : <undefined>\n" +
 		"* `yLimitLeft` : <undefined>\n" +
 		"* `yLimitRight` : <undefined>\n" +
-		"* `yUnitSystem` : (\"si\") also recognizes { \"binary\" }\n" +
+		"* `yUnitSystem` : (\"si\") also recognizes { \"binary\", \"percent\" } (**NOTE** \"percent\" only changes labels: 0.25 is shown as 25%%, `yMin`/`yMax` are still specified as fractions)\n" +
+		"* `yLabelPrecision` : (auto) number of decimals on Y axis labels and `statsBox` values\n" +
+		"* `yLabelRotate` : (0) angle in degrees to rotate the Y axis labels by, e.g. 90 or 270 to save horizontal space on narrow graphs. The label column is as wide as the rotated labels\n" +
+		"* `numberFormat` : (\"1234.5\") separators for numbers in Y axis labels, the stats box and value labels, given by an example of 1234.5 like \"1.234,5\", \"1 234,5\" or \"1,234.5\". Other values keep the default\n" +
+		"* `yMinStep` : (0) the finest step the automatic Y axis may use. Independently of it, an automatic step that would repeat labels at the label precision, as with a near-flat series, is widened\n" +
+		"* `yTicks` : (\"\") comma separated list of values to put Y axis labels and grid lines at instead of evenly spaced ones, e.g. `99,99.9,99.99`. Values outside of the axis range are ignored\n" +
 		"* `yDivisors` : (4,5,6) ...\n" + `
 ### /metrics/find/?
 
@@ -5,6 +5,7 @@ package cairo
 import (
 	"testing"
 
+	"github.com/go-graphite/carbonapi/expr/helper"
 	"github.com/go-graphite/carbonapi/expr/metadata"
 	"github.com/go-graphite/carbonapi/expr/types"
 	"github.com/go-graphite/carbonapi/pkg/parser"
@@ -13,7 +14,9 @@ import (
 
 func init() {
 	md := New("")
-	metadata.SetEvaluator(th.EvaluatorFromFunc(md[0].F))
+	evaluator := th.EvaluatorFromFunc(md[0].F)
+	metadata.SetEvaluator(evaluator)
+	helper.SetEvaluator(evaluator)
 	for _, m := range md {
 		metadata.RegisterFunction(m.Name, m.F)
 	}
@@ -75,3 +78,41 @@ func TestEvalExpressionGraph(t *testing.T) {
 		th.TestEvalExpr(t, &tt)
 	}
 }
+
+func TestEvalBands(t *testing.T) {
+	tt := th.EvalTestItem{
+		"bands(metric.{min,avg,max})",
+		map[parser.MetricRequest][]*types.MetricData{
+			{Metric: "metric.{min,avg,max}", From: 0, Until: 1}: {
+				types.MakeMetricData("metric.min", []float64{1, 2, 3}, 1, 0),
+				types.MakeMetricData("metric.avg", []float64{2, 3, 5}, 1, 0),
+				types.MakeMetricData("metric.max", []float64{4, 5, 6}, 1, 0),
+			},
+		},
+		[]*types.MetricData{
+			types.MakeMetricData("metric.min", []float64{1, 2, 3}, 1, 0),
+			types.MakeMetricData("metric.max", []float64{3, 3, 3}, 1, 0),
+			types.MakeMetricData("bands(metric.avg)", []float64{2, 3, 5}, 1, 0),
+		},
+	}
+	th.TestEvalExprOrdered(t, &tt)
+}
+
+func TestEvalConfidenceBand(t *testing.T) {
+	tt := th.EvalTestItem{
+		"confidenceBand(metric.{value,upper,lower})",
+		map[parser.MetricRequest][]*types.MetricData{
+			{Metric: "metric.{value,upper,lower}", From: 0, Until: 1}: {
+				types.MakeMetricData("metric.value", []float64{2, 3, 5}, 1, 0),
+				types.MakeMetricData("metric.upper", []float64{4, 5, 6}, 1, 0),
+				types.MakeMetricData("metric.lower", []float64{1, 2, 3}, 1, 0),
+			},
+		},
+		[]*types.MetricData{
+			types.MakeMetricData("metric.lower", []float64{1, 2, 3}, 1, 0),
+			types.MakeMetricData("metric.upper", []float64{3, 3, 3}, 1, 0),
+			types.MakeMetricData("confidenceBand(metric.value)", []float64{2, 3, 5}, 1, 0),
+		},
+	}
+	th.TestEvalExprOrdered(t, &tt)
+}
@@ -4,8 +4,12 @@ package png
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"image/color"
+	"io"
 	"io/ioutil"
 	"math"
 	"net/http"
@@ -14,6 +18,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/go-graphite/carbonapi/expr/consolidations"
 	"github.com/go-graphite/carbonapi/expr/helper"
 	"github.com/go-graphite/carbonapi/expr/types"
 	"github.com/go-graphite/carbonapi/pkg/parser"
@@ -21,6 +26,8 @@ import (
 
 	"bitbucket.org/tebeka/strftime"
 	"github.com/evmar/gocairo/cairo"
+	"github.com/lomik/zapwriter"
+	"go.uber.org/zap"
 )
 
 const HaveGraphSupport = true
@@ -50,317 +57,6 @@ const (
 	YCoordSideNone             = 3
 )
 
-type TimeUnit int32
-
-const (
-	Second TimeUnit = 1
-	Minute          = 60
-	Hour            = 60 * Minute
-	Day             = 24 * Hour
-)
-
-type unitPrefix struct {
-	prefix string
-	size   uint64
-}
-
-const (
-	unitSystemBinary = "binary"
-	unitSystemSI     = "si"
-)
-
-var unitSystems = map[string][]unitPrefix{
-	unitSystemBinary: {
-		{"Pi", 1125899906842624}, // 1024^5
-		{"Ti", 1099511627776},    // 1024^4
-		{"Gi", 1073741824},       // 1024^3
-		{"Mi", 1048576},          // 1024^2
-		{"Ki", 1024},
-	},
-	unitSystemSI: {
-		{"P", 1000000000000000}, // 1000^5
-		{"T", 1000000000000},    // 1000^4
-		{"G", 1000000000},       // 1000^3
-		{"M", 1000000},          // 1000^2
-		{"K", 1000},
-	},
-}
-
-type xAxisStruct struct {
-	seconds       float64
-	minorGridUnit TimeUnit
-	minorGridStep float64
-	majorGridUnit TimeUnit
-	majorGridStep int64
-	labelUnit     TimeUnit
-	labelStep     int64
-	format        string
-	maxInterval   int64
-}
-
-var xAxisConfigs = []xAxisStruct{
-	{
-		seconds:       0.00,
-		minorGridUnit: Second,
-		minorGridStep: 5,
-		majorGridUnit: Minute,
-		majorGridStep: 1,
-		labelUnit:     Second,
-		labelStep:     5,
-		format:        "%H:%M:%S",
-		maxInterval:   10 * Minute,
-	},
-	{
-		seconds:       0.07,
-		minorGridUnit: Second,
-		minorGridStep: 10,
-		majorGridUnit: Minute,
-		majorGridStep: 1,
-		labelUnit:     Second,
-		labelStep:     10,
-		format:        "%H:%M:%S",
-		maxInterval:   20 * Minute,
-	},
-	{
-		seconds:       0.14,
-		minorGridUnit: Second,
-		minorGridStep: 15,
-		majorGridUnit: Minute,
-		majorGridStep: 1,
-		labelUnit:     Second,
-		labelStep:     15,
-		format:        "%H:%M:%S",
-		maxInterval:   30 * Minute,
-	},
-	{
-		seconds:       0.27,
-		minorGridUnit: Second,
-		minorGridStep: 30,
-		majorGridUnit: Minute,
-		majorGridStep: 2,
-		labelUnit:     Minute,
-		labelStep:     1,
-		format:        "%H:%M",
-		maxInterval:   2 * Hour,
-	},
-	{
-		seconds:       0.5,
-		minorGridUnit: Minute,
-		minorGridStep: 1,
-		majorGridUnit: Minute,
-		majorGridStep: 2,
-		labelUnit:     Minute,
-		labelStep:     1,
-		format:        "%H:%M",
-		maxInterval:   2 * Hour,
-	},
-	{
-		seconds:       1.2,
-		minorGridUnit: Minute,
-		minorGridStep: 1,
-		majorGridUnit: Minute,
-		majorGridStep: 4,
-		labelUnit:     Minute,
-		labelStep:     2,
-		format:        "%H:%M",
-		maxInterval:   3 * Hour,
-	},
-	{
-		seconds:       2,
-		minorGridUnit: Minute,
-		minorGridStep: 1,
-		majorGridUnit: Minute,
-		majorGridStep: 10,
-		labelUnit:     Minute,
-		labelStep:     5,
-		format:        "%H:%M",
-		maxInterval:   6 * Hour,
-	},
-	{
-		seconds:       5,
-		minorGridUnit: Minute,
-		minorGridStep: 2,
-		majorGridUnit: Minute,
-		majorGridStep: 10,
-		labelUnit:     Minute,
-		labelStep:     10,
-		format:        "%H:%M",
-		maxInterval:   12 * Hour,
-	},
-	{
-		seconds:       10,
-		minorGridUnit: Minute,
-		minorGridStep: 5,
-		majorGridUnit: Minute,
-		majorGridStep: 20,
-		labelUnit:     Minute,
-		labelStep:     20,
-		format:        "%H:%M",
-		maxInterval:   Day,
-	},
-	{
-		seconds:       30,
-		minorGridUnit: Minute,
-		minorGridStep: 10,
-		majorGridUnit: Hour,
-		majorGridStep: 1,
-		labelUnit:     Hour,
-		labelStep:     1,
-		format:        "%H:%M",
-		maxInterval:   2 * Day,
-	},
-	{
-		seconds:       60,
-		minorGridUnit: Minute,
-		minorGridStep: 30,
-		majorGridUnit: Hour,
-		majorGridStep: 2,
-		labelUnit:     Hour,
-		labelStep:     2,
-		format:        "%H:%M",
-		maxInterval:   2 * Day,
-	},
-	{
-		seconds:       100,
-		minorGridUnit: Hour,
-		minorGridStep: 2,
-		majorGridUnit: Hour,
-		majorGridStep: 4,
-		labelUnit:     Hour,
-		labelStep:     4,
-		format:        "%a %H:%M",
-		maxInterval:   6 * Day,
-	},
-	{
-		seconds:       255,
-		minorGridUnit: Hour,
-		minorGridStep: 6,
-		majorGridUnit: Hour,
-		majorGridStep: 12,
-		labelUnit:     Hour,
-		labelStep:     12,
-		format:        "%a %H:%M",
-		maxInterval:   10 * Day,
-	},
-	{
-		seconds:       600,
-		minorGridUnit: Hour,
-		minorGridStep: 6,
-		majorGridUnit: Day,
-		majorGridStep: 1,
-		labelUnit:     Day,
-		labelStep:     1,
-		format:        "%m/%d",
-		maxInterval:   14 * Day,
-	},
-	{
-		seconds:       1000,
-		minorGridUnit: Hour,
-		minorGridStep: 12,
-		majorGridUnit: Day,
-		majorGridStep: 1,
-		labelUnit:     Day,
-		labelStep:     1,
-		format:        "%m/%d",
-		maxInterval:   365 * Day,
-	},
-	{
-		seconds:       2000,
-		minorGridUnit: Day,
-		minorGridStep: 1,
-		majorGridUnit: Day,
-		majorGridStep: 2,
-		labelUnit:     Day,
-		labelStep:     2,
-		format:        "%m/%d",
-		maxInterval:   365 * Day,
-	},
-	{
-		seconds:       4000,
-		minorGridUnit: Day,
-		minorGridStep: 2,
-		majorGridUnit: Day,
-		majorGridStep: 4,
-		labelUnit:     Day,
-		labelStep:     4,
-		format:        "%m/%d",
-		maxInterval:   365 * Day,
-	},
-	{
-		seconds:       8000,
-		minorGridUnit: Day,
-		minorGridStep: 3.5,
-		majorGridUnit: Day,
-		majorGridStep: 7,
-		labelUnit:     Day,
-		labelStep:     7,
-		format:        "%m/%d",
-		maxInterval:   365 * Day,
-	},
-	{
-		seconds:       16000,
-		minorGridUnit: Day,
-		minorGridStep: 7,
-		majorGridUnit: Day,
-		majorGridStep: 14,
-		labelUnit:     Day,
-		labelStep:     14,
-		format:        "%m/%d",
-		maxInterval:   365 * Day,
-	},
-	{
-		seconds:       32000,
-		minorGridUnit: Day,
-		minorGridStep: 15,
-		majorGridUnit: Day,
-		majorGridStep: 30,
-		labelUnit:     Day,
-		labelStep:     30,
-		format:        "%m/%d",
-		maxInterval:   365 * Day,
-	},
-	{
-		seconds:       64000,
-		minorGridUnit: Day,
-		minorGridStep: 30,
-		majorGridUnit: Day,
-		majorGridStep: 60,
-		labelUnit:     Day,
-		labelStep:     60,
-		format:        "%m/%d %Y",
-		maxInterval:   365 * Day,
-	},
-	{
-		seconds:       100000,
-		minorGridUnit: Day,
-		minorGridStep: 60,
-		majorGridUnit: Day,
-		majorGridStep: 120,
-		labelUnit:     Day,
-		labelStep:     120,
-		format:        "%m/%d %Y",
-		maxInterval:   365 * Day,
-	},
-	{
-		seconds:       120000,
-		minorGridUnit: Day,
-		minorGridStep: 120,
-		majorGridUnit: Day,
-		majorGridStep: 240,
-		labelUnit:     Day,
-		labelStep:     240,
-		format:        "%m/%d %Y",
-		maxInterval:   365 * Day,
-	},
-}
-
-// We accept values fractionally outside of nominal limits, so that
-// rounding errors don't cause weird effects. Since our goal is to
-// create plots, and the maximum resolution of the plots is likely to
-// be less than 10000 pixels, errors smaller than this size shouldn't
-// create any visible effects.
-const floatEpsilon = 0.00000000001
-
 func getCairoFontItalic(s FontSlant) cairo.FontSlant {
 	if s == FontSlantItalic {
 		return cairo.FontSlantItalic
@@ -388,7 +84,11 @@ type Params struct {
 	width      float64
 	height     float64
 	margin     int
+	ratio      float64
 	logBase    float64
+	logBaseL   float64
+	logBaseR   float64
+	xLogBase   float64
 	fgColor    color.RGBA
 	bgColor    color.RGBA
 	majorLine  color.RGBA
@@ -398,6 +98,10 @@ type Params struct {
 	fontBold   cairo.FontWeight
 	fontItalic cairo.FontSlant
 
+	titleFontName   string
+	titleFontBold   cairo.FontWeight
+	titleFontItalic cairo.FontSlant
+
 	graphOnly   bool
 	hideLegend  bool
 	hideGrid    bool
@@ -405,22 +109,42 @@ type Params struct {
 	hideYAxis   bool
 	hideXAxis   bool
 	yAxisSide   YAxisSide
+	plotShadow  bool
+	crispGrid   bool
+	pixelSnap   PixelSnap
 	title       string
 	vtitle      string
 	vtitleRight string
+	noDataText  string
+	noDataColor string
+	emptyFrame  bool
+	from        int64
+	until       int64
 	tz          *time.Location
 	timeRange   int64
 	startTime   int64
 	endTime     int64
 
 	lineMode       LineMode
+	stepAlign      StepAlign
 	areaMode       AreaMode
+	stackOrder     StackOrder
 	areaAlpha      float64
+	positiveColor  string
+	negativeColor  string
 	pieMode        PieMode
 	colorList      []string
+	stableColors   bool
+	decimation     Decimation
 	lineWidth      float64
+	lineCap        string
+	lineJoin       string
 	connectedLimit int
 	hasStack       bool
+	graphType      GraphType
+	sparklineDots  bool
+
+	connectedGapDash float64
 
 	yMin   float64
 	yMax   float64
@@ -430,6 +154,15 @@ type Params struct {
 	xStep  float64
 	minorY int
 
+	gridDensity int
+	xSubGrid    int
+	yDivisions  int
+
+	plotPaddingTop    float64
+	plotPaddingBottom float64
+	yMaxHeadroom      bool
+	yScalePercentile  float64
+
 	yTop           float64
 	yBottom        float64
 	ySpan          float64
@@ -438,26 +171,43 @@ type Params struct {
 	yScaleFactor   float64
 	yUnitSystem    string
 	yDivisors      []float64
+	yTicks         []float64
 	yLabelValues   []float64
+	yMinorValues   []float64
+	yGridValues    []float64
 	yLabels        []string
 	yLabelWidth    float64
 	xScaleFactor   float64
 	xFormat        string
+	snapTime       bool
+	calendarGrid   bool
 	xLabelStep     int64
 	xMinorGridStep int64
 	xMajorGridStep int64
+	xGridTimes     []float64
+	// xCalendarTimes are the labels and major gridlines of day units on
+	// calendar boundaries in tz, set with calendarGrid
+	xCalendarTimes []int64
+
+	hideFirstXLabel bool
+	hideLastXLabel  bool
 
 	minorGridLineColor string
 	majorGridLineColor string
+	gridInFront        bool
 
 	yTopL         float64
 	yBottomL      float64
 	yLabelValuesL []float64
+	yMinorValuesL []float64
+	yGridValuesL  []float64
 	yLabelsL      []string
 	yLabelWidthL  float64
 	yTopR         float64
 	yBottomR      float64
 	yLabelValuesR []float64
+	yMinorValuesR []float64
+	yGridValuesR  []float64
 	yLabelsR      []string
 	yLabelWidthR  float64
 	yStepL        float64
@@ -484,16 +234,101 @@ type Params struct {
 	leftDashed  bool
 	leftColor   string
 
+	// rightAxisPattern puts the series it matches the name of on the
+	// right Y axis, nil when there is no pattern
+	rightAxisPattern func(string) bool
+
 	area        Area
 	isPng       bool // TODO: png and svg use the same code
 	fontExtents cairo.FontExtents
 
 	uniqueLegend   bool
+	legendBox      bool
+	legendSwatch   LegendSwatch
+	legendTruncate int
+	legendEllipsis LegendEllipsis
 	secondYAxis    bool
 	drawNullAsZero bool
 	drawAsInfinite bool
 
+	// cornerRadius rounds the corners of the picture and of the plot area
+	cornerRadius float64
+
+	// legendMaxHeightPercent caps the legend at that share of the height
+	legendMaxHeightPercent float64
+
 	xConf xAxisStruct
+
+	events          []Event
+	highlightRanges []HighlightRange
+
+	statsBox    StatsBox
+	statsBoxAll bool
+
+	lineLabels LineLabels
+	showLast   bool
+
+	yLabelPrecision int
+	yLabelRotate    float64
+	yMinStep        float64
+	numberFormat    numberFormat
+
+	colorByValue     bool
+	colorByValueLow  color.RGBA
+	colorByValueHigh color.RGBA
+	colorByValueMin  float64
+	colorByValueMax  float64
+	colorScaleX      float64
+
+	bubbles         bool
+	bubbleMaxRadius float64
+	bubbleMaxSize   float64
+
+	reverseDrawOrder bool
+
+	maxSeries    int
+	hiddenSeries int
+	focusSeries  []int
+
+	// smoothWindow draws a trailing moving average of every series over
+	// that many points
+	smoothWindow int
+
+	// cumulative draws the running total of every series
+	cumulative bool
+
+	// drawStackTotal draws stackTotal, the sum of areaMode=stacked series,
+	// as a line over the areas
+	drawStackTotal  bool
+	stackTotalColor string
+	stackTotal      *types.MetricData
+
+	// showRaw draws consolidated series before consolidation as a faint line
+	// under the drawn one
+	showRaw bool
+
+	// referenceLines draws flat series, like thresholds, gray and dashed
+	// without a legend swatch
+	referenceLines bool
+
+	showTimeRange bool
+	timeRangeY    float64
+
+	// trimEmptyEdges narrows the X axis to the points any series has
+	trimEmptyEdges bool
+	// lastPoints keeps only the last points of every series
+	lastPoints int
+
+	// plotPoints collects the drawn points when recordPoints is set
+	recordPoints bool
+	plotPoints   []PlotPoint
+
+	// timings of the render stages drawGraph went through
+	timings RenderTimings
+
+	// ctx stops drawing the series left once it is done
+	ctx       context.Context
+	truncated bool
 }
 
 type cairoBackend int
@@ -556,6 +391,44 @@ func Description() map[string]types.FunctionDescription {
 			Function:    "areaBetween(seriesList)",
 			Group:       "Graph",
 		},
+		"bands": {
+			Name: "bands",
+			Params: []types.FunctionParam{
+				{
+					Name:     "seriesList",
+					Required: true,
+					Type:     types.SeriesList,
+				},
+				{
+					Default: types.NewSuggestion(0.3),
+					Name:    "alpha",
+					Type:    types.Float,
+				},
+			},
+			Module:      "graphite.render.functions",
+			Description: "Takes series in min, avg and max triples and draws every avg as a line\nwith the area between its min and max shaded around it in the same color.\nThe alpha of the shaded area defaults to 0.3.\n\nExample:\n\n.. code-block:: none\n\n  &target=bands(service.latency.{min,avg,max})",
+			Function:    "bands(seriesList, alpha=0.3)",
+			Group:       "Graph",
+		},
+		"confidenceBand": {
+			Name: "confidenceBand",
+			Params: []types.FunctionParam{
+				{
+					Name:     "seriesList",
+					Required: true,
+					Type:     types.SeriesList,
+				},
+				{
+					Default: types.NewSuggestion(0.3),
+					Name:    "alpha",
+					Type:    types.Float,
+				},
+			},
+			Module:      "graphite.render.functions",
+			Description: "Takes series in center, upper and lower bound triples, as returned by forecasts,\nand draws every center as a solid line with the area between its bounds shaded\naround it in a light version of its color. The alpha of the shaded area defaults\nto 0.3.\n\nExample:\n\n.. code-block:: none\n\n  &target=confidenceBand(group(forecast.value,forecast.upper,forecast.lower))",
+			Function:    "confidenceBand(seriesList, alpha=0.3)",
+			Group:       "Graph",
+		},
 		"alpha": {
 			Name: "alpha",
 			Params: []types.FunctionParam{
@@ -748,6 +621,55 @@ func EvalExprGraph(e parser.Expr, from, until int64, values map[parser.MetricReq
 
 		return []*types.MetricData{&lower, &upper}, nil
 
+	case "bands": // bands(seriesList, alpha=0.3)
+		arg, err := helper.GetSeriesArg(e.Args()[0], from, until, values)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(arg)%3 != 0 {
+			return nil, fmt.Errorf("bands needs min, avg and max series triples (%d series given)", len(arg))
+		}
+
+		alpha, err := e.GetFloatNamedOrPosArgDefault("alpha", 1, 0.3)
+		if err != nil {
+			return nil, err
+		}
+
+		results := make([]*types.MetricData, 0, len(arg))
+		for i := 0; i < len(arg); i += 3 {
+			line := *arg[i+1]
+			line.Name = fmt.Sprintf("%s(%s)", e.Target(), arg[i+1].Name)
+			results = append(results, makeBand(&line, *arg[i], *arg[i+2], alpha)...)
+		}
+
+		return results, nil
+
+	case "confidenceBand": // confidenceBand(seriesList, alpha=0.3)
+		arg, err := helper.GetSeriesArg(e.Args()[0], from, until, values)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(arg)%3 != 0 {
+			return nil, fmt.Errorf("confidenceBand needs center, upper and lower series triples (%d series given)", len(arg))
+		}
+
+		alpha, err := e.GetFloatNamedOrPosArgDefault("alpha", 1, 0.3)
+		if err != nil {
+			return nil, err
+		}
+
+		results := make([]*types.MetricData, 0, len(arg))
+		for i := 0; i < len(arg); i += 3 {
+			line := *arg[i]
+			line.Name = fmt.Sprintf("%s(%s)", e.Target(), arg[i].Name)
+			line.Dashed = 0
+			results = append(results, makeBand(&line, *arg[i+2], *arg[i+1], alpha)...)
+		}
+
+		return results, nil
+
 	case "alpha": // alpha(seriesList, theAlpha)
 		arg, err := helper.GetSeriesArg(e.Args()[0], from, until, values)
 		if err != nil {
@@ -871,28 +793,134 @@ func EvalExprGraph(e parser.Expr, from, until int64, values map[parser.MetricReq
 }
 
 func MarshalSVG(params PictureParams, results []*types.MetricData) []byte {
-	return marshalCairo(params, results, cairoSVG)
+	return marshalCairo(context.Background(), params, results, cairoSVG, nil)
 }
 
 func MarshalPNG(params PictureParams, results []*types.MetricData) []byte {
-	return marshalCairo(params, results, cairoPNG)
+	return marshalCairo(context.Background(), params, results, cairoPNG, nil)
+}
+
+func MarshalSVGRequest(ctx context.Context, r *http.Request, results []*types.MetricData, templateName string, truncated bool) []byte {
+	params := GetPictureParamsWithTemplate(r, templateName, results)
+	params.Truncated = truncated
+	return marshalCairo(ctx, params, results, cairoSVG, nil)
+}
+
+func MarshalPNGRequest(ctx context.Context, r *http.Request, results []*types.MetricData, templateName string, truncated bool) []byte {
+	params := GetPictureParamsWithTemplate(r, templateName, results)
+	params.Truncated = truncated
+	return marshalCairo(ctx, params, results, cairoPNG, nil)
+}
+
+// MarshalPNGRequestWithTicks is MarshalPNGRequest that also returns the axis
+// labels of the graph with their pixel positions
+func MarshalPNGRequestWithTicks(ctx context.Context, r *http.Request, results []*types.MetricData, templateName string, truncated bool) ([]byte, AxisTicks) {
+	params := GetPictureParamsWithTemplate(r, templateName, results)
+	params.Truncated = truncated
+	var info renderInfo
+	b := marshalCairo(ctx, params, results, cairoPNG, &info)
+	return b, info.ticks
 }
 
-func MarshalSVGRequest(r *http.Request, results []*types.MetricData, templateName string) []byte {
-	return marshalCairo(GetPictureParamsWithTemplate(r, templateName, results), results, cairoSVG)
+// MarshalPNGRequestWithTimings is MarshalPNGRequest that also returns how
+// long the stages of rendering took
+func MarshalPNGRequestWithTimings(ctx context.Context, r *http.Request, results []*types.MetricData, templateName string, truncated bool) ([]byte, RenderTimings) {
+	params := GetPictureParamsWithTemplate(r, templateName, results)
+	params.Truncated = truncated
+	var info renderInfo
+	b := marshalCairo(ctx, params, results, cairoPNG, &info)
+	return b, info.timings
 }
 
-func MarshalPNGRequest(r *http.Request, results []*types.MetricData, templateName string) []byte {
-	return marshalCairo(GetPictureParamsWithTemplate(r, templateName, results), results, cairoPNG)
+// MarshalPNGImageMapRequest renders the graph as an html fragment: the png
+// with an image map that has a tooltip for every drawn point
+func MarshalPNGImageMapRequest(ctx context.Context, r *http.Request, results []*types.MetricData, templateName string, truncated bool) []byte {
+	params := GetPictureParamsWithTemplate(r, templateName, results)
+	params.Truncated = truncated
+	info := renderInfo{recordPoints: true}
+	b := marshalCairo(ctx, params, results, cairoPNG, &info)
+	return FormatImageMap(b, info.points, params.Tz)
 }
 
-func marshalCairo(p PictureParams, results []*types.MetricData, backend cairoBackend) []byte {
+// makeBand returns line with the area between lower and upper shaded around
+// it: an areaBetween in a stack of its own, drawn in the color of line
+func makeBand(line *types.MetricData, lower, upper types.MetricData, alpha float64) []*types.MetricData {
+	lower.Stacked = true
+	lower.StackName = line.Name
+	lower.Invisible = true
+	lower.BandOf = line
+
+	upper.Stacked = true
+	upper.StackName = line.Name
+	upper.Alpha = alpha
+	upper.HasAlpha = true
+	upper.Color = line.Color
+	upper.BandOf = line
+
+	vals := make([]float64, len(upper.Values))
+	for i, v := range upper.Values {
+		if i < len(lower.Values) {
+			vals[i] = v - lower.Values[i]
+		} else {
+			vals[i] = math.NaN()
+		}
+	}
+	upper.Values = vals
+
+	return []*types.MetricData{&lower, &upper, line}
+}
+
+// PieSlice is a series of a pie chart with its value aggregated by pieMode and
+// the color it would be drawn with
+type PieSlice struct {
+	Name  string  `json:"name"`
+	Value float64 `json:"value"`
+	Color string  `json:"color"`
+}
+
+// MarshalPieJSONRequest returns the pie chart slices of results as json, for
+// clients that draw the chart themselves
+func MarshalPieJSONRequest(r *http.Request, results []*types.MetricData, templateName string) []byte {
+	params := newParams(GetPictureParamsWithTemplate(r, templateName, results))
+	b, _ := json.Marshal(getPieSlices(&params, results))
+	return b
+}
+
+// WritePNGRequest is MarshalPNGRequest that streams the image to w
+func WritePNGRequest(ctx context.Context, w io.Writer, r *http.Request, results []*types.MetricData, templateName string, truncated bool) error {
+	params := GetPictureParamsWithTemplate(r, templateName, results)
+	params.Truncated = truncated
+	return writePNG(ctx, w, params, results)
+}
+
+// dimAlpha is the opacity multiplier for dimmed series
+const dimAlpha = 0.3
+
+// DimSeries makes series translucent so they are drawn as a background
+// overlay, e.g. time-shifted copies requested with compareWith
+func DimSeries(results []*types.MetricData) {
+	for _, r := range results {
+		if !r.HasAlpha {
+			r.Alpha = 1
+			r.HasAlpha = true
+		}
+		r.Alpha *= dimAlpha
+	}
+}
+
+// newParams converts request parameters to the renderer state with the plot
+// area spanning the whole picture except margins
+func newParams(p PictureParams) Params {
 	var params = Params{
 		pixelRatio:     p.PixelRatio,
 		width:          p.Width,
 		height:         p.Height,
+		ratio:          p.AspectRatio,
 		margin:         p.Margin,
 		logBase:        p.LogBase,
+		logBaseL:       p.LogBaseLeft,
+		logBaseR:       p.LogBaseRight,
+		xLogBase:       p.XLogBase,
 		fgColor:        string2RGBA(p.FgColor),
 		bgColor:        string2RGBA(p.BgColor),
 		majorLine:      string2RGBA(p.MajorLine),
@@ -908,12 +936,28 @@ func marshalCairo(p PictureParams, results []*types.MetricData, backend cairoBac
 		hideYAxis:      p.HideYAxis,
 		hideXAxis:      p.HideXAxis,
 		yAxisSide:      p.YAxisSide,
+		plotShadow:     p.PlotShadow,
+		crispGrid:      p.CrispGrid,
+		pixelSnap:      p.PixelSnap,
+		cornerRadius:   p.CornerRadius,
+		showTimeRange:  p.ShowTimeRange,
+		trimEmptyEdges: p.TrimEmptyEdges,
+		lastPoints:     p.LastPoints,
 		connectedLimit: p.ConnectedLimit,
 		lineMode:       p.LineMode,
+		stepAlign:      p.StepAlign,
 		areaMode:       p.AreaMode,
+		stackOrder:     p.StackOrder,
 		areaAlpha:      p.AreaAlpha,
+		positiveColor:  p.PositiveColor,
+		negativeColor:  p.NegativeColor,
 		pieMode:        p.PieMode,
 		lineWidth:      p.LineWidth,
+		decimation:     p.Decimation,
+		lineCap:        p.LineCap,
+		lineJoin:       p.LineJoin,
+		graphType:      p.GraphType,
+		sparklineDots:  p.SparklineDots,
 
 		rightWidth:  p.RightWidth,
 		rightDashed: p.RightDashed,
@@ -923,18 +967,35 @@ func marshalCairo(p PictureParams, results []*types.MetricData, backend cairoBac
 		leftDashed: p.LeftDashed,
 		leftColor:  p.LeftColor,
 
+		rightAxisPattern: namePattern(p.RightAxisPattern),
+
 		title:       p.Title,
 		vtitle:      p.Vtitle,
 		vtitleRight: p.VtitleRight,
+		noDataText:  p.NoDataText,
+		noDataColor: p.NoDataColor,
+		emptyFrame:  p.EmptyFrame,
+		from:        p.From,
+		until:       p.Until,
 		tz:          p.Tz,
 
-		colorList: p.ColorList,
-		isPng:     true,
+		colorList:    p.ColorList,
+		stableColors: p.StableColors,
+		isPng:        true,
+
+		connectedGapDash: p.ConnectedGapDash,
 
 		majorGridLineColor: p.MajorGridLineColor,
 		minorGridLineColor: p.MinorGridLineColor,
+		gridInFront:        p.GridInFront,
+
+		legendMaxHeightPercent: p.LegendMaxHeightPercent,
 
 		uniqueLegend:   p.UniqueLegend,
+		legendBox:      p.LegendBox,
+		legendSwatch:   p.LegendSwatch,
+		legendTruncate: p.LegendTruncate,
+		legendEllipsis: p.LegendEllipsis,
 		drawNullAsZero: p.DrawNullAsZero,
 		drawAsInfinite: p.DrawAsInfinite,
 		yMin:           p.YMin,
@@ -944,7 +1005,20 @@ func marshalCairo(p PictureParams, results []*types.MetricData, backend cairoBac
 		xMax:           p.XMax,
 		xStep:          p.XStep,
 		xFormat:        p.XFormat,
+		snapTime:       p.SnapTime,
+		calendarGrid:   p.CalendarGrid,
 		minorY:         p.MinorY,
+		gridDensity:    p.GridDensity,
+		xSubGrid:       p.XSubGrid,
+		yDivisions:     p.YDivisions,
+
+		hideFirstXLabel: p.HideFirstXLabel,
+		hideLastXLabel:  p.HideLastXLabel,
+
+		plotPaddingTop:    p.PlotPaddingTop,
+		plotPaddingBottom: p.PlotPaddingBottom,
+		yMaxHeadroom:      p.YMaxHeadroom,
+		yScalePercentile:  p.YScalePercentile,
 
 		yMinLeft:    p.YMinLeft,
 		yMinRight:   p.YMinRight,
@@ -957,6 +1031,83 @@ func marshalCairo(p PictureParams, results []*types.MetricData, backend cairoBac
 
 		yUnitSystem: p.YUnitSystem,
 		yDivisors:   p.YDivisors,
+		yTicks:      p.YTicks,
+
+		events:          p.Events,
+		highlightRanges: p.HighlightRanges,
+
+		statsBox:    p.StatsBox,
+		statsBoxAll: p.StatsBoxAll,
+
+		lineLabels: p.LineLabels,
+		showLast:   p.ShowLast,
+
+		yLabelPrecision: p.YLabelPrecision,
+		yLabelRotate:    p.YLabelRotate,
+		yMinStep:        p.YMinStep,
+		numberFormat:    getNumberFormat(p.NumberFormat),
+
+		colorByValue:     p.ColorByValue,
+		colorByValueLow:  string2RGBA(p.ColorByValueLow),
+		colorByValueHigh: string2RGBA(p.ColorByValueHigh),
+		colorByValueMin:  p.ColorByValueMin,
+		colorByValueMax:  p.ColorByValueMax,
+
+		bubbles:         p.Bubbles,
+		bubbleMaxRadius: p.BubbleMaxRadius,
+
+		reverseDrawOrder: p.ReverseDrawOrder,
+
+		maxSeries:   p.MaxSeries,
+		focusSeries: p.FocusSeries,
+
+		smoothWindow: p.SmoothWindow,
+		cumulative:   p.Cumulative,
+
+		drawStackTotal:  p.DrawStackTotal,
+		stackTotalColor: p.StackTotalColor,
+
+		showRaw:        p.ShowRaw,
+		referenceLines: p.ReferenceLines,
+
+		ctx:       context.Background(),
+		truncated: p.Truncated,
+	}
+
+	if params.stackTotalColor == "" {
+		params.stackTotalColor = p.FgColor
+	}
+
+	if params.lineMode == LineModeStaircaseZero {
+		// counter resets drop to zero instead of leaving a gap
+		params.lineMode = LineModeStaircase
+		params.drawNullAsZero = true
+	}
+
+	// the title is drawn in the font of the labels unless it has its own
+	params.titleFontName = p.TitleFontName
+	if params.titleFontName == "" {
+		params.titleFontName = params.fontName
+	}
+	params.titleFontBold = getCairoFontWeight(p.TitleFontBold)
+	params.titleFontItalic = getCairoFontItalic(p.TitleFontItalic)
+
+	if p.MarginPercent > 0 {
+		// the margin keeps its proportion at any size
+		params.margin = int(math.Round(math.Min(params.width, params.height) * p.MarginPercent / 100))
+	}
+
+	if params.graphType == GraphTypeSparkline {
+		params.graphOnly = true
+		params.margin = 0
+		params.lineWidth = 1
+	}
+
+	if params.logBaseL == 0 {
+		params.logBaseL = params.logBase
+	}
+	if params.logBaseR == 0 {
+		params.logBaseR = params.logBase
 	}
 
 	margin := float64(params.margin)
@@ -965,7 +1116,31 @@ func marshalCairo(p PictureParams, results []*types.MetricData, backend cairoBac
 	params.area.ymin = margin
 	params.area.ymax = params.height - margin
 
+	return params
+}
+
+// renderInfo is what marshalCairo reports about the rendered graph besides
+// the image
+type renderInfo struct {
+	ticks   AxisTicks
+	timings RenderTimings
+
+	recordPoints bool
+	points       []PlotPoint
+}
+
+// marshalCairo renders the graph, info is filled in when not nil. The series
+// left once ctx is done are not drawn and the graph is marked as partial.
+func marshalCairo(ctx context.Context, p PictureParams, results []*types.MetricData, backend cairoBackend, info *renderInfo) []byte {
+	start := time.Now()
+	params := newParams(p)
+	params.ctx = ctx
+	if info != nil {
+		params.recordPoints = info.recordPoints
+	}
+
 	var surface *cairo.Surface
+	var image *cairo.ImageSurface
 	var tmpfile *os.File
 	switch backend {
 	case cairoSVG:
@@ -978,21 +1153,14 @@ func marshalCairo(p PictureParams, results []*types.MetricData, backend cairoBac
 		s := svgSurfaceCreate(tmpfile.Name(), params.width, params.height, params.pixelRatio)
 		surface = s.Surface
 	case cairoPNG:
-		s := imageSurfaceCreate(cairo.FormatARGB32, params.width, params.height, params.pixelRatio)
-		surface = s.Surface
+		image = imageSurfaceCreate(cairo.FormatARGB32, params.width, params.height, params.pixelRatio)
+		surface = image.Surface
+	}
+	drawPictureAt(cairo.Create(surface), &params, 0, 0, results)
+	if info != nil {
+		info.ticks = getAxisTicks(&params)
+		info.points = params.plotPoints
 	}
-	cr := createContext(surface, params.pixelRatio)
-
-	// Setting font parameters
-
-	fontOpts := cairo.FontOptionsCreate()
-	fontOpts.SetAntialias(cairo.AntialiasNone)
-	cr.context.SetFontOptions(fontOpts)
-
-	setColor(cr, params.bgColor)
-	drawRectangle(cr, &params, 0, 0, params.width, params.height, true)
-
-	drawGraph(cr, &params, results)
 
 	surface.Flush()
 
@@ -1000,10 +1168,17 @@ func marshalCairo(p PictureParams, results []*types.MetricData, backend cairoBac
 
 	switch backend {
 	case cairoPNG:
+		if p.RotateOutput != 0 {
+			rotated := rotateSurface(image, p.RotateOutput)
+			surface.Finish()
+			surface = rotated.Surface
+		}
+		encodeStart := time.Now()
 		var buf bytes.Buffer
 		surface.WriteToPNG(&buf)
 		surface.Finish()
 		b = buf.Bytes()
+		params.timings.Encode = time.Since(encodeStart)
 	case cairoSVG:
 		surface.Finish()
 		b, _ = ioutil.ReadFile(tmpfile.Name())
@@ -1015,11 +1190,120 @@ func marshalCairo(p PictureParams, results []*types.MetricData, backend cairoBac
 		b = bytes.Replace(b, []byte(`pt"`), []byte(`px"`), 2)
 	}
 
+	if info != nil {
+		info.timings = params.timings
+		info.timings.Total = time.Since(start)
+	}
+
 	return b
 }
 
+// writePNG renders the graph straight to w, without buffering the whole image
+func writePNG(ctx context.Context, w io.Writer, p PictureParams, results []*types.MetricData) error {
+	params := newParams(p)
+	params.ctx = ctx
+
+	s := imageSurfaceCreate(cairo.FormatARGB32, params.width, params.height, params.pixelRatio)
+	drawPictureAt(cairo.Create(s.Surface), &params, 0, 0, results)
+
+	s.Surface.Flush()
+	if p.RotateOutput != 0 {
+		rotated := rotateSurface(s, p.RotateOutput)
+		s.Surface.Finish()
+		s = rotated
+	}
+	err := s.Surface.WriteToPNG(w)
+	s.Surface.Finish()
+
+	return err
+}
+
+// rotateSurface returns a copy of the rendered image turned clockwise by angle degrees
+func rotateSurface(s *cairo.ImageSurface, angle int) *cairo.ImageSurface {
+	width, height, tx, ty := getRotation(angle, float64(s.GetWidth()), float64(s.GetHeight()))
+	rotated := cairo.ImageSurfaceCreate(cairo.FormatARGB32, int(width), int(height))
+	cr := cairo.Create(rotated.Surface)
+	cr.Translate(tx, ty)
+	cr.Rotate(radians(float64(angle)))
+	cr.SetSourceSurface(s.Surface, 0, 0)
+	cr.Paint()
+	rotated.Surface.Flush()
+	return rotated
+}
+
+// DrawPictureInto draws the graph into the width x height rectangle at (x, y)
+// of an existing context instead of a surface of its own, so several graphs
+// can be composited onto one canvas. The size of p is replaced by the
+// rectangle and its PixelRatio is ignored, scale cr instead.
+func DrawPictureInto(cr *cairo.Context, x, y, width, height float64, p PictureParams, results []*types.MetricData) {
+	p.Width, p.Height, p.PixelRatio = width, height, 1
+	params := newParams(p)
+	drawPictureAt(cr, &params, x, y, results)
+}
+
+// drawPictureAt draws the picture into the params.width x params.height
+// rectangle at (x, y) of c, clipped to it. The state of c is restored after.
+func drawPictureAt(c *cairo.Context, params *Params, x, y float64, results []*types.MetricData) {
+	c.Save()
+	defer c.Restore()
+	c.Translate(x, y)
+
+	cr := wrapContext(c, params.pixelRatio)
+	cr.context.Rectangle(0, 0, params.width, params.height)
+	cr.context.Clip()
+	drawPicture(cr, params, results)
+}
+
+// drawPicture draws the background and the graph on the whole surface
+func drawPicture(cr *cairoSurfaceContext, params *Params, results []*types.MetricData) {
+	// Setting font parameters
+
+	fontOpts := cairo.FontOptionsCreate()
+	fontOpts.SetAntialias(cairo.AntialiasNone)
+	cr.context.SetFontOptions(fontOpts)
+
+	setColor(cr, params.bgColor)
+	if params.cornerRadius > 0 {
+		roundedRectangle(cr, 0, 0, params.width, params.height, params.cornerRadius)
+		cr.context.Fill()
+	} else {
+		drawRectangle(cr, params, 0, 0, params.width, params.height, true)
+	}
+
+	drawGraph(cr, params, results)
+
+	if params.truncated {
+		drawPartialNote(cr, params)
+	}
+}
+
 func drawGraph(cr *cairoSurfaceContext, params *Params, results []*types.MetricData) {
+	stageStart := time.Now()
 	params.secondYAxis = false
+
+	if params.bubbles {
+		results = pairBubbles(results)
+	}
+
+	// drop extra series before anything is computed for them
+	if params.maxSeries > 0 && len(results) > params.maxSeries {
+		params.hiddenSeries = len(results) - params.maxSeries
+		results = results[:params.maxSeries]
+	}
+	if params.lastPoints > 0 {
+		keepLastPoints(results, params.lastPoints)
+	}
+	if params.trimEmptyEdges {
+		trimEmptyEdges(results)
+	}
+	if params.cumulative {
+		for _, r := range results {
+			// a new slice, the values may be shared with other results
+			r.Values = cumulativeSum(r.Values)
+			r.SetValuesPerPoint(r.ValuesPerPoint)
+		}
+	}
+
 	minNumberOfPoints := int64(0)
 	maxNumberOfPoints := int64(0)
 
@@ -1051,17 +1335,34 @@ func drawGraph(cr *cairoSurfaceContext, params *Params, results []*types.MetricD
 	}
 
 	if params.timeRange <= 0 {
-		x := params.width / 2.0
-		y := params.height / 2.0
-		setColor(cr, string2RGBA("red"))
-		fontSize := math.Log(params.width * params.height)
-		setFont(cr, params, fontSize)
-		drawText(cr, params, "No Data", x, y, HAlignCenter, VAlignTop, 0)
+		if !params.emptyFrame || params.until <= params.from {
+			drawNoData(cr, params)
+			return
+		}
+		// the axes and the grid of the requested range keep the shape of
+		// the graph, the message goes over them
+		results = nil
+		params.startTime, params.endTime = params.from, params.until
+		params.timeRange = params.endTime - params.startTime
+		defer drawNoData(cr, params)
+	}
 
+	if params.xLogBase > 0 && params.xLogBase <= 1 {
+		params.noDataText = "xLogBase needs a base above 1"
+		drawNoData(cr, params)
+		return
+	}
+	if params.xLogBase > 0 && params.startTime <= 0 {
+		params.noDataText = "xLogBase needs an X axis above 0"
+		drawNoData(cr, params)
 		return
 	}
 
 	for _, res := range results {
+		if params.rightAxisPattern != nil && params.rightAxisPattern(res.Name) {
+			// on top of the series put there by secondYAxis()
+			res.SecondYAxis = true
+		}
 		if res.SecondYAxis {
 			params.dataRight = append(params.dataRight, res)
 		} else {
@@ -1085,53 +1386,27 @@ func drawGraph(cr *cairoSurfaceContext, params *Params, results []*types.MetricD
 		params.area.ymax = params.height
 	}
 
-	if params.yAxisSide == YAxisSideRight {
-		params.margin = int(params.width)
-	}
-
 	if params.lineMode == LineModeSlope && minNumberOfPoints == 1 {
 		params.lineMode = LineModeStaircase
 	}
 
-	var colorsCur int
-	for _, res := range results {
-		if res.Color != "" {
-			// already has a color defined -- skip
-			continue
-		}
-		if params.secondYAxis && res.SecondYAxis {
-			res.LineWidth = params.rightWidth
-			res.HasLineWidth = true
-			if params.rightDashed && res.Dashed == 0 {
-				res.Dashed = 2.5
-			}
-			res.Color = params.rightColor
-		} else if params.secondYAxis {
-			res.LineWidth = params.leftWidth
-			res.HasLineWidth = true
-			if params.leftDashed && res.Dashed == 0 {
-				res.Dashed = 2.5
-			}
-			res.Color = params.leftColor
-		}
-		if res.Color == "" {
-			res.Color = params.colorList[colorsCur]
-			colorsCur++
-			if colorsCur >= len(params.colorList) {
-				colorsCur = 0
-			}
-		}
+	if params.referenceLines {
+		styleReferenceLines(results)
 	}
+	setSeriesStyles(params, results)
 
-	if params.title != "" || params.vtitle != "" || params.vtitleRight != "" {
-		titleSize := params.fontSize + math.Floor(math.Log(params.fontSize))
+	if len(params.focusSeries) > 0 {
+		dimUnfocused(params, results)
+	}
 
+	titleSize := params.fontSize + math.Floor(math.Log(params.fontSize))
+	if params.title != "" || params.vtitle != "" || params.vtitleRight != "" {
 		setColor(cr, params.fgColor)
-		setFont(cr, params, titleSize)
+		setTitleFont(cr, params, titleSize)
 	}
 
 	if params.title != "" {
-		drawTitle(cr, params)
+		drawTitle(cr, params, titleSize)
 	}
 	if params.vtitle != "" {
 		drawVTitle(cr, params, params.vtitle, false)
@@ -1141,9 +1416,23 @@ func drawGraph(cr *cairoSurfaceContext, params *Params, results []*types.MetricD
 	}
 
 	setFont(cr, params, params.fontSize)
-	if !params.hideLegend {
+	if params.showTimeRange && !params.graphOnly {
+		reserveTimeRange(params)
+	}
+	if params.colorByValue || params.graphType == GraphTypeHeatmap {
+		if !params.hideLegend {
+			reserveColorScale(cr, params)
+		}
+	} else if !params.hideLegend {
 		drawLegend(cr, params, results)
 	}
+	if params.graphType == GraphTypeHeatmap && len(results) > 0 {
+		drawHeatmap(cr, params, results[0])
+		return
+	}
+	if params.lineLabels != LineLabelsNone {
+		reserveLineLabels(cr, params, results)
+	}
 
 	// Setup axes, labels and grid
 	// First we adjust the drawing area size to fit X-axis labels
@@ -1151,7 +1440,7 @@ func drawGraph(cr *cairoSurfaceContext, params *Params, results []*types.MetricD
 		params.area.ymax -= params.fontExtents.Ascent * 2
 	}
 
-	if !(params.lineMode == LineModeStaircase || ((minNumberOfPoints == maxNumberOfPoints) && (minNumberOfPoints == 2))) {
+	if len(results) > 0 && !(params.lineMode == LineModeStaircase || ((minNumberOfPoints == maxNumberOfPoints) && (minNumberOfPoints == 2))) {
 		params.endTime = 0
 		for _, res := range results {
 			tmp := int64(res.StopTime - res.StepTime)
@@ -1174,13 +1463,13 @@ func drawGraph(cr *cairoSurfaceContext, params *Params, results []*types.MetricD
 	}
 
 	// check if we need to stack all the things
-	if params.areaMode == AreaModeStacked {
+	if params.areaMode == AreaModeStacked || params.areaMode == AreaModeStackedPercent {
 		params.hasStack = true
 		for _, r := range results {
 			r.Stacked = true
 			r.StackName = "stack"
 		}
-	} else if params.areaMode == AreaModeFirst {
+	} else if params.areaMode == AreaModeFirst && len(results) > 0 {
 		results[0].Stacked = true
 	} else if params.areaMode == AreaModeAll {
 		for _, r := range results {
@@ -1188,12 +1477,22 @@ func drawGraph(cr *cairoSurfaceContext, params *Params, results []*types.MetricD
 		}
 	}
 
-	if params.hasStack {
+	if params.areaMode == AreaModeStackedPercent {
+		normalizeStack(results)
+		params.yMin, params.yMax = 0, 1
+		params.yUnitSystem = unitSystemPercent
+	}
+
+	if params.hasStack && len(results) > 0 {
 		sort.Stable(ByStacked(results))
+		if params.stackOrder != StackOrderInput {
+			orderStacks(results, params.stackOrder)
+		}
 		// perform all aggregations / summations up so the rest of the graph drawing code doesn't need to care
 
 		var stackName = results[0].StackName
 		var total []float64
+		var stack []*types.MetricData
 		for _, r := range results {
 			if r.DrawAsInfinite {
 				continue
@@ -1207,6 +1506,7 @@ func drawGraph(cr *cairoSurfaceContext, params *Params, results []*types.MetricD
 			if r.StackName != stackName {
 				// got to a new named stack -- reset accumulator
 				total = total[:0]
+				stack = stack[:0]
 				stackName = r.StackName
 			}
 
@@ -1226,23 +1526,31 @@ func drawGraph(cr *cairoSurfaceContext, params *Params, results []*types.MetricD
 			// since these are now post-aggregation, reset the valuesPerPoint
 			r.ValuesPerPoint = 1
 			r.Values = vals
+			stack = append(stack, r)
+		}
+
+		if params.drawStackTotal && params.areaMode == AreaModeStacked && len(stack) > 0 {
+			params.stackTotal = stackTotalSeries(params, stack, total)
 		}
 	}
 
 	consolidateDataPoints(params, results)
+	params.timings.Prepare = time.Since(stageStart)
 
-	currentXMin := params.area.xmin
-	currentXMax := params.area.xmax
-	if params.secondYAxis {
-		setupTwoYAxes(cr, params, results)
-	} else {
-		setupYAxis(cr, params, results)
+	if params.graphType == GraphTypePanels && len(results) > 1 {
+		drawPanels(cr, params, results)
+		drawOverlays(cr, params, results)
+		return
 	}
 
-	for currentXMin != params.area.xmin || currentXMax != params.area.xmax {
+	stageStart = time.Now()
+
+	fitYAxes(cr, params, results)
+
+	if params.ratio > 0 {
+		// labels only ever push area edges inwards, so a single extra pass is enough
+		fitAreaToRatio(params)
 		consolidateDataPoints(params, results)
-		currentXMin = params.area.xmin
-		currentXMax = params.area.xmax
 		if params.secondYAxis {
 			setupTwoYAxes(cr, params, results)
 		} else {
@@ -1250,8 +1558,18 @@ func drawGraph(cr *cairoSurfaceContext, params *Params, results []*types.MetricD
 		}
 	}
 
+	params.timings.YAxis = time.Since(stageStart)
+
 	setupXAxis(cr, params, results)
 
+	if params.plotShadow {
+		drawPlotShadow(cr, params)
+	}
+
+	if len(params.highlightRanges) > 0 {
+		drawHighlightRanges(cr, params)
+	}
+
 	if !params.hideAxes {
 		setColor(cr, params.fgColor)
 		drawLabels(cr, params, results)
@@ -1260,142 +1578,893 @@ func drawGraph(cr *cairoSurfaceContext, params *Params, results []*types.MetricD
 		}
 	}
 
-	drawLines(cr, params, results)
-}
+	if params.colorByValue {
+		setColorByValueRange(params)
+	}
 
-func consolidateDataPoints(params *Params, results []*types.MetricData) {
-	numberOfPixels := params.area.xmax - params.area.xmin - (params.lineWidth + 1)
-	params.graphWidth = numberOfPixels
+	lines := results
+	if params.smoothWindow > 1 {
+		// the smoothed copies are only drawn, the legend and the stats
+		// are about the series themselves
+		lines = append(lines[:len(lines):len(lines)], smoothSeries(params, results)...)
+	}
+	if params.stackTotal != nil {
+		consolidateDataPoints(params, []*types.MetricData{params.stackTotal})
+		lines = append(lines[:len(lines):len(lines)], params.stackTotal)
+	}
+	stageStart = time.Now()
+	drawLines(cr, params, lines)
+	params.timings.Lines = time.Since(stageStart)
 
-	for _, series := range results {
-		numberOfDataPoints := math.Floor(float64(params.timeRange / int64(series.StepTime)))
-		// minXStep := params.minXStep
-		minXStep := 1.0
-		divisor := float64(params.timeRange) / float64(series.StepTime)
-		bestXStep := numberOfPixels / divisor
-		if bestXStep < minXStep {
-			drawableDataPoints := int(numberOfPixels / minXStep)
-			pointsPerPixel := math.Ceil(numberOfDataPoints / float64(drawableDataPoints))
-			// dumb variable naming :(
-			series.SetValuesPerPoint(int(pointsPerPixel))
-			series.XStep = (numberOfPixels * pointsPerPixel) / numberOfDataPoints
-		} else {
-			series.SetValuesPerPoint(1)
-			series.XStep = bestXStep
-		}
+	if params.lineLabels != LineLabelsNone {
+		drawLineLabels(cr, params, results)
 	}
-}
 
-func setupTwoYAxes(cr *cairoSurfaceContext, params *Params, results []*types.MetricData) {
+	if params.showLast {
+		drawLastValues(cr, params, results)
+	}
 
-	var Ldata []*types.MetricData
-	var Rdata []*types.MetricData
+	if params.colorByValue && !params.hideLegend {
+		drawColorScale(cr, params)
+	}
 
-	var seriesWithMissingValuesL []*types.MetricData
-	var seriesWithMissingValuesR []*types.MetricData
+	drawOverlays(cr, params, results)
+}
 
-	Ldata = params.dataLeft
-	Rdata = params.dataRight
+// drawHeatmap draws the series as a grid of days from left to right by hours
+// of the day in params.tz from top to bottom. Every cell is colored by the
+// average of its points on the colorByValue gradient, which defaults to the
+// range of the cells. The color scale takes the place of the legend.
+func drawHeatmap(cr *cairoSurfaceContext, params *Params, series *types.MetricData) {
+	const padding = 5
 
-	for _, s := range Ldata {
-		for _, v := range s.Values {
-			if math.IsNaN(v) {
-				seriesWithMissingValuesL = append(seriesWithMissingValuesL, s)
-				break
+	firstDay, cells := heatmapCells(series.Values, series.StartTime, series.StepTime, params.tz)
+
+	low, high := math.Inf(1), math.Inf(-1)
+	for _, day := range cells {
+		for _, v := range day {
+			if !math.IsNaN(v) {
+				low, high = math.Min(low, v), math.Max(high, v)
 			}
 		}
 	}
+	if low > high {
+		low, high = 0, 0
+	}
+	if math.IsNaN(params.colorByValueMin) {
+		params.colorByValueMin = low
+	}
+	if math.IsNaN(params.colorByValueMax) {
+		params.colorByValueMax = high
+	}
+
+	if !params.hideAxes {
+		params.area.ymax -= params.fontExtents.Ascent * 2
+		params.area.xmin += getTextExtents(cr, "00").XAdvance + padding
+	}
+	if params.area.xmax <= params.area.xmin || params.area.ymax <= params.area.ymin {
+		// no room left for the cells
+		drawNoData(cr, params)
+		return
+	}
+	cellWidth := (params.area.xmax - params.area.xmin) / float64(len(cells))
+	cellHeight := (params.area.ymax - params.area.ymin) / 24
 
-	for _, s := range Rdata {
-		for _, v := range s.Values {
+	for d, day := range cells {
+		for h, v := range day {
 			if math.IsNaN(v) {
-				seriesWithMissingValuesR = append(seriesWithMissingValuesR, s)
-				break
+				continue
 			}
+			setColor(cr, colorForValue(params, v))
+			// a bit of overlap hides seams between the cells
+			drawRectangle(cr, params, params.area.xmin+float64(d)*cellWidth, params.area.ymin+float64(h)*cellHeight, cellWidth+0.5, cellHeight+0.5, true)
 		}
+	}
 
+	if !params.hideAxes {
+		setColor(cr, params.fgColor)
+		hourStep := int(math.Ceil(params.fontExtents.Height / cellHeight))
+		if hourStep < 1 {
+			hourStep = 1
+		}
+		for h := 0; h < 24; h += hourStep {
+			y := params.area.ymin + (float64(h)+0.5)*cellHeight
+			drawText(cr, params, fmt.Sprintf("%02d", h), params.area.xmin-padding, y, HAlignRight, VAlignCenter, 0)
+		}
+
+		const dayFormat = "%m/%d"
+		label, _ := strftime.Format(dayFormat, firstDay)
+		dayStep := int(math.Ceil((getTextExtents(cr, label).XAdvance + padding) / cellWidth))
+		if dayStep < 1 {
+			dayStep = 1
+		}
+		for d := 0; d < len(cells); d += dayStep {
+			label, _ := strftime.Format(dayFormat, firstDay.AddDate(0, 0, d))
+			x := params.area.xmin + (float64(d)+0.5)*cellWidth
+			drawText(cr, params, label, x, params.area.ymax+params.fontExtents.Ascent, HAlignCenter, VAlignTop, 0)
+		}
 	}
 
-	yMinValueL := math.Inf(1)
-	if params.drawNullAsZero && len(seriesWithMissingValuesL) > 0 {
-		yMinValueL = 0
-	} else {
-		for _, s := range Ldata {
-			if s.DrawAsInfinite {
-				continue
+	if !params.hideLegend {
+		params.ySpan = params.colorByValueMax - params.colorByValueMin
+		params.yStep = params.ySpan
+		drawColorScale(cr, params)
+	}
+}
+
+// drawOverlays draws what goes over the lines: events, the stats box, the
+// sparkline dots and the time range
+func drawOverlays(cr *cairoSurfaceContext, params *Params, results []*types.MetricData) {
+	if len(params.events) > 0 {
+		drawEvents(cr, params)
+	}
+
+	if params.statsBox != StatsBoxNone {
+		drawStatsBox(cr, params, results)
+	}
+
+	if params.graphType == GraphTypeSparkline && params.sparklineDots {
+		drawMinMaxDots(cr, params, results)
+	}
+
+	if params.showTimeRange && !params.graphOnly {
+		drawTimeRange(cr, params)
+	}
+}
+
+// drawPanels splits the plot area into a band per series, stacked from top to
+// bottom. Every band has its own Y axis, the bands share the X axis, which is
+// labeled under the bottom one.
+func drawPanels(cr *cairoSurfaceContext, params *Params, results []*types.MetricData) {
+	top, bottom := params.area.ymin, params.area.ymax
+	// the gap keeps Y labels at the edges of neighbour bands apart
+	gap := params.fontExtents.Height
+	bandHeight := (bottom - top - gap*float64(len(results)-1)) / float64(len(results))
+
+	panel := func(i int) Params {
+		p := *params
+		p.secondYAxis = false
+		p.area.ymin = top + float64(i)*(bandHeight+gap)
+		p.area.ymax = p.area.ymin + bandHeight
+		return p
+	}
+
+	// the widest Y labels of all bands set the common left and right edges
+	fitPlotArea(params, results, func() {
+		for i := range results {
+			p := panel(i)
+			setupYAxis(cr, &p, results[i:i+1])
+			params.area.xmin = math.Max(params.area.xmin, p.area.xmin)
+			params.area.xmax = math.Min(params.area.xmax, p.area.xmax)
+		}
+	})
+
+	setupXAxis(cr, params, results)
+
+	for i := range results {
+		if params.ctx.Err() != nil {
+			// out of time, the panels drawn so far make a partial graph
+			params.truncated = true
+			break
+		}
+		p := panel(i)
+		setupYAxis(cr, &p, results[i:i+1])
+		if !p.hideAxes {
+			setColor(cr, p.fgColor)
+			if !p.hideYAxis {
+				drawYAxis(cr, &p, results[i:i+1])
 			}
-			for _, v := range s.AggregatedValues() {
-				if math.IsNaN(v) {
-					continue
-				}
-				if v < yMinValueL {
-					yMinValueL = v
-				}
+			if !p.hideGrid {
+				drawGridLines(cr, &p, results[i:i+1])
 			}
 		}
+		drawLines(cr, &p, results[i:i+1])
+		params.plotPoints = p.plotPoints
+		params.truncated = p.truncated
 	}
 
-	yMinValueR := math.Inf(1)
-	if params.drawNullAsZero && len(seriesWithMissingValuesR) > 0 {
-		yMinValueR = 0
-	} else {
-		for _, s := range Rdata {
-			if s.DrawAsInfinite {
-				continue
-			}
-			for _, v := range s.AggregatedValues() {
-				if math.IsNaN(v) {
-					continue
-				}
-				if v < yMinValueR {
-					yMinValueR = v
-				}
+	if !params.hideAxes && !params.hideXAxis {
+		setColor(cr, params.fgColor)
+		drawXAxis(cr, params, results)
+	}
+}
+
+// drawNoData draws the message for a graph without data in the middle of the
+// picture
+func drawNoData(cr *cairoSurfaceContext, params *Params) {
+	x := params.width / 2.0
+	y := params.height / 2.0
+	setColor(cr, string2RGBA(params.noDataColor))
+	fontSize := math.Log(params.width * params.height)
+	setFont(cr, params, fontSize)
+	// a longer message is shrunk to fit the width
+	available := params.width - 2*float64(params.margin)
+	if width := getTextExtents(cr, params.noDataText).Width; width > available && available > 0 {
+		setFont(cr, params, fontSize*available/width)
+	}
+	drawText(cr, params, params.noDataText, x, y, HAlignCenter, VAlignTop, 0)
+}
+
+const timeRangeFormat = "%Y-%m-%d %H:%M"
+
+// reserveTimeRange takes a line at the bottom of the graph, below the legend,
+// for the time range of the graph
+func reserveTimeRange(params *Params) {
+	const padding = 5
+
+	params.timeRangeY = params.area.ymax - params.fontExtents.Height
+	params.area.ymax -= params.fontExtents.Height + padding
+}
+
+// drawTimeRange prints the absolute time range of the graph, as a reference
+// that does not depend on the density of the X axis labels
+func drawTimeRange(cr *cairoSurfaceContext, params *Params) {
+	from, _ := strftime.Format(timeRangeFormat, time.Unix(params.startTime, 0).In(params.tz))
+	until, _ := strftime.Format(timeRangeFormat, time.Unix(params.endTime, 0).In(params.tz))
+
+	setColor(cr, params.fgColor)
+	setFont(cr, params, params.fontSize)
+	drawText(cr, params, fmt.Sprintf("From %s to %s", from, until), params.width/2, params.timeRangeY, HAlignCenter, VAlignTop, 0)
+}
+
+// drawPartialNote marks the graph as incomplete in the top right corner
+func drawPartialNote(cr *cairoSurfaceContext, params *Params) {
+	const padding = 2
+
+	setColor(cr, params.fgColor)
+	setFont(cr, params, params.fontSize*0.8)
+	drawText(cr, params, "partial data", params.width-padding, padding, HAlignRight, VAlignTop, 0)
+}
+
+// drawHighlightRanges shades the highlighted time ranges across the plot area,
+// clipped to the time window
+func drawHighlightRanges(cr *cairoSurfaceContext, params *Params) {
+	const alpha = 0.3
+
+	for _, hr := range params.highlightRanges {
+		start, end := hr.Start, hr.End
+		if start < params.startTime {
+			start = params.startTime
+		}
+		if end > params.endTime {
+			end = params.endTime
+		}
+		if start >= end {
+			continue
+		}
+
+		clr := colors["yellow"]
+		if hr.Color != "" {
+			clr = string2RGBA(hr.Color)
+		}
+		setColorAlpha(cr, clr, alpha)
+
+		x1 := getXCoord(params, float64(start))
+		x2 := getXCoord(params, float64(end))
+		drawRectangle(cr, params, x1, params.area.ymin, x2-x1, params.area.ymax-params.area.ymin, true)
+	}
+}
+
+// drawEvents draws a vertical line with a label for each event that fits the time window
+func drawEvents(cr *cairoSurfaceContext, params *Params) {
+	const padding = 2
+
+	cr.context.SetLineWidth(1)
+	cr.context.SetDash(nil, 0)
+	for _, e := range params.events {
+		if e.Time < params.startTime || e.Time > params.endTime {
+			continue
+		}
+
+		clr := params.fgColor
+		if e.Color != "" {
+			clr = string2RGBA(e.Color)
+		}
+		setColor(cr, clr)
+
+		x := getXCoord(params, float64(e.Time))
+		cr.context.MoveTo(x, params.area.ymin)
+		cr.context.LineTo(x, params.area.ymax)
+		cr.context.Stroke()
+
+		if e.Label != "" {
+			drawText(cr, params, e.Label, x-padding, params.area.ymin+padding, HAlignRight, VAlignBottom, 270)
+		}
+	}
+}
+
+// seriesStats returns min, max and average of the values, skipping absent
+// ones. ok is false if there are no values at all.
+func seriesStats(values []float64) (minValue, maxValue, avgValue float64, ok bool) {
+	var sum float64
+	var n int
+	for _, v := range values {
+		if math.IsNaN(v) {
+			continue
+		}
+		if n == 0 || v < minValue {
+			minValue = v
+		}
+		if n == 0 || v > maxValue {
+			maxValue = v
+		}
+		sum += v
+		n++
+	}
+	if n == 0 {
+		return 0, 0, 0, false
+	}
+
+	return minValue, maxValue, sum / float64(n), true
+}
+
+// drawStatsBox prints max, min and average of the first (or every) visible
+// series in a corner of the plot area. The legend is already placed outside
+// of the area at this point, so the box never overlaps it.
+func drawStatsBox(cr *cairoSurfaceContext, params *Params, results []*types.MetricData) {
+	const padding = 5
+
+	var lines []string
+	for _, series := range results {
+		if series.Invisible || series.DrawAsInfinite {
+			continue
+		}
+		minValue, maxValue, avgValue, ok := seriesStats(series.AggregatedValues())
+		if !ok {
+			continue
+		}
+
+		yStep, ySpan := params.yStep, params.ySpan
+		if params.secondYAxis {
+			if series.SecondYAxis {
+				yStep, ySpan = params.yStepR, params.ySpanR
+			} else {
+				yStep, ySpan = params.yStepL, params.ySpanL
 			}
 		}
+
+		lines = append(lines, fmt.Sprintf("%s  max: %s  min: %s  avg: %s", series.Name,
+			formatLabel(params, maxValue, yStep, ySpan),
+			formatLabel(params, minValue, yStep, ySpan),
+			formatLabel(params, avgValue, yStep, ySpan),
+		))
+		if !params.statsBoxAll {
+			break
+		}
+	}
+	if len(lines) == 0 {
+		return
+	}
+
+	var boxWidth float64
+	for _, line := range lines {
+		boxWidth = math.Max(boxWidth, getTextExtents(cr, line).XAdvance)
+	}
+	lineHeight := params.fontExtents.Height
+	boxWidth += 2 * padding
+	boxHeight := float64(len(lines))*lineHeight + 2*padding
+
+	x, y := params.area.xmin+padding, params.area.ymin+padding
+	if params.statsBox == StatsBoxTopRight || params.statsBox == StatsBoxBottomRight {
+		x = params.area.xmax - padding - boxWidth
+	}
+	if params.statsBox == StatsBoxBottomLeft || params.statsBox == StatsBoxBottomRight {
+		y = params.area.ymax - padding - boxHeight
+	}
+
+	setColorAlpha(cr, params.bgColor, 0.7)
+	drawRectangle(cr, params, x, y, boxWidth, boxHeight, true)
+
+	setColor(cr, params.fgColor)
+	for i, line := range lines {
+		drawText(cr, params, line, x+padding, y+padding+float64(i)*lineHeight, HAlignLeft, VAlignTop, 0)
+	}
+}
+
+// lineLabelOffset is the gap between the end of a line and its label
+const lineLabelOffset = 4
+
+// lastPoint returns the index and the value of the last present point
+func lastPoint(values []float64) (int, float64, bool) {
+	for i := len(values) - 1; i >= 0; i-- {
+		if !math.IsNaN(values[i]) && !math.IsInf(values[i], 0) {
+			return i, values[i], true
+		}
+	}
+	return 0, 0, false
+}
+
+// lineLabelText returns the label drawn at the end of the line. The value is
+// formatted on its own scale, so the label keeps its width while the axes
+// are set up.
+func lineLabelText(params *Params, series *types.MetricData, value float64) string {
+	if params.lineLabels != LineLabelsValue {
+		return series.Name
+	}
+	v := math.Abs(value)
+	return series.Name + " " + strings.TrimSpace(formatLabel(params, value, v, v))
+}
+
+// hasLineLabel tells whether the series gets a label at the end of its line
+func hasLineLabel(series *types.MetricData) bool {
+	return series.Name != "" && !series.Invisible && !series.DrawAsInfinite && series.BandOf == nil
+}
+
+// reserveLineLabels takes space for the widest line label from the right
+// side of the graph
+func reserveLineLabels(cr *cairoSurfaceContext, params *Params, results []*types.MetricData) {
+	var width float64
+	for _, series := range results {
+		if !hasLineLabel(series) {
+			continue
+		}
+		_, value, ok := lastPoint(series.Values)
+		if !ok {
+			continue
+		}
+		width = math.Max(width, getTextExtents(cr, lineLabelText(params, series, value)).XAdvance)
+	}
+	if width > 0 {
+		params.area.xmax -= width + lineLabelOffset
+	}
+}
+
+// drawLineLabels writes the name, and with lineLabels=value the last value,
+// of every series next to the last point of its line in the series color.
+// Labels that would overlap are pushed apart vertically.
+func drawLineLabels(cr *cairoSurfaceContext, params *Params, results []*types.MetricData) {
+	var labels []*types.MetricData
+	var texts []string
+	var xs, ys []float64
+	for _, series := range results {
+		if !hasLineLabel(series) {
+			continue
+		}
+		index, value, ok := lastPoint(drawnValues(params, series))
+		if !ok {
+			continue
+		}
+		y := getYCoord(params, value, getSeriesSide(params, series))
+		if math.IsNaN(y) {
+			continue
+		}
+		labels = append(labels, series)
+		texts = append(texts, lineLabelText(params, series, value))
+		xs = append(xs, getPointX(params, series, index)+lineLabelOffset)
+		ys = append(ys, y)
+	}
+
+	ys = nudgeLabels(ys, params.fontExtents.Height)
+	for i, series := range labels {
+		setColor(cr, string2RGBA(series.Color))
+		drawText(cr, params, texts[i], xs[i], ys[i], HAlignLeft, VAlignCenter, 0)
 	}
+}
 
-	var yMaxValueL, yMaxValueR float64
-	yMaxValueL = math.Inf(-1)
-	for _, s := range Ldata {
-		for _, v := range s.AggregatedValues() {
+// drawLastValues marks the last present point of every series with a dot and
+// writes its value above and left of it, so the label stays inside the plot
+func drawLastValues(cr *cairoSurfaceContext, params *Params, results []*types.MetricData) {
+	const radius = 2.5
+
+	var colors []color.RGBA
+	var texts []string
+	var xs, ys []float64
+	for _, series := range results {
+		if series.Invisible || series.DrawAsInfinite || series.BandOf != nil {
+			continue
+		}
+		index, value, ok := lastPoint(drawnValues(params, series))
+		if !ok {
+			continue
+		}
+		y := getYCoord(params, value, getSeriesSide(params, series))
+		if math.IsNaN(y) {
+			continue
+		}
+		x := getPointX(params, series, index)
+
+		c := string2RGBA(series.Color)
+		setColor(cr, c)
+		cr.context.Arc(x, y, radius, 0, 2*math.Pi)
+		cr.context.Fill()
+
+		v := math.Abs(value)
+		colors = append(colors, c)
+		texts = append(texts, strings.TrimSpace(formatLabel(params, value, v, v)))
+		xs = append(xs, x-radius)
+		ys = append(ys, y-radius)
+	}
+
+	ys = nudgeLabels(ys, params.fontExtents.Height)
+	for i, text := range texts {
+		setColor(cr, colors[i])
+		drawText(cr, params, text, xs[i], ys[i], HAlignRight, VAlignBottom, 0)
+	}
+}
+
+// drawMinMaxDots marks the lowest and the highest point of every series
+func drawMinMaxDots(cr *cairoSurfaceContext, params *Params, results []*types.MetricData) {
+	const radius = 1.5
+
+	for _, series := range results {
+		if series.Invisible || series.DrawAsInfinite {
+			continue
+		}
+
+		minIdx, maxIdx := -1, -1
+		values := drawnValues(params, series)
+		for i, v := range values {
 			if math.IsNaN(v) {
 				continue
 			}
+			if minIdx == -1 || v < values[minIdx] {
+				minIdx = i
+			}
+			if maxIdx == -1 || v > values[maxIdx] {
+				maxIdx = i
+			}
+		}
+		if minIdx == -1 {
+			continue
+		}
 
-			if v > yMaxValueL {
-				yMaxValueL = v
+		side := getSeriesSide(params, series)
+		for _, dot := range []struct {
+			idx   int
+			color string
+		}{{minIdx, "blue"}, {maxIdx, "red"}} {
+			y := getYCoord(params, values[dot.idx], side)
+			if math.IsNaN(y) {
+				continue
 			}
+			setColor(cr, string2RGBA(dot.color))
+			cr.context.Arc(getPointX(params, series, dot.idx), y, radius, 0, 2*math.Pi)
+			cr.context.Fill()
 		}
 	}
+}
 
-	yMaxValueR = math.Inf(-1)
-	for _, s := range Rdata {
-		for _, v := range s.AggregatedValues() {
-			if math.IsNaN(v) {
-				continue
+// styleReferenceLines draws the flat series gray and dashed unless they have
+// their own color or dashes, so thresholds returned as series don't take
+// colors from the palette and stay behind the real data
+func styleReferenceLines(results []*types.MetricData) {
+	for _, r := range results {
+		if !isFlat(r.Values) {
+			continue
+		}
+		if r.Color == "" {
+			r.Color = "gray"
+		}
+		if r.Dashed == 0 {
+			r.Dashed = 2.5
+		}
+	}
+}
+
+// setSeriesStyles fills in colors, line widths and dashes that were not set on
+// the series itself. The color is picked with the following precedence:
+// explicit series color, then leftColor/rightColor when there are two Y axes,
+// then the next color from the palette, or the one picked by the series name
+// with stableColors.
+func setSeriesStyles(params *Params, results []*types.MetricData) {
+	var colorsCur int
+	for _, res := range results {
+		var sideColor string
+		if params.secondYAxis {
+			sideWidth, sideDashed := params.leftWidth, params.leftDashed
+			sideColor = params.leftColor
+			if res.SecondYAxis {
+				sideWidth, sideDashed = params.rightWidth, params.rightDashed
+				sideColor = params.rightColor
 			}
 
-			if v > yMaxValueR {
-				yMaxValueR = v
+			if !res.HasLineWidth {
+				res.LineWidth = sideWidth
+				res.HasLineWidth = true
 			}
+			if sideDashed && res.Dashed == 0 {
+				res.Dashed = 2.5
+			}
+		}
+
+		if res.Color != "" || res.BandOf != nil {
+			continue
+		}
+		if sideColor != "" {
+			res.Color = sideColor
+			continue
+		}
+		if len(params.colorList) == 0 {
+			continue
+		}
+		if params.stableColors {
+			res.Color = params.colorList[stableColorIndex(res.Name, len(params.colorList))]
+			continue
+		}
+		res.Color = params.colorList[colorsCur]
+		colorsCur++
+		if colorsCur >= len(params.colorList) {
+			colorsCur = 0
 		}
 	}
 
-	if math.IsInf(yMinValueL, 1) {
-		yMinValueL = 0
+	for _, res := range results {
+		if res.BandOf != nil && res.Color == "" {
+			res.Color = res.BandOf.Color
+		}
+	}
+}
+
+// getPieSlices aggregates every series by pieMode, series without values are
+// left out
+func getPieSlices(params *Params, results []*types.MetricData) []PieSlice {
+	setSeriesStyles(params, results)
+
+	aggregate := consolidations.AvgValue
+	switch params.pieMode {
+	case PieModeMaximum:
+		aggregate = consolidations.MaxValue
+	case PieModeMinimum:
+		aggregate = consolidations.MinValue
+	}
+
+	slices := make([]PieSlice, 0, len(results))
+	for _, r := range results {
+		value := aggregate(r.Values)
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			continue
+		}
+		c := string2RGBA(r.Color)
+		slices = append(slices, PieSlice{
+			Name:  r.Name,
+			Value: value,
+			Color: fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B),
+		})
+	}
+	return slices
+}
+
+// stableColorIndex maps the series name to a palette index that does not
+// depend on the position of the series in results
+func stableColorIndex(name string, colors int) int {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return int(h.Sum32() % uint32(colors))
+}
+
+// dimUnfocused draws series that are not listed in focusSeries translucent
+// and thinner, so the focused ones stand out. Legend swatches are not affected.
+func dimUnfocused(params *Params, results []*types.MetricData) {
+	focused := make(map[int]bool, len(params.focusSeries))
+	for _, i := range params.focusSeries {
+		focused[i] = true
+	}
+
+	for i, res := range results {
+		if focused[i] {
+			continue
+		}
+		DimSeries(results[i : i+1])
+		if !res.HasLineWidth {
+			res.LineWidth = params.lineWidth
+			res.HasLineWidth = true
+		}
+		res.LineWidth /= 2
+	}
+}
+
+// smoothSeries returns a thinner dashed copy of every drawn series in the same
+// color with a trailing moving average over params.smoothWindow points
+func smoothSeries(params *Params, results []*types.MetricData) []*types.MetricData {
+	smoothed := make([]*types.MetricData, 0, len(results))
+	for _, r := range results {
+		if r.Invisible || r.DrawAsInfinite || r.BandOf != nil {
+			continue
+		}
+		s := r.Copy(false)
+		s.Values = movingAverage(r.AggregatedValues(), params.smoothWindow)
+		s.StepTime = r.AggregatedTimeStep()
+		s.ValuesPerPoint = 1
+		s.Stacked = false
+		s.BubbleSizes = nil
+		lineWidth := params.lineWidth
+		if r.HasLineWidth {
+			lineWidth = r.LineWidth
+		}
+		s.LineWidth = lineWidth / 2
+		s.HasLineWidth = true
+		s.Dashed = 3
+		smoothed = append(smoothed, s)
+	}
+	return smoothed
+}
+
+// stackTotalSeries returns total, the sum of the stack, as a bold unstacked
+// line. Unlike the top of the stack, the sum has a value wherever any of the
+// stacked series has one.
+func stackTotalSeries(params *Params, stack []*types.MetricData, total []float64) *types.MetricData {
+	s := stack[len(stack)-1].Copy(false)
+	s.Name = "total"
+	s.Values = make([]float64, len(total))
+	for i := range s.Values {
+		s.Values[i] = math.NaN()
+		for _, r := range stack {
+			if i < len(r.Values) && !math.IsNaN(r.Values[i]) {
+				s.Values[i] = total[i]
+				break
+			}
+		}
+	}
+	s.Stacked = false
+	s.StackName = ""
+	s.Invisible = false
+	s.HasAlpha = false
+	s.BubbleSizes = nil
+	s.Color = params.stackTotalColor
+	s.LineWidth = 2 * params.lineWidth
+	s.HasLineWidth = true
+	s.Dashed = 0
+	return s
+}
+
+// keepLastPoints drops all but the last n points of every series, so the
+// graph zooms to the most recent data. Shorter series are kept in full.
+func keepLastPoints(results []*types.MetricData, n int) {
+	trim := func(r *types.MetricData, from int) {
+		r.Values = r.Values[from:]
+		r.StartTime += int64(from) * r.StepTime
+		r.SetValuesPerPoint(r.ValuesPerPoint)
+	}
+	for _, r := range results {
+		if len(r.Values) <= n {
+			continue
+		}
+		from := len(r.Values) - n
+		if r.BubbleSizes != nil && len(r.BubbleSizes.Values) == len(r.Values) {
+			trim(r.BubbleSizes, from)
+		}
+		trim(r, from)
+	}
+}
+
+// trimEmptyEdges drops the points before the first and after the last point
+// any of the series has, so the time range only spans the actual data. The
+// paired bubble sizes are cut along with their series.
+func trimEmptyEdges(results []*types.MetricData) {
+	first, last := int64(math.MaxInt64), int64(math.MinInt64)
+	for _, r := range results {
+		for i, v := range r.Values {
+			if t := r.StartTime + int64(i)*r.StepTime; !math.IsNaN(v) {
+				if t < first {
+					first = t
+				}
+				break
+			}
+		}
+		for i := len(r.Values) - 1; i >= 0; i-- {
+			if t := r.StartTime + int64(i)*r.StepTime; !math.IsNaN(r.Values[i]) {
+				if t > last {
+					last = t
+				}
+				break
+			}
+		}
+	}
+	if first > last {
+		// nothing to keep, the graph says there is no data
+		return
 	}
 
-	if math.IsInf(yMinValueR, 1) {
+	trim := func(r *types.MetricData, from, to int) {
+		r.Values = r.Values[from:to]
+		r.StartTime += int64(from) * r.StepTime
+		r.StopTime = r.StartTime + int64(len(r.Values))*r.StepTime
+		r.SetValuesPerPoint(r.ValuesPerPoint)
+	}
+	for _, r := range results {
+		from, to := 0, len(r.Values)
+		for from < to && r.StartTime+int64(from)*r.StepTime < first {
+			from++
+		}
+		for to > from && r.StartTime+int64(to-1)*r.StepTime > last {
+			to--
+		}
+		if from == 0 && to == len(r.Values) {
+			continue
+		}
+		if r.BubbleSizes != nil && len(r.BubbleSizes.Values) == len(r.Values) {
+			trim(r.BubbleSizes, from, to)
+		}
+		trim(r, from, to)
+	}
+}
+
+func consolidateDataPoints(params *Params, results []*types.MetricData) {
+	numberOfPixels := params.area.xmax - params.area.xmin - (params.lineWidth + 1)
+	params.graphWidth = numberOfPixels
+
+	for _, series := range results {
+		numberOfDataPoints := math.Floor(float64(params.timeRange / int64(series.StepTime)))
+		// minXStep := params.minXStep
+		minXStep := 1.0
+		divisor := float64(params.timeRange) / float64(series.StepTime)
+		bestXStep := numberOfPixels / divisor
+		if bestXStep < minXStep {
+			drawableDataPoints := int(numberOfPixels / minXStep)
+			pointsPerPixel := math.Ceil(numberOfDataPoints / float64(drawableDataPoints))
+			// dumb variable naming :(
+			series.SetValuesPerPoint(int(pointsPerPixel))
+			// the same scale as the X axis, so series with different steps line up
+			series.XStep = (numberOfPixels * pointsPerPixel) / divisor
+		} else {
+			series.SetValuesPerPoint(1)
+			series.XStep = bestXStep
+		}
+	}
+}
+
+// fitAreaToRatio shrinks the plot area to the requested width/height ratio and
+// centers it in the space that was available, leaving letterbox margins.
+func fitAreaToRatio(params *Params) {
+	width := params.area.xmax - params.area.xmin
+	height := params.area.ymax - params.area.ymin
+	if width <= 0 || height <= 0 {
+		return
+	}
+
+	if width/height > params.ratio {
+		pad := (width - height*params.ratio) / 2
+		params.area.xmin += pad
+		params.area.xmax -= pad
+	} else {
+		pad := (height - width/params.ratio) / 2
+		params.area.ymin += pad
+		params.area.ymax -= pad
+	}
+}
+
+func setupTwoYAxes(cr *cairoSurfaceContext, params *Params, results []*types.MetricData) {
+
+	yMinValueL, yMaxValueL, hasMissingL := getDataRange(params.dataLeft)
+	yMinValueR, yMaxValueR, hasMissingR := getDataRange(params.dataRight)
+	if params.yScalePercentile > 0 {
+		yMaxValueL = getDataPercentile(params.dataLeft, params.yScalePercentile, yMaxValueL)
+		yMaxValueR = getDataPercentile(params.dataRight, params.yScalePercentile, yMaxValueR)
+	}
+
+	if yMinValueL > 0 && params.drawNullAsZero && hasMissingL {
+		yMinValueL = 0
+	}
+	if yMinValueR > 0 && params.drawNullAsZero && hasMissingR {
 		yMinValueR = 0
 	}
+	if yMaxValueL < 0 && params.drawNullAsZero && hasMissingL {
+		yMaxValueL = 0
+	}
+	if yMaxValueR < 0 && params.drawNullAsZero && hasMissingR {
+		yMaxValueR = 0
+	}
 
-	if math.IsInf(yMaxValueL, -1) {
+	if math.IsNaN(yMinValueL) {
+		yMinValueL = 0
+	}
+	if math.IsNaN(yMinValueR) {
+		yMinValueR = 0
+	}
+	if math.IsNaN(yMaxValueL) {
 		yMaxValueL = 0
 	}
-	if math.IsInf(yMaxValueR, -1) {
+	if math.IsNaN(yMaxValueR) {
 		yMaxValueR = 0
 	}
 
+	if params.logBaseL == 0 {
+		yMinValueL, yMaxValueL = padYRange(yMinValueL, yMaxValueL, params.plotPaddingBottom, params.plotPaddingTop)
+	}
+	if params.logBaseR == 0 {
+		yMinValueR, yMaxValueR = padYRange(yMinValueR, yMaxValueR, params.plotPaddingBottom, params.plotPaddingTop)
+	}
+
 	if !math.IsNaN(params.yMaxLeft) {
 		yMaxValueL = params.yMaxLeft
 	}
@@ -1424,62 +2493,18 @@ func setupTwoYAxes(cr *cairoSurfaceContext, params *Params, results []*types.Met
 		yMaxValueR = yMinValueR + 1
 	}
 
-	yVarianceL := yMaxValueL - yMinValueL
-	yVarianceR := yMaxValueR - yMinValueR
-
-	var orderL float64
-	var orderFactorL float64
-	if params.yUnitSystem == unitSystemBinary {
-		orderL = math.Log2(yVarianceL)
-		orderFactorL = math.Pow(2, math.Floor(orderL))
-	} else {
-		orderL = math.Log10(yVarianceL)
-		orderFactorL = math.Pow(10, math.Floor(orderL))
-	}
-
-	var orderR float64
-	var orderFactorR float64
-	if params.yUnitSystem == unitSystemBinary {
-		orderR = math.Log2(yVarianceR)
-		orderFactorR = math.Pow(2, math.Floor(orderR))
-	} else {
-		orderR = math.Log10(yVarianceR)
-		orderFactorR = math.Pow(10, math.Floor(orderR))
-	}
-
-	vL := yVarianceL / orderFactorL // we work with a scaled down yVariance for simplicity
-	vR := yVarianceR / orderFactorR
-
-	yDivisors := params.yDivisors
-
-	prettyValues := []float64{0.1, 0.2, 0.25, 0.5, 1.0, 1.2, 1.25, 1.5, 2.0, 2.25, 2.5}
-
-	var divinfoL divisorInfo
-	var divinfoR divisorInfo
-
-	for _, d := range yDivisors {
-		qL := vL / d                                                              // our scaled down quotient, must be in the open interval (0,10)
-		qR := vR / d                                                              // our scaled down quotient, must be in the open interval (0,10)
-		pL := closest(qL, prettyValues)                                           // the prettyValue our quotient is closest to
-		pR := closest(qR, prettyValues)                                           // the prettyValue our quotient is closest to
-		divinfoL = append(divinfoL, yaxisDivisor{p: pL, diff: math.Abs(qL - pL)}) // make a  list so we can find the prettiest of the pretty
-		divinfoR = append(divinfoR, yaxisDivisor{p: pR, diff: math.Abs(qR - pR)}) // make a  list so we can find the prettiest of the pretty
-	}
-
-	sort.Sort(divinfoL)
-	sort.Sort(divinfoR)
-
-	prettyValueL := divinfoL[0].p
-	yStepL := prettyValueL * orderFactorL
-
-	prettyValueR := divinfoR[0].p
-	yStepR := prettyValueR * orderFactorR
+	yStepL := math.Max(getYStep(yMinValueL, yMaxValueL, params.yUnitSystem, params.yDivisors), params.yMinStep)
+	yStepR := math.Max(getYStep(yMinValueR, yMaxValueR, params.yUnitSystem, params.yDivisors), params.yMinStep)
 
 	if !math.IsNaN(params.yStepL) {
 		yStepL = params.yStepL
+	} else if params.logBaseL == 0 && len(params.yTicks) == 0 {
+		yStepL = distinctYStep(yMinValueL, yMaxValueL, yStepL, yLabelFormat(params))
 	}
 	if !math.IsNaN(params.yStepR) {
 		yStepR = params.yStepR
+	} else if params.logBaseR == 0 && len(params.yTicks) == 0 {
+		yStepR = distinctYStep(yMinValueR, yMaxValueR, yStepR, yLabelFormat(params))
 	}
 
 	params.yStepL = yStepL
@@ -1491,30 +2516,46 @@ func setupTwoYAxes(cr *cairoSurfaceContext, params *Params, results []*types.Met
 	params.yBottomR = params.yStepR * math.Floor(yMinValueR/params.yStepR)
 	params.yTopR = params.yStepR * math.Ceil(yMaxValueR/params.yStepR)
 
-	if params.logBase != 0 {
-		if yMinValueL > 0 && yMinValueR > 0 {
-			params.yBottomL = math.Pow(params.logBase, math.Floor(math.Log(yMinValueL)/math.Log(params.logBase)))
-			params.yTopL = math.Pow(params.logBase, math.Ceil(math.Log(yMaxValueL/math.Log(params.logBase))))
-			params.yBottomR = math.Pow(params.logBase, math.Floor(math.Log(yMinValueR)/math.Log(params.logBase)))
-			params.yTopR = math.Pow(params.logBase, math.Ceil(math.Log(yMaxValueR/math.Log(params.logBase))))
-		} else {
-			panic("logscale with minvalue <= 0")
+	if params.yMaxHeadroom {
+		if math.IsNaN(params.yMaxLeft) && params.logBaseL == 0 {
+			params.yTopL = nextYStep(yMaxValueL, params.yStepL)
+		}
+		if math.IsNaN(params.yMaxRight) && params.logBaseR == 0 {
+			params.yTopR = nextYStep(yMaxValueR, params.yStepR)
 		}
 	}
 
+	if params.logBaseL != 0 {
+		params.yBottomL, params.yTopL = getLogRange(params.logBaseL, yMinValueL, yMaxValueL, params.dataLeft)
+	}
+	if params.logBaseR != 0 {
+		params.yBottomR, params.yTopR = getLogRange(params.logBaseR, yMinValueR, yMaxValueR, params.dataRight)
+	}
+
 	if !math.IsNaN(params.yMaxLeft) {
 		params.yTopL = params.yMaxLeft
 	}
 	if !math.IsNaN(params.yMaxRight) {
 		params.yTopR = params.yMaxRight
 	}
-	if !math.IsNaN(params.yMinLeft) {
+	if !math.IsNaN(params.yMinLeft) && (params.logBaseL == 0 || params.yMinLeft > 0) {
 		params.yBottomL = params.yMinLeft
 	}
-	if !math.IsNaN(params.yMinRight) {
+	if !math.IsNaN(params.yMinRight) && (params.logBaseR == 0 || params.yMinRight > 0) {
 		params.yBottomR = params.yMinRight
 	}
 
+	// the same number of divisions puts the labels of both axes on the same
+	// gridlines
+	if params.yDivisions > 0 {
+		if params.logBaseL == 0 {
+			params.yBottomL, params.yTopL, params.yStepL = getYDivisions(yMinValueL, yMaxValueL, params.yDivisions, !math.IsNaN(params.yMinLeft), !math.IsNaN(params.yMaxLeft))
+		}
+		if params.logBaseR == 0 {
+			params.yBottomR, params.yTopR, params.yStepR = getYDivisions(yMinValueR, yMaxValueR, params.yDivisions, !math.IsNaN(params.yMinRight), !math.IsNaN(params.yMaxRight))
+		}
+	}
+
 	params.ySpanL = params.yTopL - params.yBottomL
 	params.ySpanR = params.yTopR - params.yBottomR
 
@@ -1531,118 +2572,200 @@ func setupTwoYAxes(cr *cairoSurfaceContext, params *Params, results []*types.Met
 	params.yScaleFactorL = params.graphHeight / params.ySpanL
 	params.yScaleFactorR = params.graphHeight / params.ySpanR
 
-	params.yLabelValuesL = getYLabelValues(params, params.yBottomL, params.yTopL, params.yStepL)
-	params.yLabelValuesR = getYLabelValues(params, params.yBottomR, params.yTopR, params.yStepR)
+	params.yLabelValuesL = getYLabelValues(params.logBaseL, params.yBottomL, params.yTopL, params.yStepL)
+	params.yLabelValuesR = getYLabelValues(params.logBaseR, params.yBottomR, params.yTopR, params.yStepR)
+	if len(params.yTicks) > 0 {
+		params.yLabelValuesL = getYTickValues(params.yTicks, params.yBottomL, params.yTopL)
+		params.yLabelValuesR = getYTickValues(params.yTicks, params.yBottomR, params.yTopR)
+	}
+	params.yMinorValuesL = getYMinorValues(params.yLabelValuesL, params.minorY, params.logBaseL)
+	params.yGridValuesL = getYGridValues(params.yLabelValuesL, params.gridDensity, params.logBaseL)
+	params.yMinorValuesR = getYMinorValues(params.yLabelValuesR, params.minorY, params.logBaseR)
+	params.yGridValuesR = getYGridValues(params.yLabelValuesR, params.gridDensity, params.logBaseR)
 
 	params.yLabelsL = make([]string, len(params.yLabelValuesL))
 	for i, v := range params.yLabelValuesL {
-		params.yLabelsL[i] = makeLabel(v, params.yStepL, params.ySpanL, params.yUnitSystem)
+		params.yLabelsL[i] = formatLabel(params, v, params.yStepL, params.ySpanL)
 	}
 
 	params.yLabelsR = make([]string, len(params.yLabelValuesR))
 	for i, v := range params.yLabelValuesR {
-		params.yLabelsR[i] = makeLabel(v, params.yStepR, params.ySpanR, params.yUnitSystem)
+		params.yLabelsR[i] = formatLabel(params, v, params.yStepR, params.ySpanR)
 	}
 
 	params.yLabelWidthL = 0
 	for _, label := range params.yLabelsL {
-		t := getTextExtents(cr, label)
-		if t.XAdvance > params.yLabelWidthL {
-			params.yLabelWidthL = t.XAdvance
+		if w := getYLabelWidth(cr, params, label); w > params.yLabelWidthL {
+			params.yLabelWidthL = w
 		}
 	}
 
 	params.yLabelWidthR = 0
 	for _, label := range params.yLabelsR {
-		t := getTextExtents(cr, label)
-		if t.XAdvance > params.yLabelWidthR {
-			params.yLabelWidthR = t.XAdvance
+		if w := getYLabelWidth(cr, params, label); w > params.yLabelWidthR {
+			params.yLabelWidthR = w
 		}
 	}
 
-	xMin := float64(params.margin) + (params.yLabelWidthL * 1.02)
+	shrinkArea(params, float64(params.margin)+params.yLabelWidthL*1.02, params.width-params.yLabelWidthR*1.02)
+}
+
+// maxYAxisSetups caps how many times fitYAxes sets the Y axes up
+const maxYAxisSetups = 10
+
+// fitYAxes sets the Y axes up until the plot area stops changing and
+// returns how many setups it took. The labels take room from the plot area,
+// which changes the consolidation of the series and so the labels. As the
+// area only ever shrinks by the label widths, it settles after a few
+// setups, the cap is only a guard against float rounding.
+func fitYAxes(cr *cairoSurfaceContext, params *Params, results []*types.MetricData) int {
+	return fitPlotArea(params, results, func() {
+		if params.secondYAxis {
+			setupTwoYAxes(cr, params, results)
+		} else {
+			setupYAxis(cr, params, results)
+		}
+	})
+}
+
+// fitPlotArea runs setup, which shrinks the plot area to the Y labels, and
+// consolidates the series to the new area until it stops changing, at most
+// maxYAxisSetups times. It returns how many times setup ran.
+func fitPlotArea(params *Params, results []*types.MetricData, setup func()) int {
+	for setups := 1; ; setups++ {
+		xMin, xMax := params.area.xmin, params.area.xmax
+		setup()
+		if params.area.xmin == xMin && params.area.xmax == xMax {
+			return setups
+		}
+		consolidateDataPoints(params, results)
+		if setups == maxYAxisSetups {
+			return setups
+		}
+	}
+}
+
+// shrinkArea moves the edges of the plot area inwards to xMin and xMax, edges
+// that are already inside stay, so the area never grows back
+func shrinkArea(params *Params, xMin, xMax float64) {
 	if params.area.xmin < xMin {
 		params.area.xmin = xMin
 	}
-
-	xMax := params.width - (params.yLabelWidthR * 1.02)
 	if params.area.xmax > xMax {
 		params.area.xmax = xMax
 	}
 }
 
-type yaxisDivisor struct {
-	p    float64
-	diff float64
-}
-
-type divisorInfo []yaxisDivisor
-
-func (d divisorInfo) Len() int               { return len(d) }
-func (d divisorInfo) Less(i int, j int) bool { return d[i].diff < d[j].diff }
-func (d divisorInfo) Swap(i int, j int)      { d[i], d[j] = d[j], d[i] }
-
-func makeLabel(yValue, yStep, ySpan float64, yUnitSystem string) string {
-	yValue, prefix := formatUnits(yValue, yStep, yUnitSystem)
-	ySpan, spanPrefix := formatUnits(ySpan, yStep, yUnitSystem)
-
-	if prefix != "" {
-		prefix += " "
+// getDataRange returns the lowest and the highest value of the series and
+// whether any of them has gaps. NaN is treated as a missing point, infinite
+// values and series drawn as infinite lines are ignored. min and max are NaN
+// if there is nothing to scale to.
+func getDataRange(series []*types.MetricData) (minValue, maxValue float64, hasMissing bool) {
+	minValue, maxValue = math.NaN(), math.NaN()
+	for _, r := range series {
+		if r.DrawAsInfinite {
+			continue
+		}
+		for _, v := range r.AggregatedValues() {
+			if math.IsNaN(v) {
+				hasMissing = true
+				continue
+			}
+			if math.IsInf(v, 0) {
+				continue
+			}
+			if math.IsNaN(minValue) || v < minValue {
+				minValue = v
+			}
+			if math.IsNaN(maxValue) || v > maxValue {
+				maxValue = v
+			}
+		}
 	}
 
-	switch {
-	case yValue < 0.1:
-		return fmt.Sprintf("%.9g %s", yValue, prefix)
-	case yValue < 1.0:
-		return fmt.Sprintf("%.2f %s", yValue, prefix)
-	case ySpan > 10 || spanPrefix != prefix:
-		if yValue-math.Floor(yValue) < floatEpsilon {
-			return fmt.Sprintf("%.1f %s", yValue, prefix)
+	return minValue, maxValue, hasMissing
+}
+
+// getLogRange returns the powers of base that enclose min and max on a log
+// scale. Values <= 0 have no logarithm and are not drawn: graphite refuses
+// such a scale, here it starts at the least positive value of series instead,
+// or at 1 if there is none.
+func getLogRange(base, min, max float64, series []*types.MetricData) (bottom, top float64) {
+	if min <= 0 {
+		min = math.NaN()
+		for _, r := range series {
+			if r.DrawAsInfinite {
+				continue
+			}
+			for _, v := range r.AggregatedValues() {
+				if v > 0 && !math.IsInf(v, 0) && (math.IsNaN(min) || v < min) {
+					min = v
+				}
+			}
+		}
+		if math.IsNaN(min) {
+			min = 1
 		}
-		return fmt.Sprintf("%d %s", int(yValue), prefix)
-	case ySpan > 3:
-		return fmt.Sprintf("%.1f %s", yValue, prefix)
-	case ySpan > 0.1:
-		return fmt.Sprintf("%.2f %s", yValue, prefix)
-	default:
-		return fmt.Sprintf("%g %s", yValue, prefix)
 	}
-}
+	if max < min {
+		max = min
+	}
 
-func setupYAxis(cr *cairoSurfaceContext, params *Params, results []*types.MetricData) {
-	var seriesWithMissingValues []*types.MetricData
+	bottom = math.Pow(base, math.Floor(math.Log(min)/math.Log(base)))
+	top = math.Pow(base, math.Ceil(math.Log(max)/math.Log(base)))
+	return bottom, top
+}
 
-	var yMinValue, yMaxValue float64
+// getDataPercentile returns the percentile of all drawn values, so a few
+// outliers don't define the top of the axis. def is returned if there is
+// nothing to compute it from or the percentile is out of (0, 100).
+func getDataPercentile(series []*types.MetricData, percentile, def float64) float64 {
+	if percentile <= 0 || percentile >= 100 {
+		return def
+	}
 
-	yMinValue, yMaxValue = math.NaN(), math.NaN()
-	for _, r := range results {
+	var values []float64
+	for _, r := range series {
 		if r.DrawAsInfinite {
 			continue
 		}
-		pushed := false
-		for _, v := range r.AggregatedValues() {
-			if math.IsNaN(v) && !pushed {
-				seriesWithMissingValues = append(seriesWithMissingValues, r)
-				pushed = true
-			} else {
-				if math.IsNaN(v) {
-					continue
-				}
-				if !math.IsInf(v, 0) && (math.IsNaN(yMinValue) || yMinValue > v) {
-					yMinValue = v
-				}
-				if !math.IsInf(v, 0) && (math.IsNaN(yMaxValue) || yMaxValue < v) {
-					yMaxValue = v
-				}
+		for _, v := range r.AggregatedValues() {
+			if !math.IsNaN(v) && !math.IsInf(v, 0) {
+				values = append(values, v)
 			}
 		}
 	}
+	if len(values) == 0 {
+		return def
+	}
+
+	return consolidations.Percentile(values, percentile, true)
+}
+
+// yLabelFormat returns formatLabel for the Y axis
+func yLabelFormat(params *Params) func(value, step, span float64) string {
+	return func(value, step, span float64) string {
+		return formatLabel(params, value, step, span)
+	}
+}
+
+// formatLabel returns makeLabel with the unit system and the precision of the
+// Y axis, written with the separators of numberFormat
+func formatLabel(params *Params, value, step, span float64) string {
+	return params.numberFormat.apply(makeLabel(value, step, span, params.yUnitSystem, params.yLabelPrecision))
+}
+
+func setupYAxis(cr *cairoSurfaceContext, params *Params, results []*types.MetricData) {
+	yMinValue, yMaxValue, hasMissing := getDataRange(results)
+	if params.yScalePercentile > 0 {
+		yMaxValue = getDataPercentile(results, params.yScalePercentile, yMaxValue)
+	}
 
-	if yMinValue > 0 && params.drawNullAsZero && len(seriesWithMissingValues) > 0 {
+	if yMinValue > 0 && params.drawNullAsZero && hasMissing {
 		yMinValue = 0
 	}
 
-	if yMaxValue < 0 && params.drawNullAsZero && len(seriesWithMissingValues) > 0 {
+	if yMaxValue < 0 && params.drawNullAsZero && hasMissing {
 		yMaxValue = 0
 	}
 
@@ -1654,6 +2777,10 @@ func setupYAxis(cr *cairoSurfaceContext, params *Params, results []*types.Metric
 		yMaxValue = 1
 	}
 
+	if params.logBase == 0 {
+		yMinValue, yMaxValue = padYRange(yMinValue, yMaxValue, params.plotPaddingBottom, params.plotPaddingTop)
+	}
+
 	if !math.IsNaN(params.yMax) {
 		yMaxValue = params.yMax
 	}
@@ -1665,39 +2792,13 @@ func setupYAxis(cr *cairoSurfaceContext, params *Params, results []*types.Metric
 		yMaxValue = yMinValue + 1
 	}
 
-	yVariance := yMaxValue - yMinValue
-
-	var order float64
-	var orderFactor float64
-	if params.yUnitSystem == unitSystemBinary {
-		order = math.Log2(yVariance)
-		orderFactor = math.Pow(2, math.Floor(order))
-	} else {
-		order = math.Log10(yVariance)
-		orderFactor = math.Pow(10, math.Floor(order))
-	}
-
-	v := yVariance / orderFactor // we work with a scaled down yVariance for simplicity
-
-	yDivisors := params.yDivisors
-
-	prettyValues := []float64{0.1, 0.2, 0.25, 0.5, 1.0, 1.2, 1.25, 1.5, 2.0, 2.25, 2.5}
-
-	var divinfo divisorInfo
-
-	for _, d := range yDivisors {
-		q := v / d                                                           // our scaled down quotient, must be in the open interval (0,10)
-		p := closest(q, prettyValues)                                        // the prettyValue our quotient is closest to
-		divinfo = append(divinfo, yaxisDivisor{p: p, diff: math.Abs(q - p)}) // make a  list so we can find the prettiest of the pretty
-	}
-
-	sort.Sort(divinfo) // sort our pretty values by 'closeness to a factor"
-
-	prettyValue := divinfo[0].p        // our winner! Y-axis will have labels placed at multiples of our prettyValue
-	yStep := prettyValue * orderFactor // scale it back up to the order of yVariance
+	yStep := math.Max(getYStep(yMinValue, yMaxValue, params.yUnitSystem, params.yDivisors), params.yMinStep)
 
 	if !math.IsNaN(params.yStep) {
 		yStep = params.yStep
+	} else if params.logBase == 0 && len(params.yTicks) == 0 {
+		// a step finer than the label precision repeats labels
+		yStep = distinctYStep(yMinValue, yMaxValue, yStep, yLabelFormat(params))
 	}
 
 	params.yStep = yStep
@@ -1705,14 +2806,12 @@ func setupYAxis(cr *cairoSurfaceContext, params *Params, results []*types.Metric
 	params.yBottom = params.yStep * math.Floor(yMinValue/params.yStep+floatEpsilon) // start labels at the greatest multiple of yStep <= yMinValue
 	params.yTop = params.yStep * math.Ceil(yMaxValue/params.yStep-floatEpsilon)     // Extend the top of our graph to the lowest yStep multiple >= yMaxValue
 
+	if params.yMaxHeadroom && math.IsNaN(params.yMax) {
+		params.yTop = nextYStep(yMaxValue, params.yStep)
+	}
+
 	if params.logBase != 0 {
-		if yMinValue > 0 {
-			params.yBottom = math.Pow(params.logBase, math.Floor(math.Log(yMinValue)/math.Log(params.logBase)))
-			params.yTop = math.Pow(params.logBase, math.Ceil(math.Log(yMaxValue)/math.Log(params.logBase)))
-		} else {
-			panic("logscale with minvalue <= 0")
-			// raise GraphError('Logarithmic scale specified with a dataset with a minimum value less than or equal to zero')
-		}
+		params.yBottom, params.yTop = getLogRange(params.logBase, yMinValue, yMaxValue, results)
 	}
 
 	/*
@@ -1740,42 +2839,52 @@ func setupYAxis(cr *cairoSurfaceContext, params *Params, results []*types.Metric
 	if !params.hideAxes {
 		// Create and measure the Y-labels
 
-		params.yLabelValues = getYLabelValues(params, params.yBottom, params.yTop, params.yStep)
+		params.yLabelValues = getYLabelValues(params.logBase, params.yBottom, params.yTop, params.yStep)
+		if len(params.yTicks) > 0 {
+			params.yLabelValues = getYTickValues(params.yTicks, params.yBottom, params.yTop)
+		}
+		params.yMinorValues = getYMinorValues(params.yLabelValues, params.minorY, params.logBase)
+		params.yGridValues = getYGridValues(params.yLabelValues, params.gridDensity, params.logBase)
 
 		params.yLabels = make([]string, len(params.yLabelValues))
 		for i, v := range params.yLabelValues {
-			params.yLabels[i] = makeLabel(v, params.yStep, params.ySpan, params.yUnitSystem)
+			params.yLabels[i] = formatLabel(params, v, params.yStep, params.ySpan)
 		}
 
 		params.yLabelWidth = 0
 		for _, label := range params.yLabels {
-			t := getTextExtents(cr, label)
-			if t.XAdvance > params.yLabelWidth {
-				params.yLabelWidth = t.XAdvance
+			if w := getYLabelWidth(cr, params, label); w > params.yLabelWidth {
+				params.yLabelWidth = w
 			}
 		}
 
 		if !params.hideYAxis {
 			if params.yAxisSide == YAxisSideLeft { // scoot the graph over to the left just enough to fit the y-labels
-				xMin := float64(params.margin) + float64(params.yLabelWidth)*1.02
-				if params.area.xmin < xMin {
-					params.area.xmin = xMin
-				}
+				shrinkArea(params, float64(params.margin)+params.yLabelWidth*1.02, params.area.xmax)
 			} else { // scoot the graph over to the right just enough to fit the y-labels
-				// xMin := 0 // TODO(dgryski): bug?  Why is this set?
-				xMax := float64(params.margin) - float64(params.yLabelWidth)*1.02
-				if params.area.xmax >= xMax {
-					params.area.xmax = xMax
-				}
+				shrinkArea(params, params.area.xmin, params.width-float64(params.margin)-params.yLabelWidth*1.02)
 			}
 		}
 	} else {
 		params.yLabelValues = nil
+		params.yMinorValues = nil
+		params.yGridValues = nil
 		params.yLabels = nil
 		params.yLabelWidth = 0.0
 	}
 }
 
+// getYLabelWidth returns how much horizontal space a Y axis label takes,
+// rotated by yLabelRotate
+func getYLabelWidth(cr *cairoSurfaceContext, params *Params, label string) float64 {
+	width := getTextExtents(cr, label).XAdvance
+	if params.yLabelRotate == 0 {
+		return width
+	}
+	sin, cos := math.Sincos(radians(params.yLabelRotate))
+	return math.Abs(width*cos) + math.Abs(getFontExtents(cr).Height*sin)
+}
+
 func getFontExtents(cr *cairoSurfaceContext) cairo.FontExtents {
 	// TODO(dgryski): allow font options
 	/*
@@ -1793,91 +2902,34 @@ func getTextExtents(cr *cairoSurfaceContext, text string) cairo.TextExtents {
 	   if fontOptions:
 	     self.setFont(**fontOptions)
 	*/
-	var T cairo.TextExtents
-	cr.context.TextExtents(text, &T)
-	return T
-}
-
-// formatUnits formats the given value according to the given unit prefix system
-func formatUnits(v, step float64, system string) (float64, string) {
-
-	var condition func(float64) bool
-
-	if step == math.NaN() {
-		condition = func(size float64) bool { return math.Abs(v) >= size }
-	} else {
-		condition = func(size float64) bool { return math.Abs(v) >= size && step >= size }
+	key := textExtentsKey{text: text, font: cr.font, fontSize: cr.fontSize}
+	if T, ok := cr.textExtents[key]; ok {
+		return T
 	}
 
-	unitsystem := unitSystems[system]
-
-	for _, p := range unitsystem {
-		fsize := float64(p.size)
-		if condition(fsize) {
-			v2 := v / fsize
-			if (v2-math.Floor(v2)) < floatEpsilon && v > 1 {
-				v2 = math.Floor(v2)
-			}
-			return v2, p.prefix
+	var T cairo.TextExtents
+	cr.context.TextExtents(text, &T)
+	if text != "" && !(T.XAdvance > 0) {
+		// some fonts measure every text as empty, which collapses the layout
+		// built on the widths, so guess the width from the text length
+		if !cr.warnedTextExtents {
+			zapwriter.Logger("render").Warn("font measures text as empty, estimating text widths",
+				zap.String("font", cr.font.name),
+				zap.Float64("font_size", cr.fontSize),
+			)
+			cr.warnedTextExtents = true
 		}
-	}
-
-	if (v-math.Floor(v)) < floatEpsilon && v > 1 {
-		v = math.Floor(v)
-	}
-	return v, ""
-}
-
-func getYLabelValues(params *Params, minYValue, maxYValue, yStep float64) []float64 {
-	if params.logBase != 0 {
-		return logrange(params.logBase, minYValue, maxYValue)
-	}
-
-	return frange(minYValue, maxYValue, yStep)
-}
-
-func logrange(base, scaleMin, scaleMax float64) []float64 {
-	current := scaleMin
-	if scaleMin > 0 {
-		current = math.Floor(math.Log(scaleMin) / math.Log(base))
-	}
-	factor := current
-	var vals []float64
-	for current < scaleMax {
-		current = math.Pow(base, factor)
-		vals = append(vals, current)
-		factor++
-	}
-	return vals
-}
-
-func frange(start, end, step float64) []float64 {
-	var vals []float64
-	f := start
-	for f <= (end + floatEpsilon) {
-		vals = append(vals, f)
-		f += step
-		// Protect against rounding errors on very small float ranges
-		if f == start {
-			vals = append(vals, end)
-			break
+		T.Width = estimateTextWidth(text, cr.fontSize)
+		T.XAdvance = T.Width
+		if !(T.Height > 0) {
+			T.Height = cr.fontSize
 		}
 	}
-	return vals
-}
-
-func closest(number float64, neighbours []float64) float64 {
-	distance := math.Inf(1)
-	var closestNeighbor float64
-	for _, n := range neighbours {
-		d := math.Abs(n - number)
-		if d < distance {
-			distance = d
-			closestNeighbor = n
-		}
+	if cr.textExtents == nil {
+		cr.textExtents = make(map[textExtentsKey]cairo.TextExtents)
 	}
-
-	return closestNeighbor
+	cr.textExtents[key] = T
+	return T
 }
 
 func setupXAxis(cr *cairoSurfaceContext, params *Params, results []*types.MetricData) {
@@ -1895,22 +2947,72 @@ func setupXAxis(cr *cairoSurfaceContext, params *Params, results []*types.Metric
 		self.end_dt = datetime.fromtimestamp(self.endTime, tzinfo)
 	*/
 
+	alignTimeRange(params, results)
+
 	secondsPerPixel := float64(params.timeRange) / float64(params.graphWidth)
 	params.xScaleFactor = float64(params.graphWidth) / float64(params.timeRange)
 
-	for _, c := range xAxisConfigs {
-		if c.seconds <= secondsPerPixel && c.maxInterval >= params.timeRange {
-			params.xConf = c
-		}
-	}
+	params.xConf = getXAxisConfig(secondsPerPixel, params.timeRange)
 
-	if params.xConf.seconds == 0 {
-		params.xConf = xAxisConfigs[len(xAxisConfigs)-1]
+	if params.snapTime && params.xLogBase == 0 {
+		snapTimeRange(params, results)
 	}
 
 	params.xLabelStep = int64(params.xConf.labelUnit) * params.xConf.labelStep
 	params.xMinorGridStep = int64(float64(params.xConf.minorGridUnit) * params.xConf.minorGridStep)
 	params.xMajorGridStep = int64(params.xConf.majorGridUnit) * params.xConf.majorGridStep
+
+	params.xCalendarTimes = nil
+	if params.calendarGrid && params.xConf.labelUnit == Day {
+		params.xCalendarTimes = getCalendarTimes(params.startTime, params.endTime, params.xConf.labelStep, params.tz)
+	}
+
+	params.xGridTimes = nil
+	if params.gridDensity > 1 {
+		labelTime, labelDelta := findXTimes(params.startTime, params.xConf.labelUnit, float64(params.xConf.labelStep))
+		params.xGridTimes = getXGridTimes(params.startTime, params.endTime, labelTime, labelDelta, params.gridDensity)
+	}
+}
+
+// alignTimeRange widens the time range by the shift of stepAlign, so the last
+// points drawn in the middle or at the end of their buckets stay inside the
+// plot area. Series are rescaled to the new range.
+func alignTimeRange(params *Params, results []*types.MetricData) {
+	shift := params.stepAlign.shift()
+	var widen int64
+	for _, r := range results {
+		if w := int64(math.Ceil(float64(r.AggregatedTimeStep()) * shift)); w > widen {
+			widen = w
+		}
+	}
+	if widen == 0 {
+		return
+	}
+
+	end := params.endTime + widen
+	scale := float64(params.timeRange) / float64(end-params.startTime)
+	params.endTime, params.timeRange = end, end-params.startTime
+	for _, r := range results {
+		r.XStep *= scale
+	}
+}
+
+// snapTimeRange widens the time range to whole label units, so the X axis
+// starts and ends on round times. Series are rescaled to the new range.
+func snapTimeRange(params *Params, results []*types.MetricData) {
+	unit := int64(params.xConf.labelUnit)
+	start := params.startTime - params.startTime%unit
+	end := params.endTime
+	if r := end % unit; r != 0 {
+		end += unit - r
+	}
+
+	scale := float64(params.timeRange) / float64(end-start)
+	params.startTime, params.endTime, params.timeRange = start, end, end-start
+	params.xScaleFactor = float64(params.graphWidth) / float64(params.timeRange)
+	for _, r := range results {
+		r.XStep *= scale
+	}
 }
 
 func drawLabels(cr *cairoSurfaceContext, params *Params, results []*types.MetricData) {
@@ -1923,200 +3025,292 @@ func drawLabels(cr *cairoSurfaceContext, params *Params, results []*types.Metric
 }
 
 func drawYAxis(cr *cairoSurfaceContext, params *Params, results []*types.MetricData) {
+	align := gridAlign(params)
 	var x float64
 	if params.secondYAxis {
 
 		for _, value := range params.yLabelValuesL {
-			label := makeLabel(value, params.yStepL, params.ySpanL, params.yUnitSystem)
-			y := getYCoord(params, value, YCoordSideLeft)
+			label := formatLabel(params, value, params.yStepL, params.ySpanL)
+			y := align(getYCoord(params, value, YCoordSideLeft))
 			if y < 0 {
 				y = 0
 			}
 
 			x = params.area.xmin - float64(params.yLabelWidthL)*0.02
-			drawText(cr, params, label, x, y, HAlignRight, VAlignCenter, 0)
+			drawYLabel(cr, params, label, x, y, HAlignRight)
 
 		}
 
 		for _, value := range params.yLabelValuesR {
-			label := makeLabel(value, params.yStepR, params.ySpanR, params.yUnitSystem)
-			y := getYCoord(params, value, YCoordSideRight)
+			label := formatLabel(params, value, params.yStepR, params.ySpanR)
+			y := align(getYCoord(params, value, YCoordSideRight))
 			if y < 0 {
 				y = 0
 			}
 
 			x = params.area.xmax + float64(params.yLabelWidthR)*0.02 + 3
-			drawText(cr, params, label, x, y, HAlignLeft, VAlignCenter, 0)
+			drawYLabel(cr, params, label, x, y, HAlignLeft)
 		}
 		return
 	}
 
 	for _, value := range params.yLabelValues {
-		label := makeLabel(value, params.yStep, params.ySpan, params.yUnitSystem)
-		y := getYCoord(params, value, YCoordSideNone)
+		label := formatLabel(params, value, params.yStep, params.ySpan)
+		y := align(getYCoord(params, value, YCoordSideNone))
 		if y < 0 {
 			y = 0
 		}
 
 		if params.yAxisSide == YAxisSideLeft {
 			x = params.area.xmin - float64(params.yLabelWidth)*0.02
-			drawText(cr, params, label, x, y, HAlignRight, VAlignCenter, 0)
+			drawYLabel(cr, params, label, x, y, HAlignRight)
 		} else {
 			x = params.area.xmax + float64(params.yLabelWidth)*0.02
-			drawText(cr, params, label, x, y, HAlignLeft, VAlignCenter, 0)
+			drawYLabel(cr, params, label, x, y, HAlignLeft)
 		}
 	}
 }
 
-func findXTimes(start int64, unit TimeUnit, step float64) (int64, int64) {
-
-	t := time.Unix(int64(start), 0)
-
-	var d time.Duration
-
-	switch unit {
-	case Second:
-		d = time.Second
-	case Minute:
-		d = time.Minute
-	case Hour:
-		d = time.Hour
-	case Day:
-		d = 24 * time.Hour
-	default:
-		panic("invalid unit")
+// drawYLabel draws a Y axis label next to the axis at x: ending there with
+// HAlignRight, starting there with HAlignLeft. A label rotated by
+// yLabelRotate is centered on y with its rotated extent next to x
+func drawYLabel(cr *cairoSurfaceContext, params *Params, label string, x, y float64, align HAlign) {
+	if params.yLabelRotate == 0 {
+		drawText(cr, params, label, x, y, align, VAlignCenter, 0)
+		return
 	}
 
-	d *= time.Duration(step)
-	t = t.Truncate(d)
-
-	for t.Unix() < int64(start) {
-		t = t.Add(d)
+	width := getYLabelWidth(cr, params, label)
+	if align == HAlignRight {
+		x -= width / 2
+	} else {
+		x += width / 2
 	}
-
-	return t.Unix(), int64(d / time.Second)
+	drawText(cr, params, label, x, y, HAlignCenter, VAlignCenter, params.yLabelRotate)
 }
 
 func drawXAxis(cr *cairoSurfaceContext, params *Params, results []*types.MetricData) {
 
-	dt, xDelta := findXTimes(int64(params.startTime), params.xConf.labelUnit, float64(params.xConf.labelStep))
-
 	xFormat := params.xFormat
 	if xFormat == "" {
 		xFormat = params.xConf.format
 	}
 
 	maxAscent := getFontExtents(cr).Ascent
+	align := gridAlign(params)
+
+	if params.xLogBase > 0 {
+		for _, v := range getXLogTicks(params) {
+			label := params.numberFormat.apply(strings.TrimSpace(makeLabel(v, v, v, unitSystemSI, 0)))
+			drawText(cr, params, label, align(getXCoord(params, v)), params.area.ymax+maxAscent, HAlignCenter, VAlignTop, 0)
+		}
+		return
+	}
 
-	for dt < int64(params.endTime) {
+	for _, dt := range getXLabelTimes(params) {
 		label, _ := strftime.Format(xFormat, time.Unix(int64(dt), 0).In(params.tz))
-		x := params.area.xmin + float64(dt-params.startTime)*params.xScaleFactor
+		x := align(params.area.xmin + float64(dt-params.startTime)*params.xScaleFactor)
 		y := params.area.ymax + maxAscent
 		drawText(cr, params, label, x, y, HAlignCenter, VAlignTop, 0)
-		dt += xDelta
 	}
 }
 
-func drawGridLines(cr *cairoSurfaceContext, params *Params, results []*types.MetricData) {
-	// Horizontal grid lines
-	leftside := params.area.xmin
-	rightside := params.area.xmax
-	top := params.area.ymin
-	bottom := params.area.ymax
+// getXLogTicks returns the powers of xLogBase on the X axis
+func getXLogTicks(params *Params) []float64 {
+	return logTicks(float64(params.startTime), float64(params.endTime), params.xLogBase)
+}
 
-	var labels []float64
-	if params.secondYAxis {
-		labels = params.yLabelValuesL
-	} else {
-		labels = params.yLabelValues
+// getXLabelTimes returns the times of the X axis labels: every labelStep
+// units from the start of the graph or the calendar days with calendarGrid,
+// without the first or the last one if they are hidden
+func getXLabelTimes(params *Params) []int64 {
+	times := params.xCalendarTimes
+	if times == nil {
+		dt, xDelta := findXTimes(params.startTime, params.xConf.labelUnit, float64(params.xConf.labelStep))
+		for ; dt < params.endTime; dt += xDelta {
+			times = append(times, dt)
+		}
 	}
 
-	for i, value := range labels {
-		cr.context.SetLineWidth(0.4)
-		setColor(cr, string2RGBA(params.majorGridLineColor))
+	if params.hideFirstXLabel && len(times) > 0 {
+		times = times[1:]
+	}
+	if params.hideLastXLabel && len(times) > 0 {
+		times = times[:len(times)-1]
+	}
+	return times
+}
 
-		var y float64
-		if params.secondYAxis {
-			y = getYCoord(params, value, YCoordSideLeft)
-		} else {
-			y = getYCoord(params, value, YCoordSideNone)
-		}
+// maxXLogMinorBase is the largest xLogBase drawn with minor gridlines
+const maxXLogMinorBase = 100
+
+// drawXLogGridLines draws the vertical grid of a logarithmic X axis: major
+// lines at the powers of xLogBase and, for whole bases, minor ones at their
+// multiples
+func drawXLogGridLines(cr *cairoSurfaceContext, params *Params, align func(float64) float64) {
+	start, end := float64(params.startTime), float64(params.endTime)
+	line := func(v float64) {
+		x := align(getXCoord(params, v))
+		cr.context.MoveTo(x, params.area.ymax)
+		cr.context.LineTo(x, params.area.ymin)
+		cr.context.Stroke()
+	}
 
-		if math.IsNaN(y) || y < 0 {
-			continue
+	cr.context.SetLineWidth(0.25)
+	setColor(cr, string2RGBA(params.minorGridLineColor))
+	// past maxXLogMinorBase the minor lines of a power blur into a fill
+	if base := params.xLogBase; base == math.Floor(base) && base <= maxXLogMinorBase {
+		for _, p := range logTicks(start/base, end, base) {
+			for k := 2.0; k < base; k++ {
+				if v := k * p; v >= start && v <= end {
+					line(v)
+				}
+			}
 		}
+	}
 
-		cr.context.MoveTo(leftside, y)
-		cr.context.LineTo(rightside, y)
-		cr.context.Stroke()
-
-		// draw minor gridlines if this isn't the last label
-		if params.minorY >= 1 && i < len(labels)-1 {
-			valueLower, valueUpper := value, labels[i+1]
+	cr.context.SetLineWidth(0.33)
+	setColor(cr, string2RGBA(params.majorGridLineColor))
+	for _, v := range getXLogTicks(params) {
+		line(v)
+	}
+}
 
-			// each minor gridline is 1/minorY apart from the nearby gridlines.
-			// we calculate that distance, for adding to the value in the loop.
-			distance := ((valueUpper - valueLower) / float64(1+params.minorY))
+// getAxisTicks returns the labels drawn by drawXAxis and drawYAxis with their
+// positions scaled to image pixels
+func getAxisTicks(params *Params) AxisTicks {
+	var ticks AxisTicks
+	if params.timeRange <= 0 {
+		// "No Data" has no axes
+		return ticks
+	}
 
-			// starting from the initial valueLower, we add the minor distance
-			// for each minor gridline that we wish to draw, and then draw it.
-			for minor := 0; minor < params.minorY; minor++ {
-				cr.context.SetLineWidth(0.3)
-				setColor(cr, string2RGBA(params.minorGridLineColor))
+	yTicks := func(values []float64, side YCoordSide) []Tick {
+		res := make([]Tick, 0, len(values))
+		for _, value := range values {
+			y := getYCoord(params, value, side)
+			if math.IsNaN(y) {
+				continue
+			}
+			res = append(res, Tick{Value: value, Pixel: y * params.pixelRatio})
+		}
+		return res
+	}
+	if params.secondYAxis {
+		ticks.Y = yTicks(params.yLabelValuesL, YCoordSideLeft)
+		ticks.YRight = yTicks(params.yLabelValuesR, YCoordSideRight)
+	} else {
+		ticks.Y = yTicks(params.yLabelValues, YCoordSideNone)
+	}
 
-				// the current minor gridline value is halfway between the current and next major gridline values
-				value = (valueLower + ((1 + float64(minor)) * distance))
+	if params.xLogBase > 0 {
+		for _, v := range getXLogTicks(params) {
+			ticks.X = append(ticks.X, Tick{Value: v, Pixel: getXCoord(params, v) * params.pixelRatio})
+		}
+		return ticks
+	}
+	for _, dt := range getXLabelTimes(params) {
+		x := params.area.xmin + float64(dt-params.startTime)*params.xScaleFactor
+		ticks.X = append(ticks.X, Tick{Value: float64(dt), Pixel: x * params.pixelRatio})
+	}
 
-				var yTopFactor float64
-				if params.logBase != 0 {
-					yTopFactor = params.logBase * params.logBase
-				} else {
-					yTopFactor = 1
-				}
+	return ticks
+}
 
-				if params.secondYAxis {
-					if value >= (yTopFactor * params.yTopL) {
-						continue
-					}
-				} else {
-					if value >= (yTopFactor * params.yTop) {
-						continue
-					}
+func drawGridLines(cr *cairoSurfaceContext, params *Params, results []*types.MetricData) {
+	// Horizontal grid lines
+	leftside := params.area.xmin
+	rightside := params.area.xmax
+	top := params.area.ymin
+	bottom := params.area.ymax
 
-				}
+	// thin lines look blurry when antialiased, draw them on pixel centers instead
+	align := gridAlign(params)
+	if params.crispGrid {
+		cr.context.SetAntialias(cairo.AntialiasNone)
+		defer cr.context.SetAntialias(cairo.AntialiasDefault)
+	}
+	if params.cornerRadius > 0 {
+		// the grid stays inside the rounded corners
+		cr.context.Save()
+		plotAreaPath(cr, params)
+		cr.context.Clip()
+		defer cr.context.Restore()
+	}
 
-				if params.secondYAxis {
-					y = getYCoord(params, value, YCoordSideLeft)
-				} else {
-					y = getYCoord(params, value, YCoordSideNone)
-				}
+	var labels, minorLabels []float64
+	side := YCoordSide(YCoordSideNone)
+	if params.secondYAxis && params.logBaseR != 0 && params.logBaseL == 0 {
+		// a log scale is hard to read without its gridlines
+		labels, minorLabels = params.yGridValuesR, params.yMinorValuesR
+		side = YCoordSideRight
+	} else if params.secondYAxis {
+		labels, minorLabels = params.yGridValuesL, params.yMinorValuesL
+		side = YCoordSideLeft
+	} else {
+		labels, minorLabels = params.yGridValues, params.yMinorValues
+	}
 
-				if math.IsNaN(y) || y < 0 {
-					continue
-				}
+	// First we do the minor grid lines (majors will paint over them)
+	cr.context.SetLineWidth(0.3)
+	setColor(cr, string2RGBA(params.minorGridLineColor))
+	for _, value := range minorLabels {
+		y := getYCoord(params, value, side)
+		if math.IsNaN(y) || y < 0 {
+			continue
+		}
 
-				cr.context.MoveTo(leftside, y)
-				cr.context.LineTo(rightside, y)
-				cr.context.Stroke()
-			}
+		cr.context.MoveTo(leftside, align(y))
+		cr.context.LineTo(rightside, align(y))
+		cr.context.Stroke()
+	}
 
+	cr.context.SetLineWidth(0.4)
+	setColor(cr, string2RGBA(params.majorGridLineColor))
+	for _, value := range labels {
+		y := getYCoord(params, value, side)
+		if math.IsNaN(y) || y < 0 {
+			continue
 		}
 
+		cr.context.MoveTo(leftside, align(y))
+		cr.context.LineTo(rightside, align(y))
+		cr.context.Stroke()
 	}
 
 	// Vertical grid lines
+	if params.xLogBase > 0 {
+		drawXLogGridLines(cr, params, align)
+		drawSideBorders(cr, params, align)
+		return
+	}
+	dt, xMinorDelta := findXTimes(params.startTime, params.xConf.minorGridUnit, params.xConf.minorGridStep)
+
+	// Faint subdivisions of the minor intervals go first, everything else
+	// paints over them. They are stroked at once and skipped when too dense.
+	if params.xSubGrid > 1 && float64(xMinorDelta)/float64(params.xSubGrid)*params.xScaleFactor >= 2 {
+		cr.context.SetLineWidth(0.25)
+		setColorAlpha(cr, string2RGBA(params.minorGridLineColor), 0.3)
+		for _, t := range getXGridTimes(params.startTime, params.endTime, dt, xMinorDelta, params.xSubGrid) {
+			x := params.area.xmin + (t-float64(params.startTime))*params.xScaleFactor
+			if x < params.area.xmax {
+				cr.context.MoveTo(align(x), bottom)
+				cr.context.LineTo(align(x), top)
+			}
+		}
+		cr.context.Stroke()
+	}
 
 	// First we do the minor grid lines (majors will paint over them)
 	cr.context.SetLineWidth(0.25)
 	setColor(cr, string2RGBA(params.minorGridLineColor))
-	dt, xMinorDelta := findXTimes(params.startTime, params.xConf.minorGridUnit, params.xConf.minorGridStep)
 
 	for dt < params.endTime {
 		x := params.area.xmin + float64(dt-params.startTime)*params.xScaleFactor
 
 		if x < params.area.xmax {
-			cr.context.MoveTo(x, bottom)
-			cr.context.LineTo(x, top)
+			cr.context.MoveTo(align(x), bottom)
+			cr.context.LineTo(align(x), top)
 			cr.context.Stroke()
 		}
 
@@ -2126,29 +3320,100 @@ func drawGridLines(cr *cairoSurfaceContext, params *Params, results []*types.Met
 	// Now we do the major grid lines
 	cr.context.SetLineWidth(0.33)
 	setColor(cr, string2RGBA(params.majorGridLineColor))
-	dt, xMajorDelta := findXTimes(params.startTime, params.xConf.majorGridUnit, float64(params.xConf.majorGridStep))
+	for _, t := range params.xGridTimes {
+		x := params.area.xmin + (t-float64(params.startTime))*params.xScaleFactor
 
-	for dt < params.endTime {
+		if x < params.area.xmax {
+			cr.context.MoveTo(align(x), bottom)
+			cr.context.LineTo(align(x), top)
+			cr.context.Stroke()
+		}
+	}
+
+	if params.xGridTimes == nil && params.xCalendarTimes != nil {
+		// major gridlines of day units follow the labels
+		for _, dt := range params.xCalendarTimes {
+			x := params.area.xmin + float64(dt-params.startTime)*params.xScaleFactor
+
+			if x < params.area.xmax {
+				cr.context.MoveTo(align(x), bottom)
+				cr.context.LineTo(align(x), top)
+				cr.context.Stroke()
+			}
+		}
+	}
+
+	dt, xMajorDelta := findXTimes(params.startTime, params.xConf.majorGridUnit, float64(params.xConf.majorGridStep))
+	for params.xGridTimes == nil && params.xCalendarTimes == nil && dt < params.endTime {
 		x := params.area.xmin + float64(dt-params.startTime)*params.xScaleFactor
 
 		if x < params.area.xmax {
-			cr.context.MoveTo(x, bottom)
-			cr.context.LineTo(x, top)
+			cr.context.MoveTo(align(x), bottom)
+			cr.context.LineTo(align(x), top)
 			cr.context.Stroke()
 		}
 
 		dt += xMajorDelta
 	}
 
-	// Draw side borders for our graph area
+	drawSideBorders(cr, params, align)
+}
+
+// drawSideBorders draws the left and the right border of the graph area, or
+// the whole rounded frame with cornerRadius
+func drawSideBorders(cr *cairoSurfaceContext, params *Params, align func(float64) float64) {
 	cr.context.SetLineWidth(0.5)
-	cr.context.MoveTo(params.area.xmax, bottom)
-	cr.context.LineTo(params.area.xmax, top)
-	cr.context.MoveTo(params.area.xmin, bottom)
-	cr.context.LineTo(params.area.xmin, top)
+	if params.cornerRadius > 0 {
+		// the clip cuts the outer half of the frame, as it does for the
+		// borders on the edges of the plot area
+		plotAreaPath(cr, params)
+		cr.context.Stroke()
+		return
+	}
+	cr.context.MoveTo(align(params.area.xmax), params.area.ymax)
+	cr.context.LineTo(align(params.area.xmax), params.area.ymin)
+	cr.context.MoveTo(align(params.area.xmin), params.area.ymax)
+	cr.context.LineTo(align(params.area.xmin), params.area.ymin)
 	cr.context.Stroke()
 }
 
+// gridAlign returns how the coordinates of the gridlines are moved to pixel
+// centers, the axis labels are moved with them to stay on their lines
+func gridAlign(params *Params) func(float64) float64 {
+	if params.crispGrid || params.pixelSnap != PixelSnapNone {
+		return func(v float64) float64 { return alignToPixel(params, v) }
+	}
+	return func(v float64) float64 { return v }
+}
+
+// alignToPixel moves a coordinate to the center of the device pixel it falls
+// into, so a thin line drawn without antialiasing is exactly one pixel wide
+func alignToPixel(params *Params, v float64) float64 {
+	pr := params.pixelRatio
+	if pr <= 0 {
+		pr = 1
+	}
+	return (math.Floor(v*pr) + 0.5) / pr
+}
+
+// roundToPixel moves a coordinate to the nearest device pixel boundary
+func roundToPixel(params *Params, v float64) float64 {
+	pr := params.pixelRatio
+	if pr <= 0 {
+		pr = 1
+	}
+	return math.Round(v*pr) / pr
+}
+
+// snapToPixel aligns a coordinate of a series line to the center of its
+// pixel with pixelSnap=all
+func snapToPixel(params *Params, v float64) float64 {
+	if params.pixelSnap != PixelSnapAll {
+		return v
+	}
+	return alignToPixel(params, v)
+}
+
 func str2linecap(s string) cairo.LineCap {
 	switch s {
 	case "butt":
@@ -2178,26 +3443,31 @@ func getYCoord(params *Params, value float64, side YCoordSide) (y float64) {
 	var yLabelValues []float64
 	var yTop float64
 	var yBottom float64
+	var logBase float64
 
 	switch side {
 	case YCoordSideLeft:
 		yLabelValues = params.yLabelValuesL
 		yTop = params.yTopL
 		yBottom = params.yBottomL
+		logBase = params.logBaseL
 	case YCoordSideRight:
 		yLabelValues = params.yLabelValuesR
 		yTop = params.yTopR
 		yBottom = params.yBottomR
+		logBase = params.logBaseR
 	default:
 		yLabelValues = params.yLabelValues
 		yTop = params.yTop
 		yBottom = params.yBottom
+		logBase = params.logBase
 	}
 
 	var highestValue float64
 	var lowestValue float64
 
-	if yLabelValues != nil {
+	// explicit yTicks don't have to span the whole axis
+	if yLabelValues != nil && len(params.yTicks) == 0 {
 		highestValue = yLabelValues[len(yLabelValues)-1]
 		lowestValue = yLabelValues[0]
 	} else {
@@ -2207,31 +3477,73 @@ func getYCoord(params *Params, value float64, side YCoordSide) (y float64) {
 	pixelRange := params.area.ymax - params.area.ymin
 	relativeValue := (value - lowestValue)
 	valueRange := (highestValue - lowestValue)
-	if params.logBase != 0 {
+	if logBase != 0 {
 		if value <= 0 {
 			return math.NaN()
 		}
-		relativeValue = (math.Log(value) / math.Log(params.logBase)) - (math.Log(lowestValue) / math.Log(params.logBase))
-		valueRange = (math.Log(highestValue) / math.Log(params.logBase)) - (math.Log(lowestValue) / math.Log(params.logBase))
+		relativeValue = (math.Log(value) / math.Log(logBase)) - (math.Log(lowestValue) / math.Log(logBase))
+		valueRange = (math.Log(highestValue) / math.Log(logBase)) - (math.Log(lowestValue) / math.Log(logBase))
 	}
 	pixelToValueRatio := (pixelRange / valueRange)
 	valueInPixels := (pixelToValueRatio * relativeValue)
 	return params.area.ymax - valueInPixels
 }
 
-func drawLines(cr *cairoSurfaceContext, params *Params, results []*types.MetricData) {
+// getSeriesStartX returns x coordinate of the first point of the series
+func getSeriesStartX(params *Params, series *types.MetricData) float64 {
+	// every series has its own start and step, XStep covers one aggregated step
+	pixelsPerSecond := series.XStep / float64(series.AggregatedTimeStep())
+	startShift := float64(series.StartTime-params.startTime) * pixelsPerSecond
+	x := float64(params.area.xmin) + startShift + (params.lineWidth / 2.0)
+	// plot each value in the middle or at the end of its bucket instead of
+	// at its start
+	return x + series.XStep*params.stepAlign.shift()
+}
+
+// getPointX returns the x coordinate of the point at index of the series
+func getPointX(params *Params, series *types.MetricData, index int) float64 {
+	if params.xLogBase > 0 {
+		step := float64(series.AggregatedTimeStep())
+		t := float64(series.StartTime) + (float64(index)+params.stepAlign.shift())*step
+		return getXCoord(params, t)
+	}
+	return getSeriesStartX(params, series) + float64(index)*series.XStep
+}
 
-	linecap := "butt"
-	linejoin := "miter"
+// getXCoord returns the x coordinate of the time t, on a logarithmic scale
+// with xLogBase
+func getXCoord(params *Params, t float64) float64 {
+	if params.xLogBase > 0 {
+		return params.area.xmin + logPosition(t, float64(params.startTime), float64(params.endTime))*params.graphWidth
+	}
+	return params.area.xmin + (t-float64(params.startTime))*params.xScaleFactor
+}
+
+// getSeriesSide returns the Y axis the series is plotted against
+func getSeriesSide(params *Params, series *types.MetricData) YCoordSide {
+	if !params.secondYAxis {
+		return YCoordSideNone
+	}
+	if series.SecondYAxis {
+		return YCoordSideRight
+	}
+	return YCoordSideLeft
+}
 
+func drawLines(cr *cairoSurfaceContext, params *Params, results []*types.MetricData) {
 	cr.context.SetLineWidth(params.lineWidth)
 
+	// translucent fills and lines are blended with what is under them. Fills
+	// go first: stacked areas before the strokes appended for areaAlpha and
+	// the fills of every series before its line.
+	cr.context.SetOperator(cairo.OperatorOver)
+
 	originalWidth := params.lineWidth
 
 	cr.context.SetDash(nil, 0)
 
-	cr.context.SetLineCap(str2linecap(linecap))
-	cr.context.SetLineJoin(str2linejoin(linejoin))
+	cr.context.SetLineCap(str2linecap(params.lineCap))
+	cr.context.SetLineJoin(str2linejoin(params.lineJoin))
 
 	if !math.IsNaN(params.areaAlpha) {
 		alpha := params.areaAlpha
@@ -2269,18 +3581,48 @@ func drawLines(cr *cairoSurfaceContext, params *Params, results []*types.MetricD
 		}
 	}
 
+	if params.reverseDrawOrder {
+		results = reverseUnstacked(results)
+	}
+
 	cr.context.SetLineWidth(1.0)
-	cr.context.Rectangle(params.area.xmin, params.area.ymin, (params.area.xmax - params.area.xmin), (params.area.ymax - params.area.ymin))
+	plotAreaPath(cr, params)
 	cr.context.Clip()
 	cr.context.SetLineWidth(originalWidth)
 
+	if params.bubbles {
+		params.bubbleMaxSize = getBubbleMaxSize(results)
+	}
+
+	// the grid drawn behind the graph is hidden by opaque areas, gridInFront
+	// draws it again over the stacked areas and under the lines
+	gridInFront := params.gridInFront && !params.hideAxes && !params.hideGrid
+	drewAreas := false
+
 	cr.context.Save()
 	clipRestored := false
 	for _, series := range results {
+		if params.ctx.Err() != nil {
+			// out of time, the series drawn so far make a partial graph
+			if !clipRestored {
+				cr.context.Restore()
+			}
+			params.truncated = true
+			break
+		}
 
 		if !series.Stacked && !clipRestored {
 			cr.context.Restore()
 			clipRestored = true
+			if gridInFront && drewAreas {
+				drawGridLines(cr, params, results)
+				gridInFront = false
+			}
+		}
+		drewAreas = drewAreas || series.Stacked
+
+		if params.showRaw && series.ValuesPerPoint > 1 && !series.Stacked && !series.Invisible && !series.DrawAsInfinite && series.BubbleSizes == nil {
+			drawRawLine(cr, params, series)
 		}
 
 		if series.HasLineWidth {
@@ -2289,8 +3631,21 @@ func drawLines(cr *cairoSurfaceContext, params *Params, results []*types.MetricD
 			cr.context.SetLineWidth(params.lineWidth)
 		}
 
-		if series.Dashed != 0 {
-			cr.context.SetDash([]float64{series.Dashed}, 1)
+		if series.Dashed != 0 {
+			cr.context.SetDash([]float64{series.Dashed}, 1)
+		}
+
+		if params.colorByValue && !series.Stacked && !series.Invisible && !series.DrawAsInfinite {
+			drawSeriesByValue(cr, params, series)
+			cr.context.SetLineWidth(originalWidth)
+			if series.Dashed != 0 {
+				cr.context.SetDash(nil, 0)
+			}
+			continue
+		}
+
+		if (params.positiveColor != "" || params.negativeColor != "") && !series.Stacked && !series.Invisible && !series.DrawAsInfinite && series.BubbleSizes == nil {
+			fillBySign(cr, params, series)
 		}
 
 		if series.Invisible {
@@ -2301,16 +3656,23 @@ func drawLines(cr *cairoSurfaceContext, params *Params, results []*types.MetricD
 			setColor(cr, string2RGBA(series.Color))
 		}
 
-		missingPoints := float64(int64(series.StartTime)-params.startTime) / float64(series.StepTime)
-		startShift := series.XStep * (missingPoints / float64(series.ValuesPerPoint))
-		x := float64(params.area.xmin) + startShift + (params.lineWidth / 2.0)
+		if series.BubbleSizes != nil {
+			drawBubbles(cr, params, series)
+			cr.context.SetLineWidth(originalWidth)
+			if series.Dashed != 0 {
+				cr.context.SetDash(nil, 0)
+			}
+			continue
+		}
+
+		x := snapToPixel(params, getPointX(params, series, 0))
 		y := float64(params.area.ymin)
-		origX := x
 		startX := x
+		gapX, gapY := x, y
 
 		consecutiveNones := 0
-		for index, value := range series.AggregatedValues() {
-			x = origX + (float64(index) * series.XStep)
+		for index, value := range drawnValues(params, series) {
+			x = snapToPixel(params, getPointX(params, series, index))
 
 			if params.drawNullAsZero && math.IsNaN(value) {
 				value = 0
@@ -2319,16 +3681,9 @@ func drawLines(cr *cairoSurfaceContext, params *Params, results []*types.MetricD
 			if math.IsNaN(value) {
 				if consecutiveNones == 0 {
 					cr.context.LineTo(x, y)
+					gapX, gapY = x, y
 					if series.Stacked {
-						if params.secondYAxis {
-							if series.SecondYAxis {
-								fillAreaAndClip(cr, params, x, y, startX, getYCoord(params, 0, YCoordSideRight))
-							} else {
-								fillAreaAndClip(cr, params, x, y, startX, getYCoord(params, 0, YCoordSideLeft))
-							}
-						} else {
-							fillAreaAndClip(cr, params, x, y, startX, getYCoord(params, 0, YCoordSideNone))
-						}
+						fillAreaAndClip(cr, params, x, y, startX, getAreaBaseline(params, getSeriesSide(params, series)))
 					}
 				}
 				consecutiveNones++
@@ -2348,6 +3703,11 @@ func drawLines(cr *cairoSurfaceContext, params *Params, results []*types.MetricD
 					if y < 0 {
 						y = 0
 					}
+					// outliers above the percentile scale stick to the top edge
+					if params.yScalePercentile > 0 && y < params.area.ymin {
+						y = params.area.ymin
+					}
+					y = snapToPixel(params, y)
 				}
 				if series.DrawAsInfinite && value > 0 {
 					cr.context.MoveTo(x, params.area.ymax)
@@ -2360,6 +3720,9 @@ func drawLines(cr *cairoSurfaceContext, params *Params, results []*types.MetricD
 				}
 
 				if !math.IsNaN(y) {
+					if params.recordPoints && !series.Invisible {
+						recordPoint(params, series, index, value, x, y)
+					}
 					switch params.lineMode {
 
 					case LineModeStaircase:
@@ -2368,6 +3731,10 @@ func drawLines(cr *cairoSurfaceContext, params *Params, results []*types.MetricD
 						} else {
 							cr.context.LineTo(x, y)
 						}
+						// the value holds until the next point, so a filled
+						// area is the rectangles under the steps, up to the
+						// end of the last step before a gap or the end
+						x = snapToPixel(params, getPointX(params, series, index+1))
 					case LineModeSlope:
 						if consecutiveNones > 0 {
 							cr.context.MoveTo(x, y)
@@ -2375,6 +3742,8 @@ func drawLines(cr *cairoSurfaceContext, params *Params, results []*types.MetricD
 					case LineModeConnected:
 						if consecutiveNones > params.connectedLimit || consecutiveNones == index {
 							cr.context.MoveTo(x, y)
+						} else if consecutiveNones > 0 && params.connectedGapDash > 0 && !series.Stacked {
+							drawGapBridge(cr, params, series, gapX, gapY, x, y)
 						}
 					}
 
@@ -2385,17 +3754,7 @@ func drawLines(cr *cairoSurfaceContext, params *Params, results []*types.MetricD
 		}
 
 		if series.Stacked {
-			var areaYFrom float64
-			if params.secondYAxis {
-				if series.SecondYAxis {
-					areaYFrom = getYCoord(params, 0, YCoordSideRight)
-				} else {
-					areaYFrom = getYCoord(params, 0, YCoordSideLeft)
-				}
-			} else {
-				areaYFrom = getYCoord(params, 0, YCoordSideNone)
-			}
-			fillAreaAndClip(cr, params, x, y, startX, areaYFrom)
+			fillAreaAndClip(cr, params, x, y, startX, getAreaBaseline(params, getSeriesSide(params, series)))
 		} else {
 			cr.context.Stroke()
 		}
@@ -2405,12 +3764,315 @@ func drawLines(cr *cairoSurfaceContext, params *Params, results []*types.MetricD
 			cr.context.SetDash(nil, 0)
 		}
 	}
+
+	if gridInFront && drewAreas {
+		drawGridLines(cr, params, results)
+	}
+}
+
+// drawnValues returns the values of the series the way they are drawn, one for
+// every aggregated step. Runs of consolidated points are reduced by
+// params.decimation, stacked series always use their consolidation function
+// so the stack adds up.
+func drawnValues(params *Params, series *types.MetricData) []float64 {
+	if series.ValuesPerPoint <= 1 || series.Stacked {
+		return series.AggregatedValues()
+	}
+	switch params.decimation {
+	case DecimationLTTB:
+		return decimateLTTB(series.Values, series.ValuesPerPoint)
+	case DecimationMinMax:
+		return decimateMinMax(series.Values, series.ValuesPerPoint)
+	}
+	return series.AggregatedValues()
+}
+
+// recordPoint remembers a drawn point in image pixels for the image map
+func recordPoint(params *Params, series *types.MetricData, index int, value, x, y float64) {
+	params.plotPoints = append(params.plotPoints, PlotPoint{
+		Name:      series.Name,
+		Value:     value,
+		Timestamp: series.StartTime + int64(index)*series.AggregatedTimeStep(),
+		X:         x * params.pixelRatio,
+		Y:         y * params.pixelRatio,
+	})
+}
+
+// interpolateColor returns the color at fraction f of the way from low to high,
+// f is clamped to [0, 1]
+func interpolateColor(low, high color.RGBA, f float64) color.RGBA {
+	f = math.Max(0, math.Min(1, f))
+	mix := func(a, b uint8) uint8 {
+		return uint8(math.Round(float64(a) + (float64(b)-float64(a))*f))
+	}
+	return color.RGBA{mix(low.R, high.R), mix(low.G, high.G), mix(low.B, high.B), mix(low.A, high.A)}
+}
+
+// colorForValue maps value to the colorByValue gradient
+func colorForValue(params *Params, value float64) color.RGBA {
+	span := params.colorByValueMax - params.colorByValueMin
+	if span <= 0 {
+		return params.colorByValueHigh
+	}
+	return interpolateColor(params.colorByValueLow, params.colorByValueHigh, (value-params.colorByValueMin)/span)
+}
+
+// setColorByValueRange defaults the gradient range to the (left) Y axis range
+func setColorByValueRange(params *Params) {
+	bottom, top := params.yBottom, params.yTop
+	if params.secondYAxis {
+		bottom, top = params.yBottomL, params.yTopL
+	}
+	if math.IsNaN(params.colorByValueMin) {
+		params.colorByValueMin = bottom
+	}
+	if math.IsNaN(params.colorByValueMax) {
+		params.colorByValueMax = top
+	}
+}
+
+// fillBySign fills the area between the series and the zero line with
+// positiveColor above zero and negativeColor below it. Segments crossing zero
+// are split at the crossing point. The line itself is drawn over the fill.
+func fillBySign(cr *cairoSurfaceContext, params *Params, series *types.MetricData) {
+	side := getSeriesSide(params, series)
+	baseline := getAreaBaseline(params, side)
+
+	alpha := 1.0
+	if !math.IsNaN(params.areaAlpha) {
+		alpha = params.areaAlpha
+	}
+	fill := func(value float64, points ...float64) {
+		c := params.positiveColor
+		if value < 0 {
+			c = params.negativeColor
+		}
+		if c == "" {
+			return
+		}
+		setColorAlpha(cr, string2RGBA(c), alpha)
+		cr.context.MoveTo(points[0], points[1])
+		for i := 2; i < len(points); i += 2 {
+			cr.context.LineTo(points[i], points[i+1])
+		}
+		cr.context.ClosePath()
+		cr.context.Fill()
+	}
+
+	prevX, prevY, prevValue := 0.0, 0.0, math.NaN()
+	for index, value := range drawnValues(params, series) {
+		if params.drawNullAsZero && math.IsNaN(value) {
+			value = 0
+		}
+		x := getPointX(params, series, index)
+		y := getYCoord(params, value, side)
+		if math.IsNaN(value) || math.IsNaN(y) {
+			prevValue = math.NaN()
+			continue
+		}
+
+		if params.lineMode == LineModeStaircase {
+			// the value holds until the next point, even when that one is
+			// absent or past the last, so every step is a rectangle of its own
+			nextX := getPointX(params, series, index+1)
+			fill(value, x, y, nextX, y, nextX, baseline, x, baseline)
+			continue
+		}
+
+		switch {
+		case math.IsNaN(prevValue):
+		case (prevValue < 0) == (value < 0):
+			fill(prevValue, prevX, prevY, x, y, x, baseline, prevX, baseline)
+		default:
+			crossX := zeroCrossing(prevX, prevValue, x, value)
+			fill(prevValue, prevX, prevY, crossX, baseline, prevX, baseline)
+			fill(value, crossX, baseline, x, y, x, baseline)
+		}
+		prevX, prevY, prevValue = x, y, value
+	}
+}
+
+// drawSeriesByValue strokes the series segment by segment, each one colored by
+// the average of its end points. Gaps are never bridged.
+func drawSeriesByValue(cr *cairoSurfaceContext, params *Params, series *types.MetricData) {
+	side := getSeriesSide(params, series)
+
+	prevX, prevY, prevValue := 0.0, 0.0, math.NaN()
+	for index, value := range drawnValues(params, series) {
+		if params.drawNullAsZero && math.IsNaN(value) {
+			value = 0
+		}
+		if math.IsNaN(value) {
+			prevValue = math.NaN()
+			continue
+		}
+
+		x := getPointX(params, series, index)
+		y := getYCoord(params, value, side)
+		if math.IsNaN(y) {
+			prevValue = math.NaN()
+			continue
+		}
+		if y < 0 {
+			y = 0
+		}
+
+		if !math.IsNaN(prevValue) {
+			setColor(cr, colorForValue(params, (prevValue+value)/2))
+			cr.context.MoveTo(prevX, prevY)
+			cr.context.LineTo(x, y)
+			cr.context.Stroke()
+		}
+		prevX, prevY, prevValue = x, y, value
+	}
+}
+
+// pairBubbles takes the series in consecutive pairs: the first one of a pair
+// positions the circles and the second one sizes them. An unpaired last
+// series is drawn as usual.
+func pairBubbles(results []*types.MetricData) []*types.MetricData {
+	paired := make([]*types.MetricData, 0, (len(results)+1)/2)
+	for i := 0; i < len(results); i += 2 {
+		if i+1 < len(results) {
+			results[i].BubbleSizes = results[i+1]
+		}
+		paired = append(paired, results[i])
+	}
+	return paired
+}
+
+// getBubbleMaxSize returns the largest size over all bubble series, so the
+// circles are comparable between the series
+func getBubbleMaxSize(results []*types.MetricData) float64 {
+	maxSize := 0.0
+	for _, series := range results {
+		if series.BubbleSizes == nil {
+			continue
+		}
+		// sizes are consolidated the same way as the positions they belong to
+		series.BubbleSizes.SetValuesPerPoint(series.ValuesPerPoint)
+		for _, size := range series.BubbleSizes.AggregatedValues() {
+			if size > maxSize {
+				maxSize = size
+			}
+		}
+	}
+	return maxSize
+}
+
+// drawBubbles draws a filled circle at every point of the series, its radius
+// proportional to the paired size value. Points where either value is absent
+// or the size is not positive are skipped.
+func drawBubbles(cr *cairoSurfaceContext, params *Params, series *types.MetricData) {
+	if params.bubbleMaxSize <= 0 {
+		return
+	}
+
+	side := getSeriesSide(params, series)
+	sizes := series.BubbleSizes.AggregatedValues()
+
+	for index, value := range series.AggregatedValues() {
+		if index >= len(sizes) {
+			break
+		}
+		size := sizes[index]
+		if math.IsNaN(value) || math.IsNaN(size) || size <= 0 {
+			continue
+		}
+
+		y := getYCoord(params, value, side)
+		if math.IsNaN(y) {
+			continue
+		}
+
+		x := getPointX(params, series, index)
+		cr.context.Arc(x, y, params.bubbleMaxRadius*size/params.bubbleMaxSize, 0, 2*math.Pi)
+		cr.context.Fill()
+	}
+}
+
+const colorScaleBarWidth = 10
+
+// reserveColorScale takes space for the color scale from the right side of
+// the graph, the scale itself is drawn once the value range is known
+func reserveColorScale(cr *cairoSurfaceContext, params *Params) {
+	const padding = 5
+
+	textExtents := getTextExtents(cr, "-888.88 M")
+
+	params.area.xmax -= colorScaleBarWidth + textExtents.XAdvance + 3*padding
+	params.colorScaleX = params.area.xmax + 2*padding
+}
+
+// drawColorScale draws the legend of colorByValue: a vertical gradient bar
+// from the low color at the bottom to the high one at the top, with the
+// minimum, the middle and the maximum of the range next to it
+func drawColorScale(cr *cairoSurfaceContext, params *Params) {
+	const padding = 5
+
+	top, bottom := params.area.ymin, params.area.ymax
+	drawGradientBar(cr, params.colorScaleX, top, colorScaleBarWidth, bottom-top, params.colorByValueLow, params.colorByValueHigh)
+
+	yStep, ySpan := params.yStep, params.ySpan
+	if params.secondYAxis {
+		yStep, ySpan = params.yStepL, params.ySpanL
+	}
+	low, high := params.colorByValueMin, params.colorByValueMax
+	labelX := params.colorScaleX + colorScaleBarWidth + padding
+	setColor(cr, params.fgColor)
+	drawText(cr, params, formatLabel(params, high, yStep, ySpan), labelX, top, HAlignLeft, VAlignTop, 0)
+	drawText(cr, params, formatLabel(params, (low+high)/2, yStep, ySpan), labelX, (top+bottom)/2, HAlignLeft, VAlignCenter, 0)
+	drawText(cr, params, formatLabel(params, low, yStep, ySpan), labelX, bottom, HAlignLeft, VAlignBottom, 0)
+}
+
+// drawGradientBar fills the rectangle with a linear gradient from the low
+// color to the high one, along the longer side: bottom to top for a
+// vertical bar, left to right for a horizontal one
+func drawGradientBar(cr *cairoSurfaceContext, x, y, width, height float64, low, high color.RGBA) {
+	var gradient *cairo.Pattern
+	if height >= width {
+		gradient = cairo.PatternCreateLinear(x, y+height, x, y)
+	} else {
+		gradient = cairo.PatternCreateLinear(x, y, x+width, y)
+	}
+	addStop := func(offset float64, c color.RGBA) {
+		r, g, b, a := c.RGBA()
+		gradient.AddColorStopRGBA(offset, float64(r)/65536, float64(g)/65536, float64(b)/65536, float64(a)/65536)
+	}
+	addStop(0, low)
+	addStop(1, high)
+
+	cr.context.SetSource(gradient)
+	cr.context.Rectangle(x, y, width, height)
+	cr.context.Fill()
+}
+
+// reverseUnstacked returns a copy of results where series that are not stacked
+// are in reverse order, so the first of them is drawn last and ends up on top.
+// Stacked series keep their places as the order defines the stack.
+func reverseUnstacked(results []*types.MetricData) []*types.MetricData {
+	reversed := make([]*types.MetricData, len(results))
+	copy(reversed, results)
+
+	var idx []int
+	for i, r := range reversed {
+		if !r.Stacked {
+			idx = append(idx, i)
+		}
+	}
+	for i, j := 0, len(idx)-1; i < j; i, j = i+1, j-1 {
+		reversed[idx[i]], reversed[idx[j]] = reversed[idx[j]], reversed[idx[i]]
+	}
+
+	return reversed
 }
 
 type SeriesLegend struct {
 	name        string
 	color       string
 	secondYAxis bool
+	lineWidth   float64
+	dashed      float64
 }
 
 func drawLegend(cr *cairoSurfaceContext, params *Params, results []*types.MetricData) {
@@ -2420,54 +4082,63 @@ func drawLegend(cr *cairoSurfaceContext, params *Params, results []*types.Metric
 	var longestName string
 	var longestNameLen int
 	var uniqueNames map[string]bool
-	var numRight int
 	var legend []SeriesLegend
 	if params.uniqueLegend {
 		uniqueNames = make(map[string]bool)
 	}
 
 	for _, res := range results {
-		nameLen := len(res.Name)
-		if nameLen == 0 {
+		if len(res.Name) == 0 || res.BandOf != nil {
 			continue
 		}
-		if nameLen > longestNameLen {
-			longestNameLen = nameLen
-			longestName = res.Name
+		name := truncateName(res.Name, params.legendTruncate, params.legendEllipsis == LegendEllipsisMiddle)
+		swatchColor := res.Color
+		if params.referenceLines && isFlat(res.Values) {
+			// a legend entry without color gets no swatch
+			swatchColor = ""
 		}
-		if res.SecondYAxis {
-			numRight++
+		if nameLen := len(name); nameLen > longestNameLen {
+			longestNameLen = nameLen
+			longestName = name
 		}
 		if params.uniqueLegend {
 			if _, ok := uniqueNames[res.Name]; !ok {
 				var tmp = SeriesLegend{
-					res.Name,
-					res.Color,
+					name,
+					swatchColor,
 					res.SecondYAxis,
+					res.LineWidth,
+					res.Dashed,
 				}
 				uniqueNames[res.Name] = true
 				legend = append(legend, tmp)
 			}
 		} else {
 			var tmp = SeriesLegend{
-				res.Name,
-				res.Color,
+				name,
+				swatchColor,
 				res.SecondYAxis,
+				res.LineWidth,
+				res.Dashed,
 			}
 			legend = append(legend, tmp)
 		}
 	}
 
+	if params.hiddenSeries > 0 {
+		// a legend entry without color gets no swatch
+		legend = append(legend, SeriesLegend{fmt.Sprintf("… and %d more", params.hiddenSeries), "", false, 0, 0})
+	}
+
 	rightSideLabels := false
 	testSizeName := longestName + " " + longestName
-	var textExtents cairo.TextExtents
-	cr.context.TextExtents(testSizeName, &textExtents)
+	textExtents := getTextExtents(cr, testSizeName)
 	testWidth := textExtents.XAdvance + 2*(params.fontExtents.Height+padding)
 	if testWidth+50 < params.width {
 		rightSideLabels = true
 	}
 
-	cr.context.TextExtents(longestName, &textExtents)
+	textExtents = getTextExtents(cr, longestName)
 	boxSize := params.fontExtents.Height - 1
 	lineHeight := params.fontExtents.Height + 1
 	labelWidth := textExtents.XAdvance + 2*(boxSize+padding)
@@ -2475,24 +4146,29 @@ func drawLegend(cr *cairoSurfaceContext, params *Params, results []*types.Metric
 	x := params.area.xmin
 
 	if params.secondYAxis && rightSideLabels {
-		columns := math.Max(1, math.Floor(math.Floor((params.width-params.area.xmin)/labelWidth)/2.0))
-		numberOfLines := math.Max(float64(len(results)-numRight), float64(numRight))
+		columns := legendColumns(params.width-params.area.xmin, labelWidth, 2)
+		if capacity := legendCapacity(params, lineHeight+padding, 0, columns); len(legend) > capacity {
+			legend = capLegend(legend, capacity, params.hiddenSeries)
+		}
+		numLeft, numRight := legendSides(legend)
+		numberOfLines := math.Max(float64(numLeft), float64(numRight))
 		legendHeight := math.Max(1, (numberOfLines/columns)) * (lineHeight + padding)
 		params.area.ymax -= legendHeight
 		y := params.area.ymax + (2 * padding)
 
+		if params.legendBox {
+			drawLegendBox(cr, params, params.area.xmin-padding, params.area.ymax+padding,
+				params.area.xmax-params.area.xmin+2*padding, legendHeight+padding)
+		}
+
 		xRight := params.area.xmax - params.area.xmin
 		yRight := y
 		nRight := 0
 		n := 0
 		for _, item := range legend {
-			setColor(cr, string2RGBA(item.color))
 			if item.secondYAxis {
 				nRight++
-				drawRectangle(cr, params, xRight-padding, yRight, boxSize, boxSize, true)
-				color := colors["darkgray"]
-				setColor(cr, color)
-				drawRectangle(cr, params, xRight-padding, yRight, boxSize, boxSize, false)
+				drawLegendSwatch(cr, params, xRight-padding, yRight, boxSize, item)
 				setColor(cr, params.fgColor)
 				drawText(cr, params, item.name, xRight-boxSize, yRight, HAlignRight, VAlignTop, 0.0)
 				xRight -= labelWidth
@@ -2502,10 +4178,7 @@ func drawLegend(cr *cairoSurfaceContext, params *Params, results []*types.Metric
 				}
 			} else {
 				n++
-				drawRectangle(cr, params, x, y, boxSize, boxSize, true)
-				color := colors["darkgray"]
-				setColor(cr, color)
-				drawRectangle(cr, params, x, y, boxSize, boxSize, false)
+				drawLegendSwatch(cr, params, x, y, boxSize, item)
 				setColor(cr, params.fgColor)
 				drawText(cr, params, item.name, x+boxSize+padding, y, HAlignLeft, VAlignTop, 0.0)
 				x += labelWidth
@@ -2518,27 +4191,27 @@ func drawLegend(cr *cairoSurfaceContext, params *Params, results []*types.Metric
 		return
 	}
 	// else
-	columns := math.Max(1, math.Floor(params.width/labelWidth))
-	numberOfLines := math.Ceil(float64(len(results)) / columns)
+	columns := legendColumns(params.width, labelWidth, 1)
+	if capacity := legendCapacity(params, lineHeight, padding, columns); len(legend) > capacity {
+		legend = capLegend(legend, capacity, params.hiddenSeries)
+	}
+	numberOfLines := math.Ceil(float64(len(legend)) / columns)
 	legendHeight := (numberOfLines * lineHeight) + padding
 	params.area.ymax -= legendHeight
 	y := params.area.ymax + (2 * padding)
+	if params.legendBox {
+		drawLegendBox(cr, params, params.area.xmin-padding, params.area.ymax+padding,
+			math.Min(columns, float64(len(legend)))*labelWidth+padding, numberOfLines*lineHeight+2*padding)
+	}
 	cnt := 0
 	for _, item := range legend {
-		setColor(cr, string2RGBA(item.color))
 		if item.secondYAxis {
-			drawRectangle(cr, params, x+labelWidth+padding, y, boxSize, boxSize, true)
-			color := colors["darkgray"]
-			setColor(cr, color)
-			drawRectangle(cr, params, x+labelWidth+padding, y, boxSize, boxSize, false)
+			drawLegendSwatch(cr, params, x+labelWidth+padding, y, boxSize, item)
 			setColor(cr, params.fgColor)
 			drawText(cr, params, item.name, x+labelWidth, y, HAlignRight, VAlignTop, 0.0)
 			x += labelWidth
 		} else {
-			drawRectangle(cr, params, x, y, boxSize, boxSize, true)
-			color := colors["darkgray"]
-			setColor(cr, color)
-			drawRectangle(cr, params, x, y, boxSize, boxSize, false)
+			drawLegendSwatch(cr, params, x, y, boxSize, item)
 			setColor(cr, params.fgColor)
 			drawText(cr, params, item.name, x+boxSize+padding, y, HAlignLeft, VAlignTop, 0.0)
 			x += labelWidth
@@ -2552,20 +4225,180 @@ func drawLegend(cr *cairoSurfaceContext, params *Params, results []*types.Metric
 	return
 }
 
-func drawTitle(cr *cairoSurfaceContext, params *Params) {
+// legendCapacity returns how many entries fit into columns of lines of
+// lineHeight when the legend, padded by extra, may take at most
+// legendMaxHeightPercent of the height. At least one line always fits.
+func legendCapacity(params *Params, lineHeight, extra, columns float64) int {
+	if params.legendMaxHeightPercent <= 0 {
+		return math.MaxInt32
+	}
+	maxHeight := params.height * params.legendMaxHeightPercent / 100
+	lines := math.Max(1, math.Floor((maxHeight-extra)/lineHeight))
+	return int(lines * columns)
+}
+
+// legendSides counts the entries of the legend for the left and the right axis
+func legendSides(legend []SeriesLegend) (left, right int) {
+	for _, item := range legend {
+		if item.secondYAxis {
+			right++
+		} else {
+			left++
+		}
+	}
+	return left, right
+}
+
+// capLegend keeps the entries of the legend that fit into capacity and sums up
+// the rest in a last "… N more" entry. The note about series left out by
+// maxSeries is folded into that count.
+func capLegend(legend []SeriesLegend, capacity, hiddenSeries int) []SeriesLegend {
+	if capacity < 1 {
+		capacity = 1
+	}
+	if len(legend) <= capacity {
+		return legend
+	}
+	kept := legend[: capacity-1 : capacity-1]
+	more := len(legend) - len(kept)
+	if hiddenSeries > 0 {
+		// the note is the last entry and stands for every hidden series
+		more += hiddenSeries - 1
+	}
+	return append(kept, SeriesLegend{fmt.Sprintf("… %d more", more), "", false, 0, 0})
+}
+
+// roundedRectangle adds a rectangle with corners rounded by radius to the
+// path, the radius is capped at half of the shorter side
+func roundedRectangle(cr *cairoSurfaceContext, x, y, width, height, radius float64) {
+	r := math.Min(radius, math.Min(width, height)/2)
+	cr.context.Arc(x+width-r, y+r, r, -math.Pi/2, 0)
+	cr.context.Arc(x+width-r, y+height-r, r, 0, math.Pi/2)
+	cr.context.Arc(x+r, y+height-r, r, math.Pi/2, math.Pi)
+	cr.context.Arc(x+r, y+r, r, math.Pi, 3*math.Pi/2)
+	cr.context.ClosePath()
+}
+
+// plotAreaPath adds the outline of the plot area to the path, with the
+// corners rounded by cornerRadius
+func plotAreaPath(cr *cairoSurfaceContext, params *Params) {
+	width, height := params.area.xmax-params.area.xmin, params.area.ymax-params.area.ymin
+	if params.cornerRadius > 0 {
+		roundedRectangle(cr, params.area.xmin, params.area.ymin, width, height, params.cornerRadius)
+		return
+	}
+	cr.context.Rectangle(params.area.xmin, params.area.ymin, width, height)
+}
+
+// drawLegendBox fills a rounded translucent background behind the legend,
+// so entries stay readable over grid lines
+func drawLegendBox(cr *cairoSurfaceContext, params *Params, x, y, width, height float64) {
+	const radius = 4
+
+	roundedRectangle(cr, x, y, width, height, radius)
+	setColorAlpha(cr, params.bgColor, 0.7)
+	cr.context.Fill()
+}
+
+// drawLegendSwatch draws the legend mark of the series in the shape set by
+// legendSwatch. The line swatch keeps the width and the dashes of the series.
+func drawLegendSwatch(cr *cairoSurfaceContext, params *Params, x, y, boxSize float64, item SeriesLegend) {
+	if item.color == "" {
+		return
+	}
+	setColor(cr, string2RGBA(item.color))
+
+	switch params.legendSwatch {
+	case LegendSwatchLine:
+		lineWidth := params.lineWidth
+		if item.lineWidth > 0 {
+			lineWidth = item.lineWidth
+		}
+		cr.context.SetLineWidth(lineWidth)
+		if item.dashed != 0 {
+			cr.context.SetDash([]float64{item.dashed}, 1)
+		}
+		cr.context.MoveTo(x, y+boxSize/2)
+		cr.context.LineTo(x+boxSize, y+boxSize/2)
+		cr.context.Stroke()
+		cr.context.SetDash(nil, 0)
+		cr.context.SetLineWidth(1.0)
+	case LegendSwatchCircle:
+		cr.context.Arc(x+boxSize/2, y+boxSize/2, boxSize/2, 0, 2*math.Pi)
+		cr.context.Fill()
+	default:
+		drawRectangle(cr, params, x, y, boxSize, boxSize, true)
+		setColor(cr, colors["darkgray"])
+		drawRectangle(cr, params, x, y, boxSize, boxSize, false)
+	}
+}
+
+// drawPlotShadow paints a soft shadow under the plot area and fills the area
+// itself with the background color, so it looks like a card. Cairo has no blur
+// for image surfaces, so the shadow is faked with a few stacked translucent
+// rectangles, each one a bit larger than the previous one.
+func drawPlotShadow(cr *cairoSurfaceContext, params *Params) {
+	const (
+		offset = 3
+		layers = 4
+		alpha  = 0.08
+	)
+
+	width := params.area.xmax - params.area.xmin
+	height := params.area.ymax - params.area.ymin
+
+	setColorAlpha(cr, color.RGBA{0, 0, 0, 255}, alpha)
+	for i := layers; i > 0; i-- {
+		spread := float64(i)
+		x, y := params.area.xmin+offset-spread, params.area.ymin+offset-spread
+		if params.cornerRadius > 0 {
+			roundedRectangle(cr, x, y, width+2*spread, height+2*spread, params.cornerRadius+spread)
+			cr.context.Fill()
+			continue
+		}
+		drawRectangle(cr, params, x, y, width+2*spread, height+2*spread, true)
+	}
+
+	setColor(cr, params.bgColor)
+	plotAreaPath(cr, params)
+	cr.context.Fill()
+}
+
+// drawTitle draws the title centered at the top. Titles wider than the picture
+// are drawn with a smaller font, down to minTitleFontSize.
+func drawTitle(cr *cairoSurfaceContext, params *Params, fontSize float64) {
+	const minTitleFontSize = 6
+
 	y := params.area.ymin
 	x := params.width / 2.0
 	lines := strings.Split(params.title, "\n")
+
+	available := params.width - 2*float64(params.margin)
+	size := fontSize
+	for size > minTitleFontSize && widestLine(cr, lines) > available {
+		size = math.Max(size-1, minTitleFontSize)
+		setTitleFont(cr, params, size)
+	}
 	lineHeight := params.fontExtents.Height
 
 	for _, line := range lines {
 		drawText(cr, params, line, x, y, HAlignCenter, VAlignTop, 0.0)
 		y += lineHeight
 	}
-	params.area.ymin = y
-	if params.yAxisSide != YAxisSideRight {
-		params.area.ymin += float64(params.margin)
+	params.area.ymin = y + float64(params.margin)
+
+	// vertical titles keep the original size
+	if size != fontSize {
+		setTitleFont(cr, params, fontSize)
+	}
+}
+
+func widestLine(cr *cairoSurfaceContext, lines []string) float64 {
+	var width float64
+	for _, line := range lines {
+		width = math.Max(width, getTextExtents(cr, line).XAdvance)
 	}
+	return width
 }
 
 func drawVTitle(cr *cairoSurfaceContext, params *Params, title string, rightAlign bool) {
@@ -2597,10 +4430,9 @@ func radians(angle float64) float64 {
 
 func drawText(cr *cairoSurfaceContext, params *Params, text string, x, y float64, align HAlign, valign VAlign, rotate float64) {
 	var hAlign, vAlign float64
-	var textExtents cairo.TextExtents
 	var fontExtents cairo.FontExtents
 	var origMatrix cairo.Matrix
-	cr.context.TextExtents(text, &textExtents)
+	textExtents := getTextExtents(cr, text)
 	cr.context.FontExtents(&fontExtents)
 
 	cr.context.GetMatrix(&origMatrix)
@@ -2626,6 +4458,13 @@ func drawText(cr *cairoSurfaceContext, params *Params, text string, x, y float64
 		vAlign = 0.0
 	}
 
+	if params.pixelSnap != PixelSnapNone && rotate == 0 {
+		// start the text on a whole pixel, so the glyphs aren't blurred
+		// across two
+		x = roundToPixel(params, x-hAlign) + hAlign
+		y = roundToPixel(params, y+vAlign) - vAlign
+	}
+
 	cr.context.MoveTo(x, y)
 	cr.context.RelMoveTo(angleSin*(-vAlign), angleCos*vAlign)
 	cr.context.Rotate(angle)
@@ -2646,8 +4485,20 @@ func setColor(cr *cairoSurfaceContext, color color.RGBA) {
 }
 
 func setFont(cr *cairoSurfaceContext, params *Params, size float64) {
-	cr.context.SelectFontFace(params.fontName, params.fontItalic, params.fontBold)
+	selectFont(cr, params, fontFace{params.fontName, params.fontItalic, params.fontBold}, size)
+}
+
+// setTitleFont selects the font of the titles, setFont goes back to the one of
+// the labels
+func setTitleFont(cr *cairoSurfaceContext, params *Params, size float64) {
+	selectFont(cr, params, fontFace{params.titleFontName, params.titleFontItalic, params.titleFontBold}, size)
+}
+
+func selectFont(cr *cairoSurfaceContext, params *Params, font fontFace, size float64) {
+	cr.context.SelectFontFace(font.name, font.slant, font.weight)
 	cr.context.SetFontSize(size)
+	cr.font = font
+	cr.fontSize = size
 	cr.context.FontExtents(&params.fontExtents)
 }
 
@@ -2668,6 +4519,76 @@ func drawRectangle(cr *cairoSurfaceContext, params *Params, x float64, y float64
 	}
 }
 
+// drawRawLine draws the values of a consolidated series before consolidation
+// as a faint hairline, so the noise the consolidation hides stays visible
+// under the drawn line
+func drawRawLine(cr *cairoSurfaceContext, params *Params, series *types.MetricData) {
+	step := series.XStep / float64(series.ValuesPerPoint)
+	// the raw points are aligned within their own, shorter buckets
+	startX := getSeriesStartX(params, series) + (step-series.XStep)*params.stepAlign.shift()
+	side := getSeriesSide(params, series)
+
+	setColorAlpha(cr, string2RGBA(series.Color), 0.25)
+	cr.context.SetLineWidth(0.5)
+	cr.context.SetDash(nil, 0)
+
+	drawing := false
+	for index, value := range series.Values {
+		if params.drawNullAsZero && math.IsNaN(value) {
+			value = 0
+		}
+		if math.IsNaN(value) {
+			drawing = false
+			continue
+		}
+		y := getYCoord(params, value, side)
+		if math.IsNaN(y) {
+			drawing = false
+			continue
+		}
+		x := startX + float64(index)*step
+		if params.xLogBase > 0 {
+			x = getXCoord(params, float64(series.StartTime+int64(index)*series.StepTime))
+		}
+		if drawing {
+			cr.context.LineTo(x, y)
+		} else {
+			cr.context.MoveTo(x, y)
+		}
+		drawing = true
+	}
+	cr.context.Stroke()
+}
+
+// drawGapBridge strokes the line drawn so far and then the segment bridging
+// absent points with connectedGapDash dashes, so the bridge stands out
+func drawGapBridge(cr *cairoSurfaceContext, params *Params, series *types.MetricData, fromX, fromY, toX, toY float64) {
+	cr.context.Stroke()
+
+	cr.context.SetDash([]float64{params.connectedGapDash}, 1)
+	cr.context.MoveTo(fromX, fromY)
+	cr.context.LineTo(toX, toY)
+	cr.context.Stroke()
+
+	if series.Dashed != 0 {
+		cr.context.SetDash([]float64{series.Dashed}, 1)
+	} else {
+		cr.context.SetDash(nil, 0)
+	}
+	cr.context.MoveTo(toX, toY)
+}
+
+// getAreaBaseline returns the y coordinate areas are filled from: zero when
+// the axis range spans it, so negative values fill downwards to the line, and
+// otherwise the edge of the plot area closest to zero
+func getAreaBaseline(params *Params, side YCoordSide) float64 {
+	y := getYCoord(params, 0, side)
+	if math.IsNaN(y) {
+		return params.area.ymax
+	}
+	return math.Max(params.area.ymin, math.Min(params.area.ymax, y))
+}
+
 func fillAreaAndClip(cr *cairoSurfaceContext, params *Params, x, y, startX, areaYFrom float64) {
 
 	if math.IsNaN(startX) {
@@ -2710,6 +4631,79 @@ func fillAreaAndClip(cr *cairoSurfaceContext, params *Params, x, y, startX, area
 	cr.context.Clip()
 }
 
+// normalizeStack replaces values of stacked series with their share of the
+// column total, so once stacked every column sums up to 1. Columns without
+// a positive total become gaps. The shares are computed for the raw values,
+// so they survive consolidation.
+func normalizeStack(results []*types.MetricData) {
+	var total []float64
+	for _, r := range results {
+		if !r.Stacked || r.DrawAsInfinite {
+			continue
+		}
+		for i, v := range r.Values {
+			if len(total) <= i {
+				total = append(total, 0)
+			}
+			if !math.IsNaN(v) {
+				total[i] += v
+			}
+		}
+	}
+
+	for _, r := range results {
+		if !r.Stacked || r.DrawAsInfinite {
+			continue
+		}
+		// a new slice, the values may be shared with other results
+		shares := make([]float64, len(r.Values))
+		for i, v := range r.Values {
+			if total[i] > 0 {
+				shares[i] = v / total[i]
+			} else {
+				shares[i] = math.NaN()
+			}
+		}
+		r.Values = shares
+		r.SetValuesPerPoint(r.ValuesPerPoint)
+	}
+}
+
+// orderStacks sorts every stack of results, which are already grouped by
+// ByStacked, so the first series of a stack is at its bottom: by name or
+// with the largest total first
+func orderStacks(results []*types.MetricData, order StackOrder) {
+	less := func(a, b *types.MetricData) bool { return a.Name < b.Name }
+	if order == StackOrderValue {
+		totals := make(map[*types.MetricData]float64, len(results))
+		for _, r := range results {
+			totals[r] = seriesTotal(r.AggregatedValues())
+		}
+		less = func(a, b *types.MetricData) bool { return totals[a] > totals[b] }
+	}
+
+	for start := 0; start < len(results) && results[start].Stacked; {
+		end := start + 1
+		for end < len(results) && results[end].Stacked && results[end].StackName == results[start].StackName {
+			end++
+		}
+		stack := results[start:end]
+		sort.SliceStable(stack, func(i, j int) bool { return less(stack[i], stack[j]) })
+		start = end
+	}
+}
+
+// seriesTotal returns the sum of the present values
+func seriesTotal(values []float64) float64 {
+	var total float64
+	for _, v := range values {
+		if !math.IsNaN(v) && !math.IsInf(v, 0) {
+			total += v
+		}
+	}
+	return total
+}
+
 type ByStacked []*types.MetricData
 
 func (b ByStacked) Len() int { return len(b) }
@@ -0,0 +1,2712 @@
+// +build cairo
+
+package png
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image/color"
+	stdpng "image/png"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evmar/gocairo/cairo"
+
+	"github.com/go-graphite/carbonapi/expr/types"
+)
+
+// fakeContext is a cairoContext that draws nothing and measures text as if
+// every glyph was 0.6 of the font size wide (6x10 at the default size of 10),
+// so layout code can be tested without a surface
+type fakeContext struct {
+	lineWidth float64
+	fontSize  float64
+	family    string
+	textSizes []float64 // font sizes texts were drawn at
+	textFonts []string  // font families texts were drawn in
+	texts     []string  // texts drawn
+	arcs      []Area    // bounding boxes of drawn arcs
+	rects     []Area
+	path      []pathPoint
+	measured  int
+	strokes   []float64   // line widths of the strokes
+	dashes    [][]float64 // dash patterns set
+	operators []cairo.Operator
+	ops       []string // "fill" and "stroke" calls in order, with the source alpha
+	alpha     float64
+	patterns  int  // patterns set as the source
+	empty     bool // measure every text as empty, like some broken fonts do
+}
+
+type pathPoint struct {
+	x, y float64
+	move bool
+}
+
+func (c *fakeContext) Rectangle(x, y, width, height float64) {
+	c.rects = append(c.rects, Area{xmin: x, xmax: x + width, ymin: y, ymax: y + height})
+}
+func (c *fakeContext) GetLineWidth() float64                     { return c.lineWidth }
+func (c *fakeContext) LineTo(x, y float64)                       { c.path = append(c.path, pathPoint{x, y, false}) }
+func (c *fakeContext) MoveTo(x, y float64)                       { c.path = append(c.path, pathPoint{x, y, true}) }
+func (c *fakeContext) SetLineWidth(width float64)                { c.lineWidth = width }
+func (c *fakeContext) SetFontSize(size float64)                  { c.fontSize = size }
+func (c *fakeContext) SetFontOptions(options *cairo.FontOptions) {}
+func (c *fakeContext) Stroke()                                   { c.strokes = append(c.strokes, c.lineWidth); c.op("stroke") }
+func (c *fakeContext) SetDash(dashes []float64, offset float64)  { c.dashes = append(c.dashes, dashes) }
+func (c *fakeContext) TextExtents(utf8 string, extents *cairo.TextExtents) {
+	c.measured++
+	if c.empty {
+		*extents = cairo.TextExtents{}
+		return
+	}
+	width := 0.6 * c.size() * float64(len(utf8))
+	*extents = cairo.TextExtents{Width: width, Height: c.size(), XAdvance: width}
+}
+func (c *fakeContext) FontExtents(extents *cairo.FontExtents) {
+	*extents = cairo.FontExtents{Ascent: 0.8 * c.size(), Descent: 0.2 * c.size(), Height: c.size()}
+}
+func (c *fakeContext) size() float64 {
+	if c.fontSize == 0 {
+		return 10
+	}
+	return c.fontSize
+}
+func (c *fakeContext) Rotate(angle float64)                          {}
+func (c *fakeContext) SetLineCap(lineCap cairo.LineCap)              {}
+func (c *fakeContext) SetLineJoin(lineJoin cairo.LineJoin)           {}
+func (c *fakeContext) RelMoveTo(dx, dy float64)                      {}
+func (c *fakeContext) SetSourceRGBA(red, green, blue, alpha float64) { c.alpha = alpha }
+func (c *fakeContext) SetSource(source *cairo.Pattern)               { c.patterns++ }
+func (c *fakeContext) SetMatrix(matrix *cairo.Matrix)                {}
+func (c *fakeContext) GetMatrix(matrix *cairo.Matrix)                {}
+func (c *fakeContext) Clip()                                         {}
+func (c *fakeContext) Fill()                                         { c.op("fill") }
+func (c *fakeContext) ClosePath()                                    {}
+func (c *fakeContext) SelectFontFace(family string, slant cairo.FontSlant, weight cairo.FontWeight) {
+	c.family = family
+}
+func (c *fakeContext) TextPath(utf8 string) {
+	c.textSizes = append(c.textSizes, c.size())
+	c.textFonts = append(c.textFonts, c.family)
+	c.texts = append(c.texts, utf8)
+}
+func (c *fakeContext) Save()                       {}
+func (c *fakeContext) Restore()                    {}
+func (c *fakeContext) FillPreserve()               { c.op("fill") }
+func (c *fakeContext) AppendPath(path *cairo.Path) {}
+func (c *fakeContext) CopyPath() *cairo.Path       { return nil }
+func (c *fakeContext) Arc(xc, yc, radius, angle1, angle2 float64) {
+	c.arcs = append(c.arcs, Area{xmin: xc - radius, xmax: xc + radius, ymin: yc - radius, ymax: yc + radius})
+}
+func (c *fakeContext) SetAntialias(antialias cairo.Antialias) {}
+func (c *fakeContext) SetOperator(op cairo.Operator)          { c.operators = append(c.operators, op) }
+func (c *fakeContext) op(name string)                         { c.ops = append(c.ops, fmt.Sprintf("%s %v", name, c.alpha)) }
+
+func TestYAxisSideLayout(t *testing.T) {
+	for _, side := range []YAxisSide{YAxisSideLeft, YAxisSideRight} {
+		p := DefaultParams
+		p.Title = "title"
+		p.Vtitle = "vtitle"
+		p.YAxisSide = side
+		params := newParams(p)
+
+		results := []*types.MetricData{types.MakeMetricData("a", []float64{1, 5, 3, 1000, 2}, 60, 0)}
+		drawGraph(&cairoSurfaceContext{context: &fakeContext{}}, &params, results)
+
+		margin := float64(params.margin)
+		area := params.area
+		if area.xmin < margin || area.xmax > params.width-margin || area.xmin >= area.xmax {
+			t.Errorf("side %v: plot area x range (%v, %v) is outside of the picture", side, area.xmin, area.xmax)
+		}
+		if area.ymin < margin+10 || area.ymax > params.height-margin || area.ymin >= area.ymax {
+			t.Errorf("side %v: plot area y range (%v, %v) is outside of the picture or overlaps the title", side, area.ymin, area.ymax)
+		}
+		if side == YAxisSideRight && area.xmax > params.width-margin-params.yLabelWidth {
+			t.Errorf("right side: plot area ends at %v, no room for %v wide labels", area.xmax, params.yLabelWidth)
+		}
+		if side == YAxisSideLeft && area.xmin < margin+params.yLabelWidth {
+			t.Errorf("left side: plot area starts at %v, no room for %v wide labels", area.xmin, params.yLabelWidth)
+		}
+	}
+}
+
+func TestYLabelRotate(t *testing.T) {
+	var areas []Area
+	var widths []float64
+	for _, rotate := range []float64{0, 90} {
+		p := DefaultParams
+		p.Width = 150
+		p.YLabelRotate = rotate
+		params := newParams(p)
+
+		results := []*types.MetricData{types.MakeMetricData("a", []float64{1000000, 2500000, 1750000}, 60, 0)}
+		drawGraph(&cairoSurfaceContext{context: &fakeContext{}}, &params, results)
+		areas = append(areas, params.area)
+		widths = append(widths, params.yLabelWidth)
+	}
+	if widths[1] >= widths[0] || areas[1].xmin >= areas[0].xmin {
+		t.Errorf("got label widths %v and plot areas starting at %v and %v, want rotated labels to take less room", widths, areas[0].xmin, areas[1].xmin)
+	}
+
+	// a rotated label is centered in its own extent next to the axis
+	p := DefaultParams
+	p.YLabelRotate = 90
+	params := newParams(p)
+	cr := &fakeContext{}
+	drawYLabel(&cairoSurfaceContext{context: cr}, &params, "12345", 100, 50, HAlignRight)
+	if got, want := cr.path[0].x, 100-getFontExtents(&cairoSurfaceContext{context: cr}).Height/2; math.Abs(got-want) > floatEpsilon {
+		t.Errorf("got the rotated label centered at %v, want %v", got, want)
+	}
+}
+
+func TestRenderTimings(t *testing.T) {
+	params := newParams(DefaultParams)
+
+	results := []*types.MetricData{types.MakeMetricData("a", []float64{1, 5, 3, 1000, 2}, 60, 0)}
+	drawGraph(&cairoSurfaceContext{context: &fakeContext{}}, &params, results)
+
+	timings := params.timings
+	if timings.Prepare <= 0 || timings.YAxis <= 0 || timings.Lines <= 0 {
+		t.Errorf("got timings %v, want every stage drawGraph went through measured", timings)
+	}
+	if timings.Encode != 0 || timings.Total != 0 {
+		t.Errorf("got timings %v, want encode and total left to marshalCairo", timings)
+	}
+}
+
+func TestFitYAxes(t *testing.T) {
+	for _, secondYAxis := range []bool{false, true} {
+		p := DefaultParams
+		p.Width = 200
+		p.YUnitSystem = "none"
+		params := newParams(p)
+
+		results := []*types.MetricData{
+			types.MakeMetricData("a", []float64{123456789.25, 987654321.5, 555555555.75}, 60, 0),
+			types.MakeMetricData("b", []float64{0.001, 0.002, 0.003}, 60, 0),
+		}
+		results[1].SecondYAxis = secondYAxis
+		drawGraph(&cairoSurfaceContext{context: &fakeContext{}}, &params, results)
+
+		// start over from the full width, the wide labels take a lot of it
+		params.area.xmin = float64(params.margin)
+		params.area.xmax = params.width - float64(params.margin)
+		setups := fitYAxes(&cairoSurfaceContext{context: &fakeContext{}}, &params, results)
+		if setups < 2 || setups >= maxYAxisSetups {
+			t.Errorf("secondYAxis=%v: took %d setups, want the area to change and then settle before the cap of %d", secondYAxis, setups, maxYAxisSetups)
+		}
+
+		area := params.area
+		if setups := fitYAxes(&cairoSurfaceContext{context: &fakeContext{}}, &params, results); setups != 1 || params.area != area {
+			t.Errorf("secondYAxis=%v: got the area changed from %v to %v in %d more setups, want it settled", secondYAxis, area, params.area, setups)
+		}
+		if width := params.yLabelWidth + params.yLabelWidthL; area.xmin < float64(params.margin)+width {
+			t.Errorf("secondYAxis=%v: got the area starting at %v, want room for %v wide labels", secondYAxis, area.xmin, width)
+		}
+	}
+}
+
+func TestFitPlotAreaCap(t *testing.T) {
+	params := newParams(DefaultParams)
+	results := []*types.MetricData{types.MakeMetricData("a", []float64{1, 2, 3}, 60, 0)}
+
+	// an area that never settles stops at the cap
+	setups := fitPlotArea(&params, results, func() { params.area.xmin += 0.001 })
+	if setups != maxYAxisSetups {
+		t.Errorf("got %d setups, want the cap of %d", setups, maxYAxisSetups)
+	}
+}
+
+func TestLegendBox(t *testing.T) {
+	results := []*types.MetricData{
+		types.MakeMetricData("first", []float64{1, 2}, 60, 0),
+		types.MakeMetricData("second", []float64{2, 1}, 60, 0),
+	}
+	results[0].Color = "red"
+	results[1].Color = "blue"
+
+	for _, legendBox := range []bool{false, true} {
+		p := DefaultParams
+		p.LegendBox = legendBox
+		params := newParams(p)
+		params.fontExtents = cairo.FontExtents{Ascent: 8, Descent: 2, Height: 10}
+		cr := &fakeContext{}
+		oldYMax := params.area.ymax
+
+		drawLegend(&cairoSurfaceContext{context: cr}, &params, results)
+
+		if !legendBox {
+			if len(cr.arcs) != 0 {
+				t.Errorf("legendBox=false: got %d arcs, want none", len(cr.arcs))
+			}
+			continue
+		}
+		if len(cr.arcs) != 4 {
+			t.Fatalf("legendBox=true: got %d arcs, want 4 rounded corners", len(cr.arcs))
+		}
+		box := cr.arcs[0]
+		for _, a := range cr.arcs[1:] {
+			box = Area{xmin: math.Min(box.xmin, a.xmin), xmax: math.Max(box.xmax, a.xmax), ymin: math.Min(box.ymin, a.ymin), ymax: math.Max(box.ymax, a.ymax)}
+		}
+
+		// both entries fit on one line: 10px swatch, 5px padding and 6px glyphs
+		entriesTop := params.area.ymax + 10
+		entriesBottom := entriesTop + params.fontExtents.Height + 1
+		entriesRight := params.area.xmin + 2*(6*6+2*(9+5))
+		if box.ymin <= params.area.ymax || box.ymin > entriesTop || box.ymax < entriesBottom || box.ymax > oldYMax+params.fontExtents.Height {
+			t.Errorf("box y range (%v, %v) does not fit legend lines (%v, %v) below the plot area at %v", box.ymin, box.ymax, entriesTop, entriesBottom, params.area.ymax)
+		}
+		if box.xmin > params.area.xmin || box.xmax < entriesRight {
+			t.Errorf("box x range (%v, %v) does not cover legend entries (%v, %v)", box.xmin, box.xmax, params.area.xmin, entriesRight)
+		}
+	}
+}
+
+func TestEmptyTextExtents(t *testing.T) {
+	var results []*types.MetricData
+	for _, name := range []string{"a.short", "b.somewhat.longer.name", "c"} {
+		r := types.MakeMetricData(name, []float64{1, 2}, 60, 0)
+		r.Color = "red"
+		results = append(results, r)
+	}
+
+	legend := func(empty bool) ([]pathPoint, float64) {
+		params := newParams(DefaultParams)
+		cr := &cairoSurfaceContext{context: &fakeContext{empty: empty}}
+		setFont(cr, &params, 10)
+		drawLegend(cr, &params, results)
+		return cr.context.(*fakeContext).path, params.area.ymax
+	}
+
+	// the estimate matches what the fake measures, so the legend is laid out
+	// as with a working font
+	want, wantYMax := legend(false)
+	got, gotYMax := legend(true)
+	if !reflect.DeepEqual(got, want) || gotYMax != wantYMax {
+		t.Errorf("got legend at %v above %v, want %v above %v", got, gotYMax, want, wantYMax)
+	}
+}
+
+func TestLegendMaxHeightPercent(t *testing.T) {
+	var results []*types.MetricData
+	for i := 0; i < 100; i++ {
+		r := types.MakeMetricData(fmt.Sprintf("host-%02d.cpu", i), []float64{1, 2}, 60, 0)
+		r.Color = "red"
+		results = append(results, r)
+	}
+
+	p := DefaultParams
+	p.Width = 330
+	p.Height = 250
+	p.LegendMaxHeightPercent = 20
+	params := newParams(p)
+	params.fontExtents = cairo.FontExtents{Ascent: 8, Descent: 2, Height: 10}
+	cr := &fakeContext{}
+	ymax := params.area.ymax
+	drawLegend(&cairoSurfaceContext{context: cr}, &params, results)
+
+	if height := ymax - params.area.ymax; height > 0.2*250 {
+		t.Errorf("got a legend %v high, want at most 20%% of 250", height)
+	}
+	shown := len(cr.texts) - 1
+	if want := fmt.Sprintf("… %d more", len(results)-shown); cr.texts[shown] != want {
+		t.Errorf("got last entry %q, want %q", cr.texts[shown], want)
+	}
+
+	// series hidden by maxSeries are counted in the summary
+	legend := []SeriesLegend{{name: "a"}, {name: "b"}, {name: "c"}, {name: "… and 5 more"}}
+	if got := capLegend(legend, 2, 5); len(got) != 2 || got[1].name != "… 7 more" {
+		t.Errorf("got %v, want a and the 7 other series", got)
+	}
+}
+
+func TestMaxSeries(t *testing.T) {
+	var results []*types.MetricData
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		r := types.MakeMetricData(name, []float64{1, 2}, 60, 0)
+		r.Color = "red"
+		results = append(results, r)
+	}
+
+	p := DefaultParams
+	p.MaxSeries = 2
+	params := newParams(p)
+	params.recordPoints = true
+	cr := &fakeContext{}
+	drawGraph(&cairoSurfaceContext{context: cr}, &params, results)
+
+	for _, point := range params.plotPoints {
+		if point.Name != "a" && point.Name != "b" {
+			t.Errorf("got a point of %q drawn, want only the first 2 series", point.Name)
+		}
+	}
+
+	legend := map[string]int{}
+	for i, text := range cr.texts {
+		legend[text] = i
+	}
+	note, ok := legend["… and 3 more"]
+	if !ok {
+		t.Fatalf("got texts %q, want a legend entry for the 3 series left out", cr.texts)
+	}
+	if _, ok := legend["c"]; ok {
+		t.Errorf("got a legend entry for c, want it left out")
+	}
+	for _, name := range []string{"a", "b"} {
+		if i, ok := legend[name]; !ok || i > note {
+			t.Errorf("got texts %q, want an entry for %v before the note", cr.texts, name)
+		}
+	}
+}
+
+func TestLegendTruncate(t *testing.T) {
+	var results []*types.MetricData
+	for _, host := range []string{"a", "b", "c", "d"} {
+		r := types.MakeMetricData("servers.datacenter.rack.host-"+host+".cpu.user.percent", []float64{1, 2}, 60, 0)
+		r.Color = "red"
+		results = append(results, r)
+	}
+
+	legendHeight := func(truncate int, ellipsis LegendEllipsis) (float64, []string) {
+		p := DefaultParams
+		p.Width = 330
+		p.LegendTruncate = truncate
+		p.LegendEllipsis = ellipsis
+		params := newParams(p)
+		params.fontExtents = cairo.FontExtents{Ascent: 8, Descent: 2, Height: 10}
+		cr := &fakeContext{}
+		ymax := params.area.ymax
+		drawLegend(&cairoSurfaceContext{context: cr}, &params, results)
+		return ymax - params.area.ymax, cr.texts
+	}
+
+	full, texts := legendHeight(0, LegendEllipsisEnd)
+	if texts[0] != results[0].Name {
+		t.Errorf("legendTruncate=0: got %q, want the full name", texts[0])
+	}
+
+	short, texts := legendHeight(12, LegendEllipsisEnd)
+	if want := "servers.dat…"; texts[0] != want {
+		t.Errorf("legendEllipsis=end: got %q, want %q", texts[0], want)
+	}
+	if short >= full {
+		t.Errorf("truncated legend is %v high, want less than the %v of the single column one", short, full)
+	}
+
+	_, texts = legendHeight(12, LegendEllipsisMiddle)
+	if want := "server…rcent"; texts[0] != want {
+		t.Errorf("legendEllipsis=middle: got %q, want %q", texts[0], want)
+	}
+}
+
+func TestLegendSwatch(t *testing.T) {
+	item := SeriesLegend{name: "a", color: "red", lineWidth: 3, dashed: 2.5}
+
+	params := Params{lineWidth: 1.2, legendSwatch: LegendSwatchSquare}
+	cr := &fakeContext{}
+	drawLegendSwatch(&cairoSurfaceContext{context: cr}, &params, 10, 20, 8, item)
+	if len(cr.rects) != 2 || len(cr.arcs) != 0 {
+		t.Errorf("square: got %d rectangles and %d arcs, want a filled and an outlined rectangle", len(cr.rects), len(cr.arcs))
+	}
+
+	params.legendSwatch = LegendSwatchCircle
+	cr = &fakeContext{}
+	drawLegendSwatch(&cairoSurfaceContext{context: cr}, &params, 10, 20, 8, item)
+	if want := []Area{{xmin: 10, xmax: 18, ymin: 20, ymax: 28}}; !reflect.DeepEqual(cr.arcs, want) || len(cr.rects) != 0 {
+		t.Errorf("circle: got arcs %+v and %d rectangles, want %+v", cr.arcs, len(cr.rects), want)
+	}
+
+	params.legendSwatch = LegendSwatchLine
+	cr = &fakeContext{}
+	drawLegendSwatch(&cairoSurfaceContext{context: cr}, &params, 10, 20, 8, item)
+	if want := []float64{3}; !reflect.DeepEqual(cr.strokes, want) {
+		t.Errorf("line: got strokes of width %v, want %v", cr.strokes, want)
+	}
+	if want := [][]float64{{2.5}, nil}; !reflect.DeepEqual(cr.dashes, want) {
+		t.Errorf("line: got dashes %v, want %v", cr.dashes, want)
+	}
+
+	// without a width of its own the series is drawn with the default one
+	cr = &fakeContext{}
+	drawLegendSwatch(&cairoSurfaceContext{context: cr}, &params, 10, 20, 8, SeriesLegend{name: "b", color: "red"})
+	if want := []float64{1.2}; !reflect.DeepEqual(cr.strokes, want) {
+		t.Errorf("line: got strokes of width %v, want %v", cr.strokes, want)
+	}
+}
+
+func TestHighlightRanges(t *testing.T) {
+	params := Params{
+		area:            Area{xmin: 10, xmax: 110, ymin: 5, ymax: 55},
+		startTime:       1000,
+		endTime:         2000,
+		xScaleFactor:    0.1,
+		highlightRanges: []HighlightRange{{Start: 500, End: 1200}, {Start: 1500, End: 1600, Color: "red"}, {Start: 1900, End: 2500}, {Start: 2100, End: 2200}},
+	}
+	cr := &fakeContext{}
+
+	drawHighlightRanges(&cairoSurfaceContext{context: cr}, &params)
+
+	want := []Area{
+		{xmin: 10, xmax: 30, ymin: 5, ymax: 55},
+		{xmin: 60, xmax: 70, ymin: 5, ymax: 55},
+		{xmin: 100, xmax: 110, ymin: 5, ymax: 55},
+	}
+	if !reflect.DeepEqual(cr.rects, want) {
+		t.Errorf("got bands %+v, want %+v", cr.rects, want)
+	}
+}
+
+func TestTransparentBackground(t *testing.T) {
+	p := DefaultParams
+	p.BgColor = "rgba(255,0,0,0.5)"
+	results := []*types.MetricData{types.MakeMetricData("a", []float64{1, 2, 3}, 60, 0)}
+
+	img, err := stdpng.Decode(bytes.NewReader(MarshalPNG(p, results)))
+	if err != nil {
+		t.Fatalf("failed to decode png: %v", err)
+	}
+
+	// the corner is covered by the background only
+	got := color.NRGBAModel.Convert(img.At(0, 0)).(color.NRGBA)
+	if got.A < 0x7f || got.A > 0x81 || got.R < 0xfe {
+		t.Errorf("background pixel: got %v, want half-transparent red", got)
+	}
+}
+
+func TestDrawPictureInto(t *testing.T) {
+	s := cairo.ImageSurfaceCreate(cairo.FormatARGB32, 200, 100)
+	cr := cairo.Create(s.Surface)
+	results := []*types.MetricData{types.MakeMetricData("a", []float64{1, 2, 3}, 60, 0)}
+
+	// two graphs side by side, each clipped to its half
+	for i, bgColor := range []string{"ff0000", "0000ff"} {
+		p := DefaultParams
+		p.BgColor = bgColor
+		p.HideLegend = true
+		DrawPictureInto(cr, float64(100*i), 0, 100, 100, p, results)
+	}
+	s.Surface.Flush()
+
+	var buf bytes.Buffer
+	s.Surface.WriteToPNG(&buf)
+	img, err := stdpng.Decode(&buf)
+	if err != nil {
+		t.Fatalf("failed to decode png: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != 200 || b.Dy() != 100 {
+		t.Fatalf("got a %vx%v image, want the 200x100 canvas", b.Dx(), b.Dy())
+	}
+	for _, tt := range []struct {
+		x    int
+		want color.NRGBA
+	}{
+		{1, color.NRGBA{R: 0xff, A: 0xff}},
+		{198, color.NRGBA{B: 0xff, A: 0xff}},
+	} {
+		if got := color.NRGBAModel.Convert(img.At(tt.x, 1)).(color.NRGBA); got != tt.want {
+			t.Errorf("pixel at %d: got %v, want %v", tt.x, got, tt.want)
+		}
+	}
+}
+
+func TestDimUnfocused(t *testing.T) {
+	results := []*types.MetricData{
+		types.MakeMetricData("a", []float64{1}, 1, 0),
+		types.MakeMetricData("b", []float64{1}, 1, 0),
+		types.MakeMetricData("c", []float64{1}, 1, 0),
+	}
+	results[2].Alpha, results[2].HasAlpha = 0.5, true
+	results[2].LineWidth, results[2].HasLineWidth = 3, true
+
+	params := Params{lineWidth: 1.2, focusSeries: []int{1, 7}}
+	dimUnfocused(&params, results)
+
+	want := []struct {
+		alpha, lineWidth float64
+		dimmed           bool
+	}{
+		{dimAlpha, 0.6, true},
+		{0, 0, false},
+		{0.5 * dimAlpha, 1.5, true},
+	}
+	for i, w := range want {
+		r := results[i]
+		if r.HasAlpha != w.dimmed || r.HasLineWidth != w.dimmed {
+			t.Errorf("series %d: got HasAlpha %v and HasLineWidth %v, want %v", i, r.HasAlpha, r.HasLineWidth, w.dimmed)
+		}
+		if math.Abs(r.Alpha-w.alpha) > floatEpsilon || math.Abs(r.LineWidth-w.lineWidth) > floatEpsilon {
+			t.Errorf("series %d: got alpha %v and line width %v, want %v and %v", i, r.Alpha, r.LineWidth, w.alpha, w.lineWidth)
+		}
+	}
+}
+
+func TestDrawTitleFitsWidth(t *testing.T) {
+	tests := []struct {
+		title    string
+		wantSize float64
+	}{
+		{"short", 12},
+		{"short\n" + strings.Repeat("x", 50), 9}, // 50 glyphs of 0.6*size fit into 300-2*10 at 9
+		{strings.Repeat("x", 200), 6},
+	}
+
+	for _, tt := range tests {
+		params := newParams(DefaultParams)
+		params.width = 300
+		params.title = tt.title
+		cr := &fakeContext{}
+		setFont(&cairoSurfaceContext{context: cr}, &params, 12)
+
+		drawTitle(&cairoSurfaceContext{context: cr}, &params, 12)
+
+		for _, size := range cr.textSizes {
+			if size != tt.wantSize {
+				t.Errorf("%q: drawn at %v, want %v", tt.title, cr.textSizes, tt.wantSize)
+				break
+			}
+		}
+		if cr.fontSize != 12 {
+			t.Errorf("%q: font size is %v after the title, want it restored to 12", tt.title, cr.fontSize)
+		}
+	}
+}
+
+func TestBubbles(t *testing.T) {
+	p := DefaultParams
+	p.Bubbles = true
+	p.BubbleMaxRadius = 8
+	params := newParams(p)
+
+	nan := math.NaN()
+	results := []*types.MetricData{
+		types.MakeMetricData("positions", []float64{1, nan, 3, 4, 2}, 60, 0),
+		types.MakeMetricData("sizes", []float64{2, 4, nan, 1, 0}, 60, 0),
+	}
+	cr := &fakeContext{}
+	drawGraph(&cairoSurfaceContext{context: cr}, &params, results)
+
+	// the absent value, the absent size and the zero size are skipped, the
+	// largest size is the unused 4
+	var radii []float64
+	for _, arc := range cr.arcs {
+		radii = append(radii, (arc.xmax-arc.xmin)/2)
+	}
+	if want := []float64{4, 2}; !reflect.DeepEqual(radii, want) {
+		t.Errorf("got radii %v, want %v", radii, want)
+	}
+	if params.dataLeft[0].BubbleSizes != results[1] {
+		t.Errorf("positions are not paired with sizes")
+	}
+}
+
+func TestDifferentStepTimes(t *testing.T) {
+	params := newParams(DefaultParams)
+
+	fine := make([]float64, 3000)
+	coarse := make([]float64, 420)
+	results := []*types.MetricData{
+		types.MakeMetricData("fine", fine, 1, 0),
+		types.MakeMetricData("coarse", coarse, 7, 21),
+	}
+	drawGraph(&cairoSurfaceContext{context: &fakeContext{}}, &params, results)
+
+	// every point is where the X axis puts its timestamp
+	for _, series := range results {
+		if series.ValuesPerPoint < 1 {
+			t.Fatalf("%s: series was not consolidated", series.Name)
+		}
+		step := series.AggregatedTimeStep()
+		startX := getSeriesStartX(&params, series)
+		for _, index := range []int{0, len(series.AggregatedValues()) - 1} {
+			timestamp := series.StartTime + int64(index)*step
+			want := params.area.xmin + params.lineWidth/2 + float64(timestamp-params.startTime)*params.xScaleFactor
+			if got := startX + float64(index)*series.XStep; math.Abs(got-want) > floatEpsilon {
+				t.Errorf("%s: point %d at x %v, want %v", series.Name, index, got, want)
+			}
+		}
+	}
+}
+
+func TestShowTimeRange(t *testing.T) {
+	var ymax [2]float64
+	for i, show := range []bool{false, true} {
+		p := DefaultParams
+		p.Tz = time.UTC
+		p.ShowTimeRange = show
+		params := newParams(p)
+
+		results := []*types.MetricData{types.MakeMetricData("a", make([]float64, 61), 60, 0)}
+		cr := &fakeContext{}
+		drawGraph(&cairoSurfaceContext{context: cr}, &params, results)
+		ymax[i] = params.area.ymax
+
+		found := false
+		for _, text := range cr.texts {
+			if text == "From 1970-01-01 00:00 to 1970-01-01 01:00" {
+				found = true
+			}
+		}
+		if found != show {
+			t.Errorf("showTimeRange=%v: got time range drawn %v in %q", show, found, cr.texts)
+		}
+	}
+	if ymax[1] >= ymax[0] {
+		t.Errorf("got plot area bottom at %v, want it above %v to fit the time range", ymax[1], ymax[0])
+	}
+}
+
+func TestAreaBaseline(t *testing.T) {
+	nan := math.NaN()
+	tests := []struct {
+		name       string
+		values     []float64
+		yMin, yMax float64
+		want       func(area Area) float64
+	}{
+		{"oscillating", []float64{-5, 3, 5, -2, -5, 4}, nan, nan, nil},
+		{"positive", []float64{10, 30, 20}, 5, nan, func(area Area) float64 { return area.ymax }},
+		{"negative", []float64{-10, -30, -20}, nan, -5, func(area Area) float64 { return area.ymin }},
+	}
+
+	for _, tt := range tests {
+		p := DefaultParams
+		p.AreaMode = AreaModeAll
+		p.YMin, p.YMax = tt.yMin, tt.yMax
+		params := newParams(p)
+
+		results := []*types.MetricData{types.MakeMetricData(tt.name, tt.values, 60, 0)}
+		drawGraph(&cairoSurfaceContext{context: &fakeContext{}}, &params, results)
+
+		got := getAreaBaseline(&params, YCoordSideNone)
+		if tt.want == nil {
+			// zero is inside of the range, areas are filled from it both ways
+			want := getYCoord(&params, 0, YCoordSideNone)
+			if math.Abs(got-want) > floatEpsilon || got <= params.area.ymin || got >= params.area.ymax {
+				t.Errorf("%s: got baseline at %v, want %v inside of (%v, %v)", tt.name, got, want, params.area.ymin, params.area.ymax)
+			}
+			continue
+		}
+		if want := tt.want(params.area); math.Abs(got-want) > floatEpsilon {
+			t.Errorf("%s: got baseline at %v, want %v", tt.name, got, want)
+		}
+	}
+}
+
+func TestGetAxisTicks(t *testing.T) {
+	p := DefaultParams
+	p.PixelRatio = 2
+	params := newParams(p)
+
+	results := []*types.MetricData{types.MakeMetricData("a", []float64{0, 50, 100, 25}, 600, 0)}
+	drawGraph(&cairoSurfaceContext{context: &fakeContext{}}, &params, results)
+
+	ticks := getAxisTicks(&params)
+	if len(ticks.Y) != len(params.yLabelValues) || len(ticks.YRight) != 0 {
+		t.Fatalf("got %d and %d Y ticks, want %d labels of one axis", len(ticks.Y), len(ticks.YRight), len(params.yLabelValues))
+	}
+	for i, tick := range ticks.Y {
+		want := Tick{Value: params.yLabelValues[i], Pixel: 2 * getYCoord(&params, params.yLabelValues[i], YCoordSideNone)}
+		if tick != want {
+			t.Errorf("Y tick %d: got %+v, want %+v", i, tick, want)
+		}
+	}
+
+	if len(ticks.X) == 0 {
+		t.Fatalf("got no X ticks")
+	}
+	for i, tick := range ticks.X {
+		if tick.Value < float64(params.startTime) || tick.Value >= float64(params.endTime) {
+			t.Errorf("X tick %d: time %v is outside of the graph", i, tick.Value)
+		}
+		if tick.Pixel < 2*params.area.xmin || tick.Pixel > 2*params.area.xmax {
+			t.Errorf("X tick %d: x %v is outside of the plot area", i, tick.Pixel)
+		}
+		if i > 0 && tick.Pixel <= ticks.X[i-1].Pixel {
+			t.Errorf("X tick %d: x %v is not after the previous one", i, tick.Pixel)
+		}
+	}
+}
+
+func TestStaircaseZero(t *testing.T) {
+	p := DefaultParams
+	p.LineMode = LineModeStaircaseZero
+	params := newParams(p)
+
+	nan := math.NaN()
+	results := []*types.MetricData{types.MakeMetricData("counter", []float64{5, 7, nan, nan, 3}, 60, 0)}
+	drawGraph(&cairoSurfaceContext{context: &fakeContext{}}, &params, results)
+
+	cr := &fakeContext{}
+	drawLines(&cairoSurfaceContext{context: cr}, &params, results)
+
+	x := getSeriesStartX(&params, results[0])
+	step := results[0].XStep
+	y := func(v float64) float64 { return getYCoord(&params, v, YCoordSideNone) }
+	want := []pathPoint{
+		{x, y(5), false}, {x + step, y(5), false},
+		{x + step, y(7), false}, {x + 2*step, y(7), false},
+		{x + 2*step, y(0), false}, {x + 3*step, y(0), false},
+		{x + 3*step, y(0), false}, {x + 4*step, y(0), false},
+		{x + 4*step, y(3), false}, {x + 5*step, y(3), false},
+	}
+	if len(cr.path) != len(want) {
+		t.Fatalf("got path %v, want %v", cr.path, want)
+	}
+	for i := range want {
+		if cr.path[i].move != want[i].move || math.Abs(cr.path[i].x-want[i].x) > floatEpsilon || math.Abs(cr.path[i].y-want[i].y) > floatEpsilon {
+			t.Errorf("point %d: got %v, want %v", i, cr.path[i], want[i])
+		}
+	}
+}
+
+func TestSteppedArea(t *testing.T) {
+	for _, mode := range []LineMode{LineModeSlope, LineModeStaircase} {
+		p := DefaultParams
+		p.LineMode = mode
+		p.AreaMode = AreaModeAll
+		params := newParams(p)
+
+		results := []*types.MetricData{types.MakeMetricData("a", []float64{1, 3, 2}, 60, 0)}
+		drawGraph(&cairoSurfaceContext{context: &fakeContext{}}, &params, results)
+
+		cr := &fakeContext{}
+		drawLines(&cairoSurfaceContext{context: cr}, &params, results)
+
+		x := getSeriesStartX(&params, results[0])
+		step := results[0].XStep
+		y := func(v float64) float64 { return getYCoord(&params, v, YCoordSideNone) }
+		baseline := getAreaBaseline(&params, YCoordSideNone)
+
+		// the same data is filled under a sloped line or under the steps,
+		// with the last value held for a whole step
+		want := []pathPoint{
+			{x, y(1), false}, {x + step, y(3), false}, {x + 2*step, y(2), false},
+			{x + 2*step, baseline, false}, {x, baseline, false},
+		}
+		if mode == LineModeStaircase {
+			want = []pathPoint{
+				{x, y(1), false}, {x + step, y(1), false},
+				{x + step, y(3), false}, {x + 2*step, y(3), false},
+				{x + 2*step, y(2), false}, {x + 3*step, y(2), false},
+				{x + 3*step, baseline, false}, {x, baseline, false},
+			}
+		}
+		if len(cr.path) < len(want) {
+			t.Fatalf("lineMode %v: got path %v, want it to start with %v", mode, cr.path, want)
+		}
+		for i := range want {
+			if cr.path[i].move != want[i].move || math.Abs(cr.path[i].x-want[i].x) > floatEpsilon || math.Abs(cr.path[i].y-want[i].y) > floatEpsilon {
+				t.Errorf("lineMode %v: point %d: got %v, want %v", mode, i, cr.path[i], want[i])
+			}
+		}
+	}
+
+	// a gap ends the area after the step of the last value before it, the
+	// area after the gap starts with a step of its own
+	p := DefaultParams
+	p.LineMode = LineModeStaircase
+	p.AreaMode = AreaModeAll
+	params := newParams(p)
+
+	nan := math.NaN()
+	results := []*types.MetricData{types.MakeMetricData("a", []float64{1, nan, 2}, 60, 0)}
+	drawGraph(&cairoSurfaceContext{context: &fakeContext{}}, &params, results)
+
+	cr := &fakeContext{}
+	drawLines(&cairoSurfaceContext{context: cr}, &params, results)
+
+	x := getSeriesStartX(&params, results[0])
+	step := results[0].XStep
+	baseline := getAreaBaseline(&params, YCoordSideNone)
+	y := func(v float64) float64 { return getYCoord(&params, v, YCoordSideNone) }
+	for _, want := range [][]pathPoint{
+		{{x, y(1), false}, {x + step, y(1), false}, {x + step, y(1), false}, {x + step, baseline, false}, {x, baseline, false}},
+		{{x + 2*step, y(2), true}, {x + 3*step, y(2), false}, {x + 3*step, baseline, false}, {x + 2*step, baseline, false}},
+	} {
+		if !containsPath(cr.path, want) {
+			t.Errorf("got path %v, want the step %v", cr.path, want)
+		}
+	}
+
+	// filled by sign every step is a rectangle, including the last one and
+	// the one before a gap
+	p = DefaultParams
+	p.LineMode = LineModeStaircase
+	p.PositiveColor = "green"
+	p.NegativeColor = "red"
+	p.YMin = -4
+	p.YMax = 4
+	params = newParams(p)
+
+	results = []*types.MetricData{types.MakeMetricData("a", []float64{2, -1, nan, 1}, 60, 0)}
+	drawGraph(&cairoSurfaceContext{context: &fakeContext{}}, &params, results)
+
+	cr = &fakeContext{}
+	fillBySign(&cairoSurfaceContext{context: cr}, &params, results[0])
+
+	x = getSeriesStartX(&params, results[0])
+	step = results[0].XStep
+	if len(cr.path) != 3*4 || len(cr.ops) != 3 {
+		t.Fatalf("got path %v filled %d times, want three rectangles", cr.path, len(cr.ops))
+	}
+	for i, from := range []float64{x, x + step, x + 3*step} {
+		rect := cr.path[4*i : 4*i+4]
+		if math.Abs(rect[0].x-from) > floatEpsilon || math.Abs(rect[1].x-(from+step)) > floatEpsilon || rect[0].y != rect[1].y || rect[2].x != rect[1].x || rect[3].x != rect[0].x {
+			t.Errorf("step %d: got %v, want a rectangle from %v to %v", i, rect, from, from+step)
+		}
+	}
+}
+
+// containsPath tells whether want is a part of path
+func containsPath(path, want []pathPoint) bool {
+	for start := 0; start+len(want) <= len(path); start++ {
+		found := true
+		for i, point := range want {
+			got := path[start+i]
+			found = found && got.move == point.move && math.Abs(got.x-point.x) < floatEpsilon && math.Abs(got.y-point.y) < floatEpsilon
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+func TestConnectedGapDash(t *testing.T) {
+	p := DefaultParams
+	p.LineMode = LineModeConnected
+	p.ConnectedLimit = 2
+	p.ConnectedGapDash = 4
+	params := newParams(p)
+
+	nan := math.NaN()
+	results := []*types.MetricData{types.MakeMetricData("a", []float64{1, 2, nan, nan, 3, 4, nan, nan, nan, 5}, 60, 0)}
+	drawGraph(&cairoSurfaceContext{context: &fakeContext{}}, &params, results)
+
+	cr := &fakeContext{}
+	drawLines(&cairoSurfaceContext{context: cr}, &params, results)
+
+	// the gap of two is bridged with dashes, the gap of three is not bridged
+	if want := [][]float64{nil, {4}, nil}; !reflect.DeepEqual(cr.dashes, want) {
+		t.Errorf("got dashes %v, want %v", cr.dashes, want)
+	}
+
+	x := getSeriesStartX(&params, results[0])
+	step := results[0].XStep
+	var bridge []pathPoint
+	for i, point := range cr.path {
+		if point.move && i+1 < len(cr.path) && !cr.path[i+1].move && math.Abs(point.x-(x+2*step)) < floatEpsilon {
+			bridge = []pathPoint{point, cr.path[i+1]}
+		}
+	}
+	if len(bridge) == 0 || math.Abs(bridge[1].x-(x+4*step)) > floatEpsilon {
+		t.Errorf("got path %v, want a segment from the start of the gap at %v to the next point at %v", cr.path, x+2*step, x+4*step)
+	}
+}
+
+func TestGetPieSlices(t *testing.T) {
+	nan := math.NaN()
+	results := []*types.MetricData{
+		types.MakeMetricData("a", []float64{1, nan, 5}, 60, 0),
+		types.MakeMetricData("b", []float64{nan, nan}, 60, 0),
+		types.MakeMetricData("c", []float64{-2, 2, 6}, 60, 0),
+	}
+	results[2].Color = "ff8000"
+
+	tests := []struct {
+		pieMode PieMode
+		want    []PieSlice
+	}{
+		{PieModeAverage, []PieSlice{{"a", 3, "#6464ff"}, {"c", 2, "#ff8000"}}},
+		{PieModeMaximum, []PieSlice{{"a", 5, "#6464ff"}, {"c", 6, "#ff8000"}}},
+		{PieModeMinimum, []PieSlice{{"a", 1, "#6464ff"}, {"c", -2, "#ff8000"}}},
+	}
+
+	for _, tt := range tests {
+		params := &Params{pieMode: tt.pieMode, colorList: []string{"blue", "green"}}
+		if got := getPieSlices(params, results); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("pieMode %v: got %+v, want %+v", tt.pieMode, got, tt.want)
+		}
+	}
+}
+
+func TestSnapTime(t *testing.T) {
+	p := DefaultParams
+	p.SnapTime = true
+	params := newParams(p)
+
+	// 00:07:30 to 00:51:30
+	results := []*types.MetricData{types.MakeMetricData("a", make([]float64, 45), 60, 450)}
+	drawGraph(&cairoSurfaceContext{context: &fakeContext{}}, &params, results)
+
+	unit := int64(params.xConf.labelUnit)
+	if unit != Minute {
+		t.Fatalf("got label unit %v, the test expects minutes", unit)
+	}
+	if params.startTime != 420 || params.endTime != 3120 || params.timeRange != 2700 {
+		t.Errorf("got time range (%v, %v) of %v, want (420, 3120) of 2700", params.startTime, params.endTime, params.timeRange)
+	}
+
+	// the data stays where the axis puts its timestamps
+	series := results[0]
+	last := len(series.AggregatedValues()) - 1
+	got := getSeriesStartX(&params, series) + float64(last)*series.XStep
+	want := params.area.xmin + params.lineWidth/2 + float64(series.StartTime+int64(last)*series.StepTime-params.startTime)*params.xScaleFactor
+	if math.Abs(got-want) > floatEpsilon {
+		t.Errorf("last point at x %v, want %v", got, want)
+	}
+}
+
+func TestXSubGrid(t *testing.T) {
+	verticalLines := func(xSubGrid int) (int, *Params) {
+		p := DefaultParams
+		p.Width = 800
+		p.XSubGrid = xSubGrid
+		params := newParams(p)
+
+		results := []*types.MetricData{types.MakeMetricData("a", make([]float64, 120), 60, 0)}
+		drawGraph(&cairoSurfaceContext{context: &fakeContext{}}, &params, results)
+
+		cr := &fakeContext{}
+		drawGridLines(&cairoSurfaceContext{context: cr}, &params, results)
+		n := 0
+		for _, point := range cr.path {
+			if point.move && point.y == params.area.ymax {
+				n++
+			}
+		}
+		return n, &params
+	}
+
+	without, _ := verticalLines(0)
+	with, params := verticalLines(4)
+
+	dt, delta := findXTimes(params.startTime, params.xConf.minorGridUnit, params.xConf.minorGridStep)
+	want := 0
+	for _, t := range getXGridTimes(params.startTime, params.endTime, dt, delta, 4) {
+		if params.area.xmin+(t-float64(params.startTime))*params.xScaleFactor < params.area.xmax {
+			want++
+		}
+	}
+	if want == 0 || with-without != want {
+		t.Errorf("got %d subdivision lines, want %d", with-without, want)
+	}
+
+	// lines closer than 2 pixels are not drawn
+	if dense, _ := verticalLines(1000); dense != without {
+		t.Errorf("got %d vertical lines with too dense subdivisions, want %d", dense, without)
+	}
+}
+
+func TestTextExtentsCache(t *testing.T) {
+	params := newParams(DefaultParams)
+	fake := &fakeContext{}
+	cr := &cairoSurfaceContext{context: fake}
+
+	setFont(cr, &params, 10)
+	for i := 0; i < 3; i++ {
+		drawText(cr, &params, "12:00", 0, 0, HAlignCenter, VAlignTop, 0)
+	}
+	small := getTextExtents(cr, "12:00")
+	if fake.measured != 1 {
+		t.Errorf("got %d measurements of the same label, want 1", fake.measured)
+	}
+
+	setFont(cr, &params, 20)
+	large := getTextExtents(cr, "12:00")
+	if fake.measured != 2 || large.XAdvance != 2*small.XAdvance {
+		t.Errorf("got %d measurements and width %v at a larger size, want 2 and %v", fake.measured, large.XAdvance, 2*small.XAdvance)
+	}
+}
+
+func TestWritePNG(t *testing.T) {
+	results := []*types.MetricData{types.MakeMetricData("a", []float64{1, 2, 3}, 60, 0)}
+
+	var buf bytes.Buffer
+	if err := writePNG(context.Background(), &buf, DefaultParams, results); err != nil {
+		t.Fatalf("writePNG: %v", err)
+	}
+
+	if want := MarshalPNG(DefaultParams, results); !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("streamed png differs from the buffered one: %d bytes, want %d", buf.Len(), len(want))
+	}
+}
+
+func TestSetSeriesStyles(t *testing.T) {
+	newSeries := func(name, color string, right bool) *types.MetricData {
+		r := types.MakeMetricData(name, []float64{1, 2, 3}, 1, 0)
+		r.Color = color
+		r.SecondYAxis = right
+		return r
+	}
+
+	tests := []struct {
+		name        string
+		secondYAxis bool
+		leftColor   string
+		rightColor  string
+		series      []*types.MetricData
+		want        []string
+	}{
+		{
+			name:   "single axis uses palette unless color is explicit",
+			series: []*types.MetricData{newSeries("a", "", false), newSeries("b", "gold", false), newSeries("c", "", false)},
+			want:   []string{"blue", "gold", "green"},
+		},
+		{
+			name:        "no side colors falls back to palette on both axes",
+			secondYAxis: true,
+			series:      []*types.MetricData{newSeries("a", "", false), newSeries("b", "", true)},
+			want:        []string{"blue", "green"},
+		},
+		{
+			name:        "side colors win over palette",
+			secondYAxis: true,
+			leftColor:   "pink",
+			rightColor:  "aqua",
+			series:      []*types.MetricData{newSeries("a", "", false), newSeries("b", "", true)},
+			want:        []string{"pink", "aqua"},
+		},
+		{
+			name:        "explicit colors win over side colors",
+			secondYAxis: true,
+			leftColor:   "pink",
+			rightColor:  "aqua",
+			series:      []*types.MetricData{newSeries("a", "gold", false), newSeries("b", "rose", true)},
+			want:        []string{"gold", "rose"},
+		},
+		{
+			name:        "only left color set",
+			secondYAxis: true,
+			leftColor:   "pink",
+			series:      []*types.MetricData{newSeries("a", "", false), newSeries("b", "", true), newSeries("c", "", true)},
+			want:        []string{"pink", "blue", "green"},
+		},
+		{
+			name:        "only right color set",
+			secondYAxis: true,
+			rightColor:  "aqua",
+			series:      []*types.MetricData{newSeries("a", "", false), newSeries("b", "", true), newSeries("c", "", false)},
+			want:        []string{"blue", "aqua", "green"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := &Params{
+				secondYAxis: tt.secondYAxis,
+				leftColor:   tt.leftColor,
+				rightColor:  tt.rightColor,
+				leftWidth:   1.2,
+				rightWidth:  2,
+				colorList:   []string{"blue", "green"},
+			}
+			setSeriesStyles(params, tt.series)
+			for i, s := range tt.series {
+				if s.Color != tt.want[i] {
+					t.Errorf("series %s: got color %q, want %q", s.Name, s.Color, tt.want[i])
+				}
+				if tt.secondYAxis {
+					width := params.leftWidth
+					if s.SecondYAxis {
+						width = params.rightWidth
+					}
+					if !s.HasLineWidth || s.LineWidth != width {
+						t.Errorf("series %s: got line width %v, want %v", s.Name, s.LineWidth, width)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestStableColors(t *testing.T) {
+	params := &Params{stableColors: true, colorList: DefaultColorList}
+
+	colorsOf := func(names ...string) map[string]string {
+		results := make([]*types.MetricData, 0, len(names))
+		for _, name := range names {
+			results = append(results, types.MakeMetricData(name, []float64{1}, 1, 0))
+		}
+		setSeriesStyles(params, results)
+		colors := make(map[string]string, len(results))
+		for _, r := range results {
+			colors[r.Name] = r.Color
+		}
+		return colors
+	}
+
+	first := colorsOf("cpu.user", "cpu.system", "cpu.idle")
+	second := colorsOf("cpu.idle", "cpu.user")
+	for name, c := range second {
+		if first[name] != c {
+			t.Errorf("%s: got color %q after reordering, want %q", name, c, first[name])
+		}
+	}
+
+	explicit := types.MakeMetricData("cpu.user", []float64{1}, 1, 0)
+	explicit.Color = "black"
+	setSeriesStyles(params, []*types.MetricData{explicit})
+	if explicit.Color != "black" {
+		t.Errorf("got color %q, want the explicit black", explicit.Color)
+	}
+}
+
+func TestYTicks(t *testing.T) {
+	p := DefaultParams
+	p.YMin = 98
+	p.YMax = 100
+	p.YTicks = []float64{99.99, 99, 99.9, 100.5, 50}
+	params := newParams(p)
+
+	results := []*types.MetricData{types.MakeMetricData("sla", []float64{99.2, 99.95, 99.99}, 60, 0)}
+	setupYAxis(&cairoSurfaceContext{context: &fakeContext{}}, &params, results)
+
+	want := []float64{99, 99.9, 99.99}
+	if !reflect.DeepEqual(params.yLabelValues, want) {
+		t.Errorf("yLabelValues: got %v, want %v", params.yLabelValues, want)
+	}
+	if len(params.yLabels) != len(want) {
+		t.Errorf("yLabels: got %v, want %d labels", params.yLabels, len(want))
+	}
+
+	// ticks must not change the scale of the axis
+	if y := getYCoord(&params, 98, YCoordSide(YCoordSideNone)); math.Abs(y-params.area.ymax) > floatEpsilon {
+		t.Errorf("yMin is drawn at %v, want the bottom of the plot area %v", y, params.area.ymax)
+	}
+	if y := getYCoord(&params, 100, YCoordSide(YCoordSideNone)); math.Abs(y-params.area.ymin) > floatEpsilon {
+		t.Errorf("yMax is drawn at %v, want the top of the plot area %v", y, params.area.ymin)
+	}
+}
+
+func TestGetDataPercentile(t *testing.T) {
+	values := make([]float64, 0, 101)
+	for i := 0; i <= 100; i++ {
+		values = append(values, float64(i))
+	}
+	values[100] = 100000 // a spike
+
+	series := []*types.MetricData{
+		types.MakeMetricData("a", values[:50], 1, 0),
+		types.MakeMetricData("b", append(values[50:], math.NaN(), math.Inf(1)), 1, 0),
+		types.MakeMetricData("inf", []float64{1e9}, 1, 0),
+	}
+	series[2].DrawAsInfinite = true
+
+	tests := []struct {
+		percentile, want float64
+	}{
+		{99, 99},
+		{50, 50},
+		{0, -1},
+		{100, -1},
+	}
+
+	for _, tt := range tests {
+		got := getDataPercentile(series, tt.percentile, -1)
+		if got != tt.want {
+			t.Errorf("getDataPercentile(%v): got %v, want %v", tt.percentile, got, tt.want)
+		}
+	}
+
+	if got := getDataPercentile(series[2:], 99, -1); got != -1 {
+		t.Errorf("getDataPercentile without values: got %v, want the default", got)
+	}
+}
+
+func TestSeriesStats(t *testing.T) {
+	nan := math.NaN()
+
+	tests := []struct {
+		values                    []float64
+		wantMin, wantMax, wantAvg float64
+		wantOk                    bool
+	}{
+		{[]float64{1, 2, 3, 6}, 1, 6, 3, true},
+		{[]float64{nan, -2, nan, 4}, -2, 4, 1, true},
+		{[]float64{5}, 5, 5, 5, true},
+		{[]float64{nan, nan}, 0, 0, 0, false},
+		{nil, 0, 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		gotMin, gotMax, gotAvg, ok := seriesStats(tt.values)
+		if ok != tt.wantOk || gotMin != tt.wantMin || gotMax != tt.wantMax || gotAvg != tt.wantAvg {
+			t.Errorf("seriesStats(%v): got (%v, %v, %v, %v), want (%v, %v, %v, %v)", tt.values, gotMin, gotMax, gotAvg, ok, tt.wantMin, tt.wantMax, tt.wantAvg, tt.wantOk)
+		}
+	}
+}
+
+func TestGetDataRange(t *testing.T) {
+	nan := math.NaN()
+	newSeries := func(values ...float64) *types.MetricData {
+		return types.MakeMetricData("a", values, 1, 0)
+	}
+	infinite := newSeries(0, 1000, 0)
+	infinite.DrawAsInfinite = true
+
+	tests := []struct {
+		name             string
+		series           []*types.MetricData
+		wantMin, wantMax float64
+		wantMissing      bool
+	}{
+		{"no gaps", []*types.MetricData{newSeries(3, 1, 2)}, 1, 3, false},
+		{"leading NaN", []*types.MetricData{newSeries(nan, 5, 2)}, 2, 5, true},
+		{"NaN in the middle", []*types.MetricData{newSeries(1, nan, -4, nan)}, -4, 1, true},
+		{"all NaN", []*types.MetricData{newSeries(nan, nan)}, nan, nan, true},
+		{"several series", []*types.MetricData{newSeries(nan, nan), newSeries(7, nan, 9)}, 7, 9, true},
+		{"infinite values are ignored", []*types.MetricData{newSeries(math.Inf(1), 2, math.Inf(-1), 4)}, 2, 4, false},
+		{"drawAsInfinite series are ignored", []*types.MetricData{infinite, newSeries(1, 2)}, 1, 2, false},
+		{"no series", nil, nan, nan, false},
+	}
+
+	sameFloat := func(a, b float64) bool {
+		return a == b || (math.IsNaN(a) && math.IsNaN(b))
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotMin, gotMax, gotMissing := getDataRange(tt.series)
+			if !sameFloat(gotMin, tt.wantMin) || !sameFloat(gotMax, tt.wantMax) || gotMissing != tt.wantMissing {
+				t.Errorf("got (%v, %v, %v), want (%v, %v, %v)", gotMin, gotMax, gotMissing, tt.wantMin, tt.wantMax, tt.wantMissing)
+			}
+		})
+	}
+}
+
+func TestNormalizeStack(t *testing.T) {
+	nan := math.NaN()
+	newSeries := func(stacked bool, values ...float64) *types.MetricData {
+		r := types.MakeMetricData("a", values, 1, 0)
+		r.Stacked = stacked
+		return r
+	}
+
+	results := []*types.MetricData{
+		newSeries(true, 1, 0, nan, 3),
+		newSeries(true, 3, 0, nan, nan),
+		newSeries(false, 100, 100, 100, 100),
+	}
+	original := results[0].Values
+	normalizeStack(results)
+
+	if original[0] != 1 {
+		t.Errorf("got the original values changed to %v, want them kept", original)
+	}
+
+	want := [][]float64{
+		{0.25, nan, nan, 1},
+		{0.75, nan, nan, nan},
+		{100, 100, 100, 100},
+	}
+	for i, r := range results {
+		got := r.AggregatedValues()
+		for j := range want[i] {
+			if got[j] != want[i][j] && !(math.IsNaN(got[j]) && math.IsNaN(want[i][j])) {
+				t.Errorf("series %d: got %v, want %v", i, got, want[i])
+				break
+			}
+		}
+	}
+}
+
+func TestColorForValue(t *testing.T) {
+	params := &Params{
+		colorByValueLow:  color.RGBA{0, 0, 255, 255},
+		colorByValueHigh: color.RGBA{255, 0, 0, 255},
+		colorByValueMin:  10,
+		colorByValueMax:  20,
+	}
+
+	tests := []struct {
+		value float64
+		want  color.RGBA
+	}{
+		{10, color.RGBA{0, 0, 255, 255}},
+		{20, color.RGBA{255, 0, 0, 255}},
+		{15, color.RGBA{128, 0, 128, 255}},
+		{0, color.RGBA{0, 0, 255, 255}},
+		{100, color.RGBA{255, 0, 0, 255}},
+	}
+
+	for _, tt := range tests {
+		got := colorForValue(params, tt.value)
+		if got != tt.want {
+			t.Errorf("colorForValue(%v): got %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestColorScale(t *testing.T) {
+	p := DefaultParams
+	p.ColorByValue = true
+	params := newParams(p)
+
+	results := []*types.MetricData{types.MakeMetricData("temperature", []float64{0, 40, 100, 60}, 60, 0)}
+	cr := &fakeContext{}
+	drawGraph(&cairoSurfaceContext{context: cr}, &params, results)
+
+	if cr.patterns != 1 {
+		t.Errorf("got %d patterns set, want the gradient of the color scale", cr.patterns)
+	}
+	bar := Area{xmin: params.colorScaleX, xmax: params.colorScaleX + colorScaleBarWidth, ymin: params.area.ymin, ymax: params.area.ymax}
+	found := false
+	for _, rect := range cr.rects {
+		found = found || rect == bar
+	}
+	if !found {
+		t.Errorf("got rectangles %v, want the bar %v filled in one go", cr.rects, bar)
+	}
+
+	low, high := params.colorByValueMin, params.colorByValueMax
+	texts := strings.Join(cr.texts, "|")
+	for _, v := range []float64{low, (low + high) / 2, high} {
+		if label := formatLabel(&params, v, params.yStep, params.ySpan); !strings.Contains(texts, label) {
+			t.Errorf("got texts %v, want the label %q of %v", cr.texts, label, v)
+		}
+	}
+	if strings.Contains(texts, "temperature") {
+		t.Errorf("got texts %v, want the color scale instead of the legend", cr.texts)
+	}
+}
+
+func TestReverseUnstacked(t *testing.T) {
+	newSeries := func(name string, stacked bool) *types.MetricData {
+		r := types.MakeMetricData(name, []float64{1}, 1, 0)
+		r.Stacked = stacked
+		return r
+	}
+
+	results := []*types.MetricData{
+		newSeries("s1", true),
+		newSeries("s2", true),
+		newSeries("a", false),
+		newSeries("b", false),
+		newSeries("c", false),
+	}
+	got := reverseUnstacked(results)
+
+	want := []string{"s1", "s2", "c", "b", "a"}
+	for i, r := range got {
+		if r.Name != want[i] {
+			t.Fatalf("position %d: got %s, want order %v", i, r.Name, want)
+		}
+	}
+	if results[2].Name != "a" {
+		t.Errorf("original results were reordered")
+	}
+}
+
+func TestAlignToPixel(t *testing.T) {
+
+	tests := []struct {
+		v          float64
+		pixelRatio float64
+		want       float64
+	}{
+		{10, 1, 10.5},
+		{10.2, 1, 10.5},
+		{10.9, 1, 10.5},
+		{10, 2, 10.25},
+		{10.6, 2, 10.75},
+		{3, 0, 3.5},
+	}
+
+	for _, tt := range tests {
+		got := alignToPixel(&Params{pixelRatio: tt.pixelRatio}, tt.v)
+		if got != tt.want {
+			t.Errorf("alignToPixel(%v, ratio %v): got %v, want %v", tt.v, tt.pixelRatio, got, tt.want)
+		}
+	}
+}
+
+func TestRecordPoints(t *testing.T) {
+	p := DefaultParams
+	p.PixelRatio = 2
+	params := newParams(p)
+	params.recordPoints = true
+
+	results := []*types.MetricData{types.MakeMetricData("a", []float64{1, math.NaN(), 3}, 60, 600)}
+	drawGraph(&cairoSurfaceContext{context: &fakeContext{}}, &params, results)
+
+	if len(params.plotPoints) != 2 {
+		t.Fatalf("got %d points, want one for each value but the null", len(params.plotPoints))
+	}
+	for i, want := range []struct {
+		value     float64
+		timestamp int64
+	}{{1, 600}, {3, 720}} {
+		point := params.plotPoints[i]
+		if point.Name != "a" || point.Value != want.value || point.Timestamp != want.timestamp {
+			t.Errorf("point %d is %v, want value %v at %v", i, point, want.value, want.timestamp)
+		}
+		if y := getYCoord(&params, want.value, YCoordSideNone) * params.pixelRatio; math.Abs(point.Y-y) > floatEpsilon {
+			t.Errorf("point %d at y %v, want %v", i, point.Y, y)
+		}
+	}
+	if params.plotPoints[0].X >= params.plotPoints[1].X {
+		t.Errorf("points are not left to right: %v", params.plotPoints)
+	}
+}
+
+func TestBands(t *testing.T) {
+	line := types.MakeMetricData("bands(a.avg)", []float64{2, 3, 5}, 60, 0)
+	lower := types.MakeMetricData("a.min", []float64{1, 2, 3}, 60, 0)
+	lower.Stacked, lower.StackName, lower.Invisible, lower.BandOf = true, line.Name, true, line
+	upper := types.MakeMetricData("a.max", []float64{3, 3, 3}, 60, 0)
+	upper.Stacked, upper.StackName, upper.BandOf = true, line.Name, line
+	other := types.MakeMetricData("b", []float64{1, 1, 1}, 60, 0)
+	results := []*types.MetricData{lower, upper, line, other}
+
+	params := newParams(DefaultParams)
+	cr := &fakeContext{}
+	drawGraph(&cairoSurfaceContext{context: cr}, &params, results)
+
+	if lower.Color != line.Color || upper.Color != line.Color {
+		t.Errorf("band colors are %q and %q, want the color of the line %q", lower.Color, upper.Color, line.Color)
+	}
+	if want := params.colorList[1]; other.Color != want {
+		t.Errorf("the next series got color %q, want %q as the band takes no color of its own", other.Color, want)
+	}
+	for _, text := range cr.texts {
+		if text == lower.Name || text == upper.Name {
+			t.Errorf("got legend entry %q for the band", text)
+		}
+	}
+
+	// the band takes no room in the legend either
+	legendHeight := func(results []*types.MetricData) float64 {
+		p := DefaultParams
+		p.Width = 100
+		params := newParams(p)
+		params.fontExtents = cairo.FontExtents{Ascent: 8, Descent: 2, Height: 10}
+		ymax := params.area.ymax
+		drawLegend(&cairoSurfaceContext{context: &fakeContext{}}, &params, results)
+		return ymax - params.area.ymax
+	}
+	if got, want := legendHeight(results), legendHeight([]*types.MetricData{line, other}); got != want {
+		t.Errorf("got a legend %v high, want %v as without the band", got, want)
+	}
+}
+
+func TestTrimEmptyEdges(t *testing.T) {
+	nan := math.NaN()
+	results := []*types.MetricData{
+		types.MakeMetricData("a", []float64{nan, nan, 1, 2, nan}, 60, 0),
+		types.MakeMetricData("b", []float64{nan, 3, nan, nan, nan}, 60, 0),
+		types.MakeMetricData("c", []float64{nan, 5, nan}, 120, 0),
+	}
+	trimEmptyEdges(results)
+
+	// the first point is b at 60, the last one is a at 180
+	want := []struct {
+		values      []float64
+		start, stop int64
+	}{
+		{[]float64{nan, 1, 2}, 60, 240},
+		{[]float64{3, nan, nan}, 60, 240},
+		{[]float64{5}, 120, 240},
+	}
+	for i, w := range want {
+		r := results[i]
+		if r.StartTime != w.start || r.StopTime != w.stop || fmt.Sprint(r.Values) != fmt.Sprint(w.values) {
+			t.Errorf("%s: got %v from %d to %d, want %v from %d to %d", r.Name, r.Values, r.StartTime, r.StopTime, w.values, w.start, w.stop)
+		}
+	}
+
+	// series without any point are left as they are
+	empty := []*types.MetricData{types.MakeMetricData("a", []float64{nan, nan}, 60, 0)}
+	trimEmptyEdges(empty)
+	if len(empty[0].Values) != 2 || empty[0].StartTime != 0 {
+		t.Errorf("got %v from %d, want the empty series untouched", empty[0].Values, empty[0].StartTime)
+	}
+}
+
+func TestKeepLastPoints(t *testing.T) {
+	nan := math.NaN()
+	results := []*types.MetricData{
+		types.MakeMetricData("long", []float64{1, 2, 3, nan, 5, 6}, 60, 0),
+		types.MakeMetricData("short", []float64{7, 8}, 60, 240),
+	}
+	keepLastPoints(results, 3)
+
+	want := []struct {
+		values      []float64
+		start, stop int64
+	}{
+		{[]float64{nan, 5, 6}, 180, 360},
+		{[]float64{7, 8}, 240, 360},
+	}
+	for i, w := range want {
+		r := results[i]
+		if r.StartTime != w.start || r.StopTime != w.stop || fmt.Sprint(r.Values) != fmt.Sprint(w.values) {
+			t.Errorf("%s: got %v from %d to %d, want %v from %d to %d", r.Name, r.Values, r.StartTime, r.StopTime, w.values, w.start, w.stop)
+		}
+	}
+
+	// the X axis starts at the first kept point
+	p := DefaultParams
+	p.LastPoints = 3
+	params := newParams(p)
+	results = []*types.MetricData{types.MakeMetricData("a", []float64{1, 2, 3, 4, 5, 6}, 60, 0)}
+	drawGraph(&cairoSurfaceContext{context: &fakeContext{}}, &params, results)
+	if params.startTime != 180 {
+		t.Errorf("got the graph starting at %d, want 180", params.startTime)
+	}
+}
+
+func TestDrawnValues(t *testing.T) {
+	series := types.MakeMetricData("a", []float64{0, 0, 0, 0, 10, 0, 0, 0, 0}, 60, 0)
+	series.SetValuesPerPoint(3)
+
+	tests := []struct {
+		decimation Decimation
+		stacked    bool
+		want       []float64
+	}{
+		{DecimationAverage, false, series.AggregatedValues()},
+		{DecimationLTTB, false, []float64{0, 10, 0}},
+		{DecimationMinMax, false, []float64{0, 10, 0}},
+		// the stack has to add up, its members keep their consolidation
+		{DecimationMinMax, true, series.AggregatedValues()},
+	}
+	for _, tt := range tests {
+		series.Stacked = tt.stacked
+		params := &Params{decimation: tt.decimation}
+		if got := drawnValues(params, series); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("decimation %d, stacked %v: got %v, want %v", tt.decimation, tt.stacked, got, tt.want)
+		}
+	}
+}
+
+func TestMarginPercent(t *testing.T) {
+	tests := []struct {
+		width, height float64
+		marginPercent float64
+		want          int
+	}{
+		{330, 250, 0, 10},
+		{330, 250, 4, 10},
+		{1320, 1000, 4, 40},
+		{100, 400, 5, 5},
+	}
+
+	for _, tt := range tests {
+		p := DefaultParams
+		p.Width, p.Height, p.MarginPercent = tt.width, tt.height, tt.marginPercent
+		if got := newParams(p).margin; got != tt.want {
+			t.Errorf("%vx%v with marginPercent %v: got margin %d, want %d", tt.width, tt.height, tt.marginPercent, got, tt.want)
+		}
+	}
+}
+
+func TestUnnamedSeries(t *testing.T) {
+	for _, names := range [][]string{{"", "a"}, {"", ""}} {
+		var results []*types.MetricData
+		for _, name := range names {
+			results = append(results, types.MakeMetricData(name, []float64{1, 2, 3}, 60, 0))
+		}
+
+		p := DefaultParams
+		p.LegendBox = true
+		params := newParams(p)
+		cr := &fakeContext{}
+		drawGraph(&cairoSurfaceContext{context: cr}, &params, results)
+
+		// like in graphite-web, series without a name have no legend entry
+		for _, text := range cr.texts {
+			if text == "" {
+				t.Errorf("%q: got an empty legend entry", names)
+			}
+		}
+	}
+}
+
+func TestNoDataText(t *testing.T) {
+	draw := func(text string) *fakeContext {
+		p := DefaultParams
+		p.NoDataText = text
+		params := newParams(p)
+		cr := &fakeContext{}
+		drawGraph(&cairoSurfaceContext{context: cr}, &params, nil)
+		return cr
+	}
+
+	cr := draw("Keine Daten")
+	if !reflect.DeepEqual(cr.texts, []string{"Keine Daten"}) {
+		t.Fatalf("got texts %q, want the custom message", cr.texts)
+	}
+	defaultSize := cr.textSizes[0]
+
+	// a message wider than the image is shrunk to fit
+	long := strings.Repeat("x", 100)
+	cr = draw(long)
+	size := cr.textSizes[len(cr.textSizes)-1]
+	if size >= defaultSize {
+		t.Errorf("got font size %v for a long message, want less than %v", size, defaultSize)
+	}
+	if width := 0.6 * size * float64(len(long)); width > DefaultParams.Width-2*float64(DefaultParams.Margin)+floatEpsilon {
+		t.Errorf("message is %v wide, wider than the image", width)
+	}
+}
+
+func TestYDivisions(t *testing.T) {
+	p := DefaultParams
+	p.YDivisions = 5
+	params := newParams(p)
+	right := types.MakeMetricData("b", []float64{0, 3.5}, 60, 0)
+	right.SecondYAxis = true
+	results := []*types.MetricData{types.MakeMetricData("a", []float64{0, 100}, 60, 0), right}
+	drawGraph(&cairoSurfaceContext{context: &fakeContext{}}, &params, results)
+
+	if len(params.yLabelValuesL) != 6 || len(params.yLabelValuesR) != 6 {
+		t.Fatalf("got %v and %v labels, want 5 divisions on both axes", params.yLabelValuesL, params.yLabelValuesR)
+	}
+	for i := range params.yLabelValuesL {
+		yL := getYCoord(&params, params.yLabelValuesL[i], YCoordSideLeft)
+		yR := getYCoord(&params, params.yLabelValuesR[i], YCoordSideRight)
+		if math.Abs(yL-yR) > floatEpsilon {
+			t.Errorf("label %d is at y %v on the left and %v on the right", i, yL, yR)
+		}
+	}
+}
+
+func TestEmptyFrame(t *testing.T) {
+	for _, areaMode := range []AreaMode{AreaModeNone, AreaModeFirst, AreaModeStacked} {
+		p := DefaultParams
+		p.EmptyFrame = true
+		p.AreaMode = areaMode
+		p.From, p.Until = 0, 3600
+		params := newParams(p)
+		cr := &fakeContext{}
+		drawGraph(&cairoSurfaceContext{context: cr}, &params, nil)
+
+		if params.startTime != 0 || params.endTime != 3600 {
+			t.Errorf("areaMode %v: got time range (%v, %v), want the requested (0, 3600)", areaMode, params.startTime, params.endTime)
+		}
+		if len(params.yLabelValues) == 0 {
+			t.Errorf("areaMode %v: got no Y axis labels", areaMode)
+		}
+		if len(cr.texts) == 0 || cr.texts[len(cr.texts)-1] != DefaultParams.NoDataText {
+			t.Errorf("areaMode %v: got texts %q, want the message drawn last", areaMode, cr.texts)
+		}
+	}
+
+	// without the option only the message is drawn
+	p := DefaultParams
+	p.From, p.Until = 0, 3600
+	params := newParams(p)
+	cr := &fakeContext{}
+	drawGraph(&cairoSurfaceContext{context: cr}, &params, nil)
+	if !reflect.DeepEqual(cr.texts, []string{DefaultParams.NoDataText}) {
+		t.Errorf("got texts %q, want only the message", cr.texts)
+	}
+}
+
+func TestTitleFont(t *testing.T) {
+	p := DefaultParams
+	p.Title = "title"
+	p.Vtitle = "vtitle"
+	p.TitleFontName = "Serif"
+	params := newParams(p)
+
+	results := []*types.MetricData{types.MakeMetricData("a", []float64{1, 2, 3}, 60, 0)}
+	cr := &fakeContext{}
+	drawGraph(&cairoSurfaceContext{context: cr}, &params, results)
+
+	for i, text := range cr.texts {
+		want := "Sans"
+		if text == "title" || text == "vtitle" {
+			want = "Serif"
+		}
+		if cr.textFonts[i] != want {
+			t.Errorf("%q drawn in %q, want %q", text, cr.textFonts[i], want)
+		}
+	}
+
+	// measurements of one font are not reused for another one
+	cs := &cairoSurfaceContext{context: &fakeContext{}}
+	setFont(cs, &params, 10)
+	getTextExtents(cs, "title")
+	setTitleFont(cs, &params, 10)
+	getTextExtents(cs, "title")
+	if measured := cs.context.(*fakeContext).measured; measured != 2 {
+		t.Errorf("measured %d times, want once per font", measured)
+	}
+}
+
+func TestSmoothWindow(t *testing.T) {
+	p := DefaultParams
+	p.SmoothWindow = 3
+	params := newParams(p)
+
+	results := []*types.MetricData{types.MakeMetricData("a", []float64{1, 5, 2, 8, 3, 7}, 60, 0)}
+	cr := &fakeContext{}
+	drawGraph(&cairoSurfaceContext{context: cr}, &params, results)
+
+	if len(results) != 1 {
+		t.Fatalf("got %d series after drawing, want the smoothed copy to stay out of results", len(results))
+	}
+
+	dashed := false
+	for _, d := range cr.dashes {
+		if reflect.DeepEqual(d, []float64{3}) {
+			dashed = true
+		}
+	}
+	if !dashed {
+		t.Errorf("got dashes %v, want the smoothed line dashed", cr.dashes)
+	}
+
+	thin := false
+	for _, w := range cr.strokes {
+		if math.Abs(w-params.lineWidth/2) < floatEpsilon {
+			thin = true
+		}
+	}
+	if !thin {
+		t.Errorf("got strokes %v, want one of width %v", cr.strokes, params.lineWidth/2)
+	}
+
+	smoothed := smoothSeries(&params, results)
+	if len(smoothed) != 1 || smoothed[0].Color != results[0].Color || smoothed[0].Stacked {
+		t.Errorf("got %+v, want an unstacked copy in the color of the series", smoothed)
+	}
+}
+
+func TestCalendarGrid(t *testing.T) {
+	tz, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	p := DefaultParams
+	p.CalendarGrid = true
+	p.Tz = tz
+	params := newParams(p)
+
+	// a week of hourly points starting at UTC midnight, which is not a
+	// midnight in New York
+	start := time.Date(2023, time.March, 1, 0, 0, 0, 0, time.UTC).Unix()
+	values := make([]float64, 7*24)
+	results := []*types.MetricData{types.MakeMetricData("a", values, 3600, start)}
+	drawGraph(&cairoSurfaceContext{context: &fakeContext{}}, &params, results)
+
+	if params.xConf.labelUnit != Day {
+		t.Fatalf("got labels every %v seconds, want days", params.xConf.labelUnit)
+	}
+	if len(params.xCalendarTimes) == 0 {
+		t.Fatal("got no calendar times")
+	}
+	for _, dt := range params.xCalendarTimes {
+		if lt := time.Unix(dt, 0).In(tz); lt.Hour() != 0 || lt.Minute() != 0 {
+			t.Errorf("got a label at %v, want local midnights", lt)
+		}
+	}
+
+	ticks := getAxisTicks(&params)
+	if len(ticks.X) != len(params.xCalendarTimes) {
+		t.Fatalf("got %d x ticks, want %d", len(ticks.X), len(params.xCalendarTimes))
+	}
+	for i, tick := range ticks.X {
+		if int64(tick.Value) != params.xCalendarTimes[i] {
+			t.Errorf("tick %d: got %v, want %v", i, int64(tick.Value), params.xCalendarTimes[i])
+		}
+	}
+}
+
+func TestLineLabels(t *testing.T) {
+	p := DefaultParams
+	p.LineLabels = LineLabelsValue
+	params := newParams(p)
+
+	nan := math.NaN()
+	results := []*types.MetricData{
+		types.MakeMetricData("a", []float64{1, 3, 5}, 60, 0),
+		types.MakeMetricData("b", []float64{2, 5, nan}, 60, 0),
+	}
+	drawGraph(&cairoSurfaceContext{context: &fakeContext{}}, &params, results)
+
+	cr := &fakeContext{}
+	drawLineLabels(&cairoSurfaceContext{context: cr}, &params, results)
+
+	if want := []string{"a 5.0", "b 5.0"}; !reflect.DeepEqual(cr.texts, want) {
+		t.Fatalf("got labels %q, want %q", cr.texts, want)
+	}
+	if len(cr.path) != 2 {
+		t.Fatalf("got path %v, want a move per label", cr.path)
+	}
+
+	a, b := cr.path[0], cr.path[1]
+	if math.Abs(a.y-b.y) < params.fontExtents.Height {
+		t.Errorf("labels at %v and %v overlap", a.y, b.y)
+	}
+	if b.x >= a.x {
+		t.Errorf("got label of b at x %v, want it left of a at %v where its last present point is", b.x, a.x)
+	}
+	if right := a.x + 0.6*10*float64(len("a 5.0")); right > params.width-float64(params.margin) {
+		t.Errorf("label ends at %v, past the right margin of %v", right, params.width-float64(params.margin))
+	}
+}
+
+func TestRightAxisPattern(t *testing.T) {
+	p := DefaultParams
+	p.RightAxisPattern = "*.latency"
+	params := newParams(p)
+
+	results := []*types.MetricData{
+		types.MakeMetricData("db.query.count", []float64{1, 2}, 60, 0),
+		types.MakeMetricData("db.query.latency", []float64{100, 200}, 60, 0),
+		types.MakeMetricData("db.write.count", []float64{1, 2}, 60, 0),
+	}
+	results[2].SecondYAxis = true
+	drawGraph(&cairoSurfaceContext{context: &fakeContext{}}, &params, results)
+
+	if !params.secondYAxis {
+		t.Fatalf("got a single Y axis, want the matching series on the right one")
+	}
+	if got := []bool{results[0].SecondYAxis, results[1].SecondYAxis, results[2].SecondYAxis}; !reflect.DeepEqual(got, []bool{false, true, true}) {
+		t.Errorf("got series on the right axis %v, want the matching one and the one set by secondYAxis()", got)
+	}
+}
+
+func TestGetLogRange(t *testing.T) {
+	series := []*types.MetricData{types.MakeMetricData("a", []float64{-1, 0, 0.02, 30}, 60, 0)}
+	for _, tt := range []struct {
+		min, max    float64
+		series      []*types.MetricData
+		bottom, top float64
+	}{
+		{2, 30, series, 1, 100},
+		{-1, 30, series, 0.01, 100},
+		{0, 0, nil, 1, 1},
+	} {
+		bottom, top := getLogRange(10, tt.min, tt.max, tt.series)
+		if math.Abs(bottom-tt.bottom) > floatEpsilon || math.Abs(top-tt.top) > floatEpsilon {
+			t.Errorf("getLogRange(10, %v, %v): got %v..%v, want %v..%v", tt.min, tt.max, bottom, top, tt.bottom, tt.top)
+		}
+	}
+}
+
+func TestLogScaleOnOneAxis(t *testing.T) {
+	p := DefaultParams
+	p.LogBaseRight = 10
+	p.MinorY = 1
+	params := newParams(p)
+	cr := &fakeContext{}
+
+	results := []*types.MetricData{
+		types.MakeMetricData("left", []float64{5, 7, 10}, 60, 0),
+		types.MakeMetricData("right", []float64{0, 2, 500}, 60, 0),
+	}
+	results[1].SecondYAxis = true
+	// zero has no logarithm, it must not stop the graph from being drawn
+	drawGraph(&cairoSurfaceContext{context: cr}, &params, results)
+
+	if params.logBaseL != 0 {
+		t.Errorf("got the left axis on a log scale of base %v, want it linear", params.logBaseL)
+	}
+	if want := []float64{1, 10, 100, 1000}; !reflect.DeepEqual(params.yLabelValuesR, want) {
+		t.Errorf("got right labels %v, want %v", params.yLabelValuesR, want)
+	}
+	for i, v := range params.yMinorValuesR {
+		if want := math.Sqrt(10) * math.Pow(10, float64(i)); math.Abs(v-want) > 1e-9 {
+			t.Errorf("got right minor values %v, want them halfway between the powers of 10 on the log scale", params.yMinorValuesR)
+			break
+		}
+	}
+
+	// the grid follows the log axis, crispGrid puts it on pixel centers
+	lines := map[float64]bool{}
+	for _, point := range cr.path {
+		lines[point.y] = true
+	}
+	for _, v := range append(params.yLabelValuesR, params.yMinorValuesR...) {
+		if y := alignToPixel(&params, getYCoord(&params, v, YCoordSideRight)); !lines[y] {
+			t.Errorf("no grid line at %v of the right axis", v)
+		}
+	}
+}
+
+func TestXLogBase(t *testing.T) {
+	values := make([]float64, 1000)
+	for i := range values {
+		values[i] = float64(i)
+	}
+
+	p := DefaultParams
+	p.XLogBase = 10
+	params := newParams(p)
+	drawGraph(&cairoSurfaceContext{context: &fakeContext{}}, &params, []*types.MetricData{types.MakeMetricData("sizes", values, 1, 1)})
+
+	ticks := getAxisTicks(&params).X
+	if len(ticks) != 4 {
+		t.Fatalf("got X ticks %v, want the powers of 10 from 1 to 1000", ticks)
+	}
+	gap := ticks[1].Pixel - ticks[0].Pixel
+	for i, tick := range ticks {
+		if want := math.Pow(10, float64(i)); tick.Value != want {
+			t.Errorf("got tick %d at %v, want %v", i, tick.Value, want)
+		}
+		if i > 0 && math.Abs(tick.Pixel-ticks[i-1].Pixel-gap) > 1e-6 {
+			t.Errorf("got ticks at %v, want them evenly spaced", ticks)
+		}
+	}
+
+	// the logarithm of 0 has no place on the axis
+	params = newParams(p)
+	cr := &fakeContext{}
+	drawGraph(&cairoSurfaceContext{context: cr}, &params, []*types.MetricData{types.MakeMetricData("sizes", values, 1, 0)})
+	if want := []string{"xLogBase needs an X axis above 0"}; !reflect.DeepEqual(cr.texts, want) {
+		t.Errorf("got texts %q, want only %q", cr.texts, want)
+	}
+
+	// every power of 1 is 1, there are no ticks to draw
+	p.XLogBase = 1
+	params = newParams(p)
+	cr = &fakeContext{}
+	drawGraph(&cairoSurfaceContext{context: cr}, &params, []*types.MetricData{types.MakeMetricData("sizes", values, 1, 1)})
+	if want := []string{"xLogBase needs a base above 1"}; !reflect.DeepEqual(cr.texts, want) {
+		t.Errorf("got texts %q, want only %q", cr.texts, want)
+	}
+	if ticks := getAxisTicks(&params).X; len(ticks) != 0 {
+		t.Errorf("got X ticks %v, want none", ticks)
+	}
+}
+
+func TestCornerRadius(t *testing.T) {
+	for _, radius := range []float64{0, 6} {
+		p := DefaultParams
+		p.CornerRadius = radius
+		p.PlotShadow = true
+		params := newParams(p)
+
+		cr := &fakeContext{}
+		drawGraph(&cairoSurfaceContext{context: cr}, &params, []*types.MetricData{types.MakeMetricData("a", []float64{1, 2, 3}, 60, 0)})
+
+		// the top left corner of the plot area is rounded for the fill, the
+		// grid clip, the frame and the clip of the lines
+		corner := Area{xmin: params.area.xmin, xmax: params.area.xmin + 2*radius, ymin: params.area.ymin, ymax: params.area.ymin + 2*radius}
+		rounded := 0
+		for _, arc := range cr.arcs {
+			if arc == corner {
+				rounded++
+			}
+		}
+		if want := map[bool]int{false: 0, true: 4}[radius > 0]; rounded != want {
+			t.Errorf("cornerRadius=%v: got %d rounded corners at %v, want %d", radius, rounded, corner, want)
+		}
+	}
+}
+
+func TestCumulative(t *testing.T) {
+	p := DefaultParams
+	p.Cumulative = true
+	params := newParams(p)
+
+	values := []float64{1, 2, math.NaN(), 3}
+	results := []*types.MetricData{types.MakeMetricData("a", values, 60, 0)}
+	drawGraph(&cairoSurfaceContext{context: &fakeContext{}}, &params, results)
+
+	if got, want := results[0].Values, []float64{1, 3, 3, 6}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want the running total %v", got, want)
+	}
+	if values[1] != 2 {
+		t.Errorf("got original values %v, want them untouched", values)
+	}
+	if params.yTop < 6 {
+		t.Errorf("got Y axis up to %v, want it to fit the total of 6", params.yTop)
+	}
+}
+
+func TestHeatmap(t *testing.T) {
+	p := DefaultParams
+	p.GraphType = GraphTypeHeatmap
+	p.Tz = time.UTC
+	params := newParams(p)
+
+	// two days of hourly points
+	values := make([]float64, 48)
+	for i := range values {
+		values[i] = float64(i % 24)
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
+	cr := &fakeContext{}
+	drawGraph(&cairoSurfaceContext{context: cr}, &params, []*types.MetricData{types.MakeMetricData("requests", values, 3600, start)})
+
+	cells := 0
+	for _, r := range cr.rects {
+		if r.xmin >= params.area.xmin && r.xmax <= params.area.xmax+1 && r.ymin >= params.area.ymin && r.ymax <= params.area.ymax+1 {
+			cells++
+		}
+	}
+	if cells != 48 {
+		t.Errorf("got %d cells in the plot area, want one for every hour of the two days", cells)
+	}
+	if params.colorByValueMin != 0 || params.colorByValueMax != 23 {
+		t.Errorf("got color range %v-%v, want the range of the cells 0-23", params.colorByValueMin, params.colorByValueMax)
+	}
+	for _, want := range []string{"00", "01/01", "01/02"} {
+		found := false
+		for _, text := range cr.texts {
+			found = found || text == want
+		}
+		if !found {
+			t.Errorf("got texts %q, want a %q label", cr.texts, want)
+		}
+	}
+	for _, text := range cr.texts {
+		if text == "requests" {
+			t.Errorf("got the series in a legend, want the color scale instead")
+		}
+	}
+
+	// too small for the cells, the labels must not loop forever
+	for _, size := range []struct{ width, height float64 }{{330, 30}, {20, 250}} {
+		p.Width, p.Height = size.width, size.height
+		params := newParams(p)
+		cr := &fakeContext{}
+		drawGraph(&cairoSurfaceContext{context: cr}, &params, []*types.MetricData{types.MakeMetricData("requests", values, 3600, start)})
+		if len(cr.texts) == 0 || cr.texts[len(cr.texts)-1] != params.noDataText {
+			t.Errorf("%vx%v: got texts %q, want the no data message", size.width, size.height, cr.texts)
+		}
+	}
+}
+
+func TestNumberFormatLabels(t *testing.T) {
+	p := DefaultParams
+	p.NumberFormat = "1.234,5"
+	p.YUnitSystem = "none"
+	params := newParams(p)
+
+	results := []*types.MetricData{types.MakeMetricData("a", []float64{1000, 2500}, 60, 0)}
+	drawGraph(&cairoSurfaceContext{context: &fakeContext{}}, &params, results)
+
+	if want := "2.500,0"; !strings.Contains(strings.Join(params.yLabels, "|"), want) {
+		t.Errorf("got Y labels %q, want one of %q", params.yLabels, want)
+	}
+}
+
+func TestReferenceLines(t *testing.T) {
+	p := DefaultParams
+	p.ReferenceLines = true
+	params := newParams(p)
+
+	results := []*types.MetricData{
+		types.MakeMetricData("load", []float64{1, 5, 3}, 60, 0),
+		types.MakeMetricData("90", []float64{90, 90, 90}, 60, 0),
+		types.MakeMetricData("load2", []float64{2, 6, 4}, 60, 0),
+	}
+	drawGraph(&cairoSurfaceContext{context: &fakeContext{}}, &params, results)
+
+	if r := results[1]; r.Color != "gray" || r.Dashed == 0 {
+		t.Errorf("got the constant line colored %q with dashes %v, want it gray and dashed", r.Color, r.Dashed)
+	}
+	// the palette goes on with the real data
+	if results[0].Color != DefaultColorList[0] || results[2].Color != DefaultColorList[1] {
+		t.Errorf("got colors %q and %q, want the first two of the palette", results[0].Color, results[2].Color)
+	}
+
+	// a filled and outlined swatch for every real series, none for the
+	// constant line
+	cr := &fakeContext{}
+	drawLegend(&cairoSurfaceContext{context: cr}, &params, results)
+	if len(cr.texts) != 3 || len(cr.rects) != 2*2 {
+		t.Errorf("got legend texts %q with %d swatch rectangles, want 3 entries with 2 swatches", cr.texts, len(cr.rects))
+	}
+}
+
+func TestRenderTimeout(t *testing.T) {
+	expired, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for _, tt := range []struct {
+		ctx     context.Context
+		partial bool
+	}{{context.Background(), false}, {expired, true}} {
+		params := newParams(DefaultParams)
+		params.ctx = tt.ctx
+		params.recordPoints = true
+		cr := &fakeContext{}
+
+		results := []*types.MetricData{types.MakeMetricData("a", []float64{1, 2, 3}, 60, 0)}
+		drawPicture(&cairoSurfaceContext{context: cr}, &params, results)
+
+		noted := false
+		for _, text := range cr.texts {
+			noted = noted || text == "partial data"
+		}
+		if params.truncated != tt.partial || noted != tt.partial {
+			t.Errorf("ctx error %v: got truncated %v and note %v, want %v", tt.ctx.Err(), params.truncated, noted, tt.partial)
+		}
+		if drawn := len(params.plotPoints) != 0; drawn == tt.partial {
+			t.Errorf("ctx error %v: got %d points drawn", tt.ctx.Err(), len(params.plotPoints))
+		}
+	}
+}
+
+func TestStepAlign(t *testing.T) {
+	for _, tt := range []struct {
+		align string
+		shift float64
+	}{{"start", 0}, {"center", 0.5}, {"end", 1}} {
+		p := DefaultParams
+		p.PixelRatio = 1
+		p.StepAlign = getStepAlign(tt.align, StepAlignStart)
+		params := newParams(p)
+		params.recordPoints = true
+
+		results := []*types.MetricData{types.MakeMetricData("a", []float64{1, 2, 3, 4, 5}, 60, 0)}
+		drawGraph(&cairoSurfaceContext{context: &fakeContext{}}, &params, results)
+
+		first, last := params.plotPoints[0], params.plotPoints[len(params.plotPoints)-1]
+		if want := params.area.xmin + params.lineWidth/2 + results[0].XStep*tt.shift; math.Abs(first.X-want) > floatEpsilon {
+			t.Errorf("stepAlign=%v: got the first point at x %v, want %v", tt.align, first.X, want)
+		}
+		if max := params.area.xmax + params.lineWidth/2; last.X > max+floatEpsilon {
+			t.Errorf("stepAlign=%v: got the last point at x %v, past the end of the area at %v", tt.align, last.X, max)
+		}
+	}
+}
+
+func TestCrispAxisLabels(t *testing.T) {
+	p := DefaultParams
+	p.PixelRatio = 1
+	p.Height = 257
+	params := newParams(p)
+
+	results := []*types.MetricData{types.MakeMetricData("a", []float64{1, 2.3, 3.7}, 60, 0)}
+	drawGraph(&cairoSurfaceContext{context: &fakeContext{}}, &params, results)
+
+	// the labels move with the gridlines onto the pixel centers
+	labelYs := func(crisp bool) []float64 {
+		params.crispGrid = crisp
+		cr := &fakeContext{}
+		drawYAxis(&cairoSurfaceContext{context: cr}, &params, results)
+		var ys []float64
+		for _, point := range cr.path {
+			ys = append(ys, point.y)
+		}
+		return ys
+	}
+	plain, crisp := labelYs(false), labelYs(true)
+	if len(plain) != len(params.yLabelValues) || len(crisp) != len(plain) {
+		t.Fatalf("got %d and %d labels drawn, want %d", len(plain), len(crisp), len(params.yLabelValues))
+	}
+	moved := false
+	for i, v := range params.yLabelValues {
+		y := getYCoord(&params, v, YCoordSideNone)
+		if shift := alignToPixel(&params, y) - y; math.Abs(crisp[i]-plain[i]-shift) > floatEpsilon {
+			t.Errorf("label %v: moved by %v, want %v like its gridline", v, crisp[i]-plain[i], shift)
+		}
+		moved = moved || crisp[i] != plain[i]
+	}
+	if !moved {
+		t.Errorf("no label was moved, want a height that puts some of them off the pixel centers")
+	}
+}
+
+func TestPixelSnap(t *testing.T) {
+	for _, snap := range []PixelSnap{PixelSnapNone, PixelSnapAll} {
+		p := DefaultParams
+		p.PixelRatio = 1
+		p.Width = 333
+		p.PixelSnap = snap
+		params := newParams(p)
+		params.recordPoints = true
+
+		results := []*types.MetricData{types.MakeMetricData("a", []float64{1, 2.3, 3.7, 2.9, 1.1, 4.2, 0.3}, 60, 0)}
+		drawGraph(&cairoSurfaceContext{context: &fakeContext{}}, &params, results)
+
+		centered := true
+		for _, point := range params.plotPoints {
+			centered = centered && point.X-math.Floor(point.X) == 0.5 && point.Y-math.Floor(point.Y) == 0.5
+		}
+		if centered != (snap == PixelSnapAll) {
+			t.Errorf("pixelSnap=%v: got points %v, want them on pixel centers only with pixelSnap=all", snap, params.plotPoints)
+		}
+	}
+
+	// text starts on a whole pixel
+	p := DefaultParams
+	p.PixelRatio = 1
+	p.PixelSnap = PixelSnapAxes
+	params := newParams(p)
+	cr := &fakeContext{}
+	drawText(&cairoSurfaceContext{context: cr}, &params, "abc", 10.3, 20.6, HAlignCenter, VAlignBaseline, 0)
+	if got := cr.path[0]; got.x-0.6*10*3/2 != 1 || got.y != 21 {
+		t.Errorf("got text centered at %v, want it to start at (1, 21)", got)
+	}
+}
+
+func TestShowLast(t *testing.T) {
+	p := DefaultParams
+	p.ShowLast = true
+	params := newParams(p)
+
+	nan := math.NaN()
+	results := []*types.MetricData{
+		types.MakeMetricData("a", []float64{1, 3, 5}, 60, 0),
+		types.MakeMetricData("b", []float64{2, 4, nan}, 60, 0),
+		types.MakeMetricData("c", []float64{nan, nan, nan}, 60, 0),
+	}
+	drawGraph(&cairoSurfaceContext{context: &fakeContext{}}, &params, results)
+
+	cr := &fakeContext{}
+	drawLastValues(&cairoSurfaceContext{context: cr}, &params, results)
+
+	if want := []string{"5.0", "4.0"}; !reflect.DeepEqual(cr.texts, want) {
+		t.Fatalf("got labels %q, want only the values %q", cr.texts, want)
+	}
+	if len(cr.arcs) != 2 {
+		t.Fatalf("got dots %v, want one for every series with a present point", cr.arcs)
+	}
+	if a, b := cr.arcs[0], cr.arcs[1]; b.xmin >= a.xmin || b.ymin <= a.ymin {
+		t.Errorf("got dot of b at %v, want it left of and under a at %v", b, a)
+	}
+}
+
+func TestYScaleFactor(t *testing.T) {
+	p := DefaultParams
+	p.YMin = 0
+	p.YMax = 100
+	params := newParams(p)
+	params.area.ymin, params.area.ymax = 10, 210
+
+	results := []*types.MetricData{types.MakeMetricData("a", []float64{20, 80}, 60, 0)}
+	setupYAxis(&cairoSurfaceContext{context: &fakeContext{}}, &params, results)
+
+	if params.yBottom != 0 || params.yTop != 100 || params.ySpan != 100 {
+		t.Fatalf("got axis [%v, %v] spanning %v, want [0, 100] spanning 100", params.yBottom, params.yTop, params.ySpan)
+	}
+	if params.graphHeight != 200 {
+		t.Errorf("got graphHeight %v, want 200", params.graphHeight)
+	}
+	if math.Abs(params.yScaleFactor-2) > floatEpsilon {
+		t.Errorf("got yScaleFactor %v, want 2 pixels per unit", params.yScaleFactor)
+	}
+
+	// the scale factor maps values the same way getYCoord does
+	y := getYCoord(&params, 30, YCoordSideNone)
+	if want := params.area.ymax - (30-params.yBottom)*params.yScaleFactor; math.Abs(y-want) > floatEpsilon {
+		t.Errorf("getYCoord(30): got %v, want %v", y, want)
+	}
+}
+
+func TestDistinctYLabels(t *testing.T) {
+	p := DefaultParams
+	p.YLabelPrecision = 1
+	params := newParams(p)
+	params.area.ymin, params.area.ymax = 10, 210
+
+	// a near-flat series: the natural step is far below the 0.1 the labels show
+	results := []*types.MetricData{types.MakeMetricData("a", []float64{1000.001, 1000.002, 1000.003}, 60, 0)}
+	setupYAxis(&cairoSurfaceContext{context: &fakeContext{}}, &params, results)
+
+	if len(params.yLabels) < 2 {
+		t.Fatalf("got labels %q, want at least two", params.yLabels)
+	}
+	for i := 1; i < len(params.yLabels); i++ {
+		if params.yLabels[i] == params.yLabels[i-1] {
+			t.Errorf("got repeated labels %q with step %v", params.yLabels, params.yStep)
+			break
+		}
+	}
+
+	// yMinStep sets the finest step the axis may use
+	p = DefaultParams
+	p.YMinStep = 5
+	params = newParams(p)
+	params.area.ymin, params.area.ymax = 10, 210
+	results = []*types.MetricData{types.MakeMetricData("a", []float64{1, 2, 3}, 60, 0)}
+	setupYAxis(&cairoSurfaceContext{context: &fakeContext{}}, &params, results)
+	if params.yStep != 5 {
+		t.Errorf("yMinStep=5: got step %v, want 5", params.yStep)
+	}
+}
+
+func TestStackOrder(t *testing.T) {
+	tests := []struct {
+		order StackOrder
+		want  []string
+	}{
+		{StackOrderInput, []string{"b", "c", "a"}},
+		{StackOrderName, []string{"a", "b", "c"}},
+		{StackOrderValue, []string{"c", "a", "b"}},
+	}
+
+	for _, tt := range tests {
+		p := DefaultParams
+		p.AreaMode = AreaModeStacked
+		p.StackOrder = tt.order
+		params := newParams(p)
+
+		results := []*types.MetricData{
+			types.MakeMetricData("b", []float64{1, 1}, 60, 0),
+			types.MakeMetricData("c", []float64{5, 5}, 60, 0),
+			types.MakeMetricData("a", []float64{2, 2}, 60, 0),
+		}
+		drawGraph(&cairoSurfaceContext{context: &fakeContext{}}, &params, results)
+
+		var names []string
+		for _, r := range results {
+			names = append(names, r.Name)
+		}
+		if !reflect.DeepEqual(names, tt.want) {
+			t.Errorf("stackOrder %v: got %v from the bottom, want %v", tt.order, names, tt.want)
+		}
+
+		// the last series is the top of the stack
+		if top := results[2].Values; top[0] != 8 {
+			t.Errorf("stackOrder %v: got top of the stack %v, want 8", tt.order, top[0])
+		}
+	}
+}
+
+func TestHideEdgeXLabels(t *testing.T) {
+	results := []*types.MetricData{types.MakeMetricData("a", make([]float64, 60), 60, 0)}
+
+	p := DefaultParams
+	params := newParams(p)
+	drawGraph(&cairoSurfaceContext{context: &fakeContext{}}, &params, results)
+	all := getXLabelTimes(&params)
+	if len(all) < 3 {
+		t.Fatalf("got labels at %v, want at least 3", all)
+	}
+
+	p.HideFirstXLabel = true
+	p.HideLastXLabel = true
+	params = newParams(p)
+	drawGraph(&cairoSurfaceContext{context: &fakeContext{}}, &params, results)
+
+	if got, want := getXLabelTimes(&params), all[1:len(all)-1]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got labels at %v, want %v", got, want)
+	}
+	if ticks := getAxisTicks(&params); len(ticks.X) != len(all)-2 {
+		t.Errorf("got %d x ticks, want %d", len(ticks.X), len(all)-2)
+	}
+}
+
+func TestFillBySign(t *testing.T) {
+	p := DefaultParams
+	p.PositiveColor = "green"
+	p.NegativeColor = "red"
+	p.YMin = -4
+	p.YMax = 4
+	params := newParams(p)
+
+	results := []*types.MetricData{types.MakeMetricData("pnl", []float64{2, -2, -1}, 60, 0)}
+	drawGraph(&cairoSurfaceContext{context: &fakeContext{}}, &params, results)
+
+	cr := &fakeContext{}
+	fillBySign(&cairoSurfaceContext{context: cr}, &params, results[0])
+
+	x0 := getSeriesStartX(&params, results[0])
+	step := results[0].XStep
+	baseline := getAreaBaseline(&params, YCoordSideNone)
+
+	// a triangle up to the crossing, a triangle after it and a quad below zero
+	var starts []pathPoint
+	for _, point := range cr.path {
+		if point.move {
+			starts = append(starts, point)
+		}
+	}
+	if len(starts) != 3 || len(cr.path) != 3+3+4 {
+		t.Fatalf("got path %v, want two triangles and a quad", cr.path)
+	}
+
+	crossing := pathPoint{x: x0 + step/2, y: baseline}
+	if got := cr.path[1]; math.Abs(got.x-crossing.x) > floatEpsilon || math.Abs(got.y-crossing.y) > floatEpsilon {
+		t.Errorf("got the first fill through %v, want it to end at the zero crossing %v", got, crossing)
+	}
+	if got := starts[1]; math.Abs(got.x-crossing.x) > floatEpsilon {
+		t.Errorf("got the second fill from %v, want it to start at the zero crossing %v", got, crossing)
+	}
+}
+
+func TestPanels(t *testing.T) {
+	p := DefaultParams
+	p.GraphType = GraphTypePanels
+	p.PixelRatio = 1
+	params := newParams(p)
+	params.recordPoints = true
+
+	results := []*types.MetricData{
+		types.MakeMetricData("a", []float64{0, 5, 10}, 60, 0),
+		types.MakeMetricData("b", []float64{1000, 1500, 2000}, 60, 0),
+		types.MakeMetricData("c", []float64{-5, 0, 5}, 60, 0),
+	}
+	drawGraph(&cairoSurfaceContext{context: &fakeContext{}}, &params, results)
+
+	gap := params.fontExtents.Height
+	bandHeight := (params.area.ymax - params.area.ymin - 2*gap) / 3
+
+	for i, series := range results {
+		bandTop := params.area.ymin + float64(i)*(bandHeight+gap)
+		bandBottom := bandTop + bandHeight
+
+		lowest, highest := math.Inf(1), math.Inf(-1)
+		for _, point := range params.plotPoints {
+			if point.Name != series.Name {
+				continue
+			}
+			lowest, highest = math.Min(lowest, point.Y), math.Max(highest, point.Y)
+		}
+		if lowest < bandTop || highest > bandBottom {
+			t.Errorf("%s: points from %v to %v, want them in its band [%v, %v]", series.Name, lowest, highest, bandTop, bandBottom)
+		}
+		// every band is scaled to its own series
+		if highest-lowest < bandHeight/2 {
+			t.Errorf("%s: points span %v of the band height %v, want its own scale", series.Name, highest-lowest, bandHeight)
+		}
+	}
+
+	// out of time, the graph is marked as partial
+	expired, cancel := context.WithCancel(context.Background())
+	cancel()
+	params = newParams(p)
+	params.ctx = expired
+	params.recordPoints = true
+	cr := &fakeContext{}
+	drawPicture(&cairoSurfaceContext{context: cr}, &params, results)
+	if !params.truncated || len(params.plotPoints) != 0 || cr.texts[len(cr.texts)-1] != "partial data" {
+		t.Errorf("got truncated %v, %d points and texts %q, want no panels and the partial data note", params.truncated, len(params.plotPoints), cr.texts)
+	}
+}
+
+func TestCompositingOrder(t *testing.T) {
+	p := DefaultParams
+	p.AreaMode = AreaModeStacked
+	p.AreaAlpha = 0.5
+	params := newParams(p)
+
+	results := []*types.MetricData{
+		types.MakeMetricData("a", []float64{1, 2, 3}, 60, 0),
+		types.MakeMetricData("b", []float64{3, 2, 1}, 60, 0),
+	}
+	drawGraph(&cairoSurfaceContext{context: &fakeContext{}}, &params, results)
+
+	cr := &fakeContext{}
+	drawLines(&cairoSurfaceContext{context: cr}, &params, results)
+
+	if len(cr.operators) == 0 || cr.operators[0] != cairo.OperatorOver {
+		t.Errorf("got operators %v, want OVER set before drawing", cr.operators)
+	}
+
+	// the translucent areas are blended with each other before the opaque
+	// lines go over them
+	lastFill, firstStroke, fills := -1, len(cr.ops), 0
+	for i, op := range cr.ops {
+		if strings.HasPrefix(op, "fill") {
+			lastFill = i
+			fills++
+			if op != "fill 0.5" {
+				t.Errorf("got %q, want the areas filled with areaAlpha", op)
+			}
+		} else if i < firstStroke {
+			firstStroke = i
+		}
+	}
+	if fills != 2 || lastFill > firstStroke {
+		t.Errorf("got %v, want both fills before the strokes", cr.ops)
+	}
+}
+
+func TestGridInFront(t *testing.T) {
+	for _, gridInFront := range []bool{false, true} {
+		p := DefaultParams
+		p.AreaMode = AreaModeStacked
+		p.AreaAlpha = 1
+		p.GridInFront = gridInFront
+		params := newParams(p)
+
+		results := []*types.MetricData{
+			types.MakeMetricData("a", []float64{1, 2, 3}, 60, 0),
+			types.MakeMetricData("b", []float64{3, 2, 1}, 60, 0),
+		}
+		drawGraph(&cairoSurfaceContext{context: &fakeContext{}}, &params, results)
+
+		cr := &fakeContext{}
+		drawLines(&cairoSurfaceContext{context: cr}, &params, results)
+
+		// grid lines are thinner than the series lines
+		var grid, lines int
+		for _, width := range cr.strokes {
+			if width < params.lineWidth {
+				if lines > 0 {
+					t.Fatalf("gridInFront=%v: got a grid line over the series lines: %v", gridInFront, cr.strokes)
+				}
+				grid++
+			} else {
+				lines++
+			}
+		}
+		if gridInFront != (grid > 0) {
+			t.Errorf("gridInFront=%v: got %d grid lines drawn with the series", gridInFront, grid)
+		}
+		if lines != 2 {
+			t.Errorf("gridInFront=%v: got %d series lines, want 2", gridInFront, lines)
+		}
+		if ops := strings.Join(cr.ops, ","); !strings.HasPrefix(ops, "fill 1,fill 1,stroke") {
+			t.Errorf("gridInFront=%v: got %v, want the areas filled before the grid and the lines", gridInFront, ops)
+		}
+	}
+}
+
+func TestShowRaw(t *testing.T) {
+	values := make([]float64, 200)
+	for i := range values {
+		values[i] = float64(i % 7)
+	}
+
+	for _, showRaw := range []bool{false, true} {
+		p := DefaultParams
+		p.Width = 100
+		p.ShowRaw = showRaw
+		params := newParams(p)
+
+		results := []*types.MetricData{types.MakeMetricData("a", values, 60, 0)}
+		cr := &fakeContext{}
+		drawGraph(&cairoSurfaceContext{context: cr}, &params, results)
+
+		if results[0].ValuesPerPoint <= 1 {
+			t.Fatalf("got %d values per point, want the series consolidated", results[0].ValuesPerPoint)
+		}
+		raw := -1
+		for i, op := range cr.ops {
+			if op == "stroke 0.25" {
+				raw = i
+				break
+			}
+		}
+		if !showRaw {
+			if raw >= 0 {
+				t.Errorf("showRaw=false: got ops %v, want no raw line", cr.ops)
+			}
+			continue
+		}
+		// the faint raw line goes under the opaque consolidated one
+		if raw < 0 || raw+1 >= len(cr.ops) || !strings.HasPrefix(cr.ops[raw+1], "stroke") {
+			t.Errorf("showRaw=true: got ops %v, want the raw line stroked before the series", cr.ops)
+		}
+	}
+}
+
+func TestDrawStackTotal(t *testing.T) {
+	for _, areaMode := range []AreaMode{AreaModeNone, AreaModeStacked} {
+		p := DefaultParams
+		p.AreaMode = areaMode
+		p.DrawStackTotal = true
+		p.StackTotalColor = "red"
+		params := newParams(p)
+
+		results := []*types.MetricData{
+			types.MakeMetricData("a", []float64{1, math.NaN(), 3}, 60, 0),
+			types.MakeMetricData("b", []float64{2, math.NaN(), math.NaN()}, 60, 0),
+		}
+		cr := &fakeContext{}
+		drawGraph(&cairoSurfaceContext{context: cr}, &params, results)
+
+		if areaMode != AreaModeStacked {
+			if params.stackTotal != nil {
+				t.Errorf("areaMode=%v: got a total line, want none", areaMode)
+			}
+			continue
+		}
+		if params.stackTotal == nil {
+			t.Fatalf("areaMode=stacked: got no total line")
+		}
+		if got, want := params.stackTotal.Values, []float64{3, math.NaN(), 3}; len(got) != len(want) || got[0] != want[0] || !math.IsNaN(got[1]) || got[2] != want[2] {
+			t.Errorf("got total %v, want %v", got, want)
+		}
+		if params.stackTotal.Color != "red" || params.stackTotal.Stacked {
+			t.Errorf("got total colored %q, stacked %v, want an unstacked red line", params.stackTotal.Color, params.stackTotal.Stacked)
+		}
+
+		// the bold total is stroked after every area is filled
+		lastFill, totalStroke := -1, -1
+		strokes := 0
+		for i, op := range cr.ops {
+			if strings.HasPrefix(op, "fill") {
+				lastFill = i
+			} else if strings.HasPrefix(op, "stroke") {
+				if cr.strokes[strokes] == 2*params.lineWidth {
+					totalStroke = i
+				}
+				strokes++
+			}
+		}
+		if totalStroke < 0 || totalStroke < lastFill {
+			t.Errorf("got ops %v, want the total stroked over the areas", cr.ops)
+		}
+	}
+}
+
+func TestOverlappingAreasBlend(t *testing.T) {
+	p := DefaultParams
+	p.HideAxes = true
+	p.HideLegend = true
+	p.BgColor = "white"
+	p.ColorList = []string{"blue"}
+	p.PositiveColor = "blue"
+	p.AreaAlpha = 0.5
+	p.YMin = 0
+	p.YMax = 20
+	results := []*types.MetricData{
+		types.MakeMetricData("low", []float64{10, 10, 10}, 60, 0),
+		types.MakeMetricData("high", []float64{20, 20, 20}, 60, 0),
+	}
+
+	img, err := stdpng.Decode(bytes.NewReader(MarshalPNG(p, results)))
+	if err != nil {
+		t.Fatalf("failed to decode png: %v", err)
+	}
+
+	near := func(got, want uint8) bool { return math.Abs(float64(got)-float64(want)) <= 3 }
+	check := func(x, y int, want color.NRGBA) {
+		got := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+		if !near(got.R, want.R) || !near(got.G, want.G) || !near(got.B, want.B) {
+			t.Errorf("pixel at %d,%d: got %v, want %v", x, y, got, want)
+		}
+	}
+
+	// one 50% blue area over white
+	check(165, 60, color.NRGBA{R: 128, G: 128, B: 255, A: 255})
+	// both areas: the second one is blended over the first, not replacing it
+	check(165, 200, color.NRGBA{R: 64, G: 64, B: 255, A: 255})
+}
+
+func TestXFormat(t *testing.T) {
+	for _, step := range []int64{60, 3600} {
+		p := DefaultParams
+		p.XFormat = "%d.%m %H:%M"
+		p.Tz = time.UTC
+		params := newParams(p)
+
+		// an hour and a week of data pick different formats on their own
+		results := []*types.MetricData{types.MakeMetricData("a", make([]float64, 168), step, 0)}
+		cr := &fakeContext{}
+		drawGraph(&cairoSurfaceContext{context: cr}, &params, results)
+
+		var want []string
+		for _, dt := range getXLabelTimes(&params) {
+			want = append(want, time.Unix(dt, 0).UTC().Format("02.01 15:04"))
+		}
+		var got []string
+		for _, text := range cr.texts {
+			if strings.Contains(text, ".") && strings.Contains(text, ":") {
+				got = append(got, text)
+			}
+		}
+		if len(want) == 0 || !reflect.DeepEqual(got, want) {
+			t.Errorf("step %d: got x labels %q, want %q", step, got, want)
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package png
 
 import (
+	"errors"
 	"image/color"
+	"math"
 	"strconv"
 	"strings"
 )
@@ -60,6 +62,13 @@ func string2RGBA(clr string) color.RGBA {
 	if c, ok := colors[clr]; ok {
 		return c
 	}
+	if strings.HasPrefix(clr, "rgb") {
+		c, err := rgbaToRGBA(clr)
+		if err != nil {
+			return color.RGBA{0, 0, 0, 255}
+		}
+		return *c
+	}
 	c, err := hexToRGBA(clr)
 	if err != nil {
 		return color.RGBA{0, 0, 0, 255}
@@ -105,6 +114,51 @@ func hexToRGBA(h string) (*color.RGBA, error) {
 	return &color.RGBA{r, g, b, alpha}, nil
 }
 
+// rgbaToRGBA converts "rgba(r,g,b,a)" or "rgb(r,g,b)" string to a color,
+// components are in [0, 255] and alpha is in [0, 1].
+func rgbaToRGBA(s string) (*color.RGBA, error) {
+	var args string
+	var n int
+	switch {
+	case strings.HasPrefix(s, "rgba(") && strings.HasSuffix(s, ")"):
+		args, n = s[len("rgba("):len(s)-1], 4
+	case strings.HasPrefix(s, "rgb(") && strings.HasSuffix(s, ")"):
+		args, n = s[len("rgb("):len(s)-1], 3
+	default:
+		return nil, errInvalidColor
+	}
+
+	parts := strings.Split(args, ",")
+	if len(parts) != n {
+		return nil, errInvalidColor
+	}
+
+	var rgb [3]uint8
+	for i := range rgb {
+		v, err := strconv.ParseUint(strings.TrimSpace(parts[i]), 10, 8)
+		if err != nil {
+			return nil, err
+		}
+		rgb[i] = uint8(v)
+	}
+
+	alpha := byte(255)
+	if n == 4 {
+		a, err := strconv.ParseFloat(strings.TrimSpace(parts[3]), 64)
+		if err != nil {
+			return nil, err
+		}
+		if a < 0 || a > 1 {
+			return nil, errInvalidColor
+		}
+		alpha = uint8(math.Round(a * 255))
+	}
+
+	return &color.RGBA{rgb[0], rgb[1], rgb[2], alpha}, nil
+}
+
+var errInvalidColor = errors.New("invalid color")
+
 var colors = map[string]color.RGBA{
 	// Graphite default colors
 	"black": {0x00, 0x00, 0x00, 0xff},
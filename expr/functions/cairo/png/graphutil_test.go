@@ -0,0 +1,31 @@
+package png
+
+import (
+	"image/color"
+	"testing"
+)
+
+func TestString2RGBA(t *testing.T) {
+
+	tests := []struct {
+		s    string
+		want color.RGBA
+	}{
+		{"white", color.RGBA{0xff, 0xff, 0xff, 0xff}},
+		{"ff0000", color.RGBA{0xff, 0x00, 0x00, 0xff}},
+		{"#ff000080", color.RGBA{0xff, 0x00, 0x00, 0x80}},
+		{"rgb(10, 20, 30)", color.RGBA{10, 20, 30, 0xff}},
+		{"rgba(255,0,0,0.5)", color.RGBA{0xff, 0x00, 0x00, 0x80}},
+		{"rgba(255,0,0,0)", color.RGBA{0xff, 0x00, 0x00, 0x00}},
+		{"rgba(255,0,0,2)", color.RGBA{0x00, 0x00, 0x00, 0xff}},
+		{"rgba(256,0,0,1)", color.RGBA{0x00, 0x00, 0x00, 0xff}},
+		{"rgb(1,2)", color.RGBA{0x00, 0x00, 0x00, 0xff}},
+	}
+
+	for _, tt := range tests {
+		got := string2RGBA(tt.s)
+		if got != tt.want {
+			t.Errorf("string2RGBA(%q): got %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
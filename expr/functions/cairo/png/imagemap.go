@@ -0,0 +1,61 @@
+package png
+
+import (
+	"encoding/base64"
+	"html"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// imageMapRadius is the half size, in image pixels, of the area around a
+// point that shows its tooltip
+const imageMapRadius = 3
+
+const imageMapTimeFormat = "2006-01-02 15:04:05"
+
+// PlotPoint is a drawn point of a series with its position in image pixels
+type PlotPoint struct {
+	Name      string
+	Value     float64
+	Timestamp int64
+	X         float64
+	Y         float64
+}
+
+// DataURI returns the png as a data uri, for embedding it into html or json
+func DataURI(png []byte) []byte {
+	const prefix = "data:image/png;base64,"
+	b := make([]byte, len(prefix)+base64.StdEncoding.EncodedLen(len(png)))
+	copy(b, prefix)
+	base64.StdEncoding.Encode(b[len(prefix):], png)
+	return b
+}
+
+// FormatImageMap returns an html fragment with the png embedded as a data uri
+// and an image map with a rectangle per point, titled with its value and
+// timestamp in tz
+func FormatImageMap(png []byte, points []PlotPoint, tz *time.Location) []byte {
+	var b strings.Builder
+	b.WriteString(`<img src="`)
+	b.Write(DataURI(png))
+	b.WriteString(`" usemap="#graph">` + "\n")
+	b.WriteString(`<map name="graph">` + "\n")
+	for _, p := range points {
+		x, y := int(p.X+0.5), int(p.Y+0.5)
+		b.WriteString(`<area shape="rect" coords="`)
+		b.WriteString(strconv.Itoa(x - imageMapRadius))
+		b.WriteByte(',')
+		b.WriteString(strconv.Itoa(y - imageMapRadius))
+		b.WriteByte(',')
+		b.WriteString(strconv.Itoa(x + imageMapRadius))
+		b.WriteByte(',')
+		b.WriteString(strconv.Itoa(y + imageMapRadius))
+		b.WriteString(`" title="`)
+		title := p.Name + ": " + strconv.FormatFloat(p.Value, 'g', -1, 64) + " at " + time.Unix(p.Timestamp, 0).In(tz).Format(imageMapTimeFormat)
+		b.WriteString(html.EscapeString(title))
+		b.WriteString(`">` + "\n")
+	}
+	b.WriteString("</map>\n")
+	return []byte(b.String())
+}
@@ -0,0 +1,33 @@
+package png
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDataURI(t *testing.T) {
+	if got, want := string(DataURI([]byte("png"))), "data:image/png;base64,cG5n"; got != want {
+		t.Errorf("DataURI() = %q, want %q", got, want)
+	}
+}
+
+func TestFormatImageMap(t *testing.T) {
+	points := []PlotPoint{
+		{Name: "a.b", Value: 1.5, Timestamp: 0, X: 10.4, Y: 20.6},
+		{Name: "<c>", Value: 2, Timestamp: 60, X: 30, Y: 40},
+	}
+	got := string(FormatImageMap([]byte("png"), points, time.UTC))
+
+	want := []string{
+		`<img src="data:image/png;base64,cG5n" usemap="#graph">`,
+		`<area shape="rect" coords="7,18,13,24" title="a.b: 1.5 at 1970-01-01 00:00:00">`,
+		`<area shape="rect" coords="27,37,33,43" title="&lt;c&gt;: 2 at 1970-01-01 00:01:00">`,
+		`</map>`,
+	}
+	for _, w := range want {
+		if !strings.Contains(got, w) {
+			t.Errorf("FormatImageMap() = %q, want it to contain %q", got, w)
+		}
+	}
+}
@@ -0,0 +1,1195 @@
+package png
+
+import (
+	"fmt"
+	"math"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+type TimeUnit int32
+
+const (
+	Second TimeUnit = 1
+	Minute          = 60
+	Hour            = 60 * Minute
+	Day             = 24 * Hour
+)
+
+type unitPrefix struct {
+	prefix string
+	size   uint64
+}
+
+const (
+	unitSystemBinary  = "binary"
+	unitSystemSI      = "si"
+	unitSystemPercent = "percent"
+)
+
+var unitSystems = map[string][]unitPrefix{
+	unitSystemBinary: {
+		{"Pi", 1125899906842624}, // 1024^5
+		{"Ti", 1099511627776},    // 1024^4
+		{"Gi", 1073741824},       // 1024^3
+		{"Mi", 1048576},          // 1024^2
+		{"Ki", 1024},
+	},
+	unitSystemSI: {
+		{"P", 1000000000000000}, // 1000^5
+		{"T", 1000000000000},    // 1000^4
+		{"G", 1000000000},       // 1000^3
+		{"M", 1000000},          // 1000^2
+		{"K", 1000},
+	},
+}
+
+type xAxisStruct struct {
+	seconds       float64
+	minorGridUnit TimeUnit
+	minorGridStep float64
+	majorGridUnit TimeUnit
+	majorGridStep int64
+	labelUnit     TimeUnit
+	labelStep     int64
+	format        string
+	maxInterval   int64
+}
+
+var xAxisConfigs = []xAxisStruct{
+	{
+		// windows of seconds get a label for every second, timestamps have
+		// no finer resolution
+		seconds:       0.00,
+		minorGridUnit: Second,
+		minorGridStep: 1,
+		majorGridUnit: Second,
+		majorGridStep: 5,
+		labelUnit:     Second,
+		labelStep:     1,
+		format:        "%H:%M:%S",
+		maxInterval:   Minute,
+	},
+	{
+		seconds:       0.01,
+		minorGridUnit: Second,
+		minorGridStep: 5,
+		majorGridUnit: Minute,
+		majorGridStep: 1,
+		labelUnit:     Second,
+		labelStep:     5,
+		format:        "%H:%M:%S",
+		maxInterval:   10 * Minute,
+	},
+	{
+		seconds:       0.07,
+		minorGridUnit: Second,
+		minorGridStep: 10,
+		majorGridUnit: Minute,
+		majorGridStep: 1,
+		labelUnit:     Second,
+		labelStep:     10,
+		format:        "%H:%M:%S",
+		maxInterval:   20 * Minute,
+	},
+	{
+		seconds:       0.14,
+		minorGridUnit: Second,
+		minorGridStep: 15,
+		majorGridUnit: Minute,
+		majorGridStep: 1,
+		labelUnit:     Second,
+		labelStep:     15,
+		format:        "%H:%M:%S",
+		maxInterval:   30 * Minute,
+	},
+	{
+		seconds:       0.27,
+		minorGridUnit: Second,
+		minorGridStep: 30,
+		majorGridUnit: Minute,
+		majorGridStep: 2,
+		labelUnit:     Minute,
+		labelStep:     1,
+		format:        "%H:%M",
+		maxInterval:   2 * Hour,
+	},
+	{
+		seconds:       0.5,
+		minorGridUnit: Minute,
+		minorGridStep: 1,
+		majorGridUnit: Minute,
+		majorGridStep: 2,
+		labelUnit:     Minute,
+		labelStep:     1,
+		format:        "%H:%M",
+		maxInterval:   2 * Hour,
+	},
+	{
+		seconds:       1.2,
+		minorGridUnit: Minute,
+		minorGridStep: 1,
+		majorGridUnit: Minute,
+		majorGridStep: 4,
+		labelUnit:     Minute,
+		labelStep:     2,
+		format:        "%H:%M",
+		maxInterval:   3 * Hour,
+	},
+	{
+		seconds:       2,
+		minorGridUnit: Minute,
+		minorGridStep: 1,
+		majorGridUnit: Minute,
+		majorGridStep: 10,
+		labelUnit:     Minute,
+		labelStep:     5,
+		format:        "%H:%M",
+		maxInterval:   6 * Hour,
+	},
+	{
+		seconds:       5,
+		minorGridUnit: Minute,
+		minorGridStep: 2,
+		majorGridUnit: Minute,
+		majorGridStep: 10,
+		labelUnit:     Minute,
+		labelStep:     10,
+		format:        "%H:%M",
+		maxInterval:   12 * Hour,
+	},
+	{
+		seconds:       10,
+		minorGridUnit: Minute,
+		minorGridStep: 5,
+		majorGridUnit: Minute,
+		majorGridStep: 20,
+		labelUnit:     Minute,
+		labelStep:     20,
+		format:        "%H:%M",
+		maxInterval:   Day,
+	},
+	{
+		seconds:       30,
+		minorGridUnit: Minute,
+		minorGridStep: 10,
+		majorGridUnit: Hour,
+		majorGridStep: 1,
+		labelUnit:     Hour,
+		labelStep:     1,
+		format:        "%H:%M",
+		maxInterval:   2 * Day,
+	},
+	{
+		seconds:       60,
+		minorGridUnit: Minute,
+		minorGridStep: 30,
+		majorGridUnit: Hour,
+		majorGridStep: 2,
+		labelUnit:     Hour,
+		labelStep:     2,
+		format:        "%H:%M",
+		maxInterval:   2 * Day,
+	},
+	{
+		seconds:       100,
+		minorGridUnit: Hour,
+		minorGridStep: 2,
+		majorGridUnit: Hour,
+		majorGridStep: 4,
+		labelUnit:     Hour,
+		labelStep:     4,
+		format:        "%a %H:%M",
+		maxInterval:   6 * Day,
+	},
+	{
+		seconds:       255,
+		minorGridUnit: Hour,
+		minorGridStep: 6,
+		majorGridUnit: Hour,
+		majorGridStep: 12,
+		labelUnit:     Hour,
+		labelStep:     12,
+		format:        "%a %H:%M",
+		maxInterval:   10 * Day,
+	},
+	{
+		seconds:       600,
+		minorGridUnit: Hour,
+		minorGridStep: 6,
+		majorGridUnit: Day,
+		majorGridStep: 1,
+		labelUnit:     Day,
+		labelStep:     1,
+		format:        "%m/%d",
+		maxInterval:   14 * Day,
+	},
+	{
+		seconds:       1000,
+		minorGridUnit: Hour,
+		minorGridStep: 12,
+		majorGridUnit: Day,
+		majorGridStep: 1,
+		labelUnit:     Day,
+		labelStep:     1,
+		format:        "%m/%d",
+		maxInterval:   365 * Day,
+	},
+	{
+		seconds:       2000,
+		minorGridUnit: Day,
+		minorGridStep: 1,
+		majorGridUnit: Day,
+		majorGridStep: 2,
+		labelUnit:     Day,
+		labelStep:     2,
+		format:        "%m/%d",
+		maxInterval:   365 * Day,
+	},
+	{
+		seconds:       4000,
+		minorGridUnit: Day,
+		minorGridStep: 2,
+		majorGridUnit: Day,
+		majorGridStep: 4,
+		labelUnit:     Day,
+		labelStep:     4,
+		format:        "%m/%d",
+		maxInterval:   365 * Day,
+	},
+	{
+		seconds:       8000,
+		minorGridUnit: Day,
+		minorGridStep: 3.5,
+		majorGridUnit: Day,
+		majorGridStep: 7,
+		labelUnit:     Day,
+		labelStep:     7,
+		format:        "%m/%d",
+		maxInterval:   365 * Day,
+	},
+	{
+		seconds:       16000,
+		minorGridUnit: Day,
+		minorGridStep: 7,
+		majorGridUnit: Day,
+		majorGridStep: 14,
+		labelUnit:     Day,
+		labelStep:     14,
+		format:        "%m/%d",
+		maxInterval:   365 * Day,
+	},
+	{
+		seconds:       32000,
+		minorGridUnit: Day,
+		minorGridStep: 15,
+		majorGridUnit: Day,
+		majorGridStep: 30,
+		labelUnit:     Day,
+		labelStep:     30,
+		format:        "%m/%d",
+		maxInterval:   365 * Day,
+	},
+	{
+		seconds:       64000,
+		minorGridUnit: Day,
+		minorGridStep: 30,
+		majorGridUnit: Day,
+		majorGridStep: 60,
+		labelUnit:     Day,
+		labelStep:     60,
+		format:        "%m/%d %Y",
+		maxInterval:   365 * Day,
+	},
+	{
+		seconds:       100000,
+		minorGridUnit: Day,
+		minorGridStep: 60,
+		majorGridUnit: Day,
+		majorGridStep: 120,
+		labelUnit:     Day,
+		labelStep:     120,
+		format:        "%m/%d %Y",
+		maxInterval:   365 * Day,
+	},
+	{
+		seconds:       120000,
+		minorGridUnit: Day,
+		minorGridStep: 120,
+		majorGridUnit: Day,
+		majorGridStep: 240,
+		labelUnit:     Day,
+		labelStep:     240,
+		format:        "%m/%d %Y",
+		maxInterval:   365 * Day,
+	},
+}
+
+// We accept values fractionally outside of nominal limits, so that
+// rounding errors don't cause weird effects. Since our goal is to
+// create plots, and the maximum resolution of the plots is likely to
+// be less than 10000 pixels, errors smaller than this size shouldn't
+// create any visible effects.
+const floatEpsilon = 0.00000000001
+
+// getYStep returns the distance between Y axis labels for [minValue,
+// maxValue]: the pretty value closest to the range divided by one of divisors,
+// scaled to the order of the range
+func getYStep(minValue, maxValue float64, unitSystem string, divisors []float64) float64 {
+	yVariance := maxValue - minValue
+
+	var order float64
+	var orderFactor float64
+	if unitSystem == unitSystemBinary {
+		order = math.Log2(yVariance)
+		orderFactor = math.Pow(2, math.Floor(order))
+	} else {
+		order = math.Log10(yVariance)
+		orderFactor = math.Pow(10, math.Floor(order))
+	}
+
+	v := yVariance / orderFactor // we work with a scaled down yVariance for simplicity
+
+	prettyValues := []float64{0.1, 0.2, 0.25, 0.5, 1.0, 1.2, 1.25, 1.5, 2.0, 2.25, 2.5}
+
+	var divinfo divisorInfo
+
+	for _, d := range divisors {
+		q := v / d                                                           // our scaled down quotient, must be in the open interval (0,10)
+		p := closest(q, prettyValues)                                        // the prettyValue our quotient is closest to
+		divinfo = append(divinfo, yaxisDivisor{p: p, diff: math.Abs(q - p)}) // make a  list so we can find the prettiest of the pretty
+	}
+
+	sort.Sort(divinfo) // sort our pretty values by 'closeness to a factor"
+
+	prettyValue := divinfo[0].p      // our winner! Y-axis will have labels placed at multiples of our prettyValue
+	return prettyValue * orderFactor // scale it back up to the order of yVariance
+}
+
+// getYDivisions returns an axis range of exactly n steps that covers
+// [minValue, maxValue]. The step is a pretty value unless both ends are fixed.
+func getYDivisions(minValue, maxValue float64, n int, fixedMin, fixedMax bool) (bottom, top, step float64) {
+	divisions := float64(n)
+	if fixedMin && fixedMax {
+		return minValue, maxValue, (maxValue - minValue) / divisions
+	}
+
+	step = getPrettyStep((maxValue - minValue) / divisions)
+	for {
+		switch {
+		case fixedMin:
+			bottom = minValue
+		case fixedMax:
+			bottom = maxValue - step*divisions
+		default:
+			bottom = step * math.Floor(minValue/step)
+		}
+		top = bottom + step*divisions
+		if top >= maxValue-floatEpsilon {
+			return bottom, top, step
+		}
+		// the floored bottom may leave the top short of the data, try the
+		// next pretty step
+		step = getPrettyStep(step * 1.01)
+	}
+}
+
+// getPrettyStep returns the smallest 1, 2, 2.5 or 5 times a power of ten that
+// is at least step
+func getPrettyStep(step float64) float64 {
+	order := math.Pow(10, math.Floor(math.Log10(step)))
+	for _, m := range []float64{1, 2, 2.5, 5} {
+		if m*order >= step*(1-floatEpsilon) {
+			return m * order
+		}
+	}
+	return 10 * order
+}
+
+// distinctYStep returns step, or the smallest pretty step above it, for which
+// no two neighbouring labels of the axis over [minValue, maxValue] are the same
+// once formatted by label. Rounded labels of a near-flat series repeat when the
+// step is finer than the label precision.
+func distinctYStep(minValue, maxValue, step float64, label func(value, step, span float64) string) float64 {
+	const maxTries = 10
+
+	for i := 0; i < maxTries; i++ {
+		bottom := step * math.Floor(minValue/step+floatEpsilon)
+		top := step * math.Ceil(maxValue/step-floatEpsilon)
+		repeated := false
+		prev := ""
+		for j, v := range frange(bottom, top, step) {
+			l := label(v, step, top-bottom)
+			if j > 0 && l == prev {
+				repeated = true
+				break
+			}
+			prev = l
+		}
+		if !repeated {
+			return step
+		}
+		step = getPrettyStep(step * 1.01)
+	}
+	return step
+}
+
+type yaxisDivisor struct {
+	p    float64
+	diff float64
+}
+
+type divisorInfo []yaxisDivisor
+
+func (d divisorInfo) Len() int               { return len(d) }
+func (d divisorInfo) Less(i int, j int) bool { return d[i].diff < d[j].diff }
+func (d divisorInfo) Swap(i int, j int)      { d[i], d[j] = d[j], d[i] }
+
+// numberFormat holds the separators numbers in labels are written with
+type numberFormat struct {
+	decimal string
+	group   string
+}
+
+// getNumberFormat reads the separators from an example of one thousand two
+// hundred thirty four and a half, like "1.234,5" or "1 234,5". Anything else
+// keeps the default "1234.5".
+func getNumberFormat(s string) numberFormat {
+	def := numberFormat{decimal: "."}
+	r := []rune(s)
+	if len(r) < 6 || r[0] != '1' || r[len(r)-1] != '5' || string(r[len(r)-5:len(r)-2]) != "234" {
+		return def
+	}
+	var f numberFormat
+	switch len(r) {
+	case 6:
+	case 7:
+		f.group = string(r[1])
+	default:
+		return def
+	}
+	f.decimal = string(r[len(r)-2])
+	if unicode.IsDigit(r[len(r)-2]) || f.decimal == f.group {
+		return def
+	}
+	return f
+}
+
+var labelNumberRe = regexp.MustCompile(`\d+(\.\d+)?`)
+
+// apply rewrites the numbers of label with the separators of the format
+func (f numberFormat) apply(label string) string {
+	if f.decimal == "." && f.group == "" {
+		return label
+	}
+	return labelNumberRe.ReplaceAllStringFunc(label, func(n string) string {
+		integer, fraction := n, ""
+		if i := strings.IndexByte(n, '.'); i >= 0 {
+			integer, fraction = n[:i], f.decimal+n[i+1:]
+		}
+		if f.group != "" && len(integer) >= 4 {
+			var b strings.Builder
+			for i, c := range integer {
+				if i > 0 && (len(integer)-i)%3 == 0 {
+					b.WriteString(f.group)
+				}
+				b.WriteRune(c)
+			}
+			integer = b.String()
+		}
+		return integer + fraction
+	})
+}
+
+// makeLabel formats a value for the Y axis. A negative precision picks the
+// number of decimals automatically, otherwise exactly that many are used.
+func makeLabel(yValue, yStep, ySpan float64, yUnitSystem string, precision int) string {
+	if yUnitSystem == unitSystemPercent {
+		return makePercentLabel(yValue, yStep, precision)
+	}
+
+	yValue, prefix := formatUnits(yValue, yStep, yUnitSystem)
+	ySpan, spanPrefix := formatUnits(ySpan, yStep, yUnitSystem)
+
+	if prefix != "" {
+		prefix += " "
+	}
+
+	if precision >= 0 {
+		return fmt.Sprintf("%.*f %s", precision, yValue, prefix)
+	}
+
+	switch {
+	case yValue < 0.1:
+		return fmt.Sprintf("%.9g %s", yValue, prefix)
+	case yValue < 1.0:
+		return fmt.Sprintf("%.2f %s", yValue, prefix)
+	case ySpan > 10 || spanPrefix != prefix:
+		if yValue-math.Floor(yValue) < floatEpsilon {
+			return fmt.Sprintf("%.1f %s", yValue, prefix)
+		}
+		return fmt.Sprintf("%d %s", int(yValue), prefix)
+	case ySpan > 3:
+		return fmt.Sprintf("%.1f %s", yValue, prefix)
+	case ySpan > 0.1:
+		return fmt.Sprintf("%.2f %s", yValue, prefix)
+	default:
+		return fmt.Sprintf("%g %s", yValue, prefix)
+	}
+}
+
+// makePercentLabel formats a ratio (1.0 == 100%) as a percentage. Only the
+// label is scaled, data values and yMin/yMax stay in the original units.
+func makePercentLabel(yValue, yStep float64, precision int) string {
+	yValue *= 100
+	yStep = math.Abs(yStep * 100)
+
+	if precision >= 0 {
+		return fmt.Sprintf("%.*f%%", precision, yValue)
+	}
+	if yStep == 0 || math.IsNaN(yStep) || math.IsInf(yStep, 0) {
+		// no neighbouring labels to tell apart, e.g. a single value
+		return fmt.Sprintf("%.*f%%", autoPrecision(yValue), yValue)
+	}
+
+	// use as few decimals as needed to tell neighbouring labels apart
+	decimals := 0
+	for ; decimals < 9; decimals++ {
+		scaled := yStep * math.Pow(10, float64(decimals))
+		if math.IsNaN(scaled) || math.Abs(scaled-math.Round(scaled)) < floatEpsilon*scaled {
+			break
+		}
+	}
+
+	return fmt.Sprintf("%.*f%%", decimals, yValue)
+}
+
+// padYRange extends the data range by the given fractions of its span, so the
+// extreme points are not drawn right on the frame. Padding never makes the
+// range cross zero, otherwise non-negative data would get a negative axis.
+func padYRange(minValue, maxValue, padBottom, padTop float64) (float64, float64) {
+	span := maxValue - minValue
+	if span <= 0 {
+		return minValue, maxValue
+	}
+
+	if padTop > 0 {
+		newMax := maxValue + span*padTop
+		if maxValue <= 0 && newMax > 0 {
+			newMax = 0
+		}
+		maxValue = newMax
+	}
+	if padBottom > 0 {
+		newMin := minValue - span*padBottom
+		if minValue >= 0 && newMin < 0 {
+			newMin = 0
+		}
+		minValue = newMin
+	}
+
+	return minValue, maxValue
+}
+
+// nextYStep returns the lowest multiple of yStep strictly above value, so the
+// autoscaled top of the graph always leaves some room above the data.
+func nextYStep(value, yStep float64) float64 {
+	return yStep * (math.Floor(value/yStep+floatEpsilon) + 1)
+}
+
+// formatUnits formats the given value according to the given unit prefix system
+func formatUnits(v, step float64, system string) (float64, string) {
+
+	var condition func(float64) bool
+
+	if step == math.NaN() {
+		condition = func(size float64) bool { return math.Abs(v) >= size }
+	} else {
+		condition = func(size float64) bool { return math.Abs(v) >= size && step >= size }
+	}
+
+	unitsystem := unitSystems[system]
+
+	for _, p := range unitsystem {
+		fsize := float64(p.size)
+		if condition(fsize) {
+			v2 := v / fsize
+			if (v2-math.Floor(v2)) < floatEpsilon && v > 1 {
+				v2 = math.Floor(v2)
+			}
+			return v2, p.prefix
+		}
+	}
+
+	if (v-math.Floor(v)) < floatEpsilon && v > 1 {
+		v = math.Floor(v)
+	}
+	return v, ""
+}
+
+// FormatUnits formats v with the largest prefix of the unit system ("si" or
+// "binary") that fits it, the way Y axis labels are scaled: 1234567 is 1.23M
+func FormatUnits(v float64, system string) string {
+	v, prefix := formatUnits(v, math.Abs(v), system)
+	return fmt.Sprintf("%.2f%s", v, prefix)
+}
+
+// autoPrecisionDigits is the number of significant digits FormatAutoPrecision
+// keeps, maxAutoPrecision caps the decimals of tiny values
+const (
+	autoPrecisionDigits = 3
+	maxAutoPrecision    = 10
+)
+
+// FormatAutoPrecision formats v like FormatUnits, but picks the number of
+// decimals from the magnitude of the value instead of always printing two:
+// 0.00213 stays 0.00213 and 4512.7 becomes 4513. An empty or unknown system
+// prints v without a prefix
+func FormatAutoPrecision(v float64, system string) string {
+	v, prefix := formatUnits(v, math.Abs(v), system)
+	return fmt.Sprintf("%.*f%s", autoPrecision(v), v, prefix)
+}
+
+// autoPrecision returns the number of decimals v needs to show
+// autoPrecisionDigits significant digits
+func autoPrecision(v float64) int {
+	if v == 0 || math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0
+	}
+	decimals := autoPrecisionDigits - 1 - int(math.Floor(math.Log10(math.Abs(v))))
+	if decimals < 0 {
+		return 0
+	}
+	if decimals > maxAutoPrecision {
+		return maxAutoPrecision
+	}
+	return decimals
+}
+
+// getYGridValues returns positions of major gridlines: the labels and
+// gridDensity-1 evenly spaced lines between every pair of them
+func getYGridValues(labels []float64, gridDensity int, logBase float64) []float64 {
+	if gridDensity <= 1 || len(labels) < 2 {
+		return labels
+	}
+
+	between := getYMinorValues(labels, gridDensity-1, logBase)
+	values := make([]float64, 0, len(labels)+len(between))
+	for i, label := range labels {
+		values = append(values, label)
+		if i < len(labels)-1 {
+			values = append(values, between[i*(gridDensity-1):(i+1)*(gridDensity-1)]...)
+		}
+	}
+	return values
+}
+
+// getYMinorValues returns the positions of minorY evenly spaced minor gridlines
+// between every pair of adjacent major labels. On a log scale they are evenly
+// spaced in the logarithms of the labels.
+func getYMinorValues(labels []float64, minorY int, logBase float64) []float64 {
+	if minorY < 1 || len(labels) < 2 {
+		return nil
+	}
+
+	values := make([]float64, 0, (len(labels)-1)*minorY)
+	for i := 0; i < len(labels)-1; i++ {
+		if logBase != 0 {
+			ratio := labels[i+1] / labels[i]
+			for minor := 1; minor <= minorY; minor++ {
+				values = append(values, labels[i]*math.Pow(ratio, float64(minor)/float64(1+minorY)))
+			}
+			continue
+		}
+		distance := (labels[i+1] - labels[i]) / float64(1+minorY)
+		for minor := 1; minor <= minorY; minor++ {
+			values = append(values, labels[i]+float64(minor)*distance)
+		}
+	}
+
+	return values
+}
+
+func getYLabelValues(logBase, minYValue, maxYValue, yStep float64) []float64 {
+	if logBase != 0 {
+		return logrange(logBase, minYValue, maxYValue)
+	}
+
+	return frange(minYValue, maxYValue, yStep)
+}
+
+// getYTickValues returns the explicit yTicks that fall into [yBottom, yTop], sorted
+func getYTickValues(ticks []float64, yBottom, yTop float64) []float64 {
+	var values []float64
+	for _, v := range ticks {
+		if v >= yBottom-floatEpsilon && v <= yTop+floatEpsilon {
+			values = append(values, v)
+		}
+	}
+	sort.Float64s(values)
+	return values
+}
+
+func logrange(base, scaleMin, scaleMax float64) []float64 {
+	current := scaleMin
+	if scaleMin > 0 {
+		current = math.Floor(math.Log(scaleMin) / math.Log(base))
+	}
+	factor := current
+	var vals []float64
+	for current < scaleMax {
+		current = math.Pow(base, factor)
+		vals = append(vals, current)
+		factor++
+	}
+	return vals
+}
+
+func frange(start, end, step float64) []float64 {
+	var vals []float64
+	f := start
+	for f <= (end + floatEpsilon) {
+		vals = append(vals, f)
+		f += step
+		// Protect against rounding errors on very small float ranges
+		if f == start {
+			vals = append(vals, end)
+			break
+		}
+	}
+	return vals
+}
+
+func closest(number float64, neighbours []float64) float64 {
+	distance := math.Inf(1)
+	var closestNeighbor float64
+	for _, n := range neighbours {
+		d := math.Abs(n - number)
+		if d < distance {
+			distance = d
+			closestNeighbor = n
+		}
+	}
+
+	return closestNeighbor
+}
+
+// getXAxisConfig returns the coarsest X axis config that still fits
+// secondsPerPixel and timeRange, the last one when none does
+func getXAxisConfig(secondsPerPixel float64, timeRange int64) xAxisStruct {
+	xConf := xAxisConfigs[len(xAxisConfigs)-1]
+	for _, c := range xAxisConfigs {
+		if c.seconds <= secondsPerPixel && c.maxInterval >= timeRange {
+			xConf = c
+		}
+	}
+	return xConf
+}
+
+// getXGridTimes returns times of gridDensity evenly spaced major gridlines per
+// label interval, including the labels themselves, within [start, end)
+func getXGridTimes(start, end, labelTime, labelDelta int64, gridDensity int) []float64 {
+	delta := float64(labelDelta) / float64(gridDensity)
+	if delta <= 0 {
+		return nil
+	}
+
+	first := float64(labelTime) - math.Floor(float64(labelTime-start)/delta)*delta
+	var times []float64
+	for i := 0; ; i++ {
+		t := first + float64(i)*delta
+		if t >= float64(end) {
+			break
+		}
+		times = append(times, t)
+	}
+	return times
+}
+
+func findXTimes(start int64, unit TimeUnit, step float64) (int64, int64) {
+
+	t := time.Unix(int64(start), 0)
+
+	var d time.Duration
+
+	switch unit {
+	case Second:
+		d = time.Second
+	case Minute:
+		d = time.Minute
+	case Hour:
+		d = time.Hour
+	case Day:
+		d = 24 * time.Hour
+	default:
+		panic("invalid unit")
+	}
+
+	d *= time.Duration(step)
+	t = t.Truncate(d)
+
+	for t.Unix() < int64(start) {
+		t = t.Add(d)
+	}
+
+	return t.Unix(), int64(d / time.Second)
+}
+
+// getCalendarTimes returns local midnights in tz within [start, end) every
+// step days. Steps of 30 days and more go by months instead and return the
+// first days of every step/30 months counted from January.
+func getCalendarTimes(start, end, step int64, tz *time.Location) []int64 {
+	if step <= 0 {
+		return nil
+	}
+
+	t := time.Unix(start, 0).In(tz)
+	months, days := int(step/30), 0
+	if months > 0 {
+		t = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, tz)
+		for t.Unix() < start || int(t.Month()-1)%months != 0 {
+			t = t.AddDate(0, 1, 0)
+		}
+	} else {
+		days = int(step)
+		t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, tz)
+		if t.Unix() < start {
+			t = t.AddDate(0, 0, 1)
+		}
+	}
+
+	var times []int64
+	for ; t.Unix() < end; t = t.AddDate(0, months, days) {
+		times = append(times, t.Unix())
+	}
+	return times
+}
+
+// nudgeLabels returns the vertical centers of labels of the given height moved
+// apart so that they don't overlap. Labels keep their order from top to
+// bottom, the topmost one stays in place.
+func nudgeLabels(ys []float64, height float64) []float64 {
+	order := make([]int, len(ys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return ys[order[i]] < ys[order[j]] })
+
+	nudged := make([]float64, len(ys))
+	copy(nudged, ys)
+	for k := 1; k < len(order); k++ {
+		i, prev := order[k], order[k-1]
+		if nudged[i]-nudged[prev] < height {
+			nudged[i] = nudged[prev] + height
+		}
+	}
+	return nudged
+}
+
+// zeroCrossing returns the x at which the line from (x0, v0) to (x1, v1)
+// crosses zero, v0 and v1 must have different signs
+func zeroCrossing(x0, v0, x1, v1 float64) float64 {
+	return x0 + (x1-x0)*v0/(v0-v1)
+}
+
+// legendColumns returns how many legend entries of labelWidth fit in width,
+// when they are split between sides of the legend each side gets its share
+func legendColumns(width, labelWidth float64, sides int) float64 {
+	return math.Max(1, math.Floor(math.Floor(width/labelWidth)/float64(sides)))
+}
+
+// isFlat tells whether the values are a constant line: at least two present
+// values, all of them equal
+func isFlat(values []float64) bool {
+	n := 0
+	var first float64
+	for _, v := range values {
+		if math.IsNaN(v) {
+			continue
+		}
+		if n > 0 && v != first {
+			return false
+		}
+		first = v
+		n++
+	}
+	return n >= 2
+}
+
+// cumulativeSum returns the running total of the values. Absent values keep
+// the total so far, the ones before the first present value stay absent.
+func cumulativeSum(values []float64) []float64 {
+	sums := make([]float64, len(values))
+	sum := math.NaN()
+	for i, v := range values {
+		if !math.IsNaN(v) {
+			if math.IsNaN(sum) {
+				sum = 0
+			}
+			sum += v
+		}
+		sums[i] = sum
+	}
+	return sums
+}
+
+// movingAverage returns the trailing average of the last window values at
+// every point. Absent values are left out of the window, a point is absent if
+// the whole window is.
+func movingAverage(values []float64, window int) []float64 {
+	avg := make([]float64, len(values))
+	var sum float64
+	var n int
+	for i, v := range values {
+		if !math.IsNaN(v) {
+			sum += v
+			n++
+		}
+		if i >= window {
+			if old := values[i-window]; !math.IsNaN(old) {
+				sum -= old
+				n--
+			}
+		}
+		if n == 0 {
+			avg[i] = math.NaN()
+			continue
+		}
+		avg[i] = sum / float64(n)
+	}
+	return avg
+}
+
+// getRotation returns the size of a width x height image rotated clockwise by
+// angle degrees and the translation that brings the rotated image back into view
+func getRotation(angle int, width, height float64) (newWidth, newHeight, tx, ty float64) {
+	switch angle {
+	case 90:
+		return height, width, height, 0
+	case 180:
+		return width, height, width, height
+	case 270:
+		return height, width, 0, width
+	}
+	return width, height, 0, 0
+}
+
+// truncateName shortens name to at most max characters, replacing the cut
+// part with an ellipsis at the end or, with middle, between the head and the
+// tail of the name. A max below 1 keeps the name as is.
+func truncateName(name string, max int, middle bool) string {
+	runes := []rune(name)
+	if max < 1 || len(runes) <= max {
+		return name
+	}
+	keep := max - 1
+	if !middle {
+		return string(runes[:keep]) + "…"
+	}
+	head := (keep + 1) / 2
+	tail := keep - head
+	return string(runes[:head]) + "…" + string(runes[len(runes)-tail:])
+}
+
+// decimateMinMax keeps the minimum or the maximum of every bucket of size
+// values, whichever is farther from the value kept before, so spikes in either
+// direction survive the consolidation. Buckets without values are absent.
+func decimateMinMax(values []float64, size int) []float64 {
+	decimated := make([]float64, 0, len(values)/size+1)
+	prev := math.NaN()
+	for start := 0; start < len(values); start += size {
+		end := start + size
+		if end > len(values) {
+			end = len(values)
+		}
+
+		low, high, sum, n := math.Inf(1), math.Inf(-1), 0.0, 0
+		for _, v := range values[start:end] {
+			if math.IsNaN(v) {
+				continue
+			}
+			low, high = math.Min(low, v), math.Max(high, v)
+			sum += v
+			n++
+		}
+		if n == 0 {
+			decimated = append(decimated, math.NaN())
+			continue
+		}
+
+		ref := prev
+		if math.IsNaN(ref) {
+			ref = sum / float64(n)
+		}
+		v := low
+		if high-ref > ref-low {
+			v = high
+		}
+		decimated = append(decimated, v)
+		prev = v
+	}
+	return decimated
+}
+
+// decimateLTTB keeps one value of every bucket of size values with the
+// largest-triangle-three-buckets method: the one making the largest triangle
+// with the value kept before and the average of the next bucket. That keeps the
+// visual shape of spiky series which averaging flattens. The first value of
+// the series is kept, the last bucket takes the value farthest from the one
+// kept before.
+func decimateLTTB(values []float64, size int) []float64 {
+	decimated := make([]float64, 0, len(values)/size+1)
+	prevX, prevY := math.NaN(), math.NaN()
+	for start := 0; start < len(values); start += size {
+		end := start + size
+		if end > len(values) {
+			end = len(values)
+		}
+		nextEnd := end + size
+		if nextEnd > len(values) {
+			nextEnd = len(values)
+		}
+
+		var nextX, nextY float64
+		n := 0
+		for i := end; i < nextEnd; i++ {
+			if !math.IsNaN(values[i]) {
+				nextX += float64(i)
+				nextY += values[i]
+				n++
+			}
+		}
+		if n > 0 {
+			nextX /= float64(n)
+			nextY /= float64(n)
+		}
+
+		best, bestArea := -1, 0.0
+		for i := start; i < end; i++ {
+			v := values[i]
+			if math.IsNaN(v) {
+				continue
+			}
+			area := 0.0
+			if !math.IsNaN(prevY) {
+				x, y := nextX, nextY
+				if n == 0 {
+					// no next bucket, the triangle degrades to the
+					// distance from the previous value
+					x, y = float64(i), prevY
+				}
+				area = math.Abs((prevX-x)*(v-prevY) - (prevX-float64(i))*(y-prevY))
+			}
+			if best < 0 || area > bestArea {
+				best, bestArea = i, area
+			}
+		}
+
+		if best < 0 {
+			decimated = append(decimated, math.NaN())
+			continue
+		}
+		decimated = append(decimated, values[best])
+		prevX, prevY = float64(best), values[best]
+	}
+	return decimated
+}
+
+// estimateTextWidth guesses the width of the text from its length, for fonts
+// that can't measure it. An average glyph is about 0.6 of the font size wide.
+func estimateTextWidth(text string, fontSize float64) float64 {
+	return 0.6 * fontSize * float64(utf8.RuneCountInString(text))
+}
+
+// namePattern returns a matcher of series names for pattern, a regular
+// expression or, when it isn't a valid one, a glob like *.latency. It returns
+// nil for an empty or invalid pattern.
+func namePattern(pattern string) func(string) bool {
+	if pattern == "" {
+		return nil
+	}
+	if re, err := regexp.Compile(pattern); err == nil {
+		return re.MatchString
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil
+	}
+	return func(name string) bool {
+		ok, _ := path.Match(pattern, name)
+		return ok
+	}
+}
+
+// logPosition returns where v falls between min and max on a logarithmic
+// scale, 0 at min and 1 at max. All of them have to be positive.
+func logPosition(v, min, max float64) float64 {
+	return math.Log(v/min) / math.Log(max/min)
+}
+
+// maxLogTicks caps the number of ticks logTicks returns
+const maxLogTicks = 1000
+
+// logTicks returns the powers of base from min to max, at most maxLogTicks of
+// them. Bases <= 1 and a min <= 0 have no powers to return.
+func logTicks(min, max, base float64) []float64 {
+	if base <= 1 || min <= 0 {
+		return nil
+	}
+	var ticks []float64
+	for p := math.Ceil(math.Log(min)/math.Log(base) - floatEpsilon); len(ticks) < maxLogTicks; p++ {
+		v := math.Pow(base, p)
+		if v > max*(1+floatEpsilon) {
+			break
+		}
+		ticks = append(ticks, v)
+	}
+	return ticks
+}
+
+// heatmapCells buckets the values starting at start every step seconds by
+// days and hours of the day in tz, and averages every bucket. It returns the
+// midnight of the first day and the buckets of every day up to the one of the
+// last value, absent where a bucket has no values.
+func heatmapCells(values []float64, start, step int64, tz *time.Location) (time.Time, [][24]float64) {
+	// days are counted on calendar dates, so DST changes don't shift them
+	date := func(t time.Time) time.Time {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	first := time.Unix(start, 0).In(tz)
+	firstDate := date(first)
+
+	type bucket struct {
+		sum float64
+		n   int
+	}
+	var buckets [][24]bucket
+	if len(values) > 0 {
+		last := time.Unix(start+int64(len(values)-1)*step, 0).In(tz)
+		buckets = make([][24]bucket, int(date(last).Sub(firstDate)/(24*time.Hour))+1)
+	}
+	for i, v := range values {
+		if math.IsNaN(v) {
+			continue
+		}
+		t := time.Unix(start+int64(i)*step, 0).In(tz)
+		b := &buckets[int(date(t).Sub(firstDate)/(24*time.Hour))][t.Hour()]
+		b.sum += v
+		b.n++
+	}
+
+	cells := make([][24]float64, len(buckets))
+	for d := range buckets {
+		for h, b := range buckets[d] {
+			cells[d][h] = math.NaN()
+			if b.n > 0 {
+				cells[d][h] = b.sum / float64(b.n)
+			}
+		}
+	}
+	return time.Date(first.Year(), first.Month(), first.Day(), 0, 0, 0, 0, tz), cells
+}
@@ -0,0 +1,678 @@
+package png
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMakeLabelPercent(t *testing.T) {
+
+	tests := []struct {
+		value float64
+		step  float64
+		want  string
+	}{
+		{0, 0.25, "0%"},
+		{0.25, 0.25, "25%"},
+		{1, 0.25, "100%"},
+		{0.025, 0.025, "2.5%"},
+		{0.005, 0.001, "0.5%"},
+		{1.5, 0.5, "150%"},
+		{-0.2, 0.2, "-20%"},
+		{0.12345, 0, "12.3%"},
+		{1, 0, "100%"},
+		{0.5, math.NaN(), "50.0%"},
+	}
+
+	for _, tt := range tests {
+		got := makeLabel(tt.value, tt.step, 1, unitSystemPercent, -1)
+		if got != tt.want {
+			t.Errorf("makeLabel(%v, %v, percent): got %q, want %q", tt.value, tt.step, got, tt.want)
+		}
+	}
+}
+
+func TestMakeLabelPrecision(t *testing.T) {
+
+	tests := []struct {
+		value      float64
+		step       float64
+		unitSystem string
+		precision  int
+		want       string
+	}{
+		{2.5, 0.5, "si", -1, "2.50 "},
+		{2.5, 0.5, "si", 0, "2 "},
+		{2.5, 0.5, "si", 3, "2.500 "},
+		{2500, 1000, "si", 1, "2.5 K "},
+		{0.25, 0.25, unitSystemPercent, 2, "25.00%"},
+		{0.125, 0.125, unitSystemPercent, 0, "12%"},
+	}
+
+	for _, tt := range tests {
+		got := makeLabel(tt.value, tt.step, 1, tt.unitSystem, tt.precision)
+		if got != tt.want {
+			t.Errorf("makeLabel(%v, %v, %s, %d): got %q, want %q", tt.value, tt.step, tt.unitSystem, tt.precision, got, tt.want)
+		}
+	}
+}
+
+func TestPadYRange(t *testing.T) {
+
+	tests := []struct {
+		min, max          float64
+		padBottom, padTop float64
+		wantMin, wantMax  float64
+	}{
+		{0, 100, 0.05, 0.05, 0, 105},
+		{10, 110, 0.05, 0.05, 5, 115},
+		{-100, -10, 0.1, 0.1, -109, -1},
+		{-100, -2, 0.1, 0.1, -109.8, 0},
+		{-50, 50, 0.1, 0.1, -60, 60},
+		{10, 110, 0, 0, 10, 110},
+		{5, 5, 0.05, 0.05, 5, 5},
+	}
+
+	for _, tt := range tests {
+		gotMin, gotMax := padYRange(tt.min, tt.max, tt.padBottom, tt.padTop)
+		if math.Abs(gotMin-tt.wantMin) > 1e-9 || math.Abs(gotMax-tt.wantMax) > 1e-9 {
+			t.Errorf("padYRange(%v, %v, %v, %v): got (%v, %v), want (%v, %v)", tt.min, tt.max, tt.padBottom, tt.padTop, gotMin, gotMax, tt.wantMin, tt.wantMax)
+		}
+	}
+}
+
+func TestNextYStep(t *testing.T) {
+
+	tests := []struct {
+		value, step float64
+		want        float64
+	}{
+		{100, 20, 120},
+		{99, 20, 100},
+		{0.3, 0.1, 0.4},
+		{0, 1, 1},
+		{-5, 2, -4},
+		{-4, 2, -2},
+	}
+
+	for _, tt := range tests {
+		got := nextYStep(tt.value, tt.step)
+		if math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("nextYStep(%v, %v): got %v, want %v", tt.value, tt.step, got, tt.want)
+		}
+	}
+}
+
+func TestGetYMinorValues(t *testing.T) {
+
+	tests := []struct {
+		labels []float64
+		minorY int
+		want   []float64
+	}{
+		{[]float64{0, 10, 20}, 1, []float64{5, 15}},
+		{[]float64{0, 12}, 3, []float64{3, 6, 9}},
+		{[]float64{1, 10, 100}, 1, []float64{5.5, 55}},
+		{[]float64{0, 10, 20}, 0, nil},
+		{[]float64{0}, 4, nil},
+	}
+
+	for _, tt := range tests {
+		got := getYMinorValues(tt.labels, tt.minorY, 0)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("getYMinorValues(%v, %v): got %v, want %v", tt.labels, tt.minorY, got, tt.want)
+		}
+	}
+
+	// evenly spaced on a log scale
+	got := getYMinorValues([]float64{1, 16, 256}, 3, 2)
+	want := []float64{2, 4, 8, 32, 64, 128}
+	if len(got) != len(want) {
+		t.Fatalf("getYMinorValues on log scale: got %v, want %v", got, want)
+	}
+	for i := range want {
+		if math.Abs(got[i]-want[i]) > 1e-9 {
+			t.Errorf("getYMinorValues on log scale: got %v, want %v", got, want)
+			break
+		}
+	}
+}
+
+func TestGetYGridValues(t *testing.T) {
+
+	tests := []struct {
+		labels      []float64
+		gridDensity int
+		want        []float64
+	}{
+		{[]float64{0, 10, 20}, 1, []float64{0, 10, 20}},
+		{[]float64{0, 10, 20}, 0, []float64{0, 10, 20}},
+		{[]float64{0, 10, 20}, 2, []float64{0, 5, 10, 15, 20}},
+		{[]float64{0, 12}, 4, []float64{0, 3, 6, 9, 12}},
+		{[]float64{5}, 3, []float64{5}},
+	}
+
+	for _, tt := range tests {
+		got := getYGridValues(tt.labels, tt.gridDensity, 0)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("getYGridValues(%v, %v): got %v, want %v", tt.labels, tt.gridDensity, got, tt.want)
+		}
+	}
+}
+
+func TestGetXGridTimes(t *testing.T) {
+
+	tests := []struct {
+		start, end, labelTime, labelDelta int64
+		gridDensity                       int
+		want                              []float64
+	}{
+		{100, 400, 120, 120, 2, []float64{120, 180, 240, 300, 360}},
+		{100, 400, 120, 120, 3, []float64{120, 160, 200, 240, 280, 320, 360}},
+		{0, 300, 120, 120, 4, []float64{0, 30, 60, 90, 120, 150, 180, 210, 240, 270}},
+		{100, 400, 120, 0, 2, nil},
+	}
+
+	for _, tt := range tests {
+		got := getXGridTimes(tt.start, tt.end, tt.labelTime, tt.labelDelta, tt.gridDensity)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("getXGridTimes(%v, %v, %v, %v, %v): got %v, want %v", tt.start, tt.end, tt.labelTime, tt.labelDelta, tt.gridDensity, got, tt.want)
+		}
+	}
+}
+
+func TestGetYDivisions(t *testing.T) {
+	tests := []struct {
+		min, max           float64
+		n                  int
+		fixedMin, fixedMax bool
+		bottom, top, step  float64
+	}{
+		{0, 100, 5, false, false, 0, 100, 20},
+		{0, 3.5, 5, false, false, 0, 5, 1},
+		{0, 3.5, 4, false, false, 0, 4, 1},
+		{3, 97, 4, false, false, 0, 100, 25},
+		{-1.5, 1, 5, false, false, -1.5, 1, 0.5},
+		{0.5, 2.4, 2, false, false, 0, 4, 2},
+		{10, 12, 4, true, false, 10, 12, 0.5},
+		{0, 7, 2, false, true, -3, 7, 5},
+		{0, 7, 2, true, true, 0, 7, 3.5},
+	}
+
+	for _, tt := range tests {
+		bottom, top, step := getYDivisions(tt.min, tt.max, tt.n, tt.fixedMin, tt.fixedMax)
+		if math.Abs(bottom-tt.bottom) > floatEpsilon || math.Abs(top-tt.top) > floatEpsilon || math.Abs(step-tt.step) > floatEpsilon {
+			t.Errorf("getYDivisions(%v, %v, %v, %v, %v) = (%v, %v, %v), want (%v, %v, %v)",
+				tt.min, tt.max, tt.n, tt.fixedMin, tt.fixedMax, bottom, top, step, tt.bottom, tt.top, tt.step)
+		}
+	}
+}
+
+func TestGetYStep(t *testing.T) {
+	tests := []struct {
+		min, max   float64
+		unitSystem string
+		divisors   []float64
+		want       float64
+	}{
+		{0, 100, "si", []float64{4, 5, 6}, 25},
+		{0, 100, "si", []float64{5}, 20},
+		{0, 1, "si", []float64{4, 5, 6}, 0.25},
+		{0, 4, "si", []float64{4, 5, 6}, 1},
+		{0, 1024, unitSystemBinary, []float64{4, 5, 6}, 256},
+		{-50, 50, "si", []float64{4}, 25},
+	}
+
+	for _, tt := range tests {
+		got := getYStep(tt.min, tt.max, tt.unitSystem, tt.divisors)
+		if math.Abs(got-tt.want) > floatEpsilon {
+			t.Errorf("getYStep(%v, %v, %s, %v): got %v, want %v", tt.min, tt.max, tt.unitSystem, tt.divisors, got, tt.want)
+		}
+	}
+}
+
+func TestGetXAxisConfig(t *testing.T) {
+	tests := []struct {
+		secondsPerPixel float64
+		timeRange       int64
+		wantSeconds     float64
+	}{
+		{0.1, 600, 0.07},
+		{1000, 86400, 1000},
+		// a few seconds over the whole width
+		{0.005, 4, 0},
+		{0.02, 300, 0.01},
+		// nothing fits, the coarsest config is used
+		{0, 1 << 40, xAxisConfigs[len(xAxisConfigs)-1].seconds},
+	}
+
+	for _, tt := range tests {
+		got := getXAxisConfig(tt.secondsPerPixel, tt.timeRange)
+		if got.seconds != tt.wantSeconds {
+			t.Errorf("getXAxisConfig(%v, %v): got config for %v seconds per pixel, want %v", tt.secondsPerPixel, tt.timeRange, got.seconds, tt.wantSeconds)
+		}
+	}
+
+	if got := getXAxisConfig(0.005, 4); got.labelUnit != Second || got.labelStep != 1 {
+		t.Errorf("getXAxisConfig(0.005, 4): got a label every %d * %d seconds, want every second", got.labelStep, got.labelUnit)
+	}
+}
+
+func TestLegendColumns(t *testing.T) {
+	tests := []struct {
+		width, labelWidth float64
+		sides             int
+		want              float64
+	}{
+		{600, 100, 1, 6},
+		{650, 100, 1, 6},
+		{600, 100, 2, 3},
+		{500, 100, 2, 2},
+		{50, 100, 1, 1},
+		{50, 100, 2, 1},
+	}
+
+	for _, tt := range tests {
+		got := legendColumns(tt.width, tt.labelWidth, tt.sides)
+		if got != tt.want {
+			t.Errorf("legendColumns(%v, %v, %v): got %v, want %v", tt.width, tt.labelWidth, tt.sides, got, tt.want)
+		}
+	}
+}
+
+func TestMovingAverage(t *testing.T) {
+	nan := math.NaN()
+	tests := []struct {
+		values []float64
+		window int
+		want   []float64
+	}{
+		{[]float64{1, 2, 3, 4, 5}, 2, []float64{1, 1.5, 2.5, 3.5, 4.5}},
+		{[]float64{3, 6, 9}, 1, []float64{3, 6, 9}},
+		{[]float64{2, nan, 4, nan, nan, nan}, 3, []float64{2, 2, 3, 4, 4, nan}},
+		{[]float64{nan, nan, 1}, 2, []float64{nan, nan, 1}},
+		{nil, 3, []float64{}},
+	}
+
+	for _, tt := range tests {
+		got := movingAverage(tt.values, tt.window)
+		if len(got) != len(tt.want) {
+			t.Fatalf("movingAverage(%v, %v): got %v, want %v", tt.values, tt.window, got, tt.want)
+		}
+		for i := range got {
+			if math.IsNaN(tt.want[i]) != math.IsNaN(got[i]) || (!math.IsNaN(got[i]) && math.Abs(got[i]-tt.want[i]) > floatEpsilon) {
+				t.Errorf("movingAverage(%v, %v): got %v, want %v", tt.values, tt.window, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestGetCalendarTimes(t *testing.T) {
+	tz, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip(err)
+	}
+	at := func(year int, month time.Month, day int) int64 {
+		return time.Date(year, month, day, 0, 0, 0, 0, tz).Unix()
+	}
+
+	tests := []struct {
+		name       string
+		start, end int64
+		step       int64
+		want       []int64
+	}{
+		{
+			name:  "days",
+			start: at(2023, time.March, 1) + 3600,
+			end:   at(2023, time.March, 4) + 3600,
+			step:  1,
+			want:  []int64{at(2023, time.March, 2), at(2023, time.March, 3), at(2023, time.March, 4)},
+		},
+		{
+			// the clocks go forward on March 26, midnights stay midnights
+			name:  "dst",
+			start: at(2023, time.March, 25),
+			end:   at(2023, time.March, 30),
+			step:  2,
+			want:  []int64{at(2023, time.March, 25), at(2023, time.March, 27), at(2023, time.March, 29)},
+		},
+		{
+			name:  "months",
+			start: at(2023, time.January, 15),
+			end:   at(2023, time.July, 1),
+			step:  60,
+			want:  []int64{at(2023, time.March, 1), at(2023, time.May, 1)},
+		},
+		{
+			name:  "invalid step",
+			start: at(2023, time.January, 1),
+			end:   at(2023, time.February, 1),
+			step:  0,
+			want:  nil,
+		},
+	}
+
+	for _, tt := range tests {
+		got := getCalendarTimes(tt.start, tt.end, tt.step, tz)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNudgeLabels(t *testing.T) {
+	tests := []struct {
+		ys     []float64
+		height float64
+		want   []float64
+	}{
+		{[]float64{10, 50}, 10, []float64{10, 50}},
+		{[]float64{10, 15}, 10, []float64{10, 20}},
+		{[]float64{30, 30, 30}, 10, []float64{30, 40, 50}},
+		{[]float64{50, 12, 10}, 10, []float64{50, 20, 10}},
+		{nil, 10, []float64{}},
+	}
+
+	for _, tt := range tests {
+		got := nudgeLabels(tt.ys, tt.height)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("nudgeLabels(%v, %v): got %v, want %v", tt.ys, tt.height, got, tt.want)
+		}
+	}
+}
+
+func TestFormatUnits(t *testing.T) {
+	tests := []struct {
+		value  float64
+		system string
+		want   string
+	}{
+		{1234567, "si", "1.23M"},
+		{-1234567, "si", "-1.23M"},
+		{999, "si", "999.00"},
+		{2048, "binary", "2.00Ki"},
+		{0.5, "si", "0.50"},
+		{1234567, "none", "1234567.00"},
+	}
+
+	for _, tt := range tests {
+		if got := FormatUnits(tt.value, tt.system); got != tt.want {
+			t.Errorf("FormatUnits(%v, %s): got %q, want %q", tt.value, tt.system, got, tt.want)
+		}
+	}
+}
+
+func TestFormatAutoPrecision(t *testing.T) {
+	tests := []struct {
+		value  float64
+		system string
+		want   string
+	}{
+		{0.002, "", "0.00200"},
+		{0.0213, "", "0.0213"},
+		{3.14159, "", "3.14"},
+		{-42.42, "", "-42.4"},
+		{4512.7, "", "4513"},
+		{0, "", "0"},
+		{1e-20, "", "0.0000000000"},
+		{1234567, "si", "1.23M"},
+		{45678, "si", "45.7K"},
+		{2048, "binary", "2.00Ki"},
+	}
+
+	for _, tt := range tests {
+		if got := FormatAutoPrecision(tt.value, tt.system); got != tt.want {
+			t.Errorf("FormatAutoPrecision(%v, %q): got %q, want %q", tt.value, tt.system, got, tt.want)
+		}
+	}
+}
+
+func TestZeroCrossing(t *testing.T) {
+	tests := []struct {
+		x0, v0, x1, v1 float64
+		want           float64
+	}{
+		{0, 1, 10, -1, 5},
+		{0, -3, 10, 1, 7.5},
+		{10, 4, 20, -1, 18},
+	}
+
+	for _, tt := range tests {
+		if got := zeroCrossing(tt.x0, tt.v0, tt.x1, tt.v1); math.Abs(got-tt.want) > floatEpsilon {
+			t.Errorf("zeroCrossing(%v, %v, %v, %v): got %v, want %v", tt.x0, tt.v0, tt.x1, tt.v1, got, tt.want)
+		}
+	}
+}
+
+func TestGetRotation(t *testing.T) {
+	tests := []struct {
+		angle                 int
+		width, height         float64
+		wantWidth, wantHeight float64
+		wantTx, wantTy        float64
+	}{
+		{0, 300, 200, 300, 200, 0, 0},
+		{90, 300, 200, 200, 300, 200, 0},
+		{180, 300, 200, 300, 200, 300, 200},
+		{270, 300, 200, 200, 300, 0, 300},
+	}
+
+	for _, tt := range tests {
+		width, height, tx, ty := getRotation(tt.angle, tt.width, tt.height)
+		if width != tt.wantWidth || height != tt.wantHeight || tx != tt.wantTx || ty != tt.wantTy {
+			t.Errorf("getRotation(%d): got %vx%v translated by (%v, %v), want %vx%v translated by (%v, %v)",
+				tt.angle, width, height, tx, ty, tt.wantWidth, tt.wantHeight, tt.wantTx, tt.wantTy)
+		}
+	}
+}
+
+func TestTruncateName(t *testing.T) {
+	tests := []struct {
+		name   string
+		max    int
+		middle bool
+		want   string
+	}{
+		{"cpu.user", 0, false, "cpu.user"},
+		{"cpu.user", 8, false, "cpu.user"},
+		{"cpu.user", 5, false, "cpu.…"},
+		{"cpu.user", 5, true, "cp…er"},
+		{"cpu.user", 6, true, "cpu…er"},
+		{"процессор", 4, false, "про…"},
+		{"cpu", 1, true, "…"},
+	}
+
+	for _, tt := range tests {
+		if got := truncateName(tt.name, tt.max, tt.middle); got != tt.want {
+			t.Errorf("truncateName(%q, %d, %v): got %q, want %q", tt.name, tt.max, tt.middle, got, tt.want)
+		}
+	}
+}
+
+func TestDistinctYStep(t *testing.T) {
+	oneDecimal := func(v, step, span float64) string { return fmt.Sprintf("%.1f", v) }
+
+	tests := []struct {
+		min, max, step float64
+		want           float64
+	}{
+		{0, 10, 2, 2},
+		{1.001, 1.003, 0.0005, 0.05},
+		{1.04, 1.26, 0.05, 0.1},
+	}
+
+	for _, tt := range tests {
+		if got := distinctYStep(tt.min, tt.max, tt.step, oneDecimal); math.Abs(got-tt.want) > floatEpsilon {
+			t.Errorf("distinctYStep(%v, %v, %v): got %v, want %v", tt.min, tt.max, tt.step, got, tt.want)
+		}
+	}
+}
+
+func TestDecimate(t *testing.T) {
+	nan := math.NaN()
+	tests := []struct {
+		name   string
+		values []float64
+		size   int
+		lttb   []float64
+		minMax []float64
+	}{
+		{"spike", []float64{0, 0, 0, 0, 10, 0, 0, 0, 0}, 3, []float64{0, 10, 0}, []float64{0, 10, 0}},
+		{"dip", []float64{5, 5, 5, 5, -20, 5, 5, 5, 5}, 3, []float64{5, -20, 5}, []float64{5, -20, 5}},
+		{"partial last bucket", []float64{1, 2, 3, 4, 9}, 2, []float64{1, 4, 9}, []float64{1, 4, 9}},
+		{"absent bucket", []float64{1, 2, nan, nan, 3, 1}, 2, []float64{1, nan, 3}, []float64{1, nan, 3}},
+	}
+
+	for _, tt := range tests {
+		if got := decimateLTTB(tt.values, tt.size); fmt.Sprint(got) != fmt.Sprint(tt.lttb) {
+			t.Errorf("%s: decimateLTTB got %v, want %v", tt.name, got, tt.lttb)
+		}
+		if got := decimateMinMax(tt.values, tt.size); fmt.Sprint(got) != fmt.Sprint(tt.minMax) {
+			t.Errorf("%s: decimateMinMax got %v, want %v", tt.name, got, tt.minMax)
+		}
+	}
+}
+
+func TestEstimateTextWidth(t *testing.T) {
+	if got := estimateTextWidth("10 µs", 10); got != 30 {
+		t.Errorf("got %v, want 30 for 5 glyphs of a font of 10", got)
+	}
+}
+
+func TestNamePattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"latency$", "db.query.latency", true},
+		{"latency$", "db.latency.count", false},
+		{"^db\\.(query|write)\\.", "db.write.count", true},
+		{"*.latency", "db.query.latency", true},
+		{"*.latency", "db.query.count", false},
+		{"*.lat[", "db.query.latency", false},
+	}
+
+	for _, tt := range tests {
+		match := namePattern(tt.pattern)
+		if got := match != nil && match(tt.name); got != tt.want {
+			t.Errorf("%q on %q: got %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+	if namePattern("") != nil || namePattern("*[") != nil {
+		t.Errorf("got a matcher for an empty or an invalid pattern")
+	}
+}
+
+func TestLogTicks(t *testing.T) {
+	tests := []struct {
+		min, max, base float64
+		want           []float64
+	}{
+		{1, 1001, 10, []float64{1, 10, 100, 1000}},
+		{3, 999, 10, []float64{10, 100}},
+		{100, 1000, 10, []float64{100, 1000}},
+		{5, 70, 2, []float64{8, 16, 32, 64}},
+		{1, 1000, 1, nil},
+		{0, 1000, 10, nil},
+	}
+
+	for _, tt := range tests {
+		if got := logTicks(tt.min, tt.max, tt.base); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("logTicks(%v, %v, %v) = %v, want %v", tt.min, tt.max, tt.base, got, tt.want)
+		}
+	}
+
+	if got := logTicks(1, math.Inf(1), 2); len(got) != maxLogTicks {
+		t.Errorf("logTicks up to +Inf returned %d ticks, want %d", len(got), maxLogTicks)
+	}
+
+	if got := logPosition(100, 10, 1000); math.Abs(got-0.5) > 1e-9 {
+		t.Errorf("logPosition(100, 10, 1000) = %v, want 0.5", got)
+	}
+}
+
+func TestCumulativeSum(t *testing.T) {
+	nan := math.NaN()
+	got := cumulativeSum([]float64{nan, 1, 2, nan, 3, nan})
+	if want := []float64{nan, 1, 3, 3, 6, 6}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestHeatmapCells(t *testing.T) {
+	nan := math.NaN()
+	start := time.Date(2024, 1, 1, 22, 0, 0, 0, time.UTC).Unix()
+	// every 30 minutes from 22:00 to 01:00 the next day
+	firstDay, cells := heatmapCells([]float64{1, 3, 2, nan, 5, 7, nan}, start, 1800, time.UTC)
+
+	if want := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC); !firstDay.Equal(want) {
+		t.Errorf("got first day %v, want %v", firstDay, want)
+	}
+	if len(cells) != 2 {
+		t.Fatalf("got %d days, want 2", len(cells))
+	}
+	got := []float64{cells[0][21], cells[0][22], cells[0][23], cells[1][0], cells[1][1]}
+	if want := []float64{nan, 2, 2, 6, nan}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got cells %v, want %v", got, want)
+	}
+
+	// the hours are the ones of the time zone
+	tz := time.FixedZone("UTC+3", 3*60*60)
+	_, cells = heatmapCells([]float64{1}, start, 1800, tz)
+	if len(cells) != 1 || cells[0][1] != 1 {
+		t.Errorf("got %v, want the point at 01:00 of the next day in UTC+3", cells)
+	}
+}
+
+func TestNumberFormat(t *testing.T) {
+	tests := []struct {
+		format string
+		label  string
+		want   string
+	}{
+		{"", "1234.5 K", "1234.5 K"},
+		{"1234.5", "1234.5 K", "1234.5 K"},
+		{"1.234,5", "1234.5 K", "1.234,5 K"},
+		{"1.234,5", "-1234567.25 ", "-1.234.567,25 "},
+		{"1.234,5", "123.5", "123,5"},
+		{"1 234,5", "12345", "12 345"},
+		{"1234,5", "12345.5", "12345,5"},
+		{"1,234.5", "9876.5", "9,876.5"},
+		// not an example of 1234.5, the default is kept
+		{"1.234.5", "1234.5", "1234.5"},
+		{"12345", "1234.5", "1234.5"},
+		{"de", "1234.5", "1234.5"},
+	}
+
+	for _, tt := range tests {
+		if got := getNumberFormat(tt.format).apply(tt.label); got != tt.want {
+			t.Errorf("numberFormat %q on %q: got %q, want %q", tt.format, tt.label, got, tt.want)
+		}
+	}
+}
+
+func TestIsFlat(t *testing.T) {
+	nan := math.NaN()
+	tests := []struct {
+		values []float64
+		want   bool
+	}{
+		{[]float64{90, 90, 90}, true},
+		{[]float64{nan, 90, nan, 90}, true},
+		{[]float64{90, 90, 91}, false},
+		{[]float64{nan, 90, nan}, false},
+		{nil, false},
+	}
+
+	for _, tt := range tests {
+		if got := isFlat(tt.values); got != tt.want {
+			t.Errorf("isFlat(%v) = %v, want %v", tt.values, got, tt.want)
+		}
+	}
+}
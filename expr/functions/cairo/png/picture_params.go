@@ -8,12 +8,35 @@ import (
 	"strings"
 	"time"
 
+	"github.com/go-graphite/carbonapi/date"
 	"github.com/go-graphite/carbonapi/expr/types"
 	"github.com/go-graphite/carbonapi/pkg/parser"
 )
 
 var DefaultColorList = []string{"blue", "green", "red", "purple", "brown", "yellow", "aqua", "grey", "magenta", "pink", "gold", "rose"}
 
+// OkabeItoColorList is a palette that stays distinguishable for the most common
+// kinds of color blindness (Okabe & Ito, 2008). Black from the original set is
+// left out, as it would be invisible on the default background.
+var OkabeItoColorList = []string{"e69f00", "56b4e9", "009e73", "f0e442", "0072b2", "d55e00", "cc79a7"}
+
+// DarkColorList is a palette that reads well on a near-black background
+var DarkColorList = []string{"7eb26d", "eab839", "6ed0e0", "ef843c", "e24d42", "1f78c1", "ba43a9", "705da0", "508642", "cca300", "447ebc"}
+
+var colorLists = map[string][]string{
+	"default":    DefaultColorList,
+	"okabe-ito":  OkabeItoColorList,
+	"colorblind": OkabeItoColorList,
+	"dark":       DarkColorList,
+}
+
+func getColorList(name string, def []string) []string {
+	if l, ok := colorLists[strings.ToLower(name)]; ok {
+		return l
+	}
+	return def
+}
+
 type YAxisSide int
 
 const (
@@ -37,6 +60,8 @@ const (
 	LineModeSlope LineMode = 1 << iota
 	LineModeStaircase
 	LineModeConnected
+	// LineModeStaircaseZero is staircase with absent values drawn as zero
+	LineModeStaircaseZero
 )
 
 type AreaMode int
@@ -46,8 +71,74 @@ const (
 	AreaModeFirst
 	AreaModeAll
 	AreaModeStacked
+	AreaModeStackedPercent
+)
+
+// StackOrder is the order stacked series are piled up in, from the bottom
+type StackOrder int
+
+const (
+	StackOrderInput StackOrder = iota
+	StackOrderName
+	StackOrderValue
 )
 
+func getStackOrder(s string, def StackOrder) StackOrder {
+	switch s {
+	case "":
+		return def
+	case "name":
+		return StackOrderName
+	case "value":
+		return StackOrderValue
+	}
+	return StackOrderInput
+}
+
+// Decimation picks the drawn value of every run of points consolidated into one
+type Decimation int
+
+const (
+	DecimationAverage Decimation = iota
+	DecimationLTTB
+	DecimationMinMax
+)
+
+func getDecimation(s string, def Decimation) Decimation {
+	switch s {
+	case "":
+		return def
+	case "lttb":
+		return DecimationLTTB
+	case "minmax":
+		return DecimationMinMax
+	}
+	return DecimationAverage
+}
+
+// PixelSnap tells which coordinates are moved to pixel centers
+type PixelSnap int
+
+const (
+	PixelSnapNone PixelSnap = iota
+	// PixelSnapAxes snaps the grid and the text
+	PixelSnapAxes
+	// PixelSnapAll snaps the lines of the series too
+	PixelSnapAll
+)
+
+func getPixelSnap(s string, def PixelSnap) PixelSnap {
+	switch s {
+	case "":
+		return def
+	case "true", "axes":
+		return PixelSnapAxes
+	case "all":
+		return PixelSnapAll
+	}
+	return PixelSnapNone
+}
+
 func getAreaMode(s string, def AreaMode) AreaMode {
 	if s == "" {
 		return def
@@ -59,6 +150,8 @@ func getAreaMode(s string, def AreaMode) AreaMode {
 		return AreaModeAll
 	case "stacked":
 		return AreaModeStacked
+	case "stackedPercent":
+		return AreaModeStackedPercent
 	}
 	return AreaModeNone
 }
@@ -94,9 +187,227 @@ func getLineMode(s string, def LineMode) LineMode {
 	if s == "staircase" {
 		return LineModeStaircase
 	}
+	if s == "staircaseZero" {
+		return LineModeStaircaseZero
+	}
 	return LineModeConnected
 }
 
+type GraphType int
+
+const (
+	GraphTypeLine GraphType = iota
+	GraphTypeSparkline
+	// GraphTypePanels draws every series in its own band with its own Y axis
+	GraphTypePanels
+	// GraphTypeHeatmap draws the first series as a grid of days by hours of
+	// the day colored by value
+	GraphTypeHeatmap
+)
+
+func getGraphType(s string, def GraphType) GraphType {
+	if s == "" {
+		return def
+	}
+	if s == "sparkline" {
+		return GraphTypeSparkline
+	}
+	if s == "panels" {
+		return GraphTypePanels
+	}
+	if s == "heatmap" {
+		return GraphTypeHeatmap
+	}
+	return GraphTypeLine
+}
+
+// StepAlign tells where in its time bucket a point is drawn
+type StepAlign int
+
+const (
+	StepAlignStart StepAlign = iota
+	StepAlignCenter
+	StepAlignEnd
+)
+
+func getStepAlign(s string, def StepAlign) StepAlign {
+	switch s {
+	case "":
+		return def
+	case "center":
+		return StepAlignCenter
+	case "end":
+		return StepAlignEnd
+	}
+	return StepAlignStart
+}
+
+// shift returns how far into its bucket a point is drawn, in steps
+func (a StepAlign) shift() float64 {
+	switch a {
+	case StepAlignCenter:
+		return 0.5
+	case StepAlignEnd:
+		return 1
+	}
+	return 0
+}
+
+type LegendSwatch int
+
+const (
+	LegendSwatchSquare LegendSwatch = iota
+	LegendSwatchLine
+	LegendSwatchCircle
+)
+
+func getLegendSwatch(s string, def LegendSwatch) LegendSwatch {
+	switch s {
+	case "":
+		return def
+	case "line":
+		return LegendSwatchLine
+	case "circle":
+		return LegendSwatchCircle
+	}
+	return LegendSwatchSquare
+}
+
+type LegendEllipsis int
+
+const (
+	LegendEllipsisEnd LegendEllipsis = iota
+	LegendEllipsisMiddle
+)
+
+func getLegendEllipsis(s string, def LegendEllipsis) LegendEllipsis {
+	switch s {
+	case "":
+		return def
+	case "middle":
+		return LegendEllipsisMiddle
+	}
+	return LegendEllipsisEnd
+}
+
+type StatsBox int
+
+const (
+	StatsBoxNone StatsBox = iota
+	StatsBoxTopLeft
+	StatsBoxTopRight
+	StatsBoxBottomLeft
+	StatsBoxBottomRight
+)
+
+func getStatsBox(s string, def StatsBox) StatsBox {
+	switch s {
+	case "":
+		return def
+	case "topleft":
+		return StatsBoxTopLeft
+	case "topright":
+		return StatsBoxTopRight
+	case "bottomleft":
+		return StatsBoxBottomLeft
+	case "bottomright":
+		return StatsBoxBottomRight
+	}
+	return StatsBoxNone
+}
+
+type LineLabels int
+
+const (
+	LineLabelsNone LineLabels = iota
+	LineLabelsName
+	LineLabelsValue
+)
+
+func getLineLabels(s string, def LineLabels) LineLabels {
+	switch s {
+	case "":
+		return def
+	case "name":
+		return LineLabelsName
+	case "value":
+		return LineLabelsValue
+	}
+	return LineLabelsNone
+}
+
+// Event is a point in time marked on the graph with a vertical line
+type Event struct {
+	Time  int64
+	Label string
+	Color string
+}
+
+// getEvents parses comma separated list of "timestamp:label:color" entries,
+// label and color are optional. Malformed entries are skipped.
+func getEvents(s string, def []Event) []Event {
+	if s == "" {
+		return def
+	}
+
+	var events []Event
+	for _, e := range splitList(s) {
+		parts := strings.SplitN(strings.TrimSpace(e), ":", 3)
+		ts, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		ev := Event{Time: ts}
+		if len(parts) > 1 {
+			ev.Label = parts[1]
+		}
+		if len(parts) > 2 {
+			ev.Color = parts[2]
+		}
+		events = append(events, ev)
+	}
+
+	return events
+}
+
+// HighlightRange is a time range shaded across the whole plot height
+type HighlightRange struct {
+	Start int64
+	End   int64
+	Color string
+}
+
+// getHighlightRanges parses comma separated list of "start:end:color" entries,
+// color is optional. Malformed and empty ranges are skipped.
+func getHighlightRanges(s string, def []HighlightRange) []HighlightRange {
+	if s == "" {
+		return def
+	}
+
+	var ranges []HighlightRange
+	for _, e := range splitList(s) {
+		parts := strings.SplitN(strings.TrimSpace(e), ":", 3)
+		if len(parts) < 2 {
+			continue
+		}
+		start, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		end, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || end <= start {
+			continue
+		}
+		hr := HighlightRange{Start: start, End: end}
+		if len(parts) > 2 {
+			hr.Color = parts[2]
+		}
+		ranges = append(ranges, hr)
+	}
+
+	return ranges
+}
+
 type FontWeight int
 
 const (
@@ -133,19 +444,31 @@ func getFontItalic(s string, def FontSlant) FontSlant {
 }
 
 type PictureParams struct {
-	PixelRatio float64
-	Width      float64
-	Height     float64
-	Margin     int
-	LogBase    float64
-	FgColor    string
-	BgColor    string
-	MajorLine  string
-	MinorLine  string
-	FontName   string
-	FontSize   float64
-	FontBold   FontWeight
-	FontItalic FontSlant
+	PixelRatio  float64
+	Width       float64
+	Height      float64
+	AspectRatio float64
+	Margin      int
+	LogBase     float64
+	XLogBase    float64
+	FgColor     string
+	BgColor     string
+	MajorLine   string
+	MinorLine   string
+	FontName    string
+	FontSize    float64
+	FontBold    FontWeight
+	FontItalic  FontSlant
+
+	TitleFontName   string
+	TitleFontBold   FontWeight
+	TitleFontItalic FontSlant
+
+	MarginPercent float64
+	RotateOutput  int
+
+	GraphType     GraphType
+	SparklineDots bool
 
 	GraphOnly  bool
 	HideLegend bool
@@ -154,20 +477,53 @@ type PictureParams struct {
 	HideYAxis  bool
 	HideXAxis  bool
 	YAxisSide  YAxisSide
+	PlotShadow bool
+	CrispGrid  bool
+	PixelSnap  PixelSnap
+	EmptyFrame bool
+
+	CornerRadius float64
+
+	ShowTimeRange bool
+
+	TrimEmptyEdges bool
+	LastPoints     int
 
 	Title       string
 	Vtitle      string
 	VtitleRight string
+	NoDataText  string
+	NoDataColor string
 
 	Tz *time.Location
 
+	// From and Until are the requested time range, used to draw the axes
+	// when there is no data
+	From  int64
+	Until int64
+
 	ConnectedLimit int
 	LineMode       LineMode
+	StepAlign      StepAlign
 	AreaMode       AreaMode
+	StackOrder     StackOrder
 	AreaAlpha      float64
+	PositiveColor  string
+	NegativeColor  string
 	PieMode        PieMode
 	LineWidth      float64
+	LineCap        string
+	LineJoin       string
 	ColorList      []string
+	StableColors   bool
+	Decimation     Decimation
+
+	ConnectedGapDash float64
+
+	DrawStackTotal  bool
+	StackTotalColor string
+	ShowRaw         bool
+	ReferenceLines  bool
 
 	YMin    float64
 	YMax    float64
@@ -178,6 +534,21 @@ type PictureParams struct {
 	MinorY  int
 	XFormat string
 
+	GridDensity int
+	SnapTime    bool
+	XSubGrid    int
+	YDivisions  int
+
+	CalendarGrid bool
+
+	HideFirstXLabel bool
+	HideLastXLabel  bool
+
+	PlotPaddingTop    float64
+	PlotPaddingBottom float64
+	YMaxHeadroom      bool
+	YScalePercentile  float64
+
 	YMaxLeft    float64
 	YLimitLeft  float64
 	YMaxRight   float64
@@ -187,12 +558,27 @@ type PictureParams struct {
 	YStepL      float64
 	YStepR      float64
 
-	UniqueLegend   bool
-	DrawNullAsZero bool
-	DrawAsInfinite bool
+	LogBaseLeft  float64
+	LogBaseRight float64
+
+	UniqueLegend     bool
+	LegendBox        bool
+	LegendSwatch     LegendSwatch
+	LegendTruncate   int
+	LegendEllipsis   LegendEllipsis
+	DrawNullAsZero   bool
+	DrawAsInfinite   bool
+	ReverseDrawOrder bool
+
+	LegendMaxHeightPercent float64
 
-	YUnitSystem string
-	YDivisors   []float64
+	YUnitSystem     string
+	YLabelPrecision int
+	YLabelRotate    float64
+	NumberFormat    string
+	YMinStep        float64
+	YDivisors       []float64
+	YTicks          []float64
 
 	RightWidth  float64
 	RightDashed bool
@@ -201,8 +587,39 @@ type PictureParams struct {
 	LeftDashed  bool
 	LeftColor   string
 
+	RightAxisPattern string
+
 	MinorGridLineColor string
 	MajorGridLineColor string
+	GridInFront        bool
+
+	Events          []Event
+	HighlightRanges []HighlightRange
+
+	StatsBox    StatsBox
+	StatsBoxAll bool
+
+	LineLabels LineLabels
+	ShowLast   bool
+
+	MaxSeries   int
+	FocusSeries []int
+
+	SmoothWindow int
+	Cumulative   bool
+
+	ColorByValue     bool
+	ColorByValueLow  string
+	ColorByValueHigh string
+	ColorByValueMin  float64
+	ColorByValueMax  float64
+
+	Bubbles         bool
+	BubbleMaxRadius float64
+
+	// Truncated is set by the caller when some of the requested series are
+	// missing from results, e.g. because a backend timed out
+	Truncated bool
 }
 
 // GetPictureParams returns PictureParams with default settings
@@ -228,42 +645,97 @@ func GetPictureParamsWithTemplate(r *http.Request, template string, metricData [
 		pixelRatioParam = r.FormValue("pixelRatio")
 	}
 
+	// legend is hidden by default for crowded graphs, count only series that will be drawn
+	maxSeries := getInt(r.FormValue("maxSeries"), t.MaxSeries)
+	seriesCount := len(metricData)
+	if maxSeries > 0 && seriesCount > maxSeries {
+		seriesCount = maxSeries
+	}
+
+	// the title follows the label font unless told otherwise
+	fontBold := getFontWeight(r.FormValue("fontBold"), t.FontBold)
+	fontItalic := getFontItalic(r.FormValue("fontItalic"), t.FontItalic)
+
+	now := time.Now()
 	return PictureParams{
-		PixelRatio: getFloat64(pixelRatioParam, 1.0),
-		Width:      getFloat64(r.FormValue("width"), t.Width),
-		Height:     getFloat64(r.FormValue("height"), t.Height),
-		Margin:     getInt(r.FormValue("margin"), t.Margin),
-		LogBase:    getLogBase(r.FormValue("logBase")),
-		FgColor:    getString(r.FormValue("fgcolor"), t.FgColor),
-		BgColor:    getString(r.FormValue("bgcolor"), t.BgColor),
-		MajorLine:  getString(r.FormValue("majorLine"), t.MajorLine),
-		MinorLine:  getString(r.FormValue("minorLine"), t.MinorLine),
-		FontName:   getString(r.FormValue("fontName"), t.FontName),
-		FontSize:   getFloat64(r.FormValue("fontSize"), t.FontSize),
-		FontBold:   getFontWeight(r.FormValue("fontBold"), t.FontBold),
-		FontItalic: getFontItalic(r.FormValue("fontItalic"), t.FontItalic),
+		PixelRatio:  getFloat64(pixelRatioParam, 1.0),
+		Width:       getFloat64(r.FormValue("width"), t.Width),
+		Height:      getFloat64(r.FormValue("height"), t.Height),
+		AspectRatio: getAspectRatio(r.FormValue("aspectRatio"), t.AspectRatio),
+		Margin:      getInt(r.FormValue("margin"), t.Margin),
+		LogBase:     getLogBase(r.FormValue("logBase")),
+		XLogBase:    getLogBase(r.FormValue("xLogBase")),
+		FgColor:     getString(r.FormValue("fgcolor"), t.FgColor),
+		BgColor:     getString(r.FormValue("bgcolor"), t.BgColor),
+		MajorLine:   getString(r.FormValue("majorLine"), t.MajorLine),
+		MinorLine:   getString(r.FormValue("minorLine"), t.MinorLine),
+		FontName:    getString(r.FormValue("fontName"), t.FontName),
+		FontSize:    getFloat64(r.FormValue("fontSize"), t.FontSize),
+		FontBold:    fontBold,
+		FontItalic:  fontItalic,
+
+		TitleFontName:   getString(r.FormValue("titleFontName"), t.TitleFontName),
+		TitleFontBold:   getFontWeight(r.FormValue("titleFontBold"), fontBold),
+		TitleFontItalic: getFontItalic(r.FormValue("titleFontItalic"), fontItalic),
+
+		MarginPercent: getFloat64(r.FormValue("marginPercent"), t.MarginPercent),
+		RotateOutput:  getRotateOutput(r.FormValue("rotateOutput"), t.RotateOutput),
+
+		GraphType:     getGraphType(r.FormValue("graphType"), t.GraphType),
+		SparklineDots: getBool(r.FormValue("sparklineDots"), t.SparklineDots),
 
 		GraphOnly:  getBool(r.FormValue("graphOnly"), t.GraphOnly),
-		HideLegend: getBool(r.FormValue("hideLegend"), len(metricData) > 10),
+		HideLegend: getBool(r.FormValue("hideLegend"), seriesCount > 10),
 		HideGrid:   getBool(r.FormValue("hideGrid"), t.HideGrid),
 		HideAxes:   getBool(r.FormValue("hideAxes"), t.HideAxes),
 		HideYAxis:  getBool(r.FormValue("hideYAxis"), t.HideYAxis),
 		HideXAxis:  getBool(r.FormValue("hideXAxis"), t.HideXAxis),
 		YAxisSide:  getAxisSide(r.FormValue("yAxisSide"), t.YAxisSide),
+		PlotShadow: getBool(r.FormValue("plotShadow"), t.PlotShadow),
+		CrispGrid:  getBool(r.FormValue("crispGrid"), t.CrispGrid),
+		PixelSnap:  getPixelSnap(r.FormValue("pixelSnap"), t.PixelSnap),
+		EmptyFrame: getBool(r.FormValue("emptyFrame"), t.EmptyFrame),
+
+		CornerRadius: getFloat64(r.FormValue("cornerRadius"), t.CornerRadius),
+
+		ShowTimeRange: getBool(r.FormValue("showTimeRange"), t.ShowTimeRange),
+
+		TrimEmptyEdges: getBool(r.FormValue("trimEmptyEdges"), t.TrimEmptyEdges),
+		LastPoints:     getInt(r.FormValue("lastPoints"), t.LastPoints),
 
 		Title:       getString(r.FormValue("title"), t.Title),
 		Vtitle:      getString(r.FormValue("vtitle"), t.Vtitle),
 		VtitleRight: getString(r.FormValue("vtitleRight"), t.VtitleRight),
+		NoDataText:  getString(r.FormValue("noDataText"), t.NoDataText),
+		NoDataColor: getString(r.FormValue("noDataColor"), t.NoDataColor),
 
 		Tz: getTimeZone(r.FormValue("tz"), t.Tz),
 
+		From:  date.DateParamToEpoch(r.FormValue("from"), r.FormValue("tz"), now.Add(-24*time.Hour).Unix(), t.Tz),
+		Until: date.DateParamToEpoch(r.FormValue("until"), r.FormValue("tz"), now.Unix(), t.Tz),
+
 		ConnectedLimit: getInt(r.FormValue("connectedLimit"), t.ConnectedLimit),
 		LineMode:       getLineMode(r.FormValue("lineMode"), t.LineMode),
+		StepAlign:      getStepAlign(r.FormValue("stepAlign"), t.StepAlign),
 		AreaMode:       getAreaMode(r.FormValue("areaMode"), t.AreaMode),
+		StackOrder:     getStackOrder(r.FormValue("stackOrder"), t.StackOrder),
 		AreaAlpha:      getFloat64(r.FormValue("areaAlpha"), t.AreaAlpha),
+		PositiveColor:  getString(r.FormValue("positiveColor"), t.PositiveColor),
+		NegativeColor:  getString(r.FormValue("negativeColor"), t.NegativeColor),
 		PieMode:        getPieMode(r.FormValue("pieMode"), t.PieMode),
 		LineWidth:      getFloat64(r.FormValue("lineWidth"), t.LineWidth),
-		ColorList:      getStringArray(r.FormValue("colorList"), t.ColorList),
+		LineCap:        getString(r.FormValue("lineCap"), t.LineCap),
+		LineJoin:       getString(r.FormValue("lineJoin"), t.LineJoin),
+		ColorList:      getStringArray(r.FormValue("colorList"), getColorList(r.FormValue("colorListName"), t.ColorList)),
+		StableColors:   getBool(r.FormValue("stableColors"), t.StableColors),
+		Decimation:     getDecimation(r.FormValue("decimation"), t.Decimation),
+
+		ConnectedGapDash: getFloat64(r.FormValue("connectedGapDash"), t.ConnectedGapDash),
+
+		DrawStackTotal:  getBool(r.FormValue("drawStackTotal"), t.DrawStackTotal),
+		StackTotalColor: getString(r.FormValue("stackTotalColor"), t.StackTotalColor),
+		ShowRaw:         getBool(r.FormValue("showRaw"), t.ShowRaw),
+		ReferenceLines:  getBool(r.FormValue("referenceLines"), t.ReferenceLines),
 
 		YMin:    getFloat64(r.FormValue("yMin"), t.YMin),
 		YMax:    getFloat64(r.FormValue("yMax"), t.YMax),
@@ -274,9 +746,31 @@ func GetPictureParamsWithTemplate(r *http.Request, template string, metricData [
 		XFormat: getString(r.FormValue("xFormat"), t.XFormat),
 		MinorY:  getInt(r.FormValue("minorY"), t.MinorY),
 
-		UniqueLegend:   getBool(r.FormValue("uniqueLegend"), t.UniqueLegend),
-		DrawNullAsZero: getBool(r.FormValue("drawNullAsZero"), t.DrawNullAsZero),
-		DrawAsInfinite: getBool(r.FormValue("drawAsInfinite"), t.DrawAsInfinite),
+		GridDensity: getGridDensity(r.FormValue("gridDensity"), t.GridDensity),
+		SnapTime:    getBool(r.FormValue("snapTime"), t.SnapTime),
+		XSubGrid:    getInt(r.FormValue("xSubGrid"), t.XSubGrid),
+		YDivisions:  getInt(r.FormValue("yDivisions"), t.YDivisions),
+
+		CalendarGrid: getBool(r.FormValue("calendarGrid"), t.CalendarGrid),
+
+		HideFirstXLabel: getBool(r.FormValue("hideFirstXLabel"), t.HideFirstXLabel),
+		HideLastXLabel:  getBool(r.FormValue("hideLastXLabel"), t.HideLastXLabel),
+
+		PlotPaddingTop:    getFloat64(r.FormValue("plotPaddingTop"), t.PlotPaddingTop),
+		PlotPaddingBottom: getFloat64(r.FormValue("plotPaddingBottom"), t.PlotPaddingBottom),
+		YMaxHeadroom:      getBool(r.FormValue("yMaxHeadroom"), t.YMaxHeadroom),
+		YScalePercentile:  getFloat64(r.FormValue("yScalePercentile"), t.YScalePercentile),
+
+		UniqueLegend:     getBool(r.FormValue("uniqueLegend"), t.UniqueLegend),
+		LegendBox:        getBool(r.FormValue("legendBox"), t.LegendBox),
+		LegendSwatch:     getLegendSwatch(r.FormValue("legendSwatch"), t.LegendSwatch),
+		LegendTruncate:   getInt(r.FormValue("legendTruncate"), t.LegendTruncate),
+		LegendEllipsis:   getLegendEllipsis(r.FormValue("legendEllipsis"), t.LegendEllipsis),
+		DrawNullAsZero:   getBool(r.FormValue("drawNullAsZero"), t.DrawNullAsZero),
+		DrawAsInfinite:   getBool(r.FormValue("drawAsInfinite"), t.DrawAsInfinite),
+		ReverseDrawOrder: getBool(r.FormValue("reverseDrawOrder"), t.ReverseDrawOrder),
+
+		LegendMaxHeightPercent: getFloat64(r.FormValue("legendMaxHeightPercent"), t.LegendMaxHeightPercent),
 
 		YMinLeft:    getFloat64(r.FormValue("yMinLeft"), t.YMinLeft),
 		YMinRight:   getFloat64(r.FormValue("yMinRight"), t.YMinRight),
@@ -287,8 +781,16 @@ func GetPictureParamsWithTemplate(r *http.Request, template string, metricData [
 		YLimitLeft:  getFloat64(r.FormValue("yLimitLeft"), t.YLimitLeft),
 		YLimitRight: getFloat64(r.FormValue("yLimitRight"), t.YLimitRight),
 
-		YUnitSystem: getString(r.FormValue("yUnitSystem"), t.YUnitSystem),
-		YDivisors:   getFloatArray(r.FormValue("yDivisors"), t.YDivisors),
+		LogBaseLeft:  getLogBase(r.FormValue("logBaseLeft")),
+		LogBaseRight: getLogBase(r.FormValue("logBaseRight")),
+
+		YUnitSystem:     getString(r.FormValue("yUnitSystem"), t.YUnitSystem),
+		YLabelPrecision: getInt(r.FormValue("yLabelPrecision"), t.YLabelPrecision),
+		YLabelRotate:    getFloat64(r.FormValue("yLabelRotate"), t.YLabelRotate),
+		NumberFormat:    getString(r.FormValue("numberFormat"), t.NumberFormat),
+		YMinStep:        getFloat64(r.FormValue("yMinStep"), t.YMinStep),
+		YDivisors:       getFloatArray(r.FormValue("yDivisors"), t.YDivisors),
+		YTicks:          getFloatArray(r.FormValue("yTicks"), t.YTicks),
 
 		RightWidth:  getFloat64(r.FormValue("rightWidth"), t.RightWidth),
 		RightDashed: getBool(r.FormValue("rightDashed"), t.RightDashed),
@@ -297,9 +799,59 @@ func GetPictureParamsWithTemplate(r *http.Request, template string, metricData [
 		LeftDashed:  getBool(r.FormValue("leftDashed"), t.LeftDashed),
 		LeftColor:   getString(r.FormValue("leftColor"), t.LeftColor),
 
+		RightAxisPattern: getString(r.FormValue("rightAxisPattern"), t.RightAxisPattern),
+
 		MajorGridLineColor: getString(r.FormValue("majorGridLineColor"), t.MajorGridLineColor),
 		MinorGridLineColor: getString(r.FormValue("minorGridLineColor"), t.MinorGridLineColor),
+		GridInFront:        getBool(r.FormValue("gridInFront"), t.GridInFront),
+
+		Events:          getEvents(r.FormValue("events"), t.Events),
+		HighlightRanges: getHighlightRanges(r.FormValue("highlightRanges"), t.HighlightRanges),
+
+		StatsBox:    getStatsBox(r.FormValue("statsBox"), t.StatsBox),
+		StatsBoxAll: getBool(r.FormValue("statsBoxAll"), t.StatsBoxAll),
+
+		LineLabels: getLineLabels(r.FormValue("lineLabels"), t.LineLabels),
+		ShowLast:   getBool(r.FormValue("showLast"), t.ShowLast),
+
+		MaxSeries:   maxSeries,
+		FocusSeries: getIntArray(r.FormValue("focusSeries"), t.FocusSeries),
+
+		SmoothWindow: getInt(r.FormValue("smoothWindow"), t.SmoothWindow),
+		Cumulative:   getBool(r.FormValue("cumulative"), t.Cumulative),
+
+		ColorByValue:     getBool(r.FormValue("colorByValue"), t.ColorByValue),
+		ColorByValueLow:  getString(r.FormValue("colorByValueLow"), t.ColorByValueLow),
+		ColorByValueHigh: getString(r.FormValue("colorByValueHigh"), t.ColorByValueHigh),
+		ColorByValueMin:  getFloat64(r.FormValue("colorByValueMin"), t.ColorByValueMin),
+		ColorByValueMax:  getFloat64(r.FormValue("colorByValueMax"), t.ColorByValueMax),
+
+		Bubbles:         getBool(r.FormValue("bubbles"), t.Bubbles),
+		BubbleMaxRadius: getFloat64(r.FormValue("bubbleMaxRadius"), t.BubbleMaxRadius),
+	}
+}
+
+// splitList splits a comma separated list, except for the commas inside
+// parentheses, so rgb(r,g,b) colors stay whole
+func splitList(s string) []string {
+	var items []string
+	depth, start := 0, 0
+	for i, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			if depth > 0 {
+				depth--
+			}
+		case ',':
+			if depth == 0 {
+				items = append(items, s[start:i])
+				start = i + 1
+			}
+		}
 	}
+	return append(items, s[start:])
 }
 
 func getStringArray(s string, def []string) []string {
@@ -307,7 +859,7 @@ func getStringArray(s string, def []string) []string {
 		return def
 	}
 
-	ss := strings.Split(s, ",")
+	ss := splitList(s)
 	var strs []string
 	for _, v := range ss {
 		strs = append(strs, strings.TrimSpace(v))
@@ -332,6 +884,34 @@ func getFloatArray(s string, def []float64) []float64 {
 	return fs
 }
 
+func getIntArray(s string, def []int) []int {
+	if s == "" {
+		return def
+	}
+	ss := strings.Split(s, ",")
+	var is []int
+	for _, v := range ss {
+		i, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return def
+		}
+		is = append(is, i)
+	}
+	return is
+}
+
+// maxGridDensity caps gridDensity, a denser grid only fills the plot area
+const maxGridDensity = 10
+
+// getGridDensity accepts a number of gridlines per label interval up to
+// maxGridDensity, larger ones are lowered to it
+func getGridDensity(s string, def int) int {
+	if d := getInt(s, def); d < maxGridDensity {
+		return d
+	}
+	return maxGridDensity
+}
+
 func getLogBase(s string) float64 {
 	if s == "e" {
 		return math.E
@@ -343,6 +923,41 @@ func getLogBase(s string) float64 {
 	return b
 }
 
+// getRotateOutput accepts a multiple of 90 degrees, anything else disables the rotation
+func getRotateOutput(s string, def int) int {
+	angle := getInt(s, def) % 360
+	if angle < 0 {
+		angle += 360
+	}
+	if angle%90 != 0 {
+		return 0
+	}
+	return angle
+}
+
+// getAspectRatio accepts either a plain number ("1.5") or a "width:height" pair ("16:9")
+func getAspectRatio(s string, def float64) float64 {
+	if s == "" {
+		return def
+	}
+	var r float64
+	var err error
+	if i := strings.Index(s, ":"); i >= 0 {
+		var w, h float64
+		w, err = strconv.ParseFloat(s[:i], 64)
+		if err == nil {
+			h, err = strconv.ParseFloat(s[i+1:], 64)
+			r = w / h
+		}
+	} else {
+		r, err = strconv.ParseFloat(s, 64)
+	}
+	if err != nil || r <= 0 || math.IsInf(r, 0) || math.IsNaN(r) {
+		return def
+	}
+	return r
+}
+
 func getTimeZone(s string, def *time.Location) *time.Location {
 	if s == "" {
 		return def
@@ -360,18 +975,30 @@ func SetTemplate(name string, params *PictureParams) {
 }
 
 var DefaultParams = PictureParams{
-	Width:      330,
-	Height:     250,
-	Margin:     10,
-	LogBase:    0,
-	FgColor:    "white",
-	BgColor:    "black",
-	MajorLine:  "rose",
-	MinorLine:  "grey",
-	FontName:   "Sans",
-	FontSize:   10,
-	FontBold:   FontWeightNormal,
-	FontItalic: FontSlantNormal,
+	Width:       330,
+	Height:      250,
+	AspectRatio: 0,
+	Margin:      10,
+	LogBase:     0,
+	XLogBase:    0,
+	FgColor:     "white",
+	BgColor:     "black",
+	MajorLine:   "rose",
+	MinorLine:   "grey",
+	FontName:    "Sans",
+	FontSize:    10,
+	FontBold:    FontWeightNormal,
+	FontItalic:  FontSlantNormal,
+
+	TitleFontName:   "",
+	TitleFontBold:   FontWeightNormal,
+	TitleFontItalic: FontSlantNormal,
+
+	MarginPercent: 0,
+	RotateOutput:  0,
+
+	GraphType:     GraphTypeLine,
+	SparklineDots: false,
 
 	GraphOnly:  false,
 	HideLegend: false,
@@ -380,20 +1007,48 @@ var DefaultParams = PictureParams{
 	HideYAxis:  false,
 	HideXAxis:  false,
 	YAxisSide:  YAxisSideLeft,
+	PlotShadow: false,
+	CrispGrid:  true,
+	PixelSnap:  PixelSnapNone,
+	EmptyFrame: false,
+
+	CornerRadius: 0,
+
+	ShowTimeRange: false,
+
+	TrimEmptyEdges: false,
+	LastPoints:     0,
 
 	Title:       "",
 	Vtitle:      "",
 	VtitleRight: "",
+	NoDataText:  "No Data",
+	NoDataColor: "red",
 
 	Tz: time.Local,
 
 	ConnectedLimit: math.MaxInt32,
 	LineMode:       LineModeSlope,
+	StepAlign:      StepAlignStart,
 	AreaMode:       AreaModeNone,
+	StackOrder:     StackOrderInput,
 	AreaAlpha:      math.NaN(),
+	PositiveColor:  "",
+	NegativeColor:  "",
 	PieMode:        PieModeAverage,
 	LineWidth:      1.2,
+	LineCap:        "butt",
+	LineJoin:       "miter",
 	ColorList:      DefaultColorList,
+	StableColors:   false,
+	Decimation:     DecimationAverage,
+
+	ConnectedGapDash: 0,
+
+	DrawStackTotal:  false,
+	StackTotalColor: "",
+	ShowRaw:         false,
+	ReferenceLines:  false,
 
 	YMin:    math.NaN(),
 	YMax:    math.NaN(),
@@ -404,9 +1059,31 @@ var DefaultParams = PictureParams{
 	XFormat: "",
 	MinorY:  1,
 
-	UniqueLegend:   false,
-	DrawNullAsZero: false,
-	DrawAsInfinite: false,
+	GridDensity: 1,
+	SnapTime:    false,
+	XSubGrid:    0,
+	YDivisions:  0,
+
+	CalendarGrid: false,
+
+	HideFirstXLabel: false,
+	HideLastXLabel:  false,
+
+	PlotPaddingTop:    0.05,
+	PlotPaddingBottom: 0.05,
+	YMaxHeadroom:      false,
+	YScalePercentile:  0,
+
+	UniqueLegend:     false,
+	LegendBox:        false,
+	LegendSwatch:     LegendSwatchSquare,
+	LegendTruncate:   0,
+	LegendEllipsis:   LegendEllipsisEnd,
+	DrawNullAsZero:   false,
+	DrawAsInfinite:   false,
+	ReverseDrawOrder: false,
+
+	LegendMaxHeightPercent: 0,
 
 	YMinLeft:    math.NaN(),
 	YMinRight:   math.NaN(),
@@ -417,8 +1094,16 @@ var DefaultParams = PictureParams{
 	YLimitLeft:  math.NaN(),
 	YLimitRight: math.NaN(),
 
-	YUnitSystem: "si",
-	YDivisors:   []float64{4, 5, 6},
+	LogBaseLeft:  0,
+	LogBaseRight: 0,
+
+	YUnitSystem:     "si",
+	YLabelPrecision: -1,
+	YLabelRotate:    0,
+	NumberFormat:    "",
+	YMinStep:        0,
+	YDivisors:       []float64{4, 5, 6},
+	YTicks:          nil,
 
 	RightWidth:  1.2,
 	RightDashed: false,
@@ -427,24 +1112,60 @@ var DefaultParams = PictureParams{
 	LeftDashed:  false,
 	LeftColor:   "",
 
+	RightAxisPattern: "",
+
 	MajorGridLineColor: "white",
 	MinorGridLineColor: "grey",
+	GridInFront:        false,
+
+	StatsBox:    StatsBoxNone,
+	StatsBoxAll: false,
+
+	LineLabels: LineLabelsNone,
+	ShowLast:   false,
+
+	MaxSeries:   0,
+	FocusSeries: nil,
+
+	SmoothWindow: 0,
+	Cumulative:   false,
+
+	ColorByValue:     false,
+	ColorByValueLow:  "blue",
+	ColorByValueHigh: "red",
+	ColorByValueMin:  math.NaN(),
+	ColorByValueMax:  math.NaN(),
+
+	Bubbles:         false,
+	BubbleMaxRadius: 10,
 }
 
 var templates = map[string]PictureParams{
 	"default": {
-		Width:      330,
-		Height:     250,
-		Margin:     10,
-		LogBase:    0,
-		FgColor:    "white",
-		BgColor:    "black",
-		MajorLine:  "rose",
-		MinorLine:  "grey",
-		FontName:   "Sans",
-		FontSize:   10,
-		FontBold:   FontWeightNormal,
-		FontItalic: FontSlantNormal,
+		Width:       330,
+		Height:      250,
+		AspectRatio: 0,
+		Margin:      10,
+		LogBase:     0,
+		XLogBase:    0,
+		FgColor:     "white",
+		BgColor:     "black",
+		MajorLine:   "rose",
+		MinorLine:   "grey",
+		FontName:    "Sans",
+		FontSize:    10,
+		FontBold:    FontWeightNormal,
+		FontItalic:  FontSlantNormal,
+
+		TitleFontName:   "",
+		TitleFontBold:   FontWeightNormal,
+		TitleFontItalic: FontSlantNormal,
+
+		MarginPercent: 0,
+		RotateOutput:  0,
+
+		GraphType:     GraphTypeLine,
+		SparklineDots: false,
 
 		GraphOnly:  false,
 		HideLegend: false,
@@ -453,20 +1174,48 @@ var templates = map[string]PictureParams{
 		HideYAxis:  false,
 		HideXAxis:  false,
 		YAxisSide:  YAxisSideLeft,
+		PlotShadow: false,
+		CrispGrid:  true,
+		PixelSnap:  PixelSnapNone,
+		EmptyFrame: false,
+
+		CornerRadius: 0,
+
+		ShowTimeRange: false,
+
+		TrimEmptyEdges: false,
+		LastPoints:     0,
 
 		Title:       "",
 		Vtitle:      "",
 		VtitleRight: "",
+		NoDataText:  "No Data",
+		NoDataColor: "red",
 
 		Tz: time.Local,
 
 		ConnectedLimit: math.MaxInt32,
 		LineMode:       LineModeSlope,
+		StepAlign:      StepAlignStart,
 		AreaMode:       AreaModeNone,
+		StackOrder:     StackOrderInput,
 		AreaAlpha:      math.NaN(),
+		PositiveColor:  "",
+		NegativeColor:  "",
 		PieMode:        PieModeAverage,
 		LineWidth:      1.2,
+		LineCap:        "butt",
+		LineJoin:       "miter",
 		ColorList:      DefaultColorList,
+		StableColors:   false,
+		Decimation:     DecimationAverage,
+
+		ConnectedGapDash: 0,
+
+		DrawStackTotal:  false,
+		StackTotalColor: "",
+		ShowRaw:         false,
+		ReferenceLines:  false,
 
 		YMin:    math.NaN(),
 		YMax:    math.NaN(),
@@ -477,9 +1226,31 @@ var templates = map[string]PictureParams{
 		XFormat: "",
 		MinorY:  1,
 
-		UniqueLegend:   false,
-		DrawNullAsZero: false,
-		DrawAsInfinite: false,
+		GridDensity: 1,
+		SnapTime:    false,
+		XSubGrid:    0,
+		YDivisions:  0,
+
+		CalendarGrid: false,
+
+		HideFirstXLabel: false,
+		HideLastXLabel:  false,
+
+		PlotPaddingTop:    0.05,
+		PlotPaddingBottom: 0.05,
+		YMaxHeadroom:      false,
+		YScalePercentile:  0,
+
+		UniqueLegend:     false,
+		LegendBox:        false,
+		LegendSwatch:     LegendSwatchSquare,
+		LegendTruncate:   0,
+		LegendEllipsis:   LegendEllipsisEnd,
+		DrawNullAsZero:   false,
+		DrawAsInfinite:   false,
+		ReverseDrawOrder: false,
+
+		LegendMaxHeightPercent: 0,
 
 		YMinLeft:    math.NaN(),
 		YMinRight:   math.NaN(),
@@ -490,8 +1261,16 @@ var templates = map[string]PictureParams{
 		YLimitLeft:  math.NaN(),
 		YLimitRight: math.NaN(),
 
-		YUnitSystem: "si",
-		YDivisors:   []float64{4, 5, 6},
+		LogBaseLeft:  0,
+		LogBaseRight: 0,
+
+		YUnitSystem:     "si",
+		YLabelPrecision: -1,
+		YLabelRotate:    0,
+		NumberFormat:    "",
+		YMinStep:        0,
+		YDivisors:       []float64{4, 5, 6},
+		YTicks:          nil,
 
 		RightWidth:  1.2,
 		RightDashed: false,
@@ -500,7 +1279,45 @@ var templates = map[string]PictureParams{
 		LeftDashed:  false,
 		LeftColor:   "",
 
+		RightAxisPattern: "",
+
 		MajorGridLineColor: "white",
 		MinorGridLineColor: "grey",
+		GridInFront:        false,
+
+		StatsBox:    StatsBoxNone,
+		StatsBoxAll: false,
+
+		LineLabels: LineLabelsNone,
+		ShowLast:   false,
+
+		MaxSeries:   0,
+		FocusSeries: nil,
+
+		SmoothWindow: 0,
+		Cumulative:   false,
+
+		ColorByValue:     false,
+		ColorByValueLow:  "blue",
+		ColorByValueHigh: "red",
+		ColorByValueMin:  math.NaN(),
+		ColorByValueMax:  math.NaN(),
+
+		Bubbles:         false,
+		BubbleMaxRadius: 10,
 	},
+	"dark": darkTemplate(),
+}
+
+// darkTemplate is the default template with colors tuned for dark dashboards
+func darkTemplate() PictureParams {
+	t := DefaultParams
+	t.BgColor = "111217"
+	t.FgColor = "d8d9da"
+	t.MajorLine = "464c54"
+	t.MinorLine = "2c3235"
+	t.MajorGridLineColor = "464c54"
+	t.MinorGridLineColor = "2c3235"
+	t.ColorList = DarkColorList
+	return t
 }
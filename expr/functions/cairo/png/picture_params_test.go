@@ -0,0 +1,199 @@
+package png
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/go-graphite/carbonapi/expr/types"
+)
+
+func TestGetAspectRatio(t *testing.T) {
+
+	tests := []struct {
+		s    string
+		want float64
+	}{
+		{"", 0},
+		{"2", 2},
+		{"1.5", 1.5},
+		{"16:9", 16.0 / 9.0},
+		{"4:3", 4.0 / 3.0},
+		{"0", 0},
+		{"-1", 0},
+		{"1:0", 0},
+		{"a:b", 0},
+		{"wide", 0},
+	}
+
+	for _, tt := range tests {
+		got := getAspectRatio(tt.s, 0)
+		if got != tt.want {
+			t.Errorf("getAspectRatio(%q): got %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestGetRotateOutput(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int
+	}{
+		{"", 0},
+		{"90", 90},
+		{"180", 180},
+		{"270", 270},
+		{"360", 0},
+		{"450", 90},
+		{"-90", 270},
+		{"45", 0},
+		{"sideways", 0},
+	}
+
+	for _, tt := range tests {
+		if got := getRotateOutput(tt.s, 0); got != tt.want {
+			t.Errorf("getRotateOutput(%q): got %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestGetGridDensity(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int
+	}{
+		{"", 1},
+		{"4", 4},
+		{"10", maxGridDensity},
+		{"1000000000", maxGridDensity},
+	}
+
+	for _, tt := range tests {
+		if got := getGridDensity(tt.s, 1); got != tt.want {
+			t.Errorf("getGridDensity(%q): got %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestGetColorList(t *testing.T) {
+	def := []string{"white"}
+
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"", def},
+		{"unknown", def},
+		{"default", DefaultColorList},
+		{"okabe-ito", OkabeItoColorList},
+		{"Okabe-Ito", OkabeItoColorList},
+		{"colorblind", OkabeItoColorList},
+	}
+
+	for _, tt := range tests {
+		got := getColorList(tt.name, def)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("getColorList(%q): got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDarkTemplate(t *testing.T) {
+	r := httptest.NewRequest("GET", "/render/?target=a.b.c", nil)
+	p := GetPictureParamsWithTemplate(r, "dark", nil)
+	if p.BgColor != "111217" || p.FgColor != "d8d9da" {
+		t.Errorf("dark template: got bgcolor %q and fgcolor %q", p.BgColor, p.FgColor)
+	}
+	if !reflect.DeepEqual(p.ColorList, DarkColorList) {
+		t.Errorf("dark template: got colorList %v, want %v", p.ColorList, DarkColorList)
+	}
+	if p.Width != DefaultParams.Width || p.LineWidth != DefaultParams.LineWidth {
+		t.Errorf("dark template: non-color defaults changed, got width %v and lineWidth %v", p.Width, p.LineWidth)
+	}
+
+	// request parameters still win over the template
+	r = httptest.NewRequest("GET", "/render/?target=a.b.c&fgcolor=white&colorList=red,blue", nil)
+	p = GetPictureParamsWithTemplate(r, "dark", nil)
+	if p.BgColor != "111217" || p.FgColor != "white" {
+		t.Errorf("dark template with overrides: got bgcolor %q and fgcolor %q", p.BgColor, p.FgColor)
+	}
+	if !reflect.DeepEqual(p.ColorList, []string{"red", "blue"}) {
+		t.Errorf("dark template with overrides: got colorList %v", p.ColorList)
+	}
+
+	// the commas of rgb() colors don't split the list
+	r = httptest.NewRequest("GET", "/render/?target=a.b.c&colorList="+url.QueryEscape("rgb(1,2,3), blue"), nil)
+	p = GetPictureParamsWithTemplate(r, "dark", nil)
+	if !reflect.DeepEqual(p.ColorList, []string{"rgb(1,2,3)", "blue"}) {
+		t.Errorf("colorList with rgb(): got %v", p.ColorList)
+	}
+}
+
+func TestGetEvents(t *testing.T) {
+
+	tests := []struct {
+		s    string
+		want []Event
+	}{
+		{"", nil},
+		{"100", []Event{{Time: 100}}},
+		{"100:deploy", []Event{{Time: 100, Label: "deploy"}}},
+		{"100:deploy:red, 200::blue", []Event{{Time: 100, Label: "deploy", Color: "red"}, {Time: 200, Color: "blue"}}},
+		{"bad:deploy,300:ok", []Event{{Time: 300, Label: "ok"}}},
+		{"100::rgba(255,0,0,0.5),200", []Event{{Time: 100, Color: "rgba(255,0,0,0.5)"}, {Time: 200}}},
+	}
+
+	for _, tt := range tests {
+		got := getEvents(tt.s, nil)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("getEvents(%q): got %+v, want %+v", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestGetHighlightRanges(t *testing.T) {
+
+	tests := []struct {
+		s    string
+		want []HighlightRange
+	}{
+		{"", nil},
+		{"100:200", []HighlightRange{{Start: 100, End: 200}}},
+		{"100:200:red, 300:400:#ff000080", []HighlightRange{{Start: 100, End: 200, Color: "red"}, {Start: 300, End: 400, Color: "#ff000080"}}},
+		{"100,bad:200,100:bad,200:100,300:300,400:500", []HighlightRange{{Start: 400, End: 500}}},
+		{"100:200:rgb(0,128,0), 300:400", []HighlightRange{{Start: 100, End: 200, Color: "rgb(0,128,0)"}, {Start: 300, End: 400}}},
+	}
+
+	for _, tt := range tests {
+		got := getHighlightRanges(tt.s, nil)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("getHighlightRanges(%q): got %+v, want %+v", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestMaxSeriesHideLegend(t *testing.T) {
+	var results []*types.MetricData
+	for i := 0; i < 20; i++ {
+		results = append(results, types.MakeMetricData("a", []float64{1}, 1, 0))
+	}
+
+	tests := []struct {
+		query          string
+		wantHideLegend bool
+	}{
+		{"", true},
+		{"maxSeries=5", false},
+		{"maxSeries=15", true},
+		{"maxSeries=5&hideLegend=true", true},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/render/?target=a.*&"+tt.query, nil)
+		p := GetPictureParamsWithTemplate(r, "default", results)
+		if p.HideLegend != tt.wantHideLegend {
+			t.Errorf("%q: got hideLegend %v, want %v", tt.query, p.HideLegend, tt.wantHideLegend)
+		}
+	}
+}
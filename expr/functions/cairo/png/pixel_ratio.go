@@ -22,8 +22,9 @@ type cairoContext interface {
 	SetLineJoin(lineJoin cairo.LineJoin)
 	RelMoveTo(dx, dy float64) // pixel ratio required
 	SetSourceRGBA(red, green, blue, alpha float64)
-	SetMatrix(matrix *cairo.Matrix) // pixel ratio required
-	GetMatrix(matrix *cairo.Matrix) // pixel ratio required
+	SetSource(source *cairo.Pattern) // pixel ratio required
+	SetMatrix(matrix *cairo.Matrix)  // pixel ratio required
+	GetMatrix(matrix *cairo.Matrix)  // pixel ratio required
 	Clip()
 	Fill()
 	ClosePath()
@@ -34,6 +35,9 @@ type cairoContext interface {
 	FillPreserve()
 	AppendPath(path *cairo.Path)
 	CopyPath() *cairo.Path
+	Arc(xc, yc, radius, angle1, angle2 float64) // pixel ratio required
+	SetAntialias(antialias cairo.Antialias)
+	SetOperator(op cairo.Operator)
 }
 
 type pixelRatioContext struct {
@@ -43,6 +47,27 @@ type pixelRatioContext struct {
 
 type cairoSurfaceContext struct {
 	context cairoContext
+
+	// font and fontSize are set by setFont, textExtents caches measurements
+	// of texts in that font for the duration of a render
+	font        fontFace
+	fontSize    float64
+	textExtents map[textExtentsKey]cairo.TextExtents
+
+	// warnedTextExtents is set once a font measuring texts as empty is logged
+	warnedTextExtents bool
+}
+
+type fontFace struct {
+	name   string
+	slant  cairo.FontSlant
+	weight cairo.FontWeight
+}
+
+type textExtentsKey struct {
+	text     string
+	font     fontFace
+	fontSize float64
 }
 
 func isDefaultRatio(pixelRatio float64) bool {
@@ -66,14 +91,14 @@ func imageSurfaceCreate(format cairo.Format, width, height float64, pixelRatio f
 	return cairo.ImageSurfaceCreate(format, int(pixelRatio*float64(width)), int(pixelRatio*float64(height)))
 }
 
-func createContext(surface *cairo.Surface, pixelRatio float64) *cairoSurfaceContext {
+func wrapContext(context *cairo.Context, pixelRatio float64) *cairoSurfaceContext {
 	if isDefaultRatio(pixelRatio) {
-		return &cairoSurfaceContext{context: cairo.Create(surface)}
+		return &cairoSurfaceContext{context: context}
 	}
 
 	return &cairoSurfaceContext{
 		context: &pixelRatioContext{
-			Context: cairo.Create(surface),
+			Context: context,
 			pr:      pixelRatio,
 		},
 	}
@@ -95,6 +120,10 @@ func (c *pixelRatioContext) MoveTo(x, y float64) {
 	c.Context.MoveTo(c.pr*x, c.pr*y)
 }
 
+func (c *pixelRatioContext) Arc(xc, yc, radius, angle1, angle2 float64) {
+	c.Context.Arc(c.pr*xc, c.pr*yc, c.pr*radius, angle1, angle2)
+}
+
 func (c *pixelRatioContext) SetLineWidth(width float64) {
 	c.Context.SetLineWidth(c.pr * width)
 }
@@ -136,6 +165,15 @@ func (c *pixelRatioContext) RelMoveTo(dx, dy float64) {
 	c.Context.RelMoveTo(c.pr*dx, c.pr*dy)
 }
 
+// SetSource scales the pattern, built in the same unscaled coordinates as
+// the paths, to the surface
+func (c *pixelRatioContext) SetSource(source *cairo.Pattern) {
+	var m cairo.Matrix
+	m.InitScale(1/c.pr, 1/c.pr)
+	source.SetMatrix(&m)
+	c.Context.SetSource(source)
+}
+
 func (c *pixelRatioContext) SetMatrix(matrix *cairo.Matrix) {
 	var m cairo.Matrix
 	m.Xx = matrix.Xx * c.pr
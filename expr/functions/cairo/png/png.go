@@ -3,6 +3,8 @@
 package png
 
 import (
+	"context"
+	"io"
 	"net/http"
 
 	"github.com/go-graphite/carbonapi/expr/types"
@@ -26,12 +28,40 @@ func MarshalSVG(params PictureParams, results []*types.MetricData) []byte {
 }
 
 // skipcq: CRT-P0003
-func MarshalPNGRequest(r *http.Request, results []*types.MetricData, templateName string) []byte {
+func MarshalPNGRequest(ctx context.Context, r *http.Request, results []*types.MetricData, templateName string, truncated bool) []byte {
 	return nil
 }
 
 // skipcq: CRT-P0003
-func MarshalSVGRequest(r *http.Request, results []*types.MetricData, templateName string) []byte {
+func MarshalSVGRequest(ctx context.Context, r *http.Request, results []*types.MetricData, templateName string, truncated bool) []byte {
+	return nil
+}
+
+// skipcq: CRT-P0003
+func MarshalPieJSONRequest(r *http.Request, results []*types.MetricData, templateName string) []byte {
+	return nil
+}
+
+// skipcq: CRT-P0003
+func MarshalPNGRequestWithTicks(ctx context.Context, r *http.Request, results []*types.MetricData, templateName string, truncated bool) ([]byte, AxisTicks) {
+	return nil, AxisTicks{}
+}
+
+// skipcq: CRT-P0003
+func MarshalPNGRequestWithTimings(ctx context.Context, r *http.Request, results []*types.MetricData, templateName string, truncated bool) ([]byte, RenderTimings) {
+	return nil, RenderTimings{}
+}
+
+// skipcq: CRT-P0003
+func MarshalPNGImageMapRequest(ctx context.Context, r *http.Request, results []*types.MetricData, templateName string, truncated bool) []byte {
+	return nil
+}
+
+func DimSeries(results []*types.MetricData) {
+}
+
+// skipcq: CRT-P0003
+func WritePNGRequest(ctx context.Context, w io.Writer, r *http.Request, results []*types.MetricData, templateName string, truncated bool) error {
 	return nil
 }
 
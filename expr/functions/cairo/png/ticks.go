@@ -0,0 +1,31 @@
+package png
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Tick is an axis label value and its position in image pixels: x for the X
+// axis, where the value is a unix timestamp, and y for the Y axes
+type Tick struct {
+	Value float64
+	Pixel float64
+}
+
+// AxisTicks holds the labels of the rendered graph, so clients can overlay it
+// without repeating the tick computation. YRight is set for graphs with two
+// Y axes only, Y then belongs to the left one.
+type AxisTicks struct {
+	X      []Tick
+	Y      []Tick
+	YRight []Tick
+}
+
+// FormatTicks formats ticks as a comma separated list of "value:pixel" pairs
+func FormatTicks(ticks []Tick) string {
+	parts := make([]string, len(ticks))
+	for i, t := range ticks {
+		parts[i] = strconv.FormatFloat(t.Value, 'g', -1, 64) + ":" + strconv.FormatFloat(t.Pixel, 'f', 1, 64)
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,20 @@
+package png
+
+import "testing"
+
+func TestFormatTicks(t *testing.T) {
+	tests := []struct {
+		ticks []Tick
+		want  string
+	}{
+		{nil, ""},
+		{[]Tick{{Value: 0, Pixel: 200}, {Value: 2.5, Pixel: 120.25}}, "0:200.0,2.5:120.2"},
+		{[]Tick{{Value: 1600000000, Pixel: 42}}, "1.6e+09:42.0"},
+	}
+
+	for _, tt := range tests {
+		if got := FormatTicks(tt.ticks); got != tt.want {
+			t.Errorf("FormatTicks(%v) = %q, want %q", tt.ticks, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package png
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// RenderTimings are the durations of the stages of rendering a graph, for
+// profiling slow renders. Stages a graph doesn't get to, like the lines of a
+// graph without data, stay zero.
+type RenderTimings struct {
+	// Prepare covers everything before the Y axis: styles, the legend,
+	// stacking and consolidation of the series
+	Prepare time.Duration
+	// YAxis covers the Y axis setup until the plot area settles
+	YAxis time.Duration
+	// Lines covers drawing the series
+	Lines time.Duration
+	// Encode covers encoding the png
+	Encode time.Duration
+	// Total covers the whole render, including the stages above
+	Total time.Duration
+}
+
+// stages returns the names and the durations of the stages in the order
+// they run
+func (t RenderTimings) stages() ([]string, []time.Duration) {
+	return []string{"prepare", "yAxis", "lines", "encode", "total"},
+		[]time.Duration{t.Prepare, t.YAxis, t.Lines, t.Encode, t.Total}
+}
+
+// String formats the timings as a comma separated list of
+// "stage=milliseconds" pairs
+func (t RenderTimings) String() string {
+	names, durations := t.stages()
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = name + "=" + strconv.FormatFloat(durations[i].Seconds()*1000, 'f', 3, 64)
+	}
+	return strings.Join(parts, ",")
+}
+
+// Fields returns the timings as log fields
+func (t RenderTimings) Fields() []zap.Field {
+	names, durations := t.stages()
+	fields := make([]zap.Field, len(names))
+	for i, name := range names {
+		fields[i] = zap.Duration(name, durations[i])
+	}
+	return fields
+}
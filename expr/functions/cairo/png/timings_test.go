@@ -0,0 +1,23 @@
+package png
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRenderTimingsString(t *testing.T) {
+	timings := RenderTimings{
+		Prepare: 1500 * time.Microsecond,
+		YAxis:   250 * time.Microsecond,
+		Lines:   12 * time.Millisecond,
+		Total:   14 * time.Millisecond,
+	}
+
+	want := "prepare=1.500,yAxis=0.250,lines=12.000,encode=0.000,total=14.000"
+	if got := timings.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := len(timings.Fields()); got != 5 {
+		t.Errorf("got %d log fields, want one for every stage", got)
+	}
+}
@@ -45,6 +45,7 @@ func (f *consolidateBy) Do(ctx context.Context, e parser.Expr, from, until int64
 		r := *a
 
 		r.AggregateFunction = consolidations.ConsolidationToFunc[name]
+		r.ConsolidationFunc = name
 
 		results = append(results, &r)
 	}
@@ -3,14 +3,24 @@ package legendValue
 import (
 	"context"
 	"fmt"
+	"strings"
 
 	"github.com/go-graphite/carbonapi/expr/consolidations"
+	"github.com/go-graphite/carbonapi/expr/functions/cairo/png"
 	"github.com/go-graphite/carbonapi/expr/helper"
 	"github.com/go-graphite/carbonapi/expr/interfaces"
 	"github.com/go-graphite/carbonapi/expr/types"
 	"github.com/go-graphite/carbonapi/pkg/parser"
 )
 
+// consolidatedValueType summarizes a series with its own consolidation function,
+// so the legend matches the way the series is drawn
+const consolidatedValueType = "consolidated"
+
+// autoPrecisionOption picks the number of decimals of every value from its
+// magnitude, so 0.002 and 4500 are both printed sensibly in one graph
+const autoPrecisionOption = "auto"
+
 type legendValue struct {
 	interfaces.FunctionBase
 }
@@ -46,13 +56,45 @@ func (f *legendValue) Do(ctx context.Context, e parser.Expr, from, until int64,
 		methods[i-1] = method
 	}
 
+	// the value types are followed by options: a unit system prints values
+	// with unit prefixes, the way Y axis labels are printed, "auto" picks the
+	// decimals of every value by its magnitude. When an option repeats, the
+	// last one wins
+	var system string
+	var autoPrecision bool
+options:
+	for len(methods) > 0 {
+		switch option := methods[len(methods)-1]; option {
+		case "si", "binary":
+			if system == "" {
+				system = option
+			}
+		case autoPrecisionOption:
+			autoPrecision = true
+		default:
+			break options
+		}
+		methods = methods[:len(methods)-1]
+	}
+
 	var results []*types.MetricData
 
 	for _, a := range arg {
 		r := *a
 		for _, method := range methods {
-			summary := consolidations.SummarizeValues(method, a.Values, a.XFilesFactor)
-			r.Name = fmt.Sprintf("%s (%s: %f)", r.Name, method, summary)
+			var summary float64
+			if method == consolidatedValueType {
+				method, summary = consolidatedValue(a)
+			} else {
+				summary = consolidations.SummarizeValues(method, a.Values, a.XFilesFactor)
+			}
+			if autoPrecision {
+				r.Name = fmt.Sprintf("%s (%s: %s)", r.Name, method, png.FormatAutoPrecision(summary, system))
+			} else if system != "" {
+				r.Name = fmt.Sprintf("%s (%s: %s)", r.Name, method, png.FormatUnits(summary, system))
+			} else {
+				r.Name = fmt.Sprintf("%s (%s: %f)", r.Name, method, summary)
+			}
 		}
 
 		results = append(results, &r)
@@ -60,11 +102,23 @@ func (f *legendValue) Do(ctx context.Context, e parser.Expr, from, until int64,
 	return results, nil
 }
 
+// consolidatedValue returns the name of the series consolidation function
+// (set by consolidateBy or reported by the backend) and the series summarized with it
+func consolidatedValue(a *types.MetricData) (string, float64) {
+	name := strings.ToLower(a.ConsolidationFunc)
+	aggregate, ok := consolidations.ConsolidationToFunc[name]
+	if !ok {
+		// same fallback as for drawing
+		name, aggregate = "average", consolidations.AvgValue
+	}
+	return name, aggregate(a.Values)
+}
+
 // Description is auto-generated description, based on output of https://github.com/graphite-project/graphite-web
 func (f *legendValue) Description() map[string]types.FunctionDescription {
 	return map[string]types.FunctionDescription{
 		"legendValue": {
-			Description: "Takes one metric or a wildcard seriesList and a string in quotes.\nAppends a value to the metric name in the legend.  Currently one or several of: `last`, `avg`,\n`total`, `min`, `max`.\nThe last argument can be `si` (default) or `binary`, in that case values will be formatted in the\ncorresponding system.\n\n.. code-block:: none\n\n  &target=legendValue(Sales.widgets.largeBlue, 'avg', 'max', 'si')",
+			Description: "Takes one metric or a wildcard seriesList and a string in quotes.\nAppends a value to the metric name in the legend.  Currently one or several of: `last`, `avg`,\n`total`, `min`, `max`, or `consolidated` to use the consolidation function of the series\n(as set by consolidateBy), so the legend matches the drawn points.\nThe last argument can be `si` (default) or `binary`, in that case values will be formatted in the\ncorresponding system. `auto` among the trailing arguments, e.g. `'avg', 'auto'` or `'avg', 'auto', 'si'`,\nchooses the number of decimals of every value by its magnitude: more for small values, fewer for large ones.\n\n.. code-block:: none\n\n  &target=legendValue(Sales.widgets.largeBlue, 'avg', 'max', 'si')",
 			Function:    "legendValue(seriesList, *valueTypes)",
 			Group:       "Alias",
 			Module:      "graphite.render.functions",
@@ -78,7 +132,7 @@ func (f *legendValue) Description() map[string]types.FunctionDescription {
 				{
 					Multiple: true,
 					Name:     "valuesTypes",
-					Options:  types.StringsToSuggestionList(consolidations.AvailableSummarizers),
+					Options:  types.StringsToSuggestionList(append(append([]string{consolidatedValueType}, consolidations.AvailableSummarizers...), "si", "binary", autoPrecisionOption)),
 					Type:     types.String,
 				},
 			},
@@ -57,6 +57,99 @@ func TestFunction(t *testing.T) {
 			[]*types.MetricData{types.MakeMetricData("metric1 (sum: 15.000000) (avg: 3.000000)",
 				[]float64{1, 2, 3, 4, 5}, 1, now32)},
 		},
+		{
+			"legendValue(metric1,\"max\",\"sum\",\"si\")",
+			map[parser.MetricRequest][]*types.MetricData{
+				{"metric1", 0, 1}: {types.MakeMetricData("metric1", []float64{1000, 1234567}, 1, now32)},
+			},
+			[]*types.MetricData{types.MakeMetricData("metric1 (max: 1.23M) (sum: 1.24M)",
+				[]float64{1000, 1234567}, 1, now32)},
+		},
+		{
+			"legendValue(metric1,\"last\",\"binary\")",
+			map[parser.MetricRequest][]*types.MetricData{
+				{"metric1", 0, 1}: {types.MakeMetricData("metric1", []float64{512, 2048}, 1, now32)},
+			},
+			[]*types.MetricData{types.MakeMetricData("metric1 (last: 2.00Ki)",
+				[]float64{512, 2048}, 1, now32)},
+		},
+		{
+			"legendValue(metric1,\"min\",\"max\",\"auto\")",
+			map[parser.MetricRequest][]*types.MetricData{
+				{"metric1", 0, 1}: {types.MakeMetricData("metric1", []float64{0.002, 4500.4}, 1, now32)},
+			},
+			[]*types.MetricData{types.MakeMetricData("metric1 (min: 0.00200) (max: 4500)",
+				[]float64{0.002, 4500.4}, 1, now32)},
+		},
+		{
+			"legendValue(metric1,\"max\",\"auto\",\"si\")",
+			map[parser.MetricRequest][]*types.MetricData{
+				{"metric1", 0, 1}: {types.MakeMetricData("metric1", []float64{1000, 45678}, 1, now32)},
+			},
+			[]*types.MetricData{types.MakeMetricData("metric1 (max: 45.7K)",
+				[]float64{1000, 45678}, 1, now32)},
+		},
+		{
+			"legendValue(metric1,\"max\",\"auto\",\"si\",\"auto\")",
+			map[parser.MetricRequest][]*types.MetricData{
+				{"metric1", 0, 1}: {types.MakeMetricData("metric1", []float64{1000, 45678}, 1, now32)},
+			},
+			[]*types.MetricData{types.MakeMetricData("metric1 (max: 45.7K)",
+				[]float64{1000, 45678}, 1, now32)},
+		},
+	}
+
+	for _, tt := range tests {
+		testName := tt.Target
+		t.Run(testName, func(t *testing.T) {
+			th.TestEvalExpr(t, &tt)
+		})
+	}
+
+}
+
+func TestConsolidated(t *testing.T) {
+	now32 := int64(time.Now().Unix())
+
+	withConsolidation := func(name string) *types.MetricData {
+		m := types.MakeMetricData("metric1", []float64{1, 2, 3, 4, 5}, 1, now32)
+		m.ConsolidationFunc = name
+		return m
+	}
+
+	tests := []th.EvalTestItem{
+		{
+			"legendValue(metric1,\"consolidated\")",
+			map[parser.MetricRequest][]*types.MetricData{
+				{"metric1", 0, 1}: {withConsolidation("max")},
+			},
+			[]*types.MetricData{types.MakeMetricData("metric1 (max: 5.000000)",
+				[]float64{1, 2, 3, 4, 5}, 1, now32)},
+		},
+		{
+			"legendValue(metric1,\"consolidated\",\"avg\")",
+			map[parser.MetricRequest][]*types.MetricData{
+				{"metric1", 0, 1}: {withConsolidation("sum")},
+			},
+			[]*types.MetricData{types.MakeMetricData("metric1 (sum: 15.000000) (avg: 3.000000)",
+				[]float64{1, 2, 3, 4, 5}, 1, now32)},
+		},
+		{
+			"legendValue(metric1,\"consolidated\")",
+			map[parser.MetricRequest][]*types.MetricData{
+				{"metric1", 0, 1}: {withConsolidation("Average")},
+			},
+			[]*types.MetricData{types.MakeMetricData("metric1 (average: 3.000000)",
+				[]float64{1, 2, 3, 4, 5}, 1, now32)},
+		},
+		{
+			"legendValue(metric1,\"consolidated\")",
+			map[parser.MetricRequest][]*types.MetricData{
+				{"metric1", 0, 1}: {withConsolidation("")},
+			},
+			[]*types.MetricData{types.MakeMetricData("metric1 (average: 3.000000)",
+				[]float64{1, 2, 3, 4, 5}, 1, now32)},
+		},
 	}
 
 	for _, tt := range tests {
@@ -66,4 +159,13 @@ func TestFunction(t *testing.T) {
 		})
 	}
 
+	// the legend must agree with the consolidation used for drawing
+	for _, name := range []string{"min", "max", "sum", "first", "last"} {
+		m := withConsolidation(name)
+		m.SetValuesPerPoint(len(m.Values))
+		drawn := m.AggregatedValues()[0]
+		if _, got := consolidatedValue(m); got != drawn {
+			t.Errorf("consolidatedValue for %s: got %v, consolidated point is %v", name, got, drawn)
+		}
+	}
 }
@@ -19,4 +19,10 @@ type GraphOptions struct {
 	HasLineWidth   bool
 	Stacked        bool
 	StackName      string
+
+	// BubbleSizes is the paired series whose values set the circle radius
+	BubbleSizes *MetricData
+	// BandOf is the series a band is drawn around, the band takes its color
+	// and has no legend entry of its own
+	BandOf *MetricData
 }